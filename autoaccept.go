@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 自动接受规则
+//
+// 无人值守的机器（如构建机）无法手动 /accept，可以为受信任的用户添加自动接受规则。
+// 规则以对方的节点ID为键，节点ID由身份公钥派生，只有握手签名验证通过且身份未变更的
+// 连接才会命中规则，改名或冒用用户名都不会生效。规则还可以限制扩展名、单次请求的最大
+// 大小和接受后磁盘至少保留的空间，并指定该用户文件的保存目录。任务（目录或多个文件）
+// 中的每个文件都要满足扩展名限制，大小按整个任务计算。同一用户有多条规则时按编号顺序
+// 使用第一条满足条件的规则；都不满足时照常等待手动接受。每次规则生效都会在终端和
+// auto_accept.log 中记录一行审计信息。
+const (
+	autoAcceptFile    = "auto_accept.json"
+	autoAcceptLogFile = "auto_accept.log"
+)
+
+// AutoAcceptRule结构体 - 自动接受规则
+type AutoAcceptRule struct {
+	ID           int       `json:"id"`
+	PeerID       string    `json:"peerId"`                 // 受信任用户的节点ID
+	PeerName     string    `json:"peerName"`               // 添加规则时对方的用户名，仅用于显示
+	Extensions   []string  `json:"extensions,omitempty"`   // 允许的扩展名（小写，如 .zip），为空时不限
+	MaxSize      int64     `json:"maxSize,omitempty"`      // 单次请求的最大大小，0 表示不限
+	MinFreeSpace int64     `json:"minFreeSpace,omitempty"` // 接受后磁盘至少保留的空间，0 表示不检查
+	Directory    string    `json:"directory,omitempty"`    // 保存目录，相对路径以下载目录为基准，为空时按下载配置
+	Created      time.Time `json:"created"`
+}
+
+// 规则条件的简短描述
+func (rule *AutoAcceptRule) describe() string {
+	var conditions []string
+	if len(rule.Extensions) > 0 {
+		conditions = append(conditions, "扩展名 "+strings.Join(rule.Extensions, ","))
+	}
+	if rule.MaxSize > 0 {
+		conditions = append(conditions, "不超过 "+formatFileSize(rule.MaxSize))
+	}
+	if rule.MinFreeSpace > 0 {
+		conditions = append(conditions, "剩余空间至少 "+formatFileSize(rule.MinFreeSpace))
+	}
+	if len(conditions) == 0 {
+		conditions = append(conditions, "所有文件")
+	}
+	if rule.Directory == "" {
+		return strings.Join(conditions, "，") + "，保存到下载目录"
+	}
+	return strings.Join(conditions, "，") + "，保存到 " + rule.Directory
+}
+
+// 文件名和大小是否满足规则（不含磁盘空间检查）
+func (rule *AutoAcceptRule) matches(fileNames []string, size int64) bool {
+	if rule.MaxSize > 0 && size > rule.MaxSize {
+		return false
+	}
+	if len(rule.Extensions) == 0 {
+		return true
+	}
+	for _, name := range fileNames {
+		allowed := false
+		lower := strings.ToLower(name)
+		for _, ext := range rule.Extensions {
+			// 按后缀比较，支持 .tar.gz 这样的多段扩展名
+			if strings.HasSuffix(lower, ext) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// 根据用户名和参数创建规则；用户须在线且已验证身份，或已记录过身份指纹
+func (node *P2PNode) newAutoAcceptRule(peerName, extensions, maxSize, minFreeSpace, directory string) (AutoAcceptRule, error) {
+	rule := AutoAcceptRule{PeerName: peerName, Created: time.Now()}
+
+	node.PeersMutex.RLock()
+	for id, peer := range node.Peers {
+		if peer.Name == peerName && peer.IsActive {
+			if !peer.Authenticated || peer.IdentityChanged {
+				node.PeersMutex.RUnlock()
+				return rule, fmt.Errorf("用户 %s 的身份未经验证，不能添加自动接受规则", peerName)
+			}
+			rule.PeerID = id
+			break
+		}
+	}
+	node.PeersMutex.RUnlock()
+
+	if rule.PeerID == "" {
+		// 离线用户按已记录的身份查找，同名记录不止一条时无法确定
+		node.KnownPeersMutex.RLock()
+		matched := 0
+		for id, kp := range node.KnownPeers {
+			if kp.Name == peerName {
+				rule.PeerID = id
+				matched++
+			}
+		}
+		node.KnownPeersMutex.RUnlock()
+		if matched == 0 {
+			return rule, fmt.Errorf("用户 %s 不在线且没有已记录的身份", peerName)
+		}
+		if matched > 1 {
+			return rule, fmt.Errorf("用户 %s 有多个已记录的身份，请在对方在线时添加", peerName)
+		}
+	}
+
+	for _, ext := range strings.FieldsFunc(extensions, func(r rune) bool { return r == ',' || r == ' ' }) {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if ext == "." || strings.ContainsAny(ext, `/\`) {
+			return rule, fmt.Errorf("无效的扩展名: %s", ext)
+		}
+		rule.Extensions = append(rule.Extensions, ext)
+	}
+
+	var err error
+	if rule.MaxSize, err = parseSizeArg(maxSize); err != nil {
+		return rule, err
+	}
+	if rule.MinFreeSpace, err = parseSizeArg(minFreeSpace); err != nil {
+		return rule, err
+	}
+	if directory = strings.TrimSpace(directory); directory != "" {
+		rule.Directory = filepath.Clean(directory)
+	}
+	return rule, nil
+}
+
+// 解析大小参数，如 500MB、1.5GB、1024；空字符串表示 0
+func parseSizeArg(arg string) (int64, error) {
+	arg = strings.ToUpper(strings.TrimSpace(arg))
+	if arg == "" {
+		return 0, nil
+	}
+	number := strings.TrimRight(strings.TrimSuffix(arg, "B"), "KMGT")
+	unit := strings.TrimSuffix(strings.TrimPrefix(arg, number), "B")
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 || len(unit) > 1 {
+		return 0, fmt.Errorf("无效的大小: %s（示例: 500MB、2GB）", arg)
+	}
+	if unit != "" {
+		value *= float64(int64(1) << (10 * (strings.Index("KMGT", unit) + 1)))
+	}
+	if value > float64(1<<62) {
+		return 0, fmt.Errorf("大小超出范围: %s", arg)
+	}
+	return int64(value), nil
+}
+
+// 添加规则并保存
+func (node *P2PNode) addAutoAcceptRule(rule AutoAcceptRule) (AutoAcceptRule, error) {
+	node.AutoAcceptMutex.Lock()
+	rule.ID = 1
+	for _, existing := range node.AutoAcceptRules {
+		if existing.ID >= rule.ID {
+			rule.ID = existing.ID + 1
+		}
+	}
+	node.AutoAcceptRules = append(node.AutoAcceptRules, &rule)
+	node.AutoAcceptMutex.Unlock()
+
+	if err := node.saveAutoAcceptRules(); err != nil {
+		return rule, fmt.Errorf("保存自动接受规则失败: %v", err)
+	}
+	return rule, nil
+}
+
+// 删除规则并保存
+func (node *P2PNode) removeAutoAcceptRule(id int) error {
+	node.AutoAcceptMutex.Lock()
+	index := -1
+	for i, rule := range node.AutoAcceptRules {
+		if rule.ID == id {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		node.AutoAcceptMutex.Unlock()
+		return fmt.Errorf("没有编号为 %d 的规则", id)
+	}
+	node.AutoAcceptRules = append(node.AutoAcceptRules[:index], node.AutoAcceptRules[index+1:]...)
+	node.AutoAcceptMutex.Unlock()
+
+	if err := node.saveAutoAcceptRules(); err != nil {
+		return fmt.Errorf("保存自动接受规则失败: %v", err)
+	}
+	return nil
+}
+
+// 当前规则的副本
+func (node *P2PNode) autoAcceptRules() []AutoAcceptRule {
+	node.AutoAcceptMutex.RLock()
+	defer node.AutoAcceptMutex.RUnlock()
+	rules := make([]AutoAcceptRule, 0, len(node.AutoAcceptRules))
+	for _, rule := range node.AutoAcceptRules {
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+// 显示自动接受规则
+func (node *P2PNode) showAutoAcceptRules() {
+	rules := node.autoAcceptRules()
+	if len(rules) == 0 {
+		fmt.Println("没有自动接受规则")
+		return
+	}
+	fmt.Println("自动接受规则:")
+	for _, rule := range rules {
+		fmt.Printf("  #%d %s: %s\n", rule.ID, rule.PeerName, rule.describe())
+	}
+}
+
+// 收到请求后按规则自动接受；返回 true 表示已接受，不再询问用户
+func (node *P2PNode) tryAutoAccept(fileID string) bool {
+	node.FileTransfersMutex.RLock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists {
+		node.FileTransfersMutex.RUnlock()
+		return false
+	}
+	peerID := transfer.PeerID
+	size := transfer.FileSize
+	name := transfer.FileName
+	defaultDir := node.defaultSaveDir(transfer.PeerName, transfer.FileName, transfer.IsJob)
+	fileNames := []string{transfer.FileName}
+	if transfer.IsJob {
+		fileNames = nil
+		for _, entry := range transfer.Manifest {
+			if !entry.IsDir {
+				fileNames = append(fileNames, entry.Path)
+			}
+		}
+	}
+	node.FileTransfersMutex.RUnlock()
+
+	// 只信任握手时验证过身份的连接，已屏蔽的用户不自动接受
+	node.PeersMutex.RLock()
+	peer, online := node.Peers[peerID]
+	trusted := online && peer.Authenticated && !peer.IdentityChanged
+	node.PeersMutex.RUnlock()
+	if !trusted || node.isBlocked(peerID) {
+		return false
+	}
+
+	var rule *AutoAcceptRule
+	saveDir := defaultDir
+	for _, candidate := range node.autoAcceptRules() {
+		if candidate.PeerID != peerID || !candidate.matches(fileNames, size) {
+			continue
+		}
+		dir := defaultDir
+		if candidate.Directory != "" {
+			var err error
+			if dir, err = node.resolveSavePath(candidate.Directory); err != nil {
+				fmt.Printf("自动接受规则 #%d 未生效: %v\n", candidate.ID, err)
+				continue
+			}
+		}
+		if candidate.MinFreeSpace > 0 {
+			free, err := freeSpace(dir)
+			if err != nil || int64(free)-size < candidate.MinFreeSpace {
+				fmt.Printf("自动接受规则 #%d 未生效: %s 剩余空间不足 %s\n", candidate.ID, dir, formatFileSize(candidate.MinFreeSpace))
+				continue
+			}
+		}
+		rule = &candidate
+		saveDir = dir
+		break
+	}
+	if rule == nil {
+		return false
+	}
+
+	node.FileTransfersMutex.Lock()
+	transfer.SaveDir = saveDir
+	node.FileTransfersMutex.Unlock()
+	if err := node.respondToFileTransfer(fileID, true); err != nil {
+		fmt.Printf("自动接受规则 #%d 未生效: %v\n", rule.ID, err)
+		node.FileTransfersMutex.Lock()
+		transfer.SaveDir = ""
+		node.FileTransfersMutex.Unlock()
+		return false
+	}
+
+	node.FileTransfersMutex.RLock()
+	target := transfer.FilePath
+	node.FileTransfersMutex.RUnlock()
+	if target == "" {
+		target = saveDir
+	}
+	node.auditAutoAccept(fmt.Sprintf("规则 #%d 自动接受来自 %s (%s) 的 %s (%s)，保存到 %s",
+		rule.ID, node.getPeerName(peerID), peerID, name, formatFileSize(size), target))
+	return true
+}
+
+// 记录一行自动接受的审计信息
+func (node *P2PNode) auditAutoAccept(line string) {
+	now := time.Now().Format("2006-01-02 15:04:05")
+	fmt.Printf("[自动接受] %s\n", line)
+
+	file, err := os.OpenFile(autoAcceptLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		fmt.Printf("写入审计日志失败: %v\n", err)
+		return
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintf(file, "%s %s\n", now, line); err != nil {
+		fmt.Printf("写入审计日志失败: %v\n", err)
+	}
+}
+
+// 加载自动接受规则
+func (node *P2PNode) loadAutoAcceptRules() {
+	data, err := os.ReadFile(autoAcceptFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("读取自动接受规则失败: %v\n", err)
+		}
+		return
+	}
+
+	var rules []*AutoAcceptRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		fmt.Printf("解析自动接受规则失败: %v\n", err)
+		return
+	}
+
+	node.AutoAcceptMutex.Lock()
+	node.AutoAcceptRules = rules
+	node.AutoAcceptMutex.Unlock()
+}
+
+// 保存自动接受规则
+func (node *P2PNode) saveAutoAcceptRules() error {
+	node.AutoAcceptMutex.RLock()
+	data, err := json.MarshalIndent(node.AutoAcceptRules, "", "  ")
+	node.AutoAcceptMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(autoAcceptFile, data, 0600)
+}
+
+// 处理 /autoaccept 命令
+func (node *P2PNode) handleAutoAcceptCommand(args string) {
+	const usage = "用法: /autoaccept [list] | add <用户名> [ext=.zip,.log] [max=500MB] [minfree=10GB] [dir=目录] | remove <编号>"
+	// 目录包含空格时可用引号，如 dir="build output"
+	fields := parseSendPaths(args)
+	if len(fields) == 0 || fields[0] == "list" {
+		node.showAutoAcceptRules()
+		return
+	}
+
+	switch fields[0] {
+	case "add":
+		if len(fields) < 2 {
+			fmt.Println(usage)
+			return
+		}
+		options := make(map[string]string)
+		for _, field := range fields[2:] {
+			key, value, found := strings.Cut(field, "=")
+			if !found || (key != "ext" && key != "max" && key != "minfree" && key != "dir") {
+				fmt.Printf("未知的选项: %s\n", field)
+				fmt.Println(usage)
+				return
+			}
+			options[key] = value
+		}
+		rule, err := node.newAutoAcceptRule(fields[1], options["ext"], options["max"], options["minfree"], options["dir"])
+		if err == nil {
+			rule, err = node.addAutoAcceptRule(rule)
+		}
+		if err != nil {
+			fmt.Printf("添加自动接受规则失败: %v\n", err)
+			return
+		}
+		fmt.Printf("已添加自动接受规则 #%d %s: %s\n", rule.ID, rule.PeerName, rule.describe())
+
+	case "remove":
+		if len(fields) < 2 {
+			fmt.Println(usage)
+			return
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(fields[1], "#"))
+		if err == nil {
+			err = node.removeAutoAcceptRule(id)
+		}
+		if err != nil {
+			fmt.Printf("删除自动接受规则失败: %v\n", err)
+			return
+		}
+		fmt.Printf("已删除自动接受规则 #%d\n", id)
+
+	default:
+		fmt.Println(usage)
+	}
+}
@@ -0,0 +1,699 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 限速与传输调度
+//
+// 上传和下载各有一个全局令牌桶，也可以为单个用户（按节点ID）另设限速，两者同时生效。
+// 发送方每发一块前从令牌桶取出相应的字节数，不足时等待；下载限速由接收方推迟文件块的
+// 确认实现，发送方的滑动窗口因此放慢，不需要对方支持新的消息（不支持确认的旧版发送方
+// 不受下载限速约束）。传输的速度按已确认的字节计算，限速生效后显示的就是限速后的实际
+// 速度。同时发送的传输数可以设上限，超出的传输进入队列，按优先级（高、普通、低）和开始
+// 顺序依次发送；目录任务依次发送其中的文件，每个文件占用一个名额。限速和并发数修改后
+// 立即对进行中的传输生效，配置保存在 rate_limits.json。
+const (
+	rateLimitFile = "rate_limits.json"
+	minRateLimit  = fileChunkSize // 每秒至少一块，否则接收方推迟的确认会超时
+)
+
+// 传输优先级
+const (
+	PriorityLow    = -1
+	PriorityNormal = 0
+	PriorityHigh   = 1
+)
+
+// RateLimitConfig结构体 - 限速与并发配置，速度单位为字节/秒，0 表示不限
+type RateLimitConfig struct {
+	Upload        int64                     `json:"upload,omitempty"`
+	Download      int64                     `json:"download,omitempty"`
+	MaxConcurrent int                       `json:"maxConcurrent,omitempty"` // 同时发送的传输数
+	Peers         map[string]*PeerRateLimit `json:"peers,omitempty"`         // 节点ID -> 该用户的限速
+}
+
+// PeerRateLimit结构体 - 单个用户的限速
+type PeerRateLimit struct {
+	PeerName string `json:"peerName"` // 设置时对方的用户名，仅用于显示
+	Upload   int64  `json:"upload,omitempty"`
+	Download int64  `json:"download,omitempty"`
+}
+
+// tokenBucket结构体 - 令牌桶，最多积累一秒的令牌
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64 // 字节/秒，0 表示不限
+	tokens float64 // 可以为负，表示已预支的字节
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), last: time.Now()}
+}
+
+func (b *tokenBucket) refillLocked() {
+	now := time.Now()
+	if b.rate > 0 {
+		b.tokens += b.rate * now.Sub(b.last).Seconds()
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+}
+
+// 修改速率，已预支的字节按新速率偿还
+func (b *tokenBucket) setRate(rate int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refillLocked()
+	b.rate = float64(rate)
+	if b.rate == 0 || b.tokens > b.rate {
+		b.tokens = 0
+	}
+}
+
+// 等待令牌不再透支后取出 n 字节；stale 返回 true 时放弃等待。
+// 每次等待后按当前速率重新计算，速率修改后立即生效
+func (b *tokenBucket) wait(n int, stale func() bool) bool {
+	for {
+		b.mutex.Lock()
+		b.refillLocked()
+		if b.rate == 0 || b.tokens >= 0 {
+			if b.rate > 0 {
+				b.tokens -= float64(n)
+			}
+			b.mutex.Unlock()
+			return true
+		}
+		delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+		b.mutex.Unlock()
+
+		if delay > 100*time.Millisecond {
+			delay = 100 * time.Millisecond
+		}
+		time.Sleep(delay)
+		if stale() {
+			return false
+		}
+	}
+}
+
+// 预支 n 字节，返回需要推迟的时间
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refillLocked()
+	if b.rate == 0 {
+		return 0
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// peerBuckets结构体 - 单个用户的上传和下载令牌桶
+type peerBuckets struct {
+	upload   *tokenBucket
+	download *tokenBucket
+}
+
+// queuedSend结构体 - 等待发送名额的传输
+type queuedSend struct {
+	fileID   string
+	group    string // 所属的任务或群发ID
+	priority int
+	seq      int
+	ready    chan struct{}
+}
+
+// transferScheduler结构体 - 限制同时发送的传输数，排队的传输按优先级依次开始
+type transferScheduler struct {
+	mutex   sync.Mutex
+	max     int // 0 表示不限
+	active  int
+	seq     int
+	waiting []*queuedSend
+}
+
+// 分配名额给队列中优先级最高、最早排队的传输
+func (s *transferScheduler) promoteLocked() {
+	for len(s.waiting) > 0 && (s.max <= 0 || s.active < s.max) {
+		best := 0
+		for i, w := range s.waiting {
+			if w.priority > s.waiting[best].priority ||
+				(w.priority == s.waiting[best].priority && w.seq < s.waiting[best].seq) {
+				best = i
+			}
+		}
+		w := s.waiting[best]
+		s.waiting = append(s.waiting[:best], s.waiting[best+1:]...)
+		s.active++
+		close(w.ready)
+	}
+}
+
+// 等待发送名额；queued 在需要排队时调用，stale 返回 true 时放弃等待
+func (s *transferScheduler) acquire(fileID, group string, priority int, queued func(), stale func() bool) bool {
+	s.mutex.Lock()
+	if s.max <= 0 || (s.active < s.max && len(s.waiting) == 0) {
+		s.active++
+		s.mutex.Unlock()
+		return true
+	}
+	s.seq++
+	w := &queuedSend{fileID: fileID, group: group, priority: priority, seq: s.seq, ready: make(chan struct{})}
+	s.waiting = append(s.waiting, w)
+	s.mutex.Unlock()
+	queued()
+
+	for {
+		select {
+		case <-w.ready:
+			return true
+		case <-time.After(200 * time.Millisecond):
+		}
+		if !stale() {
+			continue
+		}
+		s.mutex.Lock()
+		for i, other := range s.waiting {
+			if other == w {
+				s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+				s.mutex.Unlock()
+				return false
+			}
+		}
+		s.mutex.Unlock()
+		// 放弃前已分配到名额，交还给下一个
+		s.release()
+		return false
+	}
+}
+
+// 交还发送名额
+func (s *transferScheduler) release() {
+	s.mutex.Lock()
+	s.active--
+	s.promoteLocked()
+	s.mutex.Unlock()
+}
+
+// 修改同时发送的传输数
+func (s *transferScheduler) setMax(max int) {
+	s.mutex.Lock()
+	s.max = max
+	s.promoteLocked()
+	s.mutex.Unlock()
+}
+
+// 修改排队中的传输（或任务、群发中各文件）的优先级
+func (s *transferScheduler) setPriority(id string, priority int) {
+	s.mutex.Lock()
+	for _, w := range s.waiting {
+		if w.fileID == id || w.group == id {
+			w.priority = priority
+		}
+	}
+	s.mutex.Unlock()
+}
+
+// 发送中和排队中的传输数
+func (s *transferScheduler) stats() (active int, waiting int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.active, len(s.waiting)
+}
+
+// 发送前等待名额，排队期间传输标记为排队中
+func (node *P2PNode) acquireSendSlot(fileID string, stale func() bool) bool {
+	node.FileTransfersMutex.RLock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists {
+		node.FileTransfersMutex.RUnlock()
+		return false
+	}
+	// 任务中的文件使用任务的优先级
+	group := transfer.BroadcastID
+	priority := transfer.Priority
+	if transfer.JobID != "" {
+		group = transfer.JobID
+		if job, exists := node.FileTransfers[transfer.JobID]; exists {
+			priority = job.Priority
+		}
+	}
+	node.FileTransfersMutex.RUnlock()
+
+	setQueued := func(queued bool) {
+		node.FileTransfersMutex.Lock()
+		transfer.Queued = queued
+		node.FileTransfersMutex.Unlock()
+		node.publishTransfer(fileID, true)
+	}
+	acquired := node.Scheduler.acquire(fileID, group, priority, func() { setQueued(true) }, stale)
+	node.FileTransfersMutex.RLock()
+	wasQueued := transfer.Queued
+	node.FileTransfersMutex.RUnlock()
+	if wasQueued {
+		setQueued(false)
+	}
+	return acquired
+}
+
+// 发送一块前等待上传令牌（全局和该用户的限速）
+func (node *P2PNode) throttleUpload(peerID string, n int, stale func() bool) bool {
+	node.RateLimitMutex.RLock()
+	buckets := []*tokenBucket{node.UploadBucket}
+	if peer, exists := node.PeerBuckets[peerID]; exists {
+		buckets = append(buckets, peer.upload)
+	}
+	node.RateLimitMutex.RUnlock()
+
+	for _, bucket := range buckets {
+		if !bucket.wait(n, stale) {
+			return false
+		}
+	}
+	return true
+}
+
+// 接收一块后按下载限速计算确认需要推迟的时间
+func (node *P2PNode) downloadDelay(peerID string, n int) time.Duration {
+	node.RateLimitMutex.RLock()
+	buckets := []*tokenBucket{node.DownloadBucket}
+	if peer, exists := node.PeerBuckets[peerID]; exists {
+		buckets = append(buckets, peer.download)
+	}
+	node.RateLimitMutex.RUnlock()
+
+	var delay time.Duration
+	for _, bucket := range buckets {
+		if d := bucket.reserve(n); d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// 对某个用户某个方向生效的限速（全局和该用户限速中较小的一个），0 表示不限
+func (node *P2PNode) effectiveRateLimit(peerID string, direction string) int64 {
+	node.RateLimitMutex.RLock()
+	defer node.RateLimitMutex.RUnlock()
+
+	limits := []int64{node.RateLimits.Upload}
+	if direction == "receive" {
+		limits[0] = node.RateLimits.Download
+	}
+	if peer, exists := node.RateLimits.Peers[peerID]; exists {
+		if direction == "receive" {
+			limits = append(limits, peer.Download)
+		} else {
+			limits = append(limits, peer.Upload)
+		}
+	}
+	effective := int64(0)
+	for _, limit := range limits {
+		if limit > 0 && (effective == 0 || limit < effective) {
+			effective = limit
+		}
+	}
+	return effective
+}
+
+// 按配置更新令牌桶和并发数，进行中的传输立即按新配置限速
+func (node *P2PNode) applyRateLimits() {
+	node.RateLimitMutex.Lock()
+	config := node.RateLimits
+	if node.UploadBucket == nil {
+		node.UploadBucket = newTokenBucket(config.Upload)
+		node.DownloadBucket = newTokenBucket(config.Download)
+		node.PeerBuckets = make(map[string]*peerBuckets)
+		node.Scheduler = &transferScheduler{}
+	} else {
+		node.UploadBucket.setRate(config.Upload)
+		node.DownloadBucket.setRate(config.Download)
+	}
+	for id, limit := range config.Peers {
+		if buckets, exists := node.PeerBuckets[id]; exists {
+			buckets.upload.setRate(limit.Upload)
+			buckets.download.setRate(limit.Download)
+		} else {
+			node.PeerBuckets[id] = &peerBuckets{upload: newTokenBucket(limit.Upload), download: newTokenBucket(limit.Download)}
+		}
+	}
+	for id := range node.PeerBuckets {
+		if _, exists := config.Peers[id]; !exists {
+			delete(node.PeerBuckets, id)
+		}
+	}
+	scheduler := node.Scheduler
+	node.RateLimitMutex.Unlock()
+
+	scheduler.setMax(config.MaxConcurrent)
+}
+
+// 解析速度参数，如 2MB、500KB/s；off 或 0 表示不限
+func parseRateArg(arg string) (int64, error) {
+	arg = strings.TrimSpace(arg)
+	if strings.EqualFold(arg, "off") {
+		return 0, nil
+	}
+	rate, err := parseSizeArg(strings.TrimSuffix(strings.TrimSuffix(arg, "/s"), "/S"))
+	if err != nil {
+		return 0, fmt.Errorf("无效的速度: %s（示例: 2MB、500KB、off）", arg)
+	}
+	if err := validateRateLimit(rate); err != nil {
+		return 0, err
+	}
+	return rate, nil
+}
+
+// 检查限速值：0 表示不限，否则不能低于每秒一块
+func validateRateLimit(rate int64) error {
+	if rate < 0 {
+		return fmt.Errorf("限速不能为负数")
+	}
+	if rate > 0 && rate < minRateLimit {
+		return fmt.Errorf("限速不能低于 %s/s", formatFileSize(minRateLimit))
+	}
+	return nil
+}
+
+// 检查整份限速配置（修改和加载时使用）
+func (config *RateLimitConfig) validate() error {
+	if err := validateRateLimit(config.Upload); err != nil {
+		return fmt.Errorf("上传%v", err)
+	}
+	if err := validateRateLimit(config.Download); err != nil {
+		return fmt.Errorf("下载%v", err)
+	}
+	if config.MaxConcurrent < 0 {
+		return fmt.Errorf("同时发送数不能为负数")
+	}
+	for _, limit := range config.Peers {
+		if limit == nil {
+			return fmt.Errorf("用户限速为空")
+		}
+		if err := validateRateLimit(limit.Upload); err != nil {
+			return fmt.Errorf("%s 的上传%v", limit.PeerName, err)
+		}
+		if err := validateRateLimit(limit.Download); err != nil {
+			return fmt.Errorf("%s 的下载%v", limit.PeerName, err)
+		}
+	}
+	return nil
+}
+
+// 显示用的速度
+func formatRateLimit(rate int64) string {
+	if rate == 0 {
+		return "不限"
+	}
+	return formatFileSize(rate) + "/s"
+}
+
+// 修改全局限速和并发数；参数为 nil 时保持不变，任一参数无效时都不修改
+func (node *P2PNode) setGlobalRateLimits(upload, download *int64, maxConcurrent *int) error {
+	if upload != nil {
+		if err := validateRateLimit(*upload); err != nil {
+			return err
+		}
+	}
+	if download != nil {
+		if err := validateRateLimit(*download); err != nil {
+			return err
+		}
+	}
+	if maxConcurrent != nil && *maxConcurrent < 0 {
+		return fmt.Errorf("同时发送数不能为负数")
+	}
+
+	node.RateLimitMutex.Lock()
+	if upload != nil {
+		node.RateLimits.Upload = *upload
+	}
+	if download != nil {
+		node.RateLimits.Download = *download
+	}
+	if maxConcurrent != nil {
+		node.RateLimits.MaxConcurrent = *maxConcurrent
+	}
+	node.RateLimitMutex.Unlock()
+
+	node.applyRateLimits()
+	return node.saveRateLimits()
+}
+
+// 修改某个用户的限速；上传和下载都不限时删除该用户的设置
+func (node *P2PNode) setPeerRateLimit(peerName string, upload, download *int64) error {
+	if upload != nil {
+		if err := validateRateLimit(*upload); err != nil {
+			return err
+		}
+	}
+	if download != nil {
+		if err := validateRateLimit(*download); err != nil {
+			return err
+		}
+	}
+	peerID := node.resolvePeerID(peerName)
+	if peerID == "" {
+		node.KnownPeersMutex.RLock()
+		for id, kp := range node.KnownPeers {
+			if kp.Name == peerName {
+				peerID = id
+				break
+			}
+		}
+		node.KnownPeersMutex.RUnlock()
+	}
+	if peerID == "" {
+		return fmt.Errorf("找不到用户 %s", peerName)
+	}
+
+	node.RateLimitMutex.Lock()
+	if node.RateLimits.Peers == nil {
+		node.RateLimits.Peers = make(map[string]*PeerRateLimit)
+	}
+	limit, exists := node.RateLimits.Peers[peerID]
+	if !exists {
+		limit = &PeerRateLimit{}
+		node.RateLimits.Peers[peerID] = limit
+	}
+	limit.PeerName = peerName
+	if upload != nil {
+		limit.Upload = *upload
+	}
+	if download != nil {
+		limit.Download = *download
+	}
+	if limit.Upload == 0 && limit.Download == 0 {
+		delete(node.RateLimits.Peers, peerID)
+	}
+	node.RateLimitMutex.Unlock()
+
+	node.applyRateLimits()
+	return node.saveRateLimits()
+}
+
+// 当前配置的副本
+func (node *P2PNode) rateLimitConfig() RateLimitConfig {
+	node.RateLimitMutex.RLock()
+	defer node.RateLimitMutex.RUnlock()
+	config := node.RateLimits
+	config.Peers = make(map[string]*PeerRateLimit)
+	for id, limit := range node.RateLimits.Peers {
+		copied := *limit
+		config.Peers[id] = &copied
+	}
+	return config
+}
+
+// 显示限速配置和发送队列
+func (node *P2PNode) showRateLimits() {
+	config := node.rateLimitConfig()
+	fmt.Printf("上传限速: %s，下载限速: %s\n", formatRateLimit(config.Upload), formatRateLimit(config.Download))
+	active, waiting := node.Scheduler.stats()
+	if config.MaxConcurrent > 0 {
+		fmt.Printf("同时发送: 最多 %d 个（发送中 %d，排队 %d）\n", config.MaxConcurrent, active, waiting)
+	} else {
+		fmt.Printf("同时发送: 不限（发送中 %d）\n", active)
+	}
+	if len(config.Peers) == 0 {
+		return
+	}
+	ids := make([]string, 0, len(config.Peers))
+	for id := range config.Peers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return config.Peers[ids[i]].PeerName < config.Peers[ids[j]].PeerName })
+	fmt.Println("用户限速:")
+	for _, id := range ids {
+		limit := config.Peers[id]
+		fmt.Printf("  %s: 上传 %s，下载 %s\n", limit.PeerName, formatRateLimit(limit.Upload), formatRateLimit(limit.Download))
+	}
+}
+
+// 处理 /limit 命令
+func (node *P2PNode) handleLimitCommand(args []string) {
+	const usage = "用法: /limit [up <速度>] [down <速度>] [max <数量>] | /limit peer <用户名> [up <速度>] [down <速度>] | /limit peer <用户名> off"
+	if len(args) == 0 {
+		node.showRateLimits()
+		return
+	}
+
+	peerName := ""
+	if args[0] == "peer" {
+		if len(args) < 3 {
+			fmt.Println(usage)
+			return
+		}
+		peerName = args[1]
+		args = args[2:]
+		if len(args) == 1 && args[0] == "off" {
+			zero := int64(0)
+			if err := node.setPeerRateLimit(peerName, &zero, &zero); err != nil {
+				fmt.Printf("修改限速失败: %v\n", err)
+				return
+			}
+			node.showRateLimits()
+			return
+		}
+	}
+	if len(args)%2 != 0 {
+		fmt.Println(usage)
+		return
+	}
+
+	var upload, download *int64
+	var maxConcurrent *int
+	for i := 0; i < len(args); i += 2 {
+		switch args[i] {
+		case "up", "down":
+			rate, err := parseRateArg(args[i+1])
+			if err != nil {
+				fmt.Printf("错误: %v\n", err)
+				return
+			}
+			if args[i] == "up" {
+				upload = &rate
+			} else {
+				download = &rate
+			}
+		case "max":
+			if peerName != "" {
+				fmt.Println(usage)
+				return
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				fmt.Printf("错误: 无效的数量: %s（0 表示不限）\n", args[i+1])
+				return
+			}
+			maxConcurrent = &n
+		default:
+			fmt.Println(usage)
+			return
+		}
+	}
+
+	var err error
+	if peerName != "" {
+		err = node.setPeerRateLimit(peerName, upload, download)
+	} else {
+		err = node.setGlobalRateLimits(upload, download, maxConcurrent)
+	}
+	if err != nil {
+		fmt.Printf("修改限速失败: %v\n", err)
+		return
+	}
+	node.showRateLimits()
+}
+
+// 解析优先级名称
+func parsePriority(name string) (int, error) {
+	switch name {
+	case "high":
+		return PriorityHigh, nil
+	case "normal":
+		return PriorityNormal, nil
+	case "low":
+		return PriorityLow, nil
+	}
+	return 0, fmt.Errorf("无效的优先级: %s（可选 high、normal、low）", name)
+}
+
+// 显示用的优先级
+func priorityText(priority int) string {
+	switch {
+	case priority > PriorityNormal:
+		return "高"
+	case priority < PriorityNormal:
+		return "低"
+	}
+	return "普通"
+}
+
+// 修改发送的优先级；任务和群发作用于其中所有文件，排队中的传输按新优先级重新排序
+func (node *P2PNode) setTransferPriority(fileID string, priority int) error {
+	node.FileTransfersMutex.Lock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists || transfer.Direction != "send" || transfer.JobID != "" {
+		node.FileTransfersMutex.Unlock()
+		return fmt.Errorf("无效的文件传输ID（只能调整发送的优先级）")
+	}
+	transfer.Priority = priority
+	if transfer.IsBroadcast {
+		for _, id := range transfer.Children {
+			if child, exists := node.FileTransfers[id]; exists {
+				child.Priority = priority
+			}
+		}
+	}
+	node.FileTransfersMutex.Unlock()
+
+	node.Scheduler.setPriority(fileID, priority)
+	node.publishTransfer(fileID, true)
+	return nil
+}
+
+// 加载限速配置
+func (node *P2PNode) loadRateLimits() {
+	data, err := os.ReadFile(rateLimitFile)
+	if err == nil {
+		var config RateLimitConfig
+		if err := json.Unmarshal(data, &config); err != nil {
+			fmt.Printf("解析限速配置失败: %v\n", err)
+		} else if err := config.validate(); err != nil {
+			fmt.Printf("限速配置无效，已忽略: %v\n", err)
+		} else {
+			node.RateLimitMutex.Lock()
+			node.RateLimits = config
+			node.RateLimitMutex.Unlock()
+		}
+	} else if !os.IsNotExist(err) {
+		fmt.Printf("读取限速配置失败: %v\n", err)
+	}
+	node.applyRateLimits()
+}
+
+// 保存限速配置
+func (node *P2PNode) saveRateLimits() error {
+	node.RateLimitMutex.RLock()
+	data, err := json.MarshalIndent(node.RateLimits, "", "  ")
+	node.RateLimitMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(rateLimitFile, data, 0600)
+}
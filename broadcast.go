@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 群发文件
+//
+// 同一个文件发给多个用户时，每个接收方各自收到一个普通的文件传输请求，独立接受、
+// 续传、暂停或取消；本地另有一条群发记录汇总各接收方的进度。整个文件的校验值只
+// 计算一次，各发送协程共用源文件的读取缓存：最先发送某块的协程读取并计算哈希，
+// 其余接收方直接使用缓存中的数据。
+const sharedSourceCacheChunks = 256 // 缓存最近读取的块数 (16MB)
+
+// sharedSource结构体 - 群发时各接收方共用的源文件读取缓存
+type sharedSource struct {
+	mutex  sync.Mutex
+	path   string
+	size   int64
+	file   *os.File
+	chunks map[int]*sourceChunk
+	order  []int // 按读取顺序淘汰
+}
+
+// sourceChunk结构体 - 缓存的数据块及其哈希（只读）
+type sourceChunk struct {
+	data []byte
+	hash []byte
+}
+
+func newSharedSource(path string, size int64) *sharedSource {
+	return &sharedSource{path: path, size: size, chunks: make(map[int]*sourceChunk)}
+}
+
+// 读取一个数据块；返回的数据在多个发送协程间共享，不能修改
+func (s *sharedSource) chunk(chunkNum int) ([]byte, []byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if cached, exists := s.chunks[chunkNum]; exists {
+		return cached.data, cached.hash, nil
+	}
+	// 全部接收方结束后会关闭文件，之后的续传重新打开
+	if s.file == nil {
+		file, err := os.Open(s.path)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.file = file
+	}
+	data := make([]byte, chunkLength(s.size, chunkNum))
+	n, err := s.file.ReadAt(data, int64(chunkNum-1)*fileChunkSize)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	data = data[:n]
+	hash := sha256.Sum256(data)
+	cached := &sourceChunk{data: data, hash: hash[:]}
+
+	s.chunks[chunkNum] = cached
+	s.order = append(s.order, chunkNum)
+	if len(s.order) > sharedSourceCacheChunks {
+		delete(s.chunks, s.order[0])
+		s.order = s.order[1:]
+	}
+	return cached.data, cached.hash, nil
+}
+
+// 释放文件和缓存
+func (s *sharedSource) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	s.chunks = make(map[int]*sourceChunk)
+	s.order = nil
+}
+
+// 把一个文件发给多个用户；targetNames 为空时发给所有在线用户
+func (node *P2PNode) sendBroadcast(filePath string, targetNames []string) {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		fmt.Printf("文件不存在或无法访问: %s\n", filePath)
+		return
+	}
+	if fileInfo.IsDir() {
+		fmt.Printf("群发只支持单个文件: %s\n", filePath)
+		return
+	}
+
+	// 选出接收方：在线、未屏蔽的用户
+	var recipients []broadcastRecipient
+	wanted := make(map[string]bool)
+	for _, name := range targetNames {
+		wanted[name] = true
+	}
+	node.PeersMutex.RLock()
+	for id, peer := range node.Peers {
+		if !peer.IsActive || (len(wanted) > 0 && !wanted[peer.Name]) {
+			continue
+		}
+		recipients = append(recipients, broadcastRecipient{
+			id:           id,
+			name:         peer.Name,
+			deferredHash: peer.hasCapability(CapabilityDeferredHash),
+		})
+		delete(wanted, peer.Name)
+	}
+	node.PeersMutex.RUnlock()
+	for name := range wanted {
+		fmt.Printf("用户 %s 不在线，已跳过\n", name)
+	}
+	var targets []broadcastRecipient
+	for _, r := range recipients {
+		if node.isBlocked(r.id) {
+			fmt.Printf("用户 %s 被屏蔽，已跳过\n", r.name)
+			continue
+		}
+		targets = append(targets, r)
+	}
+	if len(targets) == 0 {
+		fmt.Println("没有可以接收文件的在线用户")
+		return
+	}
+
+	// 校验值只计算一次，所有接收方共用。都支持时先发送请求，校验值在后台计算并随发送完成
+	// 通知送达；否则在后台算完后再发送请求，都不阻塞命令行和Web请求
+	deferred := true
+	for _, r := range targets {
+		deferred = deferred && r.deferredHash
+	}
+	if deferred {
+		node.startBroadcast(filePath, fileInfo, "", targets)
+		return
+	}
+	go func() {
+		fileHash, err := fileSHA256(filePath)
+		if err != nil {
+			fmt.Printf("计算文件校验值失败: %v\n", err)
+			return
+		}
+		node.startBroadcast(filePath, fileInfo, fileHash, targets)
+	}()
+}
+
+// broadcastRecipient结构体 - 群发的接收方
+type broadcastRecipient struct {
+	id           string
+	name         string
+	deferredHash bool // 支持由发送完成通知提供校验值
+}
+
+// 创建群发记录并向每个接收方发送请求；fileHash 为空时在后台计算
+func (node *P2PNode) startBroadcast(filePath string, fileInfo os.FileInfo, fileHash string, targets []broadcastRecipient) {
+	broadcastID := generateFileID()
+	node.FileTransfersMutex.Lock()
+	node.FileTransfers[broadcastID] = &FileTransferStatus{
+		FileID:      broadcastID,
+		FileName:    filepath.Base(filePath),
+		FilePath:    filePath,
+		FileSize:    fileInfo.Size() * int64(len(targets)),
+		SHA256:      fileHash,
+		Status:      "pending",
+		Direction:   "send",
+		PeerName:    fmt.Sprintf("%d 个接收方", len(targets)),
+		StartTime:   time.Now(),
+		IsBroadcast: true,
+		Recipients:  len(targets),
+		Source:      newSharedSource(filePath, fileInfo.Size()),
+	}
+	node.FileTransfersMutex.Unlock()
+
+	fmt.Printf("群发文件 %s (%s) 给 %d 个用户 (群发ID: %s)\n",
+		filepath.Base(filePath), formatFileSize(fileInfo.Size()), len(targets), broadcastID)
+	hashIDs := []string{broadcastID}
+	for _, r := range targets {
+		hashIDs = append(hashIDs, node.offerFile(filePath, fileInfo, fileHash, r.id, r.name, broadcastID))
+	}
+	if fileHash == "" {
+		node.hashOutgoingFile(filePath, hashIDs...)
+	}
+	node.refreshBroadcast(broadcastID, true)
+}
+
+// 群发中已结束的接收方状态
+func broadcastChildDone(status string) bool {
+	switch status {
+	case "completed", "rejected", "cancelled", "failed":
+		return true
+	}
+	return false
+}
+
+// 汇总各接收方的进度和状态到群发记录，并按需推送
+func (node *P2PNode) refreshBroadcast(broadcastID string, force bool) {
+	node.FileTransfersMutex.Lock()
+	parent, exists := node.FileTransfers[broadcastID]
+	if !exists || !parent.IsBroadcast {
+		node.FileTransfersMutex.Unlock()
+		return
+	}
+	previous := parent.Status
+
+	var size, progress int64
+	speed := 0.0
+	unfinished := 0
+	counts := make(map[string]int)
+	for _, id := range parent.Children {
+		child, exists := node.FileTransfers[id]
+		if !exists {
+			continue
+		}
+		counts[child.Status]++
+		if !broadcastChildDone(child.Status) {
+			unfinished++
+		}
+		if child.Status == "transferring" {
+			speed += child.Speed
+		}
+		// 拒绝接收的用户不计入总量
+		if child.Status != "rejected" {
+			size += child.FileSize
+			progress += child.Progress
+		}
+	}
+	parent.Recipients = len(parent.Children)
+	parent.CompletedRecipients = counts["completed"]
+	parent.FileSize = size
+	parent.Progress = progress
+	parent.Speed = speed
+	if speed > 0 {
+		parent.ETA = int64(float64(size-progress) / speed)
+	} else {
+		parent.ETA = -1
+	}
+
+	switch {
+	case unfinished == 0 && counts["completed"] > 0:
+		parent.Status = "completed"
+	case unfinished == 0 && counts["cancelled"] > 0:
+		parent.Status = "cancelled"
+	case unfinished == 0 && counts["rejected"] == len(parent.Children):
+		parent.Status = "rejected"
+	case unfinished == 0:
+		parent.Status = "failed"
+	case counts["transferring"] > 0:
+		parent.Status = "transferring"
+	case counts["pending"] > 0:
+		parent.Status = "pending"
+	case counts["paused"] > 0:
+		parent.Status = "paused"
+	case counts["interrupted"] > 0:
+		parent.Status = "interrupted"
+	case counts["corrupted"] > 0:
+		parent.Status = "corrupted"
+	}
+	parent.Resumable = counts["paused"]+counts["interrupted"]+counts["corrupted"] > 0
+	changed := parent.Status != previous
+	finished := changed && broadcastChildDone(parent.Status)
+	if finished {
+		parent.EndTime = time.Now()
+	}
+
+	now := time.Now()
+	publish := force || changed || now.Sub(parent.LastEventTime) >= transferEventInterval
+	var snapshot FileTransferStatus
+	if publish || finished {
+		parent.LastEventTime = now
+		snapshot = *parent
+	}
+	node.FileTransfersMutex.Unlock()
+
+	if finished {
+		if snapshot.Source != nil {
+			snapshot.Source.close()
+		}
+		fmt.Printf("群发结束: %s，%d/%d 个接收方已接收完成\n", snapshot.FileName, snapshot.CompletedRecipients, snapshot.Recipients)
+	}
+	if publish {
+		node.Events.Publish(EventTransfer, snapshot)
+	}
+}
+
+// 是否为群发记录
+func (node *P2PNode) isBroadcast(fileID string) bool {
+	node.FileTransfersMutex.RLock()
+	defer node.FileTransfersMutex.RUnlock()
+	transfer, exists := node.FileTransfers[fileID]
+	return exists && transfer.IsBroadcast
+}
+
+// 对群发中的每个接收方执行暂停或取消
+func (node *P2PNode) controlBroadcast(broadcastID string, control func(string) error) error {
+	node.FileTransfersMutex.RLock()
+	children := append([]string(nil), node.FileTransfers[broadcastID].Children...)
+	node.FileTransfersMutex.RUnlock()
+
+	done := 0
+	var firstErr error
+	for _, id := range children {
+		if err := control(id); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		done++
+	}
+	if done == 0 {
+		if firstErr != nil {
+			return firstErr
+		}
+		return fmt.Errorf("没有可操作的接收方")
+	}
+	node.refreshBroadcast(broadcastID, true)
+	return nil
+}
+
+// 加载续传状态后重建群发记录（群发记录本身不保存，由各接收方的记录恢复）
+func (node *P2PNode) refreshLoadedBroadcasts() {
+	var broadcasts []string
+	node.FileTransfersMutex.Lock()
+	for id, transfer := range node.FileTransfers {
+		if transfer.BroadcastID == "" {
+			continue
+		}
+		parent, exists := node.FileTransfers[transfer.BroadcastID]
+		if !exists {
+			parent = &FileTransferStatus{
+				FileID:      transfer.BroadcastID,
+				FileName:    transfer.FileName,
+				FilePath:    transfer.FilePath,
+				SHA256:      transfer.SHA256,
+				Status:      "interrupted",
+				Direction:   "send",
+				StartTime:   transfer.StartTime,
+				IsBroadcast: true,
+				Source:      newSharedSource(transfer.FilePath, transfer.FileSize),
+			}
+			node.FileTransfers[transfer.BroadcastID] = parent
+			broadcasts = append(broadcasts, transfer.BroadcastID)
+		}
+		parent.Children = append(parent.Children, id)
+		parent.PeerName = fmt.Sprintf("%d 个接收方", len(parent.Children))
+		transfer.Source = parent.Source
+	}
+	node.FileTransfersMutex.Unlock()
+
+	for _, id := range broadcasts {
+		node.refreshBroadcast(id, false)
+	}
+}
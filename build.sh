@@ -20,10 +20,19 @@ echo "正在清理旧的构建文件..."
 rm -f build/*
 
 # 源文件列表
-SOURCE_FILES="main.go types.go network.go discovery.go web.go filetransfer.go"
+SOURCE_FILES="main.go types.go network.go protocol.go identity.go knownpeers.go session.go dbkey.go migrations.go search.go resume.go flowcontrol.go datachannel.go job.go filename.go transfercontrol.go broadcast.go autoaccept.go download.go history.go bandwidth.go compression.go discovery.go web.go filetransfer.go events.go"
+
+# 按平台选择的源文件（命令行列出的文件不受构建约束筛选）
+platform_source_files() {
+    if [[ "$1" == "windows" ]]; then
+        echo "diskspace_windows.go"
+    else
+        echo "diskspace_unix.go"
+    fi
+}
 
 # 检查所有源文件是否存在
-for file in $SOURCE_FILES; do
+for file in $SOURCE_FILES diskspace_unix.go diskspace_windows.go; do
     if [ ! -f "$file" ]; then
         echo "错误: 源文件 $file 不存在"
         exit 1
@@ -75,7 +84,7 @@ build_platform() {
             return 1
         fi
         # Windows 构建使用 CGO_ENABLED=1 和相应 mingw
-        if GOOS=$GOOS GOARCH=$GOARCH CGO_ENABLED=1 CC=$CC_TOOL CXX=$CXX_TOOL go build -ldflags="-s -w" -o "build/$OUTPUT_NAME" $SOURCE_FILES; then
+        if GOOS=$GOOS GOARCH=$GOARCH CGO_ENABLED=1 CC=$CC_TOOL CXX=$CXX_TOOL go build -ldflags="-s -w" -o "build/$OUTPUT_NAME" $SOURCE_FILES $(platform_source_files $GOOS); then
             # 获取文件大小
             if command -v stat &> /dev/null; then
                 if [[ "$OSTYPE" == "darwin"* ]]; then
@@ -93,7 +102,7 @@ build_platform() {
             return 1
         fi
     else
-        if GOOS=$GOOS GOARCH=$GOARCH go build -ldflags="-s -w" -o "build/$OUTPUT_NAME" $SOURCE_FILES; then
+        if GOOS=$GOOS GOARCH=$GOARCH go build -ldflags="-s -w" -o "build/$OUTPUT_NAME" $SOURCE_FILES $(platform_source_files $GOOS); then
             # 获取文件大小
             if command -v stat &> /dev/null; then
                 if [[ "$OSTYPE" == "darwin"* ]]; then
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// 文件块与消息压缩
+//
+// 双方都支持 deflate 能力时，文件块在加密前用 DEFLATE 压缩，块头记录压缩算法，哈希仍按
+// 原始数据计算，接收方解压后照常校验。图片、视频、压缩包等已压缩的类型直接按原样发送；
+// 其他文件连续几块压缩无效（压缩后不小于原大小的 90%）时，本次发送的剩余部分也不再尝试。
+// 传输记录压缩后与原大小之比，显示在传输列表中。超过一定大小的 JSON 消息（如内嵌
+// base64 图片的聊天消息）同样压缩后再放入加密信封，帧类型为 FrameTypeCompressed。
+const (
+	compressionDeflate       = "deflate"
+	compressMessageThreshold = 4 * 1024 // 超过该大小的消息才压缩
+	compressMinSaving        = 0.9      // 压缩后不小于原大小的 90% 时按原样发送
+	incompressibleChunkLimit = 4        // 连续多少块压缩无效后停止尝试
+)
+
+// 已压缩的文件类型，再压缩几乎没有收益
+var precompressedExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".avif": true,
+	".mp4": true, ".mov": true, ".mkv": true, ".avi": true, ".webm": true, ".m4v": true,
+	".mp3": true, ".aac": true, ".ogg": true, ".flac": true, ".m4a": true, ".opus": true,
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".7z": true, ".rar": true, ".zst": true, ".lz4": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".jar": true, ".apk": true, ".dmg": true, ".pdf": true,
+}
+
+// 文件是否值得压缩
+func compressibleFile(name string) bool {
+	return !precompressedExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// 压缩器创建开销较大，按块复用
+var deflateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// DEFLATE 压缩
+func deflateBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	w := deflateWriters.Get().(*flate.Writer)
+	w.Reset(&buf)
+	w.Write(data)
+	w.Close()
+	deflateWriters.Put(w)
+	return buf.Bytes()
+}
+
+// DEFLATE 解压，解压后超过 limit 字节时报错，防止压缩炸弹
+func inflateBytes(data []byte, limit int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, fmt.Errorf("解压后超过 %d 字节", limit)
+	}
+	return out, nil
+}
+
+// 压缩文件块，压缩无效时返回 nil
+func compressChunk(data []byte) []byte {
+	compressed := deflateBytes(data)
+	if float64(len(compressed)) >= float64(len(data))*compressMinSaving {
+		return nil
+	}
+	return compressed
+}
+
+// 解压文件块，解压后不能超过块的长度
+func decompressChunk(algorithm string, data []byte, length int64) ([]byte, error) {
+	if algorithm != compressionDeflate {
+		return nil, fmt.Errorf("不支持的压缩算法: %s", algorithm)
+	}
+	return inflateBytes(data, int(length))
+}
+
+// 压缩帧负载: 原帧类型(1) | DEFLATE(原负载)；压缩无效时返回 false
+func compressFrame(frameType byte, payload []byte) ([]byte, bool) {
+	compressed := deflateBytes(payload)
+	if float64(len(compressed)) >= float64(len(payload))*compressMinSaving {
+		return nil, false
+	}
+	return append([]byte{frameType}, compressed...), true
+}
+
+// 解压帧负载，返回原帧类型和负载
+func decompressFrame(payload []byte) (byte, []byte, error) {
+	if len(payload) < 1 {
+		return 0, nil, fmt.Errorf("压缩帧负载过短")
+	}
+	if payload[0] == FrameTypeCompressed {
+		return 0, nil, fmt.Errorf("不允许嵌套的压缩帧")
+	}
+	data, err := inflateBytes(payload[1:], maxFrameSize)
+	if err != nil {
+		return 0, nil, fmt.Errorf("解压帧失败: %v", err)
+	}
+	return payload[0], data, nil
+}
+
+// 记录文件块的原始大小和传输大小，更新压缩比
+func (node *P2PNode) recordChunkCompression(fileID string, raw int, wire int, algorithm string) {
+	node.FileTransfersMutex.Lock()
+	defer node.FileTransfersMutex.Unlock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists {
+		return
+	}
+	transfer.RawBytes += int64(raw)
+	transfer.WireBytes += int64(wire)
+	if algorithm != "" {
+		transfer.Compression = algorithm
+	}
+	if transfer.Compression != "" && transfer.RawBytes > 0 {
+		transfer.CompressionRatio = float64(transfer.WireBytes) / float64(transfer.RawBytes)
+	}
+}
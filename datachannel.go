@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// 文件数据连接
+//
+// 文件块不再与聊天和控制消息共用主连接，避免大文件造成队头阻塞。发送方生成一次性
+// 密钥材料，经主连接的加密信封（会话密钥）发送给接收方；接收方回连发送方的监听
+// 端口，用由其派生的密钥证明身份，之后发送方在该连接上直接发送加密的二进制数据块。
+// 确认、补发请求等控制消息仍走主连接。建立失败时退回主连接传输。
+const (
+	dataChannelTokenSize   = 32
+	dataChannelOpenTimeout = 5 * time.Second
+	dataChannelNonceSize   = 8 // 帧序号，作为AEAD nonce
+)
+
+// DataChannelOpen结构体 - 请求接收方建立数据连接（只在加密信封内发送）
+type DataChannelOpen struct {
+	Type      string    `json:"type"`
+	FileID    string    `json:"fileId"`
+	IP        string    `json:"ip"`    // 发送方的监听地址（与发现广播中的地址一致）
+	Port      int       `json:"port"`  // 发送方的监听端口
+	Token     []byte    `json:"token"` // 一次性密钥材料
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// dataChannelHello结构体 - 接收方在数据连接上发送的第一帧
+type dataChannelHello struct {
+	FileID string `json:"fileId"`
+	From   string `json:"from"`
+	MAC    []byte `json:"mac"`
+}
+
+// pendingDataChannel结构体 - 发送方等待接收方回连的数据连接
+type pendingDataChannel struct {
+	token  []byte
+	peerID string
+	conn   chan net.Conn
+}
+
+// dataChannel结构体 - 已认证的数据连接
+type dataChannel struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	aead   cipher.AEAD
+	seq    uint64
+}
+
+// 由一次性密钥材料派生认证密钥和数据块加密密钥
+func dataChannelKeys(token []byte, fileID string) (helloKey, chunkKey [32]byte) {
+	helloKey = hkdfExpand(token, []byte(fileID), "LANShare-data-hello")
+	chunkKey = hkdfExpand(token, []byte(fileID), "LANShare-data-chunk")
+	return helloKey, chunkKey
+}
+
+// 计算回连认证码
+func dataChannelMAC(helloKey [32]byte, fileID, from string) []byte {
+	mac := hmac.New(sha256.New, helloKey[:])
+	mac.Write([]byte(fileID))
+	mac.Write([]byte{0})
+	mac.Write([]byte(from))
+	return mac.Sum(nil)
+}
+
+func newDataChannel(conn net.Conn, reader *bufio.Reader, token []byte, fileID string) (*dataChannel, error) {
+	_, chunkKey := dataChannelKeys(token, fileID)
+	aead, err := newSessionAEAD(chunkKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return &dataChannel{conn: conn, reader: reader, aead: aead}, nil
+}
+
+// 数据帧的nonce与附加认证数据
+func (dc *dataChannel) nonceAndAD(seq uint64) ([]byte, []byte) {
+	nonce := make([]byte, dc.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-dataChannelNonceSize:], seq)
+	ad := []byte{frameMagic, ProtocolVersionCurrent, FrameTypeDataChunk}
+	return nonce, ad
+}
+
+// 发送一个数据块: 负载 = 序号(8) | AEAD(文件块负载)
+func (dc *dataChannel) writeChunk(chunk FileChunk) error {
+	plaintext, err := encodeFileChunkPayload(chunk)
+	if err != nil {
+		return err
+	}
+	nonce, ad := dc.nonceAndAD(dc.seq)
+	header := make([]byte, dataChannelNonceSize)
+	binary.BigEndian.PutUint64(header, dc.seq)
+	dc.seq++
+	return writeFrame(dc.conn, FrameTypeDataChunk, 0, dc.aead.Seal(header, nonce, plaintext, ad))
+}
+
+// 读取一个数据块；TCP 保证顺序，序号必须连续
+func (dc *dataChannel) readChunk() (FileChunk, error) {
+	frame, err := readFrame(dc.reader)
+	if err != nil {
+		return FileChunk{}, err
+	}
+	if frame.Type != FrameTypeDataChunk || len(frame.Payload) < dataChannelNonceSize {
+		return FileChunk{}, fmt.Errorf("无效的数据帧 (类型 0x%02x)", frame.Type)
+	}
+	seq := binary.BigEndian.Uint64(frame.Payload)
+	if seq != dc.seq {
+		return FileChunk{}, fmt.Errorf("数据帧序号错误 (期望 %d, 实际 %d)", dc.seq, seq)
+	}
+	nonce, ad := dc.nonceAndAD(seq)
+	plaintext, err := dc.aead.Open(nil, nonce, frame.Payload[dataChannelNonceSize:], ad)
+	if err != nil {
+		return FileChunk{}, fmt.Errorf("数据帧认证失败")
+	}
+	dc.seq++
+	return decodeFileChunkPayload(plaintext)
+}
+
+func (dc *dataChannel) Close() error {
+	return dc.conn.Close()
+}
+
+// 发送方：请求接收方回连并等待数据连接建立
+func (node *P2PNode) openDataChannel(peer *Peer, fileID string) (*dataChannel, error) {
+	token := make([]byte, dataChannelTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	pending := &pendingDataChannel{token: token, peerID: peer.ID, conn: make(chan net.Conn, 1)}
+
+	node.DataChannelsMutex.Lock()
+	node.DataChannels[fileID] = pending
+	node.DataChannelsMutex.Unlock()
+	defer func() {
+		node.DataChannelsMutex.Lock()
+		if node.DataChannels[fileID] == pending {
+			delete(node.DataChannels, fileID)
+		}
+		node.DataChannelsMutex.Unlock()
+	}()
+
+	msg := Message{
+		Type:      "data_open",
+		From:      node.ID,
+		To:        peer.ID,
+		Timestamp: time.Now(),
+		Data: DataChannelOpen{
+			Type:      "data_open",
+			FileID:    fileID,
+			IP:        node.LocalIP,
+			Port:      node.LocalPort,
+			Token:     token,
+			Timestamp: time.Now(),
+		},
+	}
+	if err := node.sendMessageToPeer(peer, msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case conn := <-pending.conn:
+		return newDataChannel(conn, nil, token, fileID)
+	case <-time.After(dataChannelOpenTimeout):
+		// 认证通过的连接可能恰好在超时后到达
+		node.DataChannelsMutex.Lock()
+		delete(node.DataChannels, fileID)
+		node.DataChannelsMutex.Unlock()
+		select {
+		case conn := <-pending.conn:
+			conn.Close()
+		default:
+		}
+		return nil, fmt.Errorf("等待对方建立数据连接超时")
+	}
+}
+
+// 发送方：认证接收方回连的数据连接（由 handleIncomingConnection 识别后调用）
+func (node *P2PNode) acceptDataConnection(conn net.Conn, reader *bufio.Reader) {
+	conn.SetReadDeadline(time.Now().Add(dataChannelOpenTimeout))
+	frame, err := readFrame(reader)
+	if err != nil || frame.Type != FrameTypeDataHello {
+		conn.Close()
+		return
+	}
+	var hello dataChannelHello
+	if err := json.Unmarshal(frame.Payload, &hello); err != nil {
+		conn.Close()
+		return
+	}
+
+	node.DataChannelsMutex.Lock()
+	pending, exists := node.DataChannels[hello.FileID]
+	if exists {
+		helloKey, _ := dataChannelKeys(pending.token, hello.FileID)
+		if hello.From != pending.peerID || !hmac.Equal(hello.MAC, dataChannelMAC(helloKey, hello.FileID, hello.From)) {
+			exists = false
+		} else {
+			// 密钥材料只能使用一次
+			delete(node.DataChannels, hello.FileID)
+		}
+	}
+	node.DataChannelsMutex.Unlock()
+
+	if !exists {
+		fmt.Printf("拒绝来自 %s 的数据连接: 认证失败\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	pending.conn <- conn
+}
+
+// 接收方：处理建立数据连接的请求
+func (node *P2PNode) handleDataChannelOpen(from string, open DataChannelOpen) {
+	node.FileTransfersMutex.RLock()
+	transfer, exists := node.FileTransfers[open.FileID]
+	valid := exists && transfer.PeerID == from && transfer.Direction == "receive"
+	node.FileTransfersMutex.RUnlock()
+
+	node.PeersMutex.RLock()
+	peer, online := node.Peers[from]
+	node.PeersMutex.RUnlock()
+
+	// 只接受经加密信封送达的密钥材料
+	if !valid || !online || !peer.sealsEnvelope() || len(open.Token) != dataChannelTokenSize {
+		return
+	}
+
+	go node.receiveOnDataChannel(peer, open)
+}
+
+// 接收方：回连发送方并接收数据块
+func (node *P2PNode) receiveOnDataChannel(peer *Peer, open DataChannelOpen) {
+	host := open.IP
+	if host == "" {
+		host = peer.IP
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(open.Port))
+	conn, err := net.DialTimeout("tcp", address, dataChannelOpenTimeout)
+	if err != nil {
+		fmt.Printf("建立数据连接失败: %v，将通过主连接接收\n", err)
+		return
+	}
+	defer conn.Close()
+
+	helloKey, _ := dataChannelKeys(open.Token, open.FileID)
+	hello, err := json.Marshal(dataChannelHello{
+		FileID: open.FileID,
+		From:   node.ID,
+		MAC:    dataChannelMAC(helloKey, open.FileID, node.ID),
+	})
+	if err != nil {
+		return
+	}
+	if err := writeFrame(conn, FrameTypeDataHello, 0, hello); err != nil {
+		fmt.Printf("建立数据连接失败: %v\n", err)
+		return
+	}
+
+	channel, err := newDataChannel(conn, bufio.NewReader(conn), open.Token, open.FileID)
+	if err != nil {
+		return
+	}
+
+	node.FileTransfersMutex.Lock()
+	if transfer, exists := node.FileTransfers[open.FileID]; exists {
+		transfer.DataChannel = true
+	}
+	node.FileTransfersMutex.Unlock()
+	defer func() {
+		node.FileTransfersMutex.Lock()
+		if transfer, exists := node.FileTransfers[open.FileID]; exists {
+			transfer.DataChannel = false
+		}
+		node.FileTransfersMutex.Unlock()
+	}()
+
+	// 数据块直接在本协程处理，不经过主连接的消息队列
+	for {
+		chunk, err := channel.readChunk()
+		if err != nil {
+			return // 发送方发送完毕或连接断开；缺失的块由续传和补发机制处理
+		}
+		if chunk.FileID != open.FileID {
+			fmt.Printf("数据连接中的文件块不属于该传输，已断开\n")
+			return
+		}
+		node.handleFileChunk(chunk)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// 本地历史数据库密钥
+//
+// 两种模式:
+//
+//	keyfile    - 随机生成32字节密钥，保存在仅所有者可读写的 message.key 中（默认）
+//	passphrase - 由用户口令经 scrypt 派生，盐和参数保存在数据库 settings 表中
+//
+// settings 表中保存密钥校验值，用于在启动时发现口令错误或密钥文件丢失，
+// 避免用错误的密钥写入新消息。
+const (
+	dbKeyFile           = "message.key"
+	dbPassphraseEnv     = "LANSHARE_DB_PASSPHRASE"
+	dbKeyModeKeyfile    = "keyfile"
+	dbKeyModePassphrase = "passphrase"
+	minDBPassphraseLen  = 8
+)
+
+// scrypt 参数（交互式使用的推荐值）
+const (
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptSaltLen = 16
+)
+
+// settings 表中的键
+const (
+	settingDBKeyMode  = "db_key_mode"
+	settingDBKeySalt  = "db_key_salt"
+	settingDBKeyN     = "db_key_scrypt_n"
+	settingDBKeyCheck = "db_key_check"
+)
+
+var errDBKeyMismatch = errors.New("数据库密钥不正确")
+
+// 计算密钥校验值（不泄露密钥本身）
+func dbKeyCheck(key [32]byte) string {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte("LANShare-db-key-check"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 由口令派生数据库密钥
+func deriveDBKey(passphrase string, salt []byte, n int) ([32]byte, error) {
+	var key [32]byte
+	derived, err := scrypt.Key([]byte(passphrase), salt, n, scryptR, scryptP, 32)
+	if err != nil {
+		return key, err
+	}
+	copy(key[:], derived)
+	return key, nil
+}
+
+// 读取设置项，不存在时返回空字符串
+func getSetting(db *sql.DB, key string) (string, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+// 在事务中写入设置项
+func setSettingTx(tx *sql.Tx, key, value string) error {
+	_, err := tx.Exec("INSERT OR REPLACE INTO settings (key, value) VALUES (?, ?)", key, value)
+	return err
+}
+
+// 读取密钥文件
+func readDBKeyFile(path string) ([32]byte, error) {
+	var key [32]byte
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return key, err
+	}
+	decoded, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(decoded) != 32 {
+		return key, fmt.Errorf("密钥文件 %s 格式无效", path)
+	}
+	copy(key[:], decoded)
+	return key, nil
+}
+
+// 写入密钥文件（仅所有者可读写）
+func writeDBKeyFile(path string, key [32]byte) error {
+	return os.WriteFile(path, []byte(hex.EncodeToString(key[:])+"\n"), 0600)
+}
+
+// 生成随机密钥
+func newRandomDBKey() ([32]byte, error) {
+	var key [32]byte
+	_, err := rand.Read(key[:])
+	return key, err
+}
+
+// 初始化数据库密钥：首次使用时生成密钥文件，并把旧版全零密钥加密的记录迁移到新密钥
+func (node *P2PNode) initDBKey() error {
+	mode, err := getSetting(node.DB, settingDBKeyMode)
+	if err != nil {
+		return err
+	}
+	check, err := getSetting(node.DB, settingDBKeyCheck)
+	if err != nil {
+		return err
+	}
+
+	if check == "" {
+		// 新数据库或旧版数据库（使用全零密钥）
+		key, err := newRandomDBKey()
+		if err != nil {
+			return err
+		}
+		var legacyKey [32]byte
+		migrated, err := node.reencryptDB(legacyKey, key, dbKeyModeKeyfile, nil, 0)
+		if err != nil {
+			return err
+		}
+		node.LocalDBKey = key
+		if migrated > 0 {
+			fmt.Printf("已为 %d 条历史消息启用新的数据库密钥 (%s)\n", migrated, dbKeyFile)
+		}
+		return nil
+	}
+
+	switch mode {
+	case dbKeyModePassphrase:
+		return node.unlockDBWithPassphrase(check)
+	case dbKeyModeKeyfile:
+		key, err := readDBKeyFile(dbKeyFile)
+		if err != nil {
+			// 更换密钥时若在重命名前中断，新密钥仍在临时文件中
+			if tmpKey, tmpErr := readDBKeyFile(dbKeyFile + ".tmp"); tmpErr == nil && dbKeyCheck(tmpKey) == check {
+				if err := os.Rename(dbKeyFile+".tmp", dbKeyFile); err != nil {
+					return err
+				}
+				node.LocalDBKey = tmpKey
+				return nil
+			}
+			return fmt.Errorf("读取数据库密钥文件失败: %v", err)
+		}
+		if dbKeyCheck(key) != check {
+			return fmt.Errorf("%w: %s 与数据库不匹配", errDBKeyMismatch, dbKeyFile)
+		}
+		node.LocalDBKey = key
+		return nil
+	default:
+		return fmt.Errorf("未知的数据库密钥模式: %s", mode)
+	}
+}
+
+// 使用口令解锁数据库：优先读取环境变量，否则交互输入（最多3次）
+func (node *P2PNode) unlockDBWithPassphrase(check string) error {
+	saltHex, err := getSetting(node.DB, settingDBKeySalt)
+	if err != nil {
+		return err
+	}
+	nStr, err := getSetting(node.DB, settingDBKeyN)
+	if err != nil {
+		return err
+	}
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil {
+		return fmt.Errorf("数据库口令盐值无效: %v", err)
+	}
+	n, err := strconv.Atoi(nStr)
+	if err != nil {
+		return fmt.Errorf("数据库口令参数无效: %v", err)
+	}
+
+	tryPassphrase := func(passphrase string) bool {
+		key, err := deriveDBKey(passphrase, salt, n)
+		if err != nil || dbKeyCheck(key) != check {
+			return false
+		}
+		node.LocalDBKey = key
+		return true
+	}
+
+	if passphrase := os.Getenv(dbPassphraseEnv); passphrase != "" {
+		if tryPassphrase(passphrase) {
+			return nil
+		}
+		return fmt.Errorf("%w: 环境变量 %s 中的口令错误", errDBKeyMismatch, dbPassphraseEnv)
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		passphrase, err := readPassphrase("请输入历史记录口令: ")
+		if err != nil {
+			return fmt.Errorf("%w: %v，可通过环境变量 %s 提供口令", errDBKeyMismatch, err, dbPassphraseEnv)
+		}
+		if tryPassphrase(passphrase) {
+			return nil
+		}
+		fmt.Println("口令错误")
+	}
+	return errDBKeyMismatch
+}
+
+// 从终端读取口令，输入时不回显
+func readPassphrase(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("标准输入不是终端，无法输入口令")
+	}
+	fmt.Print(prompt)
+	data, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// 交互输入新口令并确认
+func readNewPassphrase() (string, error) {
+	passphrase, err := readPassphrase("请输入新口令: ")
+	if err != nil {
+		return "", err
+	}
+	if len([]rune(passphrase)) < minDBPassphraseLen {
+		return "", fmt.Errorf("口令至少需要 %d 个字符", minDBPassphraseLen)
+	}
+	confirm, err := readPassphrase("请再次输入新口令: ")
+	if err != nil {
+		return "", err
+	}
+	if confirm != passphrase {
+		return "", fmt.Errorf("两次输入的口令不一致")
+	}
+	return passphrase, nil
+}
+
+// 用新密钥重新加密全部消息和传输历史，并在同一事务中重建搜索索引、更新密钥设置
+// keyfile 模式下新密钥先写入临时文件，事务提交后再替换正式文件
+func (node *P2PNode) reencryptDB(oldKey, newKey [32]byte, mode string, salt []byte, n int) (int, error) {
+	tx, err := node.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, content, nonce, COALESCE(file_name, '') FROM messages")
+	if err != nil {
+		return 0, err
+	}
+	type encryptedRow struct {
+		id        int64
+		content   []byte
+		nonce     []byte
+		plaintext string
+		fileName  string
+	}
+	var pending []encryptedRow
+	skipped := 0
+	for rows.Next() {
+		var id int64
+		var content, nonce []byte
+		var fileName string
+		if err := rows.Scan(&id, &content, &nonce, &fileName); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		plaintext, err := decryptMessage(oldKey, content, nonce)
+		if err != nil {
+			skipped++
+			continue
+		}
+		ciphertext, newNonce, err := encryptMessage(newKey, plaintext)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, encryptedRow{id, ciphertext, newNonce, string(plaintext), fileName})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// 索引令牌由数据库密钥派生，需随密钥一同更换
+	if _, err := tx.Exec("DELETE FROM message_tokens"); err != nil {
+		return 0, err
+	}
+	indexKey := searchIndexKey(newKey)
+	for _, row := range pending {
+		if _, err := tx.Exec("UPDATE messages SET content = ?, nonce = ? WHERE id = ?", row.content, row.nonce, row.id); err != nil {
+			return 0, err
+		}
+		if err := indexMessage(tx, indexKey, row.id, row.plaintext, row.fileName); err != nil {
+			return 0, err
+		}
+	}
+	if skipped > 0 {
+		fmt.Printf("警告: %d 条消息无法用原密钥解密，保持不变\n", skipped)
+	}
+	skippedTransfers, err := reencryptTransferHistory(tx, oldKey, newKey)
+	if err != nil {
+		return 0, err
+	}
+	if skippedTransfers > 0 {
+		fmt.Printf("警告: %d 条传输历史无法用原密钥解密，保持不变\n", skippedTransfers)
+	}
+
+	settings := map[string]string{
+		settingDBKeyMode:   mode,
+		settingDBKeyCheck:  dbKeyCheck(newKey),
+		settingDBKeySalt:   hex.EncodeToString(salt),
+		settingDBKeyN:      strconv.Itoa(n),
+		settingSearchIndex: searchIndexVersion,
+	}
+	for key, value := range settings {
+		if err := setSettingTx(tx, key, value); err != nil {
+			return 0, err
+		}
+	}
+
+	if mode == dbKeyModeKeyfile {
+		if err := writeDBKeyFile(dbKeyFile+".tmp", newKey); err != nil {
+			return 0, fmt.Errorf("写入数据库密钥文件失败: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		os.Remove(dbKeyFile + ".tmp")
+		return 0, err
+	}
+
+	if mode == dbKeyModeKeyfile {
+		if err := os.Rename(dbKeyFile+".tmp", dbKeyFile); err != nil {
+			return len(pending), fmt.Errorf("替换数据库密钥文件失败: %v", err)
+		}
+	} else {
+		// 口令模式下不再需要密钥文件
+		if err := os.Remove(dbKeyFile); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("删除旧密钥文件失败: %v\n", err)
+		}
+	}
+	return len(pending), nil
+}
+
+// 更换数据库密钥：passphrase 为空时改用随机密钥文件
+func (node *P2PNode) changeDBKey(passphrase string) error {
+	if node.DB == nil {
+		return fmt.Errorf("数据库未启用")
+	}
+
+	var newKey [32]byte
+	var salt []byte
+	var n int
+	var err error
+	mode := dbKeyModeKeyfile
+	if passphrase != "" {
+		if len([]rune(passphrase)) < minDBPassphraseLen {
+			return fmt.Errorf("口令至少需要 %d 个字符", minDBPassphraseLen)
+		}
+		mode = dbKeyModePassphrase
+		salt = make([]byte, scryptSaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		n = scryptN
+		newKey, err = deriveDBKey(passphrase, salt, n)
+	} else {
+		newKey, err = newRandomDBKey()
+	}
+	if err != nil {
+		return err
+	}
+
+	// 重新加密期间阻止其他读写使用旧密钥
+	node.DBKeyMutex.Lock()
+	defer node.DBKeyMutex.Unlock()
+
+	count, err := node.reencryptDB(node.LocalDBKey, newKey, mode, salt, n)
+	if err != nil {
+		return err
+	}
+	node.LocalDBKey = newKey
+	fmt.Printf("已使用新密钥重新加密 %d 条历史消息\n", count)
+	return nil
+}
+
+// 使用数据库密钥解密
+func (node *P2PNode) decryptFromDB(ciphertext, nonce []byte) ([]byte, error) {
+	node.DBKeyMutex.RLock()
+	defer node.DBKeyMutex.RUnlock()
+	return decryptMessage(node.LocalDBKey, ciphertext, nonce)
+}
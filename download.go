@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 下载位置
+//
+// 接收的文件默认保存到下载目录，聊天中收到的图片保存到图片目录。两个目录都可以配置，
+// 支持用 ~ 表示用户主目录，相对路径在启动时按当前目录转换为绝对路径，之后不再受工作
+// 目录影响。下载目录下可以按对方用户名（peer）或文件类型（type）分子目录；目录或多
+// 文件任务没有单一类型，按类型分目录时保存在下载目录下。接受时也可以为单个传输指定
+// 保存位置，相对路径以下载目录为基准。配置保存在 download_config.json。
+const (
+	downloadConfigFile = "download_config.json"
+	defaultDownloadDir = "downloads"
+	defaultImageDir    = "images"
+)
+
+// 下载目录下的子目录划分方式
+const (
+	SubfolderNone = ""
+	SubfolderPeer = "peer"
+	SubfolderType = "type"
+)
+
+// DownloadConfig结构体 - 接收文件的保存位置
+type DownloadConfig struct {
+	Dir       string `json:"dir"`                 // 下载目录，可用 ~ 表示用户主目录
+	ImageDir  string `json:"imageDir"`            // 聊天图片目录
+	Subfolder string `json:"subfolder,omitempty"` // 按对方用户名(peer)或文件类型(type)分子目录
+}
+
+// 按扩展名划分的文件类型子目录
+var fileTypeFolders = map[string]string{
+	".jpg": "images", ".jpeg": "images", ".png": "images", ".gif": "images", ".webp": "images", ".bmp": "images", ".svg": "images", ".heic": "images",
+	".mp4": "videos", ".mov": "videos", ".mkv": "videos", ".avi": "videos", ".webm": "videos",
+	".mp3": "audio", ".wav": "audio", ".flac": "audio", ".aac": "audio", ".ogg": "audio", ".m4a": "audio",
+	".pdf": "documents", ".doc": "documents", ".docx": "documents", ".xls": "documents", ".xlsx": "documents",
+	".ppt": "documents", ".pptx": "documents", ".txt": "documents", ".md": "documents", ".csv": "documents",
+	".zip": "archives", ".rar": "archives", ".7z": "archives", ".tar": "archives", ".gz": "archives", ".tgz": "archives", ".xz": "archives", ".bz2": "archives",
+	".exe": "programs", ".msi": "programs", ".dmg": "programs", ".pkg": "programs", ".deb": "programs", ".rpm": "programs", ".apk": "programs", ".iso": "programs",
+}
+
+// 文件所属的类型子目录
+func fileTypeFolder(name string) string {
+	if folder, exists := fileTypeFolders[strings.ToLower(filepath.Ext(name))]; exists {
+		return folder
+	}
+	return "other"
+}
+
+// 展开开头的 ~ 为用户主目录
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") && !strings.HasPrefix(path, `~\`) {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("无法确定用户主目录: %v", err)
+	}
+	return filepath.Join(home, path[1:]), nil
+}
+
+// 把配置中的目录转换为绝对路径
+func resolveDir(path string) (string, error) {
+	path, err := expandHome(strings.TrimSpace(path))
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		return "", fmt.Errorf("目录不能为空")
+	}
+	return filepath.Abs(path)
+}
+
+// 下载目录
+func (node *P2PNode) downloadDir() string {
+	node.DownloadsMutex.RLock()
+	defer node.DownloadsMutex.RUnlock()
+	return node.Downloads.Dir
+}
+
+// 聊天图片目录
+func (node *P2PNode) imageDir() string {
+	node.DownloadsMutex.RLock()
+	defer node.DownloadsMutex.RUnlock()
+	return node.Downloads.ImageDir
+}
+
+// 未指定保存位置时的保存目录：下载目录，按配置加上用户名或类型子目录
+func (node *P2PNode) defaultSaveDir(peerName string, fileName string, isJob bool) string {
+	node.DownloadsMutex.RLock()
+	config := node.Downloads
+	node.DownloadsMutex.RUnlock()
+
+	switch config.Subfolder {
+	case SubfolderPeer:
+		// 用户名由对方提供，按文件名的规则清理
+		if folder, err := sanitizeFileName(peerName); err == nil {
+			return filepath.Join(config.Dir, folder)
+		}
+		return filepath.Join(config.Dir, "unknown")
+	case SubfolderType:
+		if !isJob {
+			return filepath.Join(config.Dir, fileTypeFolder(fileName))
+		}
+	}
+	return config.Dir
+}
+
+// 解析接受时指定的保存位置，相对路径以下载目录为基准
+func (node *P2PNode) resolveSavePath(path string) (string, error) {
+	path, err := expandHome(strings.TrimSpace(path))
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		return "", fmt.Errorf("保存位置不能为空")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(node.downloadDir(), path)
+	}
+	return filepath.Clean(path), nil
+}
+
+// 为待接受的传输指定保存位置。已存在的目录或以路径分隔符结尾的路径作为保存目录，
+// 否则作为保存的文件路径；任务总是保存到该目录下
+func (node *P2PNode) setSaveLocation(fileID string, path string) error {
+	trailingSlash := strings.HasSuffix(path, "/") || strings.HasSuffix(path, string(filepath.Separator))
+	target, err := node.resolveSavePath(path)
+	if err != nil {
+		return err
+	}
+
+	node.FileTransfersMutex.Lock()
+	defer node.FileTransfersMutex.Unlock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists || transfer.Direction != "receive" || transfer.JobID != "" {
+		return fmt.Errorf("无效的文件传输ID")
+	}
+	if transfer.Status != "pending" {
+		return fmt.Errorf("该传输已处理（状态: %s）", transfer.Status)
+	}
+
+	if info, err := os.Stat(target); trailingSlash || transfer.IsJob || (err == nil && info.IsDir()) {
+		transfer.SaveDir = target
+		transfer.SaveName = ""
+		return nil
+	}
+	name, err := sanitizeFileName(filepath.Base(target))
+	if err != nil {
+		return err
+	}
+	transfer.SaveDir = filepath.Dir(target)
+	transfer.SaveName = name
+	return nil
+}
+
+// 清除指定的保存位置，接受失败时使用，之后再次接受时不会沿用失败的位置
+func (node *P2PNode) clearSaveLocation(fileID string) {
+	node.FileTransfersMutex.Lock()
+	defer node.FileTransfersMutex.Unlock()
+	if transfer, exists := node.FileTransfers[fileID]; exists && transfer.Status == "pending" {
+		transfer.SaveDir = ""
+		transfer.SaveName = ""
+	}
+}
+
+// 修改下载配置并保存；dir 和 imageDir 为空时保持不变
+func (node *P2PNode) updateDownloadConfig(dir, imageDir, subfolder string) error {
+	node.DownloadsMutex.RLock()
+	config := node.Downloads
+	node.DownloadsMutex.RUnlock()
+
+	var err error
+	if dir != "" {
+		if config.Dir, err = resolveDir(dir); err != nil {
+			return err
+		}
+	}
+	if imageDir != "" {
+		if config.ImageDir, err = resolveDir(imageDir); err != nil {
+			return err
+		}
+	}
+	switch subfolder {
+	case "":
+	case "none":
+		config.Subfolder = SubfolderNone
+	case SubfolderPeer, SubfolderType:
+		config.Subfolder = subfolder
+	default:
+		return fmt.Errorf("无效的子目录方式: %s（可选 none、peer、type）", subfolder)
+	}
+
+	node.DownloadsMutex.Lock()
+	node.Downloads = config
+	node.DownloadsMutex.Unlock()
+	return node.saveDownloadConfig()
+}
+
+// 显示下载配置
+func (node *P2PNode) showDownloadConfig() {
+	node.DownloadsMutex.RLock()
+	config := node.Downloads
+	node.DownloadsMutex.RUnlock()
+
+	subfolder := "不分子目录"
+	switch config.Subfolder {
+	case SubfolderPeer:
+		subfolder = "按对方用户名"
+	case SubfolderType:
+		subfolder = "按文件类型"
+	}
+	fmt.Printf("下载目录: %s (%s)\n", config.Dir, subfolder)
+	fmt.Printf("图片目录: %s\n", config.ImageDir)
+}
+
+// 处理 /downloads 命令
+func (node *P2PNode) handleDownloadsCommand(args string) {
+	const usage = "用法: /downloads [dir <目录>] [images <目录>] [subfolder none|peer|type]"
+	fields := parseSendPaths(args)
+	if len(fields) == 0 {
+		node.showDownloadConfig()
+		return
+	}
+	if len(fields)%2 != 0 {
+		fmt.Println(usage)
+		return
+	}
+
+	var dir, imageDir, subfolder string
+	for i := 0; i < len(fields); i += 2 {
+		switch fields[i] {
+		case "dir":
+			dir = fields[i+1]
+		case "images":
+			imageDir = fields[i+1]
+		case "subfolder":
+			subfolder = fields[i+1]
+		default:
+			fmt.Println(usage)
+			return
+		}
+	}
+	if err := node.updateDownloadConfig(dir, imageDir, subfolder); err != nil {
+		fmt.Printf("修改下载目录失败: %v\n", err)
+		return
+	}
+	node.showDownloadConfig()
+}
+
+// 加载下载配置，未配置时使用当前目录下的 downloads 和 images
+func (node *P2PNode) loadDownloadConfig() {
+	config := DownloadConfig{Dir: defaultDownloadDir, ImageDir: defaultImageDir}
+	data, err := os.ReadFile(downloadConfigFile)
+	if err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			fmt.Printf("解析下载配置失败: %v\n", err)
+		}
+	} else if !os.IsNotExist(err) {
+		fmt.Printf("读取下载配置失败: %v\n", err)
+	}
+
+	if config.Dir, err = resolveDir(config.Dir); err != nil {
+		fmt.Printf("下载目录无效: %v，使用 %s\n", err, defaultDownloadDir)
+		config.Dir, _ = filepath.Abs(defaultDownloadDir)
+	}
+	if config.ImageDir, err = resolveDir(config.ImageDir); err != nil {
+		fmt.Printf("图片目录无效: %v，使用 %s\n", err, defaultImageDir)
+		config.ImageDir, _ = filepath.Abs(defaultImageDir)
+	}
+	if config.Subfolder != SubfolderPeer && config.Subfolder != SubfolderType {
+		config.Subfolder = SubfolderNone
+	}
+
+	node.DownloadsMutex.Lock()
+	node.Downloads = config
+	node.DownloadsMutex.Unlock()
+}
+
+// 保存下载配置
+func (node *P2PNode) saveDownloadConfig() error {
+	node.DownloadsMutex.RLock()
+	data, err := json.MarshalIndent(node.Downloads, "", "  ")
+	node.DownloadsMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(downloadConfigFile, data, 0600)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// 推送给Web界面的事件类型
+const (
+	EventChat            = "chat"             // 新消息
+	EventPeerJoined      = "peer_joined"      // 节点上线
+	EventPeerLeft        = "peer_left"        // 节点离线
+	EventPeerRenamed     = "peer_renamed"     // 用户改名
+	EventTransfer        = "transfer"         // 文件传输状态或进度变化
+	EventTransferRemoved = "transfer_removed" // 文件传输记录被移除
+	EventFileRequest     = "file_request"     // 收到文件传输请求
+	EventACL             = "acl"              // 屏蔽列表变化
+)
+
+// 传输进度事件的最小间隔，避免大文件传输时刷屏
+const transferEventInterval = 200 * time.Millisecond
+
+// 每个订阅者的缓冲区大小；消费过慢的订阅者会被断开，由客户端重连后重新同步
+const eventSubscriberBuffer = 256
+
+// Event结构体 - 事件总线上的一条事件
+type Event struct {
+	Type string
+	Data interface{}
+}
+
+// EventBus结构体 - 进程内事件总线，发布不阻塞
+type EventBus struct {
+	mutex       sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func newEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[chan Event]struct{})}
+}
+
+// 订阅事件
+func (bus *EventBus) Subscribe() chan Event {
+	ch := make(chan Event, eventSubscriberBuffer)
+	bus.mutex.Lock()
+	bus.subscribers[ch] = struct{}{}
+	bus.mutex.Unlock()
+	return ch
+}
+
+// 取消订阅
+func (bus *EventBus) Unsubscribe(ch chan Event) {
+	bus.mutex.Lock()
+	if _, exists := bus.subscribers[ch]; exists {
+		delete(bus.subscribers, ch)
+		close(ch)
+	}
+	bus.mutex.Unlock()
+}
+
+// 发布事件
+func (bus *EventBus) Publish(eventType string, data interface{}) {
+	event := Event{Type: eventType, Data: data}
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	for ch := range bus.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// 缓冲区已满：断开该订阅者，客户端重连时会重新拉取完整状态
+			delete(bus.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// 断开所有订阅者（关闭Web服务器时使用）
+func (bus *EventBus) DisconnectAll() {
+	bus.mutex.Lock()
+	for ch := range bus.subscribers {
+		delete(bus.subscribers, ch)
+		close(ch)
+	}
+	bus.mutex.Unlock()
+}
+
+// 发布节点上下线事件
+func (node *P2PNode) publishPeerEvent(eventType string, peer *Peer) {
+	node.Events.Publish(eventType, map[string]string{
+		"id":   peer.ID,
+		"name": peer.Name,
+	})
+}
+
+// 发布文件传输状态；force 为 false 时按最小间隔节流
+func (node *P2PNode) publishTransfer(fileID string, force bool) {
+	node.recordTransferChange(fileID)
+	node.FileTransfersMutex.Lock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists {
+		node.FileTransfersMutex.Unlock()
+		return
+	}
+	// 任务中的文件不单独推送，只更新任务的汇总进度
+	if jobID := transfer.JobID; jobID != "" {
+		node.FileTransfersMutex.Unlock()
+		node.refreshJob(jobID, force)
+		return
+	}
+	now := time.Now()
+	if !force && now.Sub(transfer.LastEventTime) < transferEventInterval {
+		node.FileTransfersMutex.Unlock()
+		return
+	}
+	transfer.LastEventTime = now
+	snapshot := *transfer
+	node.FileTransfersMutex.Unlock()
+
+	node.Events.Publish(EventTransfer, snapshot)
+	// 群发中的每个接收方单独显示，同时更新群发的汇总进度
+	if snapshot.BroadcastID != "" {
+		node.refreshBroadcast(snapshot.BroadcastID, force)
+	}
+}
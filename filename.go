@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 文件名清理
+//
+// 对方提供的文件名只能作为下载目录中的单个文件名使用：包含路径分隔符、绝对路径或
+// . / .. 的名称直接拒绝；控制字符、Windows 保留字符和双向文本控制字符替换为下划线；
+// 与已有文件重名时改用 "名称 (1).扩展名"，不会覆盖或追加到已有文件。
+const (
+	maxFileNameBytes     = 255
+	maxCollisionAttempts = 10000
+	maxFileIDLength      = 64
+)
+
+// Windows 的保留设备名，不区分大小写，带扩展名时同样保留
+var reservedFileNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// 清理对方提供的文件名
+func sanitizeFileName(name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("文件名为空")
+	}
+	if strings.ContainsAny(name, `/\`) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("文件名不能包含路径: %q", name)
+	}
+	if name == "." || name == ".." {
+		return "", fmt.Errorf("无效的文件名: %q", name)
+	}
+
+	var builder strings.Builder
+	for _, r := range strings.ToValidUTF8(name, "_") {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			builder.WriteRune('_')
+		case strings.ContainsRune(`<>:"|?*`, r):
+			builder.WriteRune('_')
+		case unicode.Is(unicode.Bidi_Control, r):
+			// 双向文本控制字符可以伪装扩展名（如 "txt.exe" 显示为 "exe.txt"）
+			builder.WriteRune('_')
+		default:
+			builder.WriteRune(r)
+		}
+	}
+
+	// Windows 会去掉末尾的点和空格
+	cleaned := strings.TrimSpace(strings.TrimRight(builder.String(), ". "))
+	if cleaned == "" || strings.Trim(cleaned, ".") == "" {
+		return "", fmt.Errorf("无效的文件名: %q", name)
+	}
+	if stem := strings.SplitN(cleaned, ".", 2)[0]; reservedFileNames[strings.ToUpper(stem)] {
+		cleaned = "_" + cleaned
+	}
+	return truncateFileName(cleaned, maxFileNameBytes), nil
+}
+
+// 按字节截断过长的文件名，尽量保留扩展名
+func truncateFileName(name string, limit int) string {
+	if len(name) <= limit {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > limit/4 {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+	stem = stem[:limit-len(ext)]
+	for !utf8.ValidString(stem) {
+		stem = stem[:len(stem)-1]
+	}
+	return stem + ext
+}
+
+// 文件ID会用作续传状态的文件名，只允许字母、数字、下划线和连字符
+func validFileID(id string) bool {
+	if id == "" || len(id) > maxFileIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// 重名时的候选名称: "名称 (n).扩展名"
+func collisionName(name string, n int) string {
+	if n == 0 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if ext == name {
+		ext = "" // 以点开头的文件名（如 .bashrc）整体作为名称
+	}
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// 在目录中独占创建 名称+suffix；目标文件或其临时文件已存在时依次尝试其他名称。
+// 返回打开的文件和不含 suffix 的目标路径
+func createUniqueFile(dir, name, suffix string) (*os.File, string, error) {
+	for n := 0; n < maxCollisionAttempts; n++ {
+		path := filepath.Join(dir, collisionName(name, n))
+		if _, err := os.Lstat(path); err == nil {
+			continue
+		}
+		file, err := os.OpenFile(path+suffix, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		return file, path, nil
+	}
+	return nil, "", fmt.Errorf("同名文件过多: %s", name)
+}
+
+// 目录中未被占用的名称（包括接收中的临时文件和 reserved 中已分配的名称，不区分大小写）
+func uniqueName(dir, name string, reserved map[string]bool) (string, error) {
+	for n := 0; n < maxCollisionAttempts; n++ {
+		candidate := collisionName(name, n)
+		if reserved[strings.ToLower(candidate)] {
+			continue
+		}
+		path := filepath.Join(dir, candidate)
+		if _, err := os.Lstat(path); err == nil {
+			continue
+		}
+		if _, err := os.Lstat(partFilePath(path)); err == nil {
+			continue
+		}
+		return candidate, nil
+	}
+	return "", fmt.Errorf("同名文件过多: %s", name)
+}
+
+// 先写临时文件并落盘再重命名，写入中断或断电时不会留下不完整的文件
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// 把接收完成的临时文件重命名为目标文件；接收期间出现同名文件时改用新名称，不覆盖。
+// 用硬链接代替重命名：目标已存在时链接失败而不是替换，检查和重命名之间不会被抢占
+func renameNoClobber(partPath, target string) (string, error) {
+	dir, name := filepath.Split(target)
+	candidate := target
+	for n := 0; n < maxCollisionAttempts; n++ {
+		err := os.Link(partPath, candidate)
+		if err == nil {
+			os.Remove(partPath)
+			return candidate, nil
+		}
+		if !os.IsExist(err) {
+			// 不支持硬链接的文件系统（如 FAT）只能先检查再重命名
+			if _, statErr := os.Lstat(candidate); !os.IsNotExist(statErr) {
+				return "", err
+			}
+			return candidate, os.Rename(partPath, candidate)
+		}
+		next, err := uniqueName(dir, name, nil)
+		if err != nil {
+			return "", err
+		}
+		candidate = filepath.Join(dir, next)
+	}
+	return "", fmt.Errorf("同名文件过多: %s", name)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"普通文件名", "report.pdf", "report.pdf", false},
+		{"中文文件名", "报告.txt", "报告.txt", false},
+		{"空文件名", "", "", true},
+		{"上级目录", "../x", "", true},
+		{"只有点", ".", "", true},
+		{"两个点", "..", "", true},
+		{"全是点", "...", "", true},
+		{"绝对路径", "/etc/passwd", "", true},
+		{"子目录", "dir/file.txt", "", true},
+		{"反斜杠", `..\x`, "", true},
+		{"Windows 路径", `C:\Windows\win.ini`, "", true},
+		{"盘符相对路径", "C:foo", "C_foo", false},
+		{"NUL 字符", "a\x00b.txt", "a_b.txt", false},
+		{"换行和制表符", "a\nb\tc", "a_b_c", false},
+		{"DEL 字符", "a\x7fb", "a_b", false},
+		{"Windows 保留字符", `a<b>c"d|e?f*g`, "a_b_c_d_e_f_g", false},
+		{"双向文本覆盖", "invoice\u202Etxt.exe", "invoice_txt.exe", false},
+		{"双向文本隔离", "\u2066a\u2069.txt", "_a_.txt", false},
+		{"保留设备名", "CON.txt", "_CON.txt", false},
+		{"保留设备名小写", "nul", "_nul", false},
+		{"保留设备名多扩展名", "com1.tar.gz", "_com1.tar.gz", false},
+		{"保留名作为前缀", "CONSOLE.txt", "CONSOLE.txt", false},
+		{"末尾的点", "file.txt.", "file.txt", false},
+		{"末尾的空格", "file.txt  ", "file.txt", false},
+		{"末尾的点和空格", "file. . .", "file", false},
+		{"只有空格", "   ", "", true},
+		{"无效 UTF-8", "a\xffb", "a_b", false},
+		{"以点开头", ".bashrc", ".bashrc", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sanitizeFileName(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("sanitizeFileName(%q) = %q, 期望返回错误", tt.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sanitizeFileName(%q) 返回错误: %v", tt.input, err)
+			}
+			if got != tt.want {
+				t.Errorf("sanitizeFileName(%q) = %q, 期望 %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFileNameTruncatesLongNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantExt string
+	}{
+		{"ASCII", strings.Repeat("a", 300) + ".txt", ".txt"},
+		{"多字节字符", strings.Repeat("文", 100) + ".txt", ".txt"},
+		{"四字节字符", strings.Repeat("😀", 80) + ".png", ".png"},
+		{"过长的扩展名", "a." + strings.Repeat("b", 300), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sanitizeFileName(tt.input)
+			if err != nil {
+				t.Fatalf("sanitizeFileName 返回错误: %v", err)
+			}
+			if len(got) > maxFileNameBytes {
+				t.Errorf("文件名长度 %d 超过 %d 字节", len(got), maxFileNameBytes)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("截断后不是有效的 UTF-8: %q", got)
+			}
+			if tt.wantExt != "" && !strings.HasSuffix(got, tt.wantExt) {
+				t.Errorf("截断后丢失扩展名 %s: %q", tt.wantExt, got)
+			}
+		})
+	}
+}
+
+func TestCollisionName(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		want string
+	}{
+		{"a.txt", 0, "a.txt"},
+		{"a.txt", 1, "a (1).txt"},
+		{"a.tar.gz", 2, "a.tar (2).gz"},
+		{"README", 3, "README (3)"},
+		{".bashrc", 1, ".bashrc (1)"},
+	}
+
+	for _, tt := range tests {
+		if got := collisionName(tt.name, tt.n); got != tt.want {
+			t.Errorf("collisionName(%q, %d) = %q, 期望 %q", tt.name, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestCreateUniqueFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("existing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 接收中的临时文件同样占用名称
+	if err := os.WriteFile(filepath.Join(dir, "a (1).txt.part"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file, path, err := createUniqueFile(dir, "a.txt", partFileSuffix)
+	if err != nil {
+		t.Fatalf("createUniqueFile 返回错误: %v", err)
+	}
+	file.Close()
+
+	if want := filepath.Join(dir, "a (2).txt"); path != want {
+		t.Errorf("目标路径 = %q, 期望 %q", path, want)
+	}
+	if _, err := os.Stat(partFilePath(path)); err != nil {
+		t.Errorf("临时文件未创建: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(data) != "existing" {
+		t.Errorf("已有文件被修改: %q", data)
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "a (1).txt.part"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 符号链接（即使指向不存在的目标）也占用名称
+	if err := os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "a (2).txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := uniqueName(dir, "a.txt", map[string]bool{"a (3).txt": true})
+	if err != nil {
+		t.Fatalf("uniqueName 返回错误: %v", err)
+	}
+	if got != "a (4).txt" {
+		t.Errorf("uniqueName = %q, 期望 %q", got, "a (4).txt")
+	}
+
+	got, err = uniqueName(dir, "b.txt", nil)
+	if err != nil || got != "b.txt" {
+		t.Errorf("uniqueName(b.txt) = %q, %v, 期望原名", got, err)
+	}
+}
+
+func TestCleanJobPath(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"docs/a.txt", filepath.Join("docs", "a.txt"), false},
+		{"a/b/c.txt", filepath.Join("a", "b", "c.txt"), false},
+		{"docs/CON.txt", filepath.Join("docs", "_CON.txt"), false},
+		{"", "", true},
+		{"../a.txt", "", true},
+		{"docs/../../a.txt", "", true},
+		{"./a.txt", "", true},
+		{"/etc/passwd", "", true},
+		{`docs\a.txt`, "", true},
+		{"docs//a.txt", "", true},
+		{"docs/a\x00.txt", "", true},
+		{"C:/a.txt", filepath.Join("C_", "a.txt"), false},
+	}
+
+	for _, tt := range tests {
+		got, err := cleanJobPath(tt.input)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("cleanJobPath(%q) = %q, 期望返回错误", tt.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("cleanJobPath(%q) 返回错误: %v", tt.input, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("cleanJobPath(%q) = %q, 期望 %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestEnsureWithinDirSymlink(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+
+	inside := filepath.Join(root, "docs")
+	if err := os.Mkdir(inside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureWithinDir(root, inside); err != nil {
+		t.Errorf("目录内的路径被拒绝: %v", err)
+	}
+
+	// 下载目录中的符号链接指向外部目录
+	escape := filepath.Join(root, "escape")
+	if err := os.Symlink(outside, escape); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureWithinDir(root, escape); err == nil {
+		t.Error("通过符号链接逃逸下载目录未被拒绝")
+	}
+	nested := filepath.Join(escape, "sub")
+	if err := os.Mkdir(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureWithinDir(root, nested); err == nil {
+		t.Error("符号链接下的子目录未被拒绝")
+	}
+
+	// 指向目录内部的符号链接是允许的
+	internal := filepath.Join(root, "link")
+	if err := os.Symlink(inside, internal); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureWithinDir(root, internal); err != nil {
+		t.Errorf("指向目录内部的符号链接被拒绝: %v", err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte("new"), 0600); err != nil {
+		t.Fatalf("writeFileAtomic 返回错误: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new" {
+		t.Errorf("文件内容 = %q, 期望 %q", data, "new")
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("临时文件未清理: %v", err)
+	}
+}
+
+func TestRenameNoClobber(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "a.txt")
+	write := func(path, content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(partFilePath(target), "first")
+	saved, err := renameNoClobber(partFilePath(target), target)
+	if err != nil || saved != target {
+		t.Fatalf("renameNoClobber = %q, %v, 期望 %q", saved, err, target)
+	}
+
+	// 接收期间出现的同名文件不被覆盖
+	write(partFilePath(target), "second")
+	saved, err = renameNoClobber(partFilePath(target), target)
+	if err != nil {
+		t.Fatalf("renameNoClobber 返回错误: %v", err)
+	}
+	if want := filepath.Join(dir, "a (1).txt"); saved != want {
+		t.Errorf("保存路径 = %q, 期望 %q", saved, want)
+	}
+	if data, _ := os.ReadFile(target); string(data) != "first" {
+		t.Errorf("已有文件被覆盖: %q", data)
+	}
+	if data, _ := os.ReadFile(saved); string(data) != "second" {
+		t.Errorf("新文件内容 = %q, 期望 %q", data, "second")
+	}
+	if _, err := os.Lstat(partFilePath(target)); !os.IsNotExist(err) {
+		t.Errorf("临时文件未删除: %v", err)
+	}
+
+	// 指向外部的符号链接同样视为已占用，不会写入链接目标
+	outside := filepath.Join(t.TempDir(), "outside.txt")
+	write(outside, "outside")
+	link := filepath.Join(dir, "b.txt")
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatal(err)
+	}
+	write(partFilePath(link), "third")
+	saved, err = renameNoClobber(partFilePath(link), link)
+	if err != nil || saved != filepath.Join(dir, "b (1).txt") {
+		t.Errorf("renameNoClobber = %q, %v, 期望 b (1).txt", saved, err)
+	}
+	if data, _ := os.ReadFile(outside); string(data) != "outside" {
+		t.Errorf("符号链接目标被修改: %q", data)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -10,6 +12,12 @@ import (
 	"time"
 )
 
+// 文件块大小（续传时按块号计算偏移，双方必须一致）
+const fileChunkSize = 64 * 1024 // 64KB
+
+// 传输速度的采样间隔
+const speedSampleInterval = 200 * time.Millisecond
+
 // 生成文件ID
 func generateFileID() string {
 	bytes := make([]byte, 8)
@@ -28,18 +36,19 @@ func (node *P2PNode) sendFileTransferRequest(filePath string, targetName string)
 		return
 	}
 
-	// 检查文件大小
-	if fileInfo.Size() > 100*1024*1024 { // 100MB限制
-		fmt.Printf("文件大小超过限制 (最大100MB): %s\n", formatFileSize(fileInfo.Size()))
+	if fileInfo.IsDir() {
+		fmt.Printf("不能直接发送目录: %s\n", filePath)
 		return
 	}
 
 	// 查找目标用户
 	var targetID string
+	deferredHash := false
 	node.PeersMutex.RLock()
 	for id, peer := range node.Peers {
 		if peer.Name == targetName {
 			targetID = id
+			deferredHash = peer.hasCapability(CapabilityDeferredHash)
 			break
 		}
 	}
@@ -50,6 +59,55 @@ func (node *P2PNode) sendFileTransferRequest(filePath string, targetName string)
 		return
 	}
 
+	// 计算大文件的校验值需要较长时间，不阻塞命令行和Web请求：对方支持时先发送请求，
+	// 校验值在后台计算并随发送完成通知送达；旧版接收方只能从请求中获得校验值，算完后再发送请求
+	if deferredHash {
+		node.offerFile(filePath, fileInfo, "", targetID, targetName, "")
+		return
+	}
+	go func() {
+		fileHash, err := fileSHA256(filePath)
+		if err != nil {
+			fmt.Printf("计算文件校验值失败: %v\n", err)
+			return
+		}
+		node.offerFile(filePath, fileInfo, fileHash, targetID, targetName, "")
+	}()
+}
+
+// 标记发送方的校验值仍在计算（调用方需持有 FileTransfersMutex）
+func (transfer *FileTransferStatus) deferHash() {
+	transfer.HashPending = true
+	transfer.HashDone = make(chan struct{})
+}
+
+// 在后台计算待发送文件的校验值，群发时所有接收方共用一次计算。sendFile 发完后等待其完成，
+// 随 file_sent 通知发给接收方；各传输需已通过 deferHash 标记
+func (node *P2PNode) hashOutgoingFile(filePath string, fileIDs ...string) {
+	go func() {
+		fileHash, err := fileSHA256(filePath)
+		if err != nil {
+			fmt.Printf("计算文件校验值失败: %v，接收方将无法校验 %s\n", err, filepath.Base(filePath))
+		}
+		node.FileTransfersMutex.Lock()
+		defer node.FileTransfersMutex.Unlock()
+		for _, fileID := range fileIDs {
+			transfer, exists := node.FileTransfers[fileID]
+			if !exists {
+				continue
+			}
+			transfer.SHA256 = fileHash
+			if transfer.HashPending && transfer.HashDone != nil {
+				transfer.HashPending = false
+				close(transfer.HashDone)
+			}
+		}
+	}()
+}
+
+// 向一个用户发送文件传输请求（群发时每个接收方调用一次，校验值只计算一次）
+// fileHash 为空时校验值在后台计算，由发送完成通知提供；群发时由调用方统一计算
+func (node *P2PNode) offerFile(filePath string, fileInfo os.FileInfo, fileHash string, targetID string, targetName string, broadcastID string) string {
 	// 生成文件ID
 	fileID := generateFileID()
 
@@ -59,32 +117,55 @@ func (node *P2PNode) sendFileTransferRequest(filePath string, targetName string)
 		FileID:    fileID,
 		FileName:  filepath.Base(filePath),
 		FileSize:  fileInfo.Size(),
+		SHA256:    fileHash,
 		From:      node.ID,
 		To:        targetID,
 		Timestamp: time.Now(),
+
+		HashPending: fileHash == "",
 	}
 
 	// 添加到传输状态
 	node.FileTransfersMutex.Lock()
-	node.FileTransfers[fileID] = &FileTransferStatus{
+	transfer := &FileTransferStatus{
 		FileID:    fileID,
 		FileName:  request.FileName,
 		FilePath:  filePath, // 保存完整路径
 		FileSize:  request.FileSize,
+		SHA256:    request.SHA256,
 		Progress:  0,
 		Status:    "pending",
 		Direction: "send",
 		PeerName:  targetName,
 		PeerID:    targetID, // 存储目标用户的peer ID
 		StartTime: time.Now(),
+
+		TotalChunks:   chunkCount(fileInfo.Size()),
+		SourceModTime: fileInfo.ModTime(),
+	}
+	if parent, exists := node.FileTransfers[broadcastID]; exists {
+		transfer.BroadcastID = broadcastID
+		transfer.Source = parent.Source
+		parent.Children = append(parent.Children, fileID)
+	}
+	if fileHash == "" {
+		transfer.deferHash()
 	}
+	node.FileTransfers[fileID] = transfer
 	node.FileTransfersMutex.Unlock()
+	if fileHash == "" && broadcastID == "" {
+		node.hashOutgoingFile(filePath, fileID)
+	}
+	node.publishTransfer(fileID, true)
 
 	fmt.Printf("向 %s 发送文件传输请求: %s (%s)\n", 
 		targetName, request.FileName, formatFileSize(request.FileSize))
 
 	// 发送请求
-	if peer, exists := node.Peers[targetID]; exists {
+	node.PeersMutex.RLock()
+	peer, exists := node.Peers[targetID]
+	node.PeersMutex.RUnlock()
+	if exists {
 		msg := Message{
 			Type:      "file_request",
 			From:      node.ID,
@@ -94,43 +175,134 @@ func (node *P2PNode) sendFileTransferRequest(filePath string, targetName string)
 		}
 		node.sendMessageToPeer(peer, msg)
 	}
+	return fileID
 }
 
 // 处理文件传输请求
 func (node *P2PNode) handleFileTransferRequest(request FileTransferRequest) {
+	// 文件名和ID都由对方提供，先检查再使用
+	fileName, err := sanitizeFileName(request.FileName)
+	if err == nil && (!validFileID(request.FileID) || request.FileSize < 0) {
+		err = fmt.Errorf("无效的文件ID或大小")
+	}
+	if err != nil {
+		fmt.Printf("\n拒绝来自 %s 的文件传输请求: %v\n", node.getPeerName(request.From), err)
+		node.rejectFileRequest(request.From, request.FileID, "文件名无效或请求无效")
+		return
+	}
+	node.FileTransfersMutex.RLock()
+	_, duplicate := node.FileTransfers[request.FileID]
+	node.FileTransfersMutex.RUnlock()
+	if duplicate {
+		// 重复的请求不覆盖已有的传输记录
+		return
+	}
+	if fileName != request.FileName {
+		fmt.Printf("\n文件名 %q 包含不安全的字符，已改为 %q\n", request.FileName, fileName)
+		request.FileName = fileName
+	}
+
 	fmt.Printf("\n收到来自 %s 的文件传输请求: %s (%s)\n",
 		node.getPeerName(request.From), request.FileName, formatFileSize(request.FileSize))
 
 	// 添加到传输状态
 	node.FileTransfersMutex.Lock()
-	node.FileTransfers[request.FileID] = &FileTransferStatus{
+	status := &FileTransferStatus{
 		FileID:    request.FileID,
 		FileName:  request.FileName,
 		FileSize:  request.FileSize,
+		SHA256:    request.SHA256,
 		Progress:  0,
 		Status:    "pending",
 		Direction: "receive",
 		PeerName:  node.getPeerName(request.From),
 		PeerID:    request.From, // 存储发送方的peer ID
 		StartTime: time.Now(),
+
+		HashPending: request.HashPending && request.SHA256 == "",
 	}
+	node.FileTransfers[request.FileID] = status
+	snapshot := *status
 	node.FileTransfersMutex.Unlock()
 
+	node.recordTransferChange(request.FileID)
+	// 命中自动接受规则时不再询问用户
+	if node.tryAutoAccept(request.FileID) {
+		return
+	}
+	node.Events.Publish(EventFileRequest, snapshot)
+
 	// 通知用户
+	if err := checkDiskSpace(node.defaultSaveDir(status.PeerName, request.FileName, false), request.FileSize); err != nil {
+		fmt.Printf("警告: %v\n", err)
+	}
 	fmt.Printf("要接受，请输入: /accept %s\n", request.FileID)
 	fmt.Printf("要拒绝，请输入: /reject %s\n", request.FileID)
 }
 
+// 拒绝无效的文件传输请求（不创建传输记录）
+func (node *P2PNode) rejectFileRequest(peerID string, fileID string, message string) {
+	node.PeersMutex.RLock()
+	peer, exists := node.Peers[peerID]
+	node.PeersMutex.RUnlock()
+	if !exists {
+		return
+	}
+	msg := Message{
+		Type:      "file_response",
+		From:      node.ID,
+		To:        peerID,
+		Timestamp: time.Now(),
+		Data: FileTransferResponse{
+			Type:      "file_response",
+			FileID:    fileID,
+			Accepted:  false,
+			Message:   message,
+			Timestamp: time.Now(),
+		},
+	}
+	node.sendMessageToPeer(peer, msg)
+}
+
 // 响应文件传输请求
-func (node *P2PNode) respondToFileTransfer(fileID string, accepted bool) {
+func (node *P2PNode) respondToFileTransfer(fileID string, accepted bool) error {
 	node.FileTransfersMutex.Lock()
 	transfer, exists := node.FileTransfers[fileID]
 	if !exists || transfer.Direction != "receive" {
 		node.FileTransfersMutex.Unlock()
-		fmt.Println("无效的文件传输ID")
-		return
+		return fmt.Errorf("无效的文件传输ID")
+	}
+	// 检查与占用在同一临界区内完成，命令行、Web和自动接受同时响应时只有一个生效
+	if transfer.Status != "pending" {
+		status := transfer.Status
+		node.FileTransfersMutex.Unlock()
+		return fmt.Errorf("该传输已处理（状态: %s）", status)
+	}
+	if transfer.Responding {
+		node.FileTransfersMutex.Unlock()
+		return fmt.Errorf("该传输正在处理中")
+	}
+	transfer.Responding = true
+	isJob := transfer.IsJob
+	fromPeerID := transfer.PeerID
+	downloadDir := transfer.SaveDir
+	saveName := transfer.SaveName
+	if saveName == "" {
+		saveName = transfer.FileName
+	}
+	if downloadDir == "" {
+		downloadDir = node.defaultSaveDir(transfer.PeerName, transfer.FileName, false)
 	}
 	node.FileTransfersMutex.Unlock()
+	defer func() {
+		node.FileTransfersMutex.Lock()
+		transfer.Responding = false
+		node.FileTransfersMutex.Unlock()
+	}()
+
+	if isJob {
+		return node.respondToJob(fileID, accepted)
+	}
 
 	// 发送响应
 	responseMsg := FileTransferResponse{
@@ -141,48 +313,89 @@ func (node *P2PNode) respondToFileTransfer(fileID string, accepted bool) {
 		Timestamp: time.Now(),
 	}
 
-	// 找到请求来源的Peer
-	var fromPeerID string
+	// 按节点ID找到请求来源，用户名可能已更改或被他人使用
 	node.PeersMutex.RLock()
-	for id, peer := range node.Peers {
-		if peer.Name == transfer.PeerName {
-			fromPeerID = id
-			break
-		}
-	}
+	peer, online := node.Peers[fromPeerID]
 	node.PeersMutex.RUnlock()
-
-	if fromPeerID == "" {
-		fmt.Println("找不到文件发送方")
-		return
+	if !online {
+		return fmt.Errorf("找不到文件发送方")
 	}
 
 	if accepted {
+		// 数据块按偏移写入预分配的临时文件，全部到齐后再重命名为目标文件
+		if err := os.MkdirAll(downloadDir, 0755); err != nil {
+			return fmt.Errorf("创建下载目录失败: %v", err)
+		}
+		// 预分配的文件可能是稀疏文件，不占用实际空间，因此先检查剩余空间
+		if err := checkDiskSpace(downloadDir, transfer.FileSize); err != nil {
+			return err
+		}
+		// 同名文件已存在时改用 "名称 (1).扩展名"，不覆盖已有文件
+		file, filePath, err := createUniqueFile(downloadDir, saveName, partFileSuffix)
+		if err != nil {
+			return fmt.Errorf("创建文件失败: %v", err)
+		}
+		if name := filepath.Base(filePath); name != saveName {
+			fmt.Printf("%s 目录中已有同名文件，将保存为 %s\n", downloadDir, name)
+		}
+		err = file.Truncate(transfer.FileSize)
+		file.Close()
+		if err != nil {
+			os.Remove(partFilePath(filePath))
+			return fmt.Errorf("预分配文件失败: %v", err)
+		}
+
 		responseMsg.Message = "文件传输已接受"
-		fmt.Printf("已接受文件传输，准备接收文件...\n")
-		node.FileTransfersMutex.Lock()
-		transfer.Status = "transferring"
-		node.FileTransfersMutex.Unlock()
+		if transfer.FileSize == 0 {
+			// 空文件没有数据块，不会收到 file_chunk，接受时直接保存
+			savedPath, err := renameNoClobber(partFilePath(filePath), filePath)
+			if err != nil {
+				os.Remove(partFilePath(filePath))
+				return fmt.Errorf("保存文件失败: %v", err)
+			}
+			applyFileAttributes(savedPath, transfer.Mode, transfer.SourceModTime)
+			node.FileTransfersMutex.Lock()
+			transfer.Status = "completed"
+			transfer.FilePath = savedPath
+			transfer.SavedPath = savedPath
+			transfer.EndTime = time.Now()
+			node.FileTransfersMutex.Unlock()
+			fmt.Printf("文件接收完成: %s，已保存到 %s\n", transfer.FileName, savedPath)
+		} else {
+			fmt.Printf("已接受文件传输，准备接收文件...\n")
+			node.FileTransfersMutex.Lock()
+			transfer.Status = "transferring"
+			transfer.FilePath = filePath
+			transfer.TotalChunks = chunkCount(transfer.FileSize)
+			transfer.ChunkBitmap = make([]byte, (transfer.TotalChunks+7)/8)
+			transfer.Resumable = true
+			node.FileTransfersMutex.Unlock()
+			if err := node.saveTransferState(fileID); err != nil {
+				fmt.Printf("保存续传状态失败: %v\n", err)
+			}
+		}
+		node.publishTransfer(fileID, true)
 	} else {
 		responseMsg.Message = "文件传输被拒绝"
 		fmt.Printf("已拒绝文件传输\n")
 		
 		// 清理状态
+		node.recordRejectedTransfer(fileID)
 		node.FileTransfersMutex.Lock()
 		delete(node.FileTransfers, fileID)
 		node.FileTransfersMutex.Unlock()
+		node.Events.Publish(EventTransferRemoved, map[string]string{"fileId": fileID})
 	}
 
-	if peer, exists := node.Peers[fromPeerID]; exists {
-		msg := Message{
-			Type:      "file_response",
-			From:      node.ID,
-			To:        fromPeerID,
-			Timestamp: time.Now(),
-			Data:      responseMsg,
-		}
-		node.sendMessageToPeer(peer, msg)
+	msg := Message{
+		Type:      "file_response",
+		From:      node.ID,
+		To:        fromPeerID,
+		Timestamp: time.Now(),
+		Data:      responseMsg,
 	}
+	node.sendMessageToPeer(peer, msg)
+	return nil
 }
 
 // 处理文件传输响应
@@ -194,97 +407,203 @@ func (node *P2PNode) handleFileTransferResponse(response FileTransferResponse) {
 	if !exists {
 		return
 	}
+	if transfer.IsJob {
+		node.handleJobResponse(response)
+		return
+	}
+	node.FileTransfersMutex.RLock()
+	status := transfer.Status
+	node.FileTransfersMutex.RUnlock()
+	if status != "pending" {
+		return // 等待确认期间已取消
+	}
 
 	if response.Accepted {
 		fmt.Printf("文件传输请求已被接受，开始发送文件: %s\n", transfer.FileName)
 		// 更新状态
 		node.FileTransfersMutex.Lock()
 		transfer.Status = "transferring"
+		transfer.Resumable = true
 		node.FileTransfersMutex.Unlock()
+		if err := node.saveTransferState(response.FileID); err != nil {
+			fmt.Printf("保存续传状态失败: %v\n", err)
+		}
+		node.publishTransfer(response.FileID, true)
 
 		// 开始发送文件
-		go node.sendFile(transfer.FileID, transfer.FilePath)
+		go node.sendFile(transfer.FileID, transfer.FilePath, nil)
 	} else {
 		fmt.Printf("文件传输请求被拒绝: %s\n", response.Message)
+		if transfer.BroadcastID != "" {
+			// 群发中保留被拒绝的记录，显示各接收方的结果
+			node.FileTransfersMutex.Lock()
+			transfer.Status = "rejected"
+			transfer.EndTime = time.Now()
+			node.FileTransfersMutex.Unlock()
+			node.publishTransfer(response.FileID, true)
+			return
+		}
 		// 清理状态
+		node.recordRejectedTransfer(response.FileID)
 		node.FileTransfersMutex.Lock()
 		delete(node.FileTransfers, response.FileID)
 		node.FileTransfersMutex.Unlock()
+		node.Events.Publish(EventTransferRemoved, map[string]string{"fileId": response.FileID})
 	}
 }
 
-// 发送文件
-func (node *P2PNode) sendFile(fileID string, filePath string) {
-	const chunkSize = 64 * 1024 // 64KB
-
+// 发送文件（skip 为接收方已收到的块，续传时跳过）
+func (node *P2PNode) sendFile(fileID string, filePath string, skip []byte) {
 	// 查找目标用户
-	node.FileTransfersMutex.RLock()
+	node.FileTransfersMutex.Lock()
 	transfer, exists := node.FileTransfers[fileID]
 	if !exists {
-		node.FileTransfersMutex.RUnlock()
+		node.FileTransfersMutex.Unlock()
 		fmt.Printf("发送文件失败: 无效的文件ID %s\n", fileID)
 		return
 	}
-	targetName := transfer.PeerName
-	node.FileTransfersMutex.RUnlock()
+	targetID := transfer.PeerID
+	source := transfer.Source
+	hashDone := transfer.HashDone
+	node.FileTransfersMutex.Unlock()
 
-	var targetPeer *Peer
 	node.PeersMutex.RLock()
-	for _, p := range node.Peers {
-		if p.Name == targetName {
-			targetPeer = p
-			break
-		}
-	}
+	targetPeer := node.Peers[targetID]
 	node.PeersMutex.RUnlock()
 
 	if targetPeer == nil {
-		fmt.Printf("发送文件失败: 用户 %s 不在线\n", targetName)
+		fmt.Printf("发送文件失败: 用户 %s 不在线\n", transfer.PeerName)
 		return
 	}
 
-	// 打开文件
-	file, err := os.Open(filePath)
-	if err != nil {
-		fmt.Printf("发送文件失败: 无法打开文件 %s: %v\n", filePath, err)
+	// 支持确认的对端使用滑动窗口，否则按旧方式连续发送
+	var window *sendWindow
+	if targetPeer.hasCapability(CapabilityFileAck) {
+		window = newSendWindow()
+	}
+
+	// 续传时旧的发送协程可能仍在运行，通过尝试序号让其退出
+	node.FileTransfersMutex.Lock()
+	transfer.Attempt++
+	attempt := transfer.Attempt
+	transfer.Window = window
+	node.FileTransfersMutex.Unlock()
+
+	stale := func() bool {
+		node.FileTransfersMutex.RLock()
+		defer node.FileTransfersMutex.RUnlock()
+		return transfer.Attempt != attempt || transfer.Status != "transferring"
+	}
+
+	// 超过同时发送数时排队，按优先级依次开始
+	if !node.acquireSendSlot(fileID, stale) {
 		return
 	}
-	defer file.Close()
+	defer node.Scheduler.release()
+
+	// 打开文件（群发时由各接收方共用的读取缓存读取）
+	var file *os.File
+	var fileSize int64
+	var err error
+	if source != nil {
+		fileSize = source.size
+	} else {
+		file, err = os.Open(filePath)
+		if err != nil {
+			fmt.Printf("发送文件失败: 无法打开文件 %s: %v\n", filePath, err)
+			return
+		}
+		defer file.Close()
 
-	fileInfo, _ := file.Stat()
-	totalChunks := (int(fileInfo.Size()) + chunkSize - 1) / chunkSize
-	
-	buffer := make([]byte, chunkSize)
-	chunkNum := 0
+		fileInfo, _ := file.Stat()
+		fileSize = fileInfo.Size()
+	}
+	totalChunks := chunkCount(fileSize)
 
-	for {
-		bytesRead, err := file.Read(buffer)
+	// 文件块优先通过独立的数据连接发送，主连接只传控制消息；建立失败时退回主连接
+	var channel *dataChannel
+	if window != nil && targetPeer.sealsEnvelope() && targetPeer.hasCapability(CapabilityDataChannel) {
+		channel, err = node.openDataChannel(targetPeer, fileID)
 		if err != nil {
+			fmt.Printf("建立数据连接失败: %v，将通过主连接发送\n", err)
+		} else {
+			defer channel.Close()
+		}
+	}
+	node.FileTransfersMutex.Lock()
+	if transfer.Attempt == attempt {
+		transfer.DataChannel = channel != nil
+	}
+	node.FileTransfersMutex.Unlock()
+
+	buffer := make([]byte, fileChunkSize)
+	compress := targetPeer.hasCapability(CapabilityCompression) && compressibleFile(transfer.FileName)
+	incompressible := 0
+
+	for chunkNum := 1; chunkNum <= totalChunks; chunkNum++ {
+		if stale() {
+			return // 传输已中断或已由新的续传接管
+		}
+		if bitmapHas(skip, chunkNum) {
+			continue
+		}
+		var chunkData, chunkHash []byte
+		if source != nil {
+			chunkData, chunkHash, err = source.chunk(chunkNum)
+		} else {
+			var bytesRead int
+			bytesRead, err = file.ReadAt(buffer[:chunkLength(fileSize, chunkNum)], int64(chunkNum-1)*fileChunkSize)
 			if err == io.EOF {
-				break // 文件读取完毕
+				err = nil
 			}
+			chunkData = buffer[:bytesRead]
+			sum := sha256.Sum256(chunkData)
+			chunkHash = sum[:]
+		}
+		if err != nil {
 			fmt.Printf("发送文件失败: 读取文件时出错: %v\n", err)
 			return
 		}
-		if bytesRead == 0 {
-			break
+
+		// 在加密前压缩，连续几块压缩无效时不再尝试
+		payload := chunkData
+		algorithm := ""
+		if compress {
+			if compressed := compressChunk(chunkData); compressed != nil {
+				payload = compressed
+				algorithm = compressionDeflate
+				incompressible = 0
+			} else {
+				incompressible++
+				compress = incompressible < incompressibleChunkLimit
+			}
 		}
 
-		chunkNum++
-		chunkData := buffer[:bytesRead]
+		// 先按限速等待再占用窗口，等待时间不计入往返时延
+		if !node.throttleUpload(targetID, len(payload), stale) {
+			return
+		}
+		if window != nil && !window.acquire(chunkNum, stale) {
+			return
+		}
 
 		chunk := FileChunk{
 			Type:        "file_chunk",
 			FileID:      fileID,
 			ChunkNum:    chunkNum,
 			TotalChunks: totalChunks,
-			Data:        chunkData,
+			Offset:      int64(chunkNum-1) * fileChunkSize,
+			Hash:        chunkHash,
+			Data:        payload,
 			Timestamp:   time.Now(),
+			Compression: algorithm,
 		}
 
-		// 加密 chunk Data
-		if len(targetPeer.SharedKey) == 32 {
-			ciphertext, nonce, err := encryptMessage([32]byte(targetPeer.SharedKey), chunkData)
+		// 加密 chunk Data（数据连接和加密信封已整体加密时无需重复加密）
+		if channel != nil || targetPeer.sealsEnvelope() {
+			chunk.Encrypted = false
+		} else if len(targetPeer.SharedKey) == 32 {
+			ciphertext, nonce, err := encryptMessage([32]byte(targetPeer.SharedKey), payload)
 			if err == nil {
 				chunk.Encrypted = true
 				chunk.Nonce = nonce
@@ -294,12 +613,12 @@ func (node *P2PNode) sendFile(fileID string, filePath string) {
 				fmt.Printf("加密文件块失败: %v，将尝试不加密传输\n", err)
 				// 如果加密失败，保持明文传输
 				chunk.Encrypted = false
-				chunk.Data = chunkData
+				chunk.Data = payload
 			}
 		} else {
 			// 密钥无效，保持明文传输
 			chunk.Encrypted = false
-			chunk.Data = chunkData
+			chunk.Data = payload
 		}
 
 		msg := Message{
@@ -309,55 +628,146 @@ func (node *P2PNode) sendFile(fileID string, filePath string) {
 			Data: chunk,
 		}
 
-		if err := node.sendMessageToPeer(targetPeer, msg); err != nil {
+		err = nil
+		if channel != nil {
+			if err = channel.writeChunk(chunk); err != nil {
+				// 数据连接断开但主连接可能仍然可用，剩余的块改走主连接
+				fmt.Printf("数据连接中断: %v，改用主连接发送\n", err)
+				channel.Close()
+				channel = nil
+			}
+		}
+		if channel == nil {
+			err = node.sendMessageToPeer(targetPeer, msg)
+		}
+		if err != nil {
 			fmt.Printf("发送文件块失败: %v\n", err)
-			// 标记传输失败
+			if window != nil {
+				window.release(chunkNum)
+			}
+			// 支持续传的对端标记为已中断，重新连接后由接收方发起续传
 			node.FileTransfersMutex.Lock()
-			if transfer, exists := node.FileTransfers[fileID]; exists {
+			resumable := targetPeer.hasCapability(CapabilityResume) && transfer.Attempt == attempt
+			if resumable {
+				transfer.Status = "interrupted"
+				fmt.Printf("文件传输中断: %s，重新连接后将自动续传\n", transfer.FileName)
+			} else {
 				transfer.Status = "failed"
 				transfer.EndTime = time.Now()
 				fmt.Printf("文件传输失败: %s\n", transfer.FileName)
 			}
 			node.FileTransfersMutex.Unlock()
+			if resumable {
+				if err := node.saveTransferState(fileID); err != nil {
+					fmt.Printf("保存续传状态失败: %v\n", err)
+				}
+			}
+			node.publishTransfer(fileID, true)
 			return
 		}
 
-		// 更新进度
-		node.updateTransferProgress(fileID, int64(bytesRead))
+		node.recordChunkCompression(fileID, len(chunkData), len(payload), algorithm)
+
+		// 更新进度（使用滑动窗口时按接收方确认的字节更新）
+		if window == nil {
+			node.updateTransferProgress(fileID, int64(len(chunkData)))
+			node.publishTransfer(fileID, false)
+		}
+	}
+
+	// 等待最后一批确认；超时未确认的块由接收方请求补发
+	if window != nil && !window.drain(stale) && stale() {
+		return
+	}
+
+	// 后台计算的校验值要随发送完成通知一起发出
+	if hashDone != nil {
+		<-hashDone
 	}
 
 	// 发送完成
 	node.FileTransfersMutex.Lock()
-	if transfer, exists := node.FileTransfers[fileID]; exists {
-		transfer.Status = "completed"
-		transfer.EndTime = time.Now()
+	if transfer.Attempt != attempt {
+		node.FileTransfersMutex.Unlock()
+		return
 	}
+	transfer.Status = "completed"
+	transfer.EndTime = time.Now()
+	transfer.DataChannel = false
+	fileHash := transfer.SHA256
 	node.FileTransfersMutex.Unlock()
+	removeTransferState(fileID)
+	node.publishTransfer(fileID, true)
+
+	// 通知接收方已发完全部块，接收方据此请求补发缺失的块
+	if targetPeer.hasCapability(CapabilityResume) {
+		msg := Message{
+			Type:      "file_sent",
+			From:      node.ID,
+			To:        targetPeer.ID,
+			Timestamp: time.Now(),
+			Data: FileTransferResponse{
+				Type:      "file_sent",
+				FileID:    fileID,
+				Accepted:  true,
+				SHA256:    fileHash,
+				Timestamp: time.Now(),
+			},
+		}
+		node.sendMessageToPeer(targetPeer, msg)
+	}
 
-	fmt.Printf("文件发送完成: %s\n", filePath)
+	if transfer.JobID == "" {
+		fmt.Printf("文件发送完成: %s\n", filePath)
+	}
 }
 
 // 处理文件数据块
 func (node *P2PNode) handleFileChunk(chunk FileChunk) {
 	node.FileTransfersMutex.Lock()
 	transfer, exists := node.FileTransfers[chunk.FileID]
-	if !exists {
+	if !exists || transfer.Direction != "receive" || transfer.Status == "completed" ||
+		transfer.Status == "paused" || transfer.Status == "cancelled" {
+		node.FileTransfersMutex.Unlock()
+		return
+	}
+	if transfer.ChunkBitmap == nil {
+		transfer.TotalChunks = chunkCount(transfer.FileSize)
+		transfer.ChunkBitmap = make([]byte, (transfer.TotalChunks+7)/8)
+	}
+	if transfer.FilePath == "" {
+		// 尚未接受的传输没有保存路径，忽略数据块
 		node.FileTransfersMutex.Unlock()
 		return
 	}
+	filePath := transfer.FilePath
+	duplicate := bitmapHas(transfer.ChunkBitmap, chunk.ChunkNum)
 	node.FileTransfersMutex.Unlock()
 
-	// 创建下载目录
-	downloadDir := "downloads"
-	if err := os.MkdirAll(downloadDir, 0755); err != nil {
-		fmt.Printf("创建下载目录失败: %v\n", err)
+	if chunk.ChunkNum < 1 || chunk.ChunkNum > chunkCount(transfer.FileSize) {
+		fmt.Printf("忽略无效的文件块 %d (文件: %s)\n", chunk.ChunkNum, transfer.FileName)
 		return
 	}
+	// 发送方支持确认时，处理过的块（包括重复的块）都需要确认以释放窗口
+	node.PeersMutex.RLock()
+	senderPeer := node.Peers[transfer.PeerID]
+	node.PeersMutex.RUnlock()
+	sendAcks := senderPeer != nil && senderPeer.hasCapability(CapabilityFileAck)
 
-	filePath := filepath.Join(downloadDir, transfer.FileName)
+	if duplicate {
+		if sendAcks {
+			node.queueChunkAck(chunk.FileID, chunk.ChunkNum, false)
+		}
+		return // 续传时可能重复收到已写入的块
+	}
 
-	// 以追加模式打开文件
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	// 按块号对应的偏移写入临时文件，重复或乱序的块不会破坏文件
+	// 临时文件在接受时已预分配，不存在说明传输刚被取消，丢弃数据块而不是重新创建
+	partPath := partFilePath(filePath)
+	file, err := os.OpenFile(partPath, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return
+	}
 	if err != nil {
 		fmt.Printf("打开文件失败: %v\n", err)
 		return
@@ -401,23 +811,263 @@ func (node *P2PNode) handleFileChunk(chunk FileChunk) {
 		chunkData = chunk.Data
 	}
 
+	// 解压（发送方在加密前压缩）
+	wireSize := len(chunkData)
+	if chunk.Compression != "" {
+		plain, err := decompressChunk(chunk.Compression, chunkData, chunkLength(transfer.FileSize, chunk.ChunkNum))
+		if err != nil {
+			fmt.Printf("文件块 %d 解压失败: %v，等待补发 (文件: %s)\n", chunk.ChunkNum, err, transfer.FileName)
+			return
+		}
+		chunkData = plain
+	}
+
+	// 校验块的长度、偏移和哈希（旧版发送方不提供哈希）
+	// 校验失败的块不写入，发送方发完后由接收方请求补发
+	if int64(len(chunkData)) != chunkLength(transfer.FileSize, chunk.ChunkNum) {
+		fmt.Printf("文件块 %d 长度不正确，等待补发 (文件: %s)\n", chunk.ChunkNum, transfer.FileName)
+		return
+	}
+	if len(chunk.Hash) > 0 {
+		sum := sha256.Sum256(chunkData)
+		if chunk.Offset != int64(chunk.ChunkNum-1)*fileChunkSize || !bytes.Equal(sum[:], chunk.Hash) {
+			fmt.Printf("文件块 %d 校验失败，等待补发 (文件: %s)\n", chunk.ChunkNum, transfer.FileName)
+			return
+		}
+	}
+
 	// 写入数据
-	if _, err := file.Write(chunkData); err != nil {
+	if _, err := file.WriteAt(chunkData, int64(chunk.ChunkNum-1)*fileChunkSize); err != nil {
 		fmt.Printf("写入文件块失败: %v\n", err)
 		return
 	}
 
+	// 记录已接收的块
+	node.FileTransfersMutex.Lock()
+	if bitmapHas(transfer.ChunkBitmap, chunk.ChunkNum) {
+		node.FileTransfersMutex.Unlock()
+		if sendAcks {
+			node.queueChunkAck(chunk.FileID, chunk.ChunkNum, false)
+		}
+		return
+	}
+	bitmapSet(transfer.ChunkBitmap, chunk.ChunkNum)
+	transfer.ReceivedChunks++
+	transfer.UnsavedChunks++
+	completed := transfer.ReceivedChunks >= transfer.TotalChunks
+	// 校验值由发送完成通知提供时，收到通知后再完成接收
+	finalize := completed && !transfer.HashPending
+	saveState := !completed && transfer.UnsavedChunks >= resumeSaveInterval
+	if saveState {
+		transfer.UnsavedChunks = 0
+	}
+	node.FileTransfersMutex.Unlock()
+
 	// 更新进度
 	node.updateTransferProgress(chunk.FileID, int64(len(chunkData)))
+	node.recordChunkCompression(chunk.FileID, len(chunkData), wireSize, chunk.Compression)
+	if sendAcks {
+		// 下载限速：推迟确认，发送方的窗口随之放慢
+		if delay := node.downloadDelay(transfer.PeerID, wireSize); delay > 0 && !completed {
+			fileID, chunkNum := chunk.FileID, chunk.ChunkNum
+			time.AfterFunc(delay, func() {
+				node.queueChunkAck(fileID, chunkNum, false)
+			})
+		} else {
+			node.queueChunkAck(chunk.FileID, chunk.ChunkNum, completed)
+		}
+	}
+
+	if saveState {
+		// 先落盘再记录，保证续传状态中的块都已写入
+		if err := file.Sync(); err != nil {
+			fmt.Printf("同步文件失败: %v\n", err)
+		} else if err := node.saveTransferState(chunk.FileID); err != nil {
+			fmt.Printf("保存续传状态失败: %v\n", err)
+		}
+	}
 
 	// 检查是否完成
+	if completed {
+		if err := file.Sync(); err != nil {
+			fmt.Printf("同步文件失败: %v\n", err)
+		}
+		file.Close()
+		if finalize {
+			node.finishReceivedFile(chunk.FileID)
+			return
+		}
+	}
+	node.publishTransfer(chunk.FileID, completed)
+}
+
+// 全部数据块已写入：校验整个文件后把临时文件重命名为目标文件
+func (node *P2PNode) finishReceivedFile(fileID string) {
+	node.FileTransfersMutex.RLock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists {
+		node.FileTransfersMutex.RUnlock()
+		return
+	}
+	filePath := transfer.FilePath
+	expectedHash := transfer.SHA256
+	node.FileTransfersMutex.RUnlock()
+
+	partPath := partFilePath(filePath)
+	hashOK := true
+	if expectedHash != "" {
+		actual, err := fileSHA256(partPath)
+		hashOK = err == nil && actual == expectedHash
+	}
+
+	// 校验大文件期间传输可能已被取消；检查状态与保存文件在同一临界区内完成，已取消的文件不会落地
 	node.FileTransfersMutex.Lock()
-	if transfer.Progress >= transfer.FileSize {
-		transfer.Status = "completed"
+	if transfer.Status == "cancelled" {
+		node.FileTransfersMutex.Unlock()
+		if err := os.Remove(partPath); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("删除临时文件失败: %v\n", err)
+		}
+		return
+	}
+	if !hashOK {
+		node.FileTransfersMutex.Unlock()
+		fmt.Printf("\n文件 %s 校验失败: 内容与发送方不一致\n", transfer.FileName)
+		node.markTransferCorrupted(fileID, true)
+		return
+	}
+	// 接收期间出现的同名文件同样不覆盖
+	savedPath, err := renameNoClobber(partPath, filePath)
+	if err != nil {
+		transfer.Status = "failed"
 		transfer.EndTime = time.Now()
-		fmt.Printf("\n文件接收完成: %s，已保存到 %s 目录\n", transfer.FileName, downloadDir)
+		node.FileTransfersMutex.Unlock()
+		fmt.Printf("\n保存文件 %s 失败: %v\n", transfer.FileName, err)
+		node.publishTransfer(fileID, true)
+		return
+	}
+	filePath = savedPath
+	transfer.FilePath = filePath
+	transfer.SavedPath = filePath
+	transfer.Status = "completed"
+	transfer.Resumable = false
+	transfer.EndTime = time.Now()
+	mode, modTime := transfer.Mode, transfer.SourceModTime
+	// 任务中的文件完成时不单独提示，由任务汇总
+	if transfer.JobID == "" {
+		if expectedHash != "" {
+			fmt.Printf("\n文件接收完成: %s，已保存到 %s (SHA-256 校验通过)\n", transfer.FileName, filePath)
+		} else {
+			fmt.Printf("\n文件接收完成: %s，已保存到 %s\n", transfer.FileName, filePath)
+		}
+	}
+	node.FileTransfersMutex.Unlock()
+	applyFileAttributes(filePath, mode, modTime)
+	removeTransferState(fileID)
+	node.publishTransfer(fileID, true)
+}
+
+// 处理发送方的发送完成通知：仍有缺失的块时请求补发
+func (node *P2PNode) handleFileSent(from string, notice FileTransferResponse) {
+	node.FileTransfersMutex.Lock()
+	transfer, exists := node.FileTransfers[notice.FileID]
+	if !exists || transfer.PeerID != from || transfer.Direction != "receive" || transfer.Status != "transferring" {
+		node.FileTransfersMutex.Unlock()
+		return
+	}
+	// 发送方后台计算的校验值随通知送达；数据块已全部写入时现在完成接收
+	finalize := false
+	if transfer.HashPending {
+		transfer.HashPending = false
+		transfer.SHA256 = notice.SHA256
+		finalize = transfer.ReceivedChunks >= transfer.TotalChunks
+	}
+	missing := transfer.TotalChunks - transfer.ReceivedChunks
+	if missing <= 0 {
+		node.FileTransfersMutex.Unlock()
+		if finalize {
+			node.finishReceivedFile(notice.FileID)
+		}
+		return
+	}
+	transfer.MissingRetries++
+	retries := transfer.MissingRetries
+	node.FileTransfersMutex.Unlock()
+
+	if retries > maxMissingRetries {
+		fmt.Printf("\n文件 %s 多次补发后仍缺少 %d 个数据块\n", transfer.FileName, missing)
+		node.markTransferCorrupted(notice.FileID, false)
+		return
+	}
+	fmt.Printf("文件 %s 缺少 %d 个数据块，请求发送方补发 (第 %d 次)\n", transfer.FileName, missing, retries)
+	if err := node.sendFileResume(notice.FileID); err != nil {
+		fmt.Printf("请求补发失败: %v\n", err)
+	}
+}
+
+// 标记传输已损坏；整个文件校验失败时已写入的内容不可信，需全部重新传输
+func (node *P2PNode) markTransferCorrupted(fileID string, wholeFile bool) {
+	node.FileTransfersMutex.Lock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists {
+		node.FileTransfersMutex.Unlock()
+		return
+	}
+	alreadyCorrupted := transfer.Status == "corrupted"
+	transfer.Status = "corrupted"
+	transfer.Resumable = true
+	transfer.EndTime = time.Now()
+	if wholeFile {
+		transfer.ChunkBitmap = make([]byte, (transfer.TotalChunks+7)/8)
+		transfer.ReceivedChunks = 0
+		transfer.Progress = 0
 	}
 	node.FileTransfersMutex.Unlock()
+
+	if err := node.saveTransferState(fileID); err != nil {
+		fmt.Printf("保存续传状态失败: %v\n", err)
+	}
+	if !alreadyCorrupted {
+		fmt.Printf("要重新传输，请输入: /resume %s\n", fileID)
+	}
+	node.publishTransfer(fileID, true)
+}
+
+// 检查目录所在磁盘是否有足够空间；无法查询时不阻止接收
+func checkDiskSpace(dir string, size int64) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		return nil
+	}
+	if size > 0 && uint64(size) > free {
+		return fmt.Errorf("磁盘空间不足: 需要 %s，可用 %s", formatFileSize(size), formatFileSize(int64(free)))
+	}
+	return nil
+}
+
+// 查询目录所在磁盘的可用空间，目录尚未创建时查询最近的上级目录
+func freeSpace(dir string) (uint64, error) {
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return diskFreeSpace(dir)
+}
+
+// 计算文件的SHA-256（十六进制）
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 // 更新文件传输状态（计算速度和ETA）
@@ -432,6 +1082,8 @@ func (node *P2PNode) updateTransferProgress(fileID string, bytesAdded int64) {
 
 	// 更新进度
 	transfer.Progress += bytesAdded
+	transfer.SpeedBytes += bytesAdded
+	transfer.RateLimit = node.effectiveRateLimit(transfer.PeerID, transfer.Direction)
 	now := time.Now()
 
 	// 计算速度和ETA
@@ -439,10 +1091,15 @@ func (node *P2PNode) updateTransferProgress(fileID string, bytesAdded int64) {
 		transfer.LastUpdateTime = transfer.StartTime
 	}
 
+	// 按采样间隔累计字节计算速度，避免确认成批到达时速度跳动
 	elapsed := now.Sub(transfer.LastUpdateTime).Seconds()
-	if elapsed > 0 {
-		// 计算瞬时速度（最近一段时间的速度）
-		transfer.Speed = float64(bytesAdded) / elapsed
+	if elapsed >= speedSampleInterval.Seconds() || (elapsed > 0 && transfer.Progress >= transfer.FileSize) {
+		instant := float64(transfer.SpeedBytes) / elapsed
+		if transfer.Speed > 0 {
+			transfer.Speed = 0.7*transfer.Speed + 0.3*instant
+		} else {
+			transfer.Speed = instant
+		}
 
 		// 计算ETA
 		remaining := transfer.FileSize - transfer.Progress
@@ -451,10 +1108,16 @@ func (node *P2PNode) updateTransferProgress(fileID string, bytesAdded int64) {
 		} else {
 			transfer.ETA = -1 // 无法计算
 		}
-	}
 
-	transfer.LastUpdateTime = now
-	transfer.Status = "transferring"
+		transfer.LastUpdateTime = now
+		transfer.SpeedBytes = 0
+	}
+	// 连接中断、校验失败、暂停或取消后仍在处理的残留数据块和确认不改变状态
+	switch transfer.Status {
+	case "interrupted", "corrupted", "paused", "cancelled":
+	default:
+		transfer.Status = "transferring"
+	}
 }
 
 // 格式化文件大小
@@ -484,16 +1147,78 @@ func (node *P2PNode) showFileTransfers() {
 	fmt.Println("\n文件传输列表:")
 	fmt.Println("===========================================")
 	for _, transfer := range node.FileTransfers {
-		progressPercent := float64(transfer.Progress) / float64(transfer.FileSize) * 100
+		// 任务中的文件汇总在任务中显示，群发的各接收方显示在群发记录下
+		if transfer.JobID != "" || transfer.BroadcastID != "" {
+			continue
+		}
+		progressPercent := 0.0
+		if transfer.FileSize > 0 {
+			progressPercent = float64(transfer.Progress) / float64(transfer.FileSize) * 100
+		} else if transfer.Status == "completed" {
+			progressPercent = 100
+		}
 		duration := time.Since(transfer.StartTime)
 		
-		fmt.Printf("文件: %s\n", transfer.FileName)
+		if transfer.IsJob {
+			fmt.Printf("任务: %s (ID: %s)\n", transfer.FileName, transfer.FileID)
+			fmt.Printf("文件数: %d/%d\n", transfer.CompletedFiles, transfer.Files)
+		} else if transfer.IsBroadcast {
+			fmt.Printf("群发: %s (ID: %s)\n", transfer.FileName, transfer.FileID)
+			fmt.Printf("接收方: %d/%d 已完成\n", transfer.CompletedRecipients, transfer.Recipients)
+			for _, id := range transfer.Children {
+				if child, exists := node.FileTransfers[id]; exists {
+					childPercent := float64(0)
+					if child.FileSize > 0 {
+						childPercent = float64(child.Progress) / float64(child.FileSize) * 100
+					} else if child.Status == "completed" {
+						// 空文件没有进度，完成即为 100%
+						childPercent = 100
+					}
+					fmt.Printf("  %s: %.1f%% %s (ID: %s)\n", child.PeerName,
+						childPercent, child.Status, child.FileID)
+				}
+			}
+		} else {
+			fmt.Printf("文件: %s (ID: %s)\n", transfer.FileName, transfer.FileID)
+		}
 		fmt.Printf("大小: %s\n", formatFileSize(transfer.FileSize))
 		fmt.Printf("进度: %.1f%% (%s/%s)\n", 
 			progressPercent, 
 			formatFileSize(transfer.Progress), 
 			formatFileSize(transfer.FileSize))
 		fmt.Printf("状态: %s\n", transfer.Status)
+		if transfer.Queued {
+			fmt.Printf("排队中，等待发送名额 (优先级: %s)\n", priorityText(transfer.Priority))
+		}
+		if transfer.Status == "transferring" {
+			if transfer.RateLimit > 0 {
+				fmt.Printf("速度: %s/s (限速 %s)\n", formatFileSize(int64(transfer.Speed)), formatRateLimit(transfer.RateLimit))
+			} else {
+				fmt.Printf("速度: %s/s\n", formatFileSize(int64(transfer.Speed)))
+			}
+		}
+		if (transfer.Status == "interrupted" || transfer.Status == "paused") && transfer.Resumable {
+			fmt.Printf("续传: /resume %s\n", transfer.FileID)
+		}
+		if transfer.Status == "corrupted" {
+			fmt.Printf("校验失败，重新传输: /resume %s\n", transfer.FileID)
+		}
+		if transfer.SavedPath != "" {
+			fmt.Printf("保存到: %s\n", transfer.SavedPath)
+		}
+		if transfer.Compression != "" {
+			fmt.Printf("压缩: %s，传输量为原大小的 %.0f%%\n", transfer.Compression, transfer.CompressionRatio*100)
+		}
+		if transfer.SHA256 != "" {
+			fmt.Printf("SHA-256: %s\n", transfer.SHA256)
+		}
+		if transfer.Window != nil && transfer.Status == "transferring" {
+			size, inFlight, srtt := transfer.Window.stats()
+			fmt.Printf("窗口: %d 块 (未确认 %d, RTT %v)\n", size, inFlight, srtt.Round(time.Millisecond))
+		}
+		if transfer.DataChannel {
+			fmt.Printf("通道: 独立数据连接\n")
+		}
 		fmt.Printf("方向: %s\n", transfer.Direction)
 		fmt.Printf("对方: %s\n", transfer.PeerName)
 		fmt.Printf("时长: %v\n", duration.Round(time.Second))
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 在临时目录中创建未启动网络的节点
+func newTestNode(t *testing.T, name string) *P2PNode {
+	t.Helper()
+	dir := t.TempDir()
+	old, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(old) })
+
+	node := NewP2PNode(name, false, "127.0.0.1")
+	t.Cleanup(func() { node.DB.Close() })
+	node.Downloads.Dir = filepath.Join(dir, "downloads")
+	return node
+}
+
+func TestAcceptEmptyFileCompletes(t *testing.T) {
+	node := newTestNode(t, "receiver")
+	node.Peers["sender-id"] = &Peer{ID: "sender-id", Name: "sender", IsActive: true}
+
+	node.handleFileTransferRequest(FileTransferRequest{
+		Type:      "file_request",
+		FileID:    "emptyfile01",
+		FileName:  "empty.txt",
+		FileSize:  0,
+		From:      "sender-id",
+		Timestamp: time.Now(),
+	})
+	if err := node.respondToFileTransfer("emptyfile01", true); err != nil {
+		t.Fatalf("接受空文件失败: %v", err)
+	}
+
+	node.FileTransfersMutex.RLock()
+	transfer := node.FileTransfers["emptyfile01"]
+	status, savedPath := transfer.Status, transfer.SavedPath
+	node.FileTransfersMutex.RUnlock()
+
+	if status != "completed" {
+		t.Errorf("空文件接受后状态 = %s, 期望 completed", status)
+	}
+	want := filepath.Join(node.Downloads.Dir, "empty.txt")
+	if savedPath != want {
+		t.Errorf("保存路径 = %q, 期望 %q", savedPath, want)
+	}
+	info, err := os.Stat(want)
+	if err != nil {
+		t.Fatalf("空文件未创建: %v", err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("文件大小 = %d, 期望 0", info.Size())
+	}
+	if _, err := os.Stat(partFilePath(want)); !os.IsNotExist(err) {
+		t.Errorf("临时文件未清理: %v", err)
+	}
+
+	// 发送方随后的发送完成通知不应改变状态
+	node.handleFileSent("sender-id", FileTransferResponse{Type: "file_sent", FileID: "emptyfile01"})
+	node.FileTransfersMutex.RLock()
+	status = transfer.Status
+	node.FileTransfersMutex.RUnlock()
+	if status != "completed" {
+		t.Errorf("收到发送完成通知后状态 = %s, 期望 completed", status)
+	}
+}
+
+func TestHashOutgoingFileSharedByRecipients(t *testing.T) {
+	node := newTestNode(t, "sender")
+	path := filepath.Join(t.TempDir(), "setup.exe")
+	if err := os.WriteFile(path, []byte("broadcast payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := fileSHA256(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 群发记录本身不等待校验值，各接收方的传输等待同一次计算
+	ids := []string{"parent", "child1", "child2"}
+	node.FileTransfersMutex.Lock()
+	for _, id := range ids {
+		transfer := &FileTransferStatus{FileID: id, Direction: "send", Status: "pending"}
+		if id != "parent" {
+			transfer.deferHash()
+		}
+		node.FileTransfers[id] = transfer
+	}
+	node.FileTransfersMutex.Unlock()
+
+	node.hashOutgoingFile(path, ids...)
+
+	for _, id := range ids {
+		node.FileTransfersMutex.RLock()
+		done := node.FileTransfers[id].HashDone
+		node.FileTransfersMutex.RUnlock()
+		if done != nil {
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s 的校验值计算未完成", id)
+			}
+		}
+	}
+	// 群发记录没有等待通道，等待最后一个接收方即可确认计算已结束
+	node.FileTransfersMutex.RLock()
+	defer node.FileTransfersMutex.RUnlock()
+	for _, id := range ids {
+		transfer := node.FileTransfers[id]
+		if transfer.SHA256 != want || transfer.HashPending {
+			t.Errorf("%s: 校验值 = %q, 等待中 = %v, 期望 %q", id, transfer.SHA256, transfer.HashPending, want)
+		}
+	}
+}
+
+// 创建通过内存连接收发消息的旧版协议对端，返回写给对端的消息
+func newPipePeer(t *testing.T, id, name string) (*Peer, <-chan Message) {
+	t.Helper()
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	received := make(chan Message, 16)
+	go func() {
+		decoder := json.NewDecoder(remote)
+		for {
+			var msg Message
+			if err := decoder.Decode(&msg); err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+	return &Peer{
+		ID:              id,
+		Name:            name,
+		Conn:            local,
+		IsActive:        true,
+		ProtocolVersion: ProtocolVersionLegacy,
+		SharedKey:       make([]byte, 32),
+	}, received
+}
+
+func TestRespondToFileTransferOnce(t *testing.T) {
+	node := newTestNode(t, "receiver")
+	sender, toSender := newPipePeer(t, "sender-id", "renamed")
+	// 另一个用户使用了请求中记录的用户名，响应不能发给他
+	impostor, toImpostor := newPipePeer(t, "impostor-id", "sender")
+	node.Peers[sender.ID] = sender
+	node.Peers[impostor.ID] = impostor
+
+	node.FileTransfers["race01"] = &FileTransferStatus{
+		FileID:    "race01",
+		FileName:  "a.txt",
+		FileSize:  10,
+		Status:    "pending",
+		Direction: "receive",
+		PeerName:  "sender",
+		PeerID:    sender.ID,
+	}
+
+	const workers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- node.respondToFileTransfer("race01", true)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	accepted := 0
+	for err := range errs {
+		if err == nil {
+			accepted++
+		}
+	}
+	if accepted != 1 {
+		t.Fatalf("并发接受成功 %d 次, 期望 1 次", accepted)
+	}
+
+	entries, err := os.ReadDir(node.Downloads.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("下载目录中的文件 = %v, 期望只有一个临时文件", names)
+	}
+
+	select {
+	case msg := <-toSender:
+		if msg.Type != "file_response" {
+			t.Errorf("发送方收到 %s, 期望 file_response", msg.Type)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("发送方未收到响应")
+	}
+	select {
+	case msg := <-toImpostor:
+		t.Errorf("同名的其他用户收到了 %s", msg.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestFinishReceivedFileAfterCancel(t *testing.T) {
+	node := newTestNode(t, "receiver")
+	if err := os.MkdirAll(node.Downloads.Dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(node.Downloads.Dir, "a.txt")
+	if err := os.WriteFile(partFilePath(target), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 全部数据块到齐后、保存之前用户取消了传输
+	node.FileTransfers["cancel01"] = &FileTransferStatus{
+		FileID:    "cancel01",
+		FileName:  "a.txt",
+		FilePath:  target,
+		FileSize:  4,
+		Status:    "cancelled",
+		Direction: "receive",
+		PeerID:    "sender-id",
+	}
+	node.finishReceivedFile("cancel01")
+
+	if status := node.FileTransfers["cancel01"].Status; status != "cancelled" {
+		t.Errorf("状态 = %s, 期望保持 cancelled", status)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("已取消的文件被保存: %v", err)
+	}
+	if _, err := os.Stat(partFilePath(target)); !os.IsNotExist(err) {
+		t.Errorf("临时文件未删除: %v", err)
+	}
+}
+
+func TestShowFileTransfersEmptyBroadcastChild(t *testing.T) {
+	node := newTestNode(t, "sender")
+	node.FileTransfers["bc01"] = &FileTransferStatus{
+		FileID:      "bc01",
+		FileName:    "empty.txt",
+		Status:      "completed",
+		Direction:   "send",
+		IsBroadcast: true,
+		Recipients:  2,
+		Children:    []string{"bc01-a", "bc01-b"},
+		StartTime:   time.Now(),
+	}
+	for _, child := range []struct{ id, status string }{{"bc01-a", "completed"}, {"bc01-b", "pending"}} {
+		node.FileTransfers[child.id] = &FileTransferStatus{
+			FileID:      child.id,
+			FileName:    "empty.txt",
+			Status:      child.status,
+			Direction:   "send",
+			PeerName:    child.id,
+			BroadcastID: "bc01",
+		}
+	}
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	node.showFileTransfers()
+	os.Stdout = stdout
+	w.Close()
+	output, _ := io.ReadAll(r)
+
+	if strings.Contains(string(output), "NaN") {
+		t.Errorf("空文件的群发进度输出了 NaN:\n%s", output)
+	}
+	for _, want := range []string{"bc01-a: 100.0% completed", "bc01-b: 0.0% pending"} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("输出中缺少 %q:\n%s", want, output)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 文件块的滑动窗口流控
+//
+// 接收方每处理一批数据块就发送 file_ack 确认（按块号区间合并），发送方最多保留
+// 窗口大小个未确认的块。窗口随往返时延调整：时延接近最小值时逐步扩大，排队导致
+// 时延明显上升时收缩，并且不小于按吞吐量和最小时延估算的带宽时延积。
+const (
+	initialWindowSize = 8
+	minWindowSize     = 2
+	maxWindowSize     = 256 // 256块 = 16MB
+	ackBatchSize      = 4   // 接收方累计多少块发送一次确认
+	ackFlushDelay     = 20 * time.Millisecond
+	ackTimeout        = 10 * time.Second // 超时未确认的块不再占用窗口，由接收方最后请求补发
+	drainTimeout      = 30 * time.Second // 发完后等待最后一批确认的时间
+)
+
+// ChunkRange结构体 - 连续的块号区间（含两端）
+type ChunkRange struct {
+	First int `json:"first"`
+	Last  int `json:"last"`
+}
+
+// FileAck结构体 - 接收方对已处理数据块的确认
+type FileAck struct {
+	Type      string       `json:"type"`
+	FileID    string       `json:"fileId"`
+	Ranges    []ChunkRange `json:"ranges"`
+	Timestamp time.Time    `json:"timestamp"`
+}
+
+// sendWindow结构体 - 单次发送的窗口状态
+type sendWindow struct {
+	mutex     sync.Mutex
+	inFlight  map[int]time.Time // 块号 -> 发送时间
+	size      int
+	srtt      time.Duration // 平滑往返时延
+	minRTT    time.Duration
+	rate      float64 // 已确认字节的平滑吞吐量 (bytes/second)
+	rateBytes int64   // 当前采样区间内确认的字节数
+	rateStart time.Time
+	notify    chan struct{}
+}
+
+func newSendWindow() *sendWindow {
+	return &sendWindow{
+		inFlight: make(map[int]time.Time),
+		size:     initialWindowSize,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// 等待窗口有空位；stale 返回 true 时放弃等待
+func (w *sendWindow) acquire(chunkNum int, stale func() bool) bool {
+	for {
+		w.mutex.Lock()
+		w.expireLocked()
+		if len(w.inFlight) < w.size {
+			w.inFlight[chunkNum] = time.Now()
+			w.mutex.Unlock()
+			return true
+		}
+		w.mutex.Unlock()
+
+		select {
+		case <-w.notify:
+		case <-time.After(100 * time.Millisecond):
+		}
+		if stale() {
+			return false
+		}
+	}
+}
+
+// 发送失败时释放占用的窗口
+func (w *sendWindow) release(chunkNum int) {
+	w.mutex.Lock()
+	delete(w.inFlight, chunkNum)
+	w.mutex.Unlock()
+}
+
+// 超时未确认的块不再占用窗口
+func (w *sendWindow) expireLocked() {
+	now := time.Now()
+	for chunkNum, sent := range w.inFlight {
+		if now.Sub(sent) > ackTimeout {
+			delete(w.inFlight, chunkNum)
+		}
+	}
+}
+
+// 处理确认，返回本次新确认的字节数
+func (w *sendWindow) ack(ranges []ChunkRange, fileSize int64) int64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	now := time.Now()
+	var acked int64
+	var sample time.Duration
+	// 只确认窗口内的块，旧的发送尝试或超时后的确认会被忽略
+	for chunkNum, sent := range w.inFlight {
+		for _, r := range ranges {
+			if chunkNum < r.First || chunkNum > r.Last {
+				continue
+			}
+			delete(w.inFlight, chunkNum)
+			acked += chunkLength(fileSize, chunkNum)
+			if rtt := now.Sub(sent); rtt > sample {
+				sample = rtt
+			}
+			break
+		}
+	}
+	if acked == 0 {
+		return 0
+	}
+
+	// 更新往返时延
+	if w.srtt == 0 {
+		w.srtt = sample
+	} else {
+		w.srtt = (7*w.srtt + sample) / 8
+	}
+	if w.minRTT == 0 || sample < w.minRTT {
+		w.minRTT = sample
+	}
+
+	// 更新吞吐量（按采样间隔累计，确认成批到达时不会高估）
+	if w.rateStart.IsZero() {
+		w.rateStart = now
+	} else {
+		w.rateBytes += acked
+		if elapsed := now.Sub(w.rateStart); elapsed >= speedSampleInterval/4 {
+			instant := float64(w.rateBytes) / elapsed.Seconds()
+			if w.rate == 0 {
+				w.rate = instant
+			} else {
+				w.rate = 0.8*w.rate + 0.2*instant
+			}
+			w.rateBytes = 0
+			w.rateStart = now
+		}
+	}
+
+	// 调整窗口：时延接近最小值时扩大，明显排队时收缩
+	switch {
+	case sample < w.minRTT*3/2+time.Millisecond:
+		w.size++
+	case sample > w.minRTT*3:
+		w.size = w.size * 3 / 4
+	}
+	if bdp := int(w.rate * w.minRTT.Seconds() / fileChunkSize); w.size < bdp {
+		w.size = bdp
+	}
+	if w.size < minWindowSize {
+		w.size = minWindowSize
+	}
+	if w.size > maxWindowSize {
+		w.size = maxWindowSize
+	}
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+	return acked
+}
+
+// 等待所有已发送的块被确认
+func (w *sendWindow) drain(stale func() bool) bool {
+	deadline := time.Now().Add(drainTimeout)
+	for time.Now().Before(deadline) {
+		w.mutex.Lock()
+		remaining := len(w.inFlight)
+		w.mutex.Unlock()
+		if remaining == 0 {
+			return true
+		}
+		select {
+		case <-w.notify:
+		case <-time.After(100 * time.Millisecond):
+		}
+		if stale() {
+			return false
+		}
+	}
+	return false
+}
+
+// 窗口状态（用于诊断显示）
+func (w *sendWindow) stats() (size int, inFlight int, srtt time.Duration) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.size, len(w.inFlight), w.srtt
+}
+
+// 将块号合并为区间
+func chunkRanges(chunks []int) []ChunkRange {
+	sort.Ints(chunks)
+	var ranges []ChunkRange
+	for _, n := range chunks {
+		if len(ranges) > 0 {
+			last := &ranges[len(ranges)-1]
+			if n == last.Last || n == last.Last+1 {
+				last.Last = n
+				continue
+			}
+		}
+		ranges = append(ranges, ChunkRange{First: n, Last: n})
+	}
+	return ranges
+}
+
+// 接收方记录待确认的块，累计到一批或短暂延迟后发送确认
+func (node *P2PNode) queueChunkAck(fileID string, chunkNum int, flush bool) {
+	node.FileTransfersMutex.Lock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists {
+		node.FileTransfersMutex.Unlock()
+		return
+	}
+	transfer.PendingAcks = append(transfer.PendingAcks, chunkNum)
+	if flush || len(transfer.PendingAcks) >= ackBatchSize {
+		node.FileTransfersMutex.Unlock()
+		node.flushChunkAcks(fileID)
+		return
+	}
+	if transfer.AckTimer == nil {
+		transfer.AckTimer = time.AfterFunc(ackFlushDelay, func() {
+			node.flushChunkAcks(fileID)
+		})
+	}
+	node.FileTransfersMutex.Unlock()
+}
+
+// 发送累计的确认
+func (node *P2PNode) flushChunkAcks(fileID string) {
+	node.FileTransfersMutex.Lock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists {
+		node.FileTransfersMutex.Unlock()
+		return
+	}
+	if transfer.AckTimer != nil {
+		transfer.AckTimer.Stop()
+		transfer.AckTimer = nil
+	}
+	pending := transfer.PendingAcks
+	transfer.PendingAcks = nil
+	peerID := transfer.PeerID
+	node.FileTransfersMutex.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	node.PeersMutex.RLock()
+	peer, online := node.Peers[peerID]
+	node.PeersMutex.RUnlock()
+	if !online {
+		return
+	}
+
+	msg := Message{
+		Type:      "file_ack",
+		From:      node.ID,
+		To:        peerID,
+		Timestamp: time.Now(),
+		Data: FileAck{
+			Type:      "file_ack",
+			FileID:    fileID,
+			Ranges:    chunkRanges(pending),
+			Timestamp: time.Now(),
+		},
+	}
+	if err := node.sendMessageToPeer(peer, msg); err != nil {
+		fmt.Printf("发送文件块确认失败: %v\n", err)
+	}
+}
+
+// 发送方处理确认：释放窗口并按已确认的字节更新进度
+func (node *P2PNode) handleFileAck(from string, ack FileAck) {
+	node.FileTransfersMutex.RLock()
+	transfer, exists := node.FileTransfers[ack.FileID]
+	if !exists || transfer.PeerID != from || transfer.Direction != "send" || transfer.Window == nil {
+		node.FileTransfersMutex.RUnlock()
+		return
+	}
+	window := transfer.Window
+	fileSize := transfer.FileSize
+	node.FileTransfersMutex.RUnlock()
+
+	if acked := window.ack(ack.Ranges, fileSize); acked > 0 {
+		node.updateTransferProgress(ack.FileID, acked)
+		node.publishTransfer(ack.FileID, false)
+	}
+}
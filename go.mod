@@ -4,4 +4,9 @@ go 1.21
 
 require golang.org/x/crypto v0.14.0
 
-require github.com/mattn/go-sqlite3 v1.14.32 // indirect
+require (
+	github.com/mattn/go-sqlite3 v1.14.32
+	golang.org/x/term v0.14.0
+)
+
+require golang.org/x/sys v0.14.0 // indirect
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 传输历史
+//
+// 内存中的传输列表在完成 10 分钟后清理，历史记录保存在数据库的 transfers 表中：文件、
+// 任务和群发中每个接收方的传输在状态变化时写入一行，记录文件名、大小、校验值、对方的
+// 节点ID和身份指纹、方向、结果、耗时、平均速度和保存路径。文件名、对方用户名和保存
+// 路径与消息内容一样用数据库密钥加密，按这些字段筛选时在解密后进行。任务中的单个文件
+// 只体现在任务的记录中。启动时从续传状态恢复可续传的传输（transferResumable），同步到
+// 历史记录，可以继续续传或取消；历史中已结束的传输（transferFinished）即使留有续传状态
+// 也不再恢复；未结束、但续传状态已不存在的传输（如退出前尚未接受的请求）标记为失败。
+const (
+	historyDefaultLimit = 50
+	historyMaxLimit     = 500
+)
+
+// TransferRecord结构体 - 传输历史记录
+type TransferRecord struct {
+	FileID      string    `json:"fileId"`
+	FileName    string    `json:"fileName"`
+	FileSize    int64     `json:"fileSize"`
+	SHA256      string    `json:"sha256,omitempty"`
+	Direction   string    `json:"direction"` // send, receive
+	PeerID      string    `json:"peerId"`
+	PeerName    string    `json:"peerName"`
+	Fingerprint string    `json:"fingerprint,omitempty"` // 对方的身份指纹
+	Status      string    `json:"status"`
+	IsJob       bool      `json:"isJob,omitempty"`
+	Files       int       `json:"files,omitempty"`
+	BroadcastID string    `json:"broadcastId,omitempty"`
+	Transferred int64     `json:"transferred"` // 已传输的字节数
+	StartTime   time.Time `json:"startTime"`
+	EndTime     time.Time `json:"endTime"`  // 未结束时为零值
+	Duration    float64   `json:"duration"` // 秒，未结束时为 0
+	AvgSpeed    float64   `json:"avgSpeed"` // 字节/秒，未结束时为 0
+	SavedPath   string    `json:"savedPath,omitempty"`
+}
+
+// TransferHistoryFilter结构体 - 传输历史的筛选条件
+type TransferHistoryFilter struct {
+	Peer      string // 对方用户名
+	Status    string
+	Direction string    // send, receive
+	Name      string    // 文件名包含的关键词
+	Since     time.Time // 包含
+	Until     time.Time // 不包含
+	Limit     int
+}
+
+// transferDetails结构体 - 传输记录中加密保存的字段
+type transferDetails struct {
+	FileName  string `json:"fileName"`
+	PeerName  string `json:"peerName"`
+	SavedPath string `json:"savedPath,omitempty"`
+}
+
+// 用数据库密钥加密传输记录的字段
+func sealTransferDetails(key [32]byte, details transferDetails) ([]byte, []byte, error) {
+	plaintext, err := json.Marshal(details)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encryptMessage(key, plaintext)
+}
+
+// 解密传输记录的字段
+func openTransferDetails(key [32]byte, ciphertext, nonce []byte) (transferDetails, error) {
+	var details transferDetails
+	plaintext, err := decryptMessage(key, ciphertext, nonce)
+	if err != nil {
+		return details, err
+	}
+	err = json.Unmarshal(plaintext, &details)
+	return details, err
+}
+
+// 传输是否已结束（不会再变化），重启后不再恢复
+func transferFinished(status string) bool {
+	switch status {
+	case "completed", "failed", "cancelled", "rejected":
+		return true
+	}
+	return false
+}
+
+// 传输是否可以续传：保留续传状态，重启后恢复并可用 /resume 继续
+// pending、transferring 等进行中的状态在退出时如有续传状态则恢复为 interrupted
+func transferResumable(status string) bool {
+	switch status {
+	case "interrupted", "paused", "corrupted":
+		return true
+	}
+	return false
+}
+
+// 传输状态变化时写入历史记录
+func (node *P2PNode) recordTransferChange(fileID string) {
+	if node.DB == nil {
+		return
+	}
+	node.FileTransfersMutex.Lock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists || transfer.JobID != "" || transfer.IsBroadcast || transfer.Status == transfer.RecordedStatus {
+		node.FileTransfersMutex.Unlock()
+		return
+	}
+	transfer.RecordedStatus = transfer.Status
+	snapshot := *transfer
+	node.FileTransfersMutex.Unlock()
+
+	if err := node.saveTransferRecord(snapshot); err != nil {
+		fmt.Printf("保存传输历史失败: %v\n", err)
+	}
+}
+
+// 被拒绝的传输在移除前记录结果
+func (node *P2PNode) recordRejectedTransfer(fileID string) {
+	node.FileTransfersMutex.Lock()
+	if transfer, exists := node.FileTransfers[fileID]; exists {
+		transfer.Status = "rejected"
+		transfer.EndTime = time.Now()
+	}
+	node.FileTransfersMutex.Unlock()
+	node.recordTransferChange(fileID)
+}
+
+// 写入或更新一条传输记录
+func (node *P2PNode) saveTransferRecord(transfer FileTransferStatus) error {
+	node.KnownPeersMutex.RLock()
+	fingerprint := ""
+	if kp, exists := node.KnownPeers[transfer.PeerID]; exists {
+		fingerprint = kp.Fingerprint
+	}
+	node.KnownPeersMutex.RUnlock()
+
+	var endTime interface{}
+	duration, speed := 0.0, 0.0
+	if transferFinished(transfer.Status) && !transfer.EndTime.IsZero() {
+		endTime = transfer.EndTime.UTC().Format(searchTimestampLayout)
+		duration = transfer.EndTime.Sub(transfer.StartTime).Seconds()
+		if duration > 0 {
+			speed = float64(transfer.Progress) / duration
+		}
+	}
+
+	// 持有读锁直到写入完成，避免与更换密钥交错
+	node.DBKeyMutex.RLock()
+	defer node.DBKeyMutex.RUnlock()
+	details, nonce, err := sealTransferDetails(node.LocalDBKey, transferDetails{
+		FileName:  transfer.FileName,
+		PeerName:  transfer.PeerName,
+		SavedPath: transfer.SavedPath,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = node.DB.Exec(`
+		INSERT INTO transfers (file_id, file_name, file_size, sha256, direction, peer_id,
+			peer_fingerprint, status, is_job, files, broadcast_id, transferred, start_time, end_time,
+			duration, avg_speed, details, details_nonce, updated_at)
+		VALUES (?, '', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(file_id) DO UPDATE SET
+			file_size = excluded.file_size, sha256 = excluded.sha256,
+			peer_fingerprint = excluded.peer_fingerprint,
+			status = excluded.status, files = excluded.files, transferred = excluded.transferred,
+			end_time = excluded.end_time, duration = excluded.duration, avg_speed = excluded.avg_speed,
+			details = excluded.details, details_nonce = excluded.details_nonce, updated_at = excluded.updated_at
+	`, transfer.FileID, transfer.FileSize, transfer.SHA256, transfer.Direction,
+		transfer.PeerID, fingerprint, transfer.Status, transfer.IsJob, transfer.Files,
+		transfer.BroadcastID, transfer.Progress, transfer.StartTime.UTC().Format(searchTimestampLayout),
+		endTime, duration, speed, details, nonce, time.Now().UTC().Format(searchTimestampLayout))
+	return err
+}
+
+// 加密以明文保存的旧传输记录（数据库升级后首次启动时）
+func (node *P2PNode) encryptPlainTransferHistory() error {
+	node.DBKeyMutex.RLock()
+	defer node.DBKeyMutex.RUnlock()
+
+	tx, err := node.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id, file_name, COALESCE(peer_name, ''), COALESCE(saved_path, '')
+		FROM transfers WHERE details IS NULL
+	`)
+	if err != nil {
+		return err
+	}
+	type plainRow struct {
+		id      int64
+		details transferDetails
+	}
+	var plain []plainRow
+	for rows.Next() {
+		var row plainRow
+		if err := rows.Scan(&row.id, &row.details.FileName, &row.details.PeerName, &row.details.SavedPath); err != nil {
+			rows.Close()
+			return err
+		}
+		plain = append(plain, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, row := range plain {
+		details, nonce, err := sealTransferDetails(node.LocalDBKey, row.details)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+			UPDATE transfers SET file_name = '', peer_name = NULL, saved_path = NULL, details = ?, details_nonce = ?
+			WHERE id = ?
+		`, details, nonce, row.id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(plain) > 0 {
+		fmt.Printf("已加密 %d 条传输历史记录\n", len(plain))
+	}
+	return nil
+}
+
+// 更换数据库密钥时在同一事务中重新加密传输历史，返回无法解密而保持不变的记录数
+func reencryptTransferHistory(tx *sql.Tx, oldKey, newKey [32]byte) (int, error) {
+	rows, err := tx.Query("SELECT id, details, details_nonce FROM transfers WHERE details IS NOT NULL")
+	if err != nil {
+		return 0, err
+	}
+	type encryptedRow struct {
+		id      int64
+		details []byte
+		nonce   []byte
+	}
+	var pending []encryptedRow
+	skipped := 0
+	for rows.Next() {
+		var id int64
+		var ciphertext, nonce []byte
+		if err := rows.Scan(&id, &ciphertext, &nonce); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		plaintext, err := decryptMessage(oldKey, ciphertext, nonce)
+		if err != nil {
+			skipped++
+			continue
+		}
+		ciphertext, nonce, err = encryptMessage(newKey, plaintext)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, encryptedRow{id, ciphertext, nonce})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, row := range pending {
+		if _, err := tx.Exec("UPDATE transfers SET details = ?, details_nonce = ? WHERE id = ?", row.details, row.nonce, row.id); err != nil {
+			return 0, err
+		}
+	}
+	return skipped, nil
+}
+
+// 启动时同步历史记录与续传状态：历史中已结束的传输即使留有续传状态也不再恢复，
+// 可续传的传输恢复为记录中的状态
+func (node *P2PNode) reconcileTransferHistory() {
+	if node.DB == nil {
+		return
+	}
+	node.FileTransfersMutex.RLock()
+	loaded := make(map[string]bool)
+	for id := range node.FileTransfers {
+		loaded[id] = true
+	}
+	node.FileTransfersMutex.RUnlock()
+
+	rows, err := node.DB.Query("SELECT file_id, status FROM transfers")
+	if err != nil {
+		fmt.Printf("读取传输历史失败: %v\n", err)
+		return
+	}
+	var finished, stale []string
+	resumable := make(map[string]string)
+	for rows.Next() {
+		var id, status string
+		if err := rows.Scan(&id, &status); err != nil {
+			continue
+		}
+		switch {
+		case loaded[id] && transferFinished(status):
+			finished = append(finished, id)
+		case loaded[id] && transferResumable(status):
+			resumable[id] = status
+		case !loaded[id] && !transferFinished(status):
+			stale = append(stale, id)
+		}
+	}
+	rows.Close()
+
+	node.dropFinishedTransfers(finished)
+
+	node.FileTransfersMutex.Lock()
+	for id, status := range resumable {
+		// 加载时一律标记为已中断，已暂停的以续传状态为准
+		if transfer, exists := node.FileTransfers[id]; exists && transfer.Status == "interrupted" {
+			transfer.Status = status
+		}
+	}
+	node.FileTransfersMutex.Unlock()
+
+	for id := range loaded {
+		node.recordTransferChange(id)
+	}
+
+	// 未结束、但续传状态已不存在的传输无法继续
+	now := time.Now().UTC().Format(searchTimestampLayout)
+	for _, id := range stale {
+		if _, err := node.DB.Exec("UPDATE transfers SET status = 'failed', end_time = ?, updated_at = ? WHERE file_id = ?", now, now, id); err != nil {
+			fmt.Printf("更新传输历史失败: %v\n", err)
+		}
+	}
+}
+
+// 移除历史中已结束的传输及其残留的续传状态（如完成后删除状态文件前退出）
+func (node *P2PNode) dropFinishedTransfers(ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	var broadcasts []string
+	node.FileTransfersMutex.Lock()
+	for _, id := range ids {
+		transfer, exists := node.FileTransfers[id]
+		if !exists {
+			continue
+		}
+		// 任务中的文件不单独记录历史，随任务一起移除
+		for _, child := range transfer.Children {
+			delete(node.FileTransfers, child)
+			removeTransferState(child)
+		}
+		delete(node.FileTransfers, id)
+		removeTransferState(id)
+
+		if parent, exists := node.FileTransfers[transfer.BroadcastID]; exists {
+			for i, child := range parent.Children {
+				if child == id {
+					parent.Children = append(parent.Children[:i], parent.Children[i+1:]...)
+					break
+				}
+			}
+			if len(parent.Children) == 0 {
+				delete(node.FileTransfers, transfer.BroadcastID)
+			} else {
+				broadcasts = append(broadcasts, transfer.BroadcastID)
+			}
+		}
+	}
+	node.FileTransfersMutex.Unlock()
+
+	for _, id := range broadcasts {
+		node.refreshBroadcast(id, false)
+	}
+}
+
+// 查询传输历史，按开始时间倒序
+func (node *P2PNode) queryTransferHistory(filter TransferHistoryFilter) ([]TransferRecord, error) {
+	if node.DB == nil {
+		return nil, fmt.Errorf("数据库不可用，没有传输历史")
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = historyDefaultLimit
+	}
+	if limit > historyMaxLimit {
+		limit = historyMaxLimit
+	}
+
+	// 文件名和对方用户名加密保存，这两项条件在解密后筛选
+	peerID := ""
+	if filter.Peer != "" {
+		peerID = node.resolvePeerID(filter.Peer)
+	}
+	name := strings.ToLower(filter.Name)
+
+	query := `
+		SELECT file_id, file_size, COALESCE(sha256, ''), direction, COALESCE(peer_id, ''),
+			COALESCE(peer_fingerprint, ''), status, is_job, files, COALESCE(broadcast_id, ''),
+			transferred, start_time, end_time, duration, avg_speed, details, details_nonce,
+			file_name, COALESCE(peer_name, ''), COALESCE(saved_path, '')
+		FROM transfers WHERE 1 = 1`
+	var args []interface{}
+	if filter.Status != "" {
+		query += " AND status = ?"
+		args = append(args, filter.Status)
+	}
+	if filter.Direction != "" {
+		query += " AND direction = ?"
+		args = append(args, filter.Direction)
+	}
+	// 时间以UTC保存
+	if !filter.Since.IsZero() {
+		query += " AND start_time >= ?"
+		args = append(args, filter.Since.UTC().Format(searchTimestampLayout))
+	}
+	if !filter.Until.IsZero() {
+		query += " AND start_time < ?"
+		args = append(args, filter.Until.UTC().Format(searchTimestampLayout))
+	}
+	query += " ORDER BY start_time DESC, id DESC"
+	if filter.Peer == "" && filter.Name == "" {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	node.DBKeyMutex.RLock()
+	defer node.DBKeyMutex.RUnlock()
+	rows, err := node.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []TransferRecord
+	for rows.Next() && len(records) < limit {
+		var record TransferRecord
+		var endTime sql.NullTime
+		var ciphertext, nonce []byte
+		if err := rows.Scan(&record.FileID, &record.FileSize, &record.SHA256, &record.Direction,
+			&record.PeerID, &record.Fingerprint, &record.Status, &record.IsJob, &record.Files,
+			&record.BroadcastID, &record.Transferred, &record.StartTime, &endTime, &record.Duration,
+			&record.AvgSpeed, &ciphertext, &nonce, &record.FileName, &record.PeerName,
+			&record.SavedPath); err != nil {
+			return nil, err
+		}
+		// 尚未加密的旧记录直接使用明文列
+		if ciphertext != nil {
+			details, err := openTransferDetails(node.LocalDBKey, ciphertext, nonce)
+			if err != nil {
+				continue
+			}
+			record.FileName, record.PeerName, record.SavedPath = details.FileName, details.PeerName, details.SavedPath
+		}
+		if filter.Peer != "" && record.PeerID != peerID && record.PeerName != filter.Peer {
+			continue
+		}
+		if name != "" && !strings.Contains(strings.ToLower(record.FileName), name) {
+			continue
+		}
+		record.EndTime = endTime.Time
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// 解析命令行筛选参数: peer:用户 status:状态 dir:send|receive after:日期 before:日期 limit:条数，其余为文件名关键词
+func parseTransferHistoryArgs(args []string) (TransferHistoryFilter, error) {
+	var filter TransferHistoryFilter
+	var terms []string
+	for _, arg := range args {
+		key, value, found := strings.Cut(arg, ":")
+		if !found || value == "" {
+			terms = append(terms, arg)
+			continue
+		}
+		switch key {
+		case "peer":
+			filter.Peer = value
+		case "status":
+			filter.Status = value
+		case "dir":
+			if value != "send" && value != "receive" {
+				return filter, fmt.Errorf("方向应为 send 或 receive: %s", value)
+			}
+			filter.Direction = value
+		case "after", "before":
+			date, err := time.ParseInLocation(searchDateLayout, value, time.Local)
+			if err != nil {
+				return filter, fmt.Errorf("日期格式应为 YYYY-MM-DD: %s", value)
+			}
+			if key == "after" {
+				filter.Since = date
+			} else {
+				filter.Until = date.AddDate(0, 0, 1) // 包含当天
+			}
+		case "limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit <= 0 {
+				return filter, fmt.Errorf("无效的条数: %s", value)
+			}
+			filter.Limit = limit
+		default:
+			terms = append(terms, arg)
+		}
+	}
+	filter.Name = strings.Join(terms, " ")
+	return filter, nil
+}
+
+// 命令行显示传输历史
+func (node *P2PNode) showTransferHistory(args []string) {
+	filter, err := parseTransferHistoryArgs(args)
+	if err != nil {
+		fmt.Printf("错误: %v\n", err)
+		return
+	}
+	records, err := node.queryTransferHistory(filter)
+	if err != nil {
+		fmt.Printf("查询传输历史失败: %v\n", err)
+		return
+	}
+	if len(records) == 0 {
+		fmt.Println("没有符合条件的传输记录")
+		return
+	}
+
+	fmt.Printf("传输历史 (%d 条):\n", len(records))
+	for _, record := range records {
+		direction := "发送给"
+		if record.Direction == "receive" {
+			direction = "接收自"
+		}
+		name := record.FileName
+		if record.IsJob {
+			name = fmt.Sprintf("%s (%d 个文件)", record.FileName, record.Files)
+		}
+		fmt.Printf("  [%s] %s %s: %s (%s) - %s", record.StartTime.Local().Format("2006-01-02 15:04"),
+			direction, record.PeerName, name, formatFileSize(record.FileSize), record.Status)
+		if record.Status == "completed" && record.Duration > 0 {
+			fmt.Printf("，用时 %v，平均 %s/s", time.Duration(record.Duration*float64(time.Second)).Round(time.Second),
+				formatFileSize(int64(record.AvgSpeed)))
+		}
+		fmt.Printf(" (ID: %s)\n", record.FileID)
+		if record.SavedPath != "" {
+			fmt.Printf("      保存到: %s\n", record.SavedPath)
+		}
+		if record.Fingerprint != "" {
+			fmt.Printf("      对方指纹: %s\n", record.Fingerprint)
+		}
+	}
+}
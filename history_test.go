@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 写入一条已完成的接收记录
+func saveTestTransfer(t *testing.T, node *P2PNode, fileID, fileName, peerName string) {
+	t.Helper()
+	start := time.Now().Add(-time.Minute)
+	err := node.saveTransferRecord(FileTransferStatus{
+		FileID:    fileID,
+		FileName:  fileName,
+		FileSize:  4,
+		Progress:  4,
+		Status:    "completed",
+		Direction: "receive",
+		PeerID:    peerName + "-id",
+		PeerName:  peerName,
+		SavedPath: "/home/user/Downloads/" + fileName,
+		StartTime: start,
+		EndTime:   start.Add(time.Second),
+	})
+	if err != nil {
+		t.Fatalf("保存传输记录失败: %v", err)
+	}
+}
+
+// 数据库文件中不应出现的明文
+func assertNoPlaintextTransfer(t *testing.T, node *P2PNode, secrets ...string) {
+	t.Helper()
+	rows, err := node.DB.Query(`
+		SELECT file_name, COALESCE(peer_name, ''), COALESCE(saved_path, ''), COALESCE(details, '')
+		FROM transfers
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fileName, peerName, savedPath string
+		var details []byte
+		if err := rows.Scan(&fileName, &peerName, &savedPath, &details); err != nil {
+			t.Fatal(err)
+		}
+		if fileName != "" || peerName != "" || savedPath != "" {
+			t.Errorf("明文列未清空: %q %q %q", fileName, peerName, savedPath)
+		}
+		for _, secret := range secrets {
+			if bytes.Contains(details, []byte(secret)) {
+				t.Errorf("加密字段中出现明文 %q", secret)
+			}
+		}
+	}
+}
+
+func TestTransferHistoryEncrypted(t *testing.T) {
+	node := newTestNode(t, "local")
+	saveTestTransfer(t, node, "hist01", "report.pdf", "alice")
+	saveTestTransfer(t, node, "hist02", "Photo.JPG", "bob")
+	assertNoPlaintextTransfer(t, node, "report.pdf", "alice", "Downloads")
+
+	tests := []struct {
+		name   string
+		filter TransferHistoryFilter
+		want   []string
+	}{
+		{"全部", TransferHistoryFilter{}, []string{"hist02", "hist01"}},
+		{"按文件名", TransferHistoryFilter{Name: "report"}, []string{"hist01"}},
+		{"文件名不区分大小写", TransferHistoryFilter{Name: "photo"}, []string{"hist02"}},
+		{"按对方用户名", TransferHistoryFilter{Peer: "bob"}, []string{"hist02"}},
+		{"筛选后限制条数", TransferHistoryFilter{Name: "p", Limit: 1}, []string{"hist02"}},
+		{"没有匹配", TransferHistoryFilter{Name: "missing"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := node.queryTransferHistory(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, record := range records {
+				got = append(got, record.FileID)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("查询结果 = %v, 期望 %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("查询结果 = %v, 期望 %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	records, err := node.queryTransferHistory(TransferHistoryFilter{Peer: "alice"})
+	if err != nil || len(records) != 1 {
+		t.Fatalf("查询 alice 的记录: %v, %v", records, err)
+	}
+	if record := records[0]; record.FileName != "report.pdf" || record.PeerName != "alice" ||
+		record.SavedPath != "/home/user/Downloads/report.pdf" {
+		t.Errorf("解密后的记录 = %+v", record)
+	}
+}
+
+func TestTransferHistoryReencryptedWithNewKey(t *testing.T) {
+	node := newTestNode(t, "local")
+	saveTestTransfer(t, node, "hist01", "report.pdf", "alice")
+
+	if err := node.changeDBKey(""); err != nil {
+		t.Fatalf("更换密钥失败: %v", err)
+	}
+	records, err := node.queryTransferHistory(TransferHistoryFilter{Name: "report"})
+	if err != nil || len(records) != 1 || records[0].PeerName != "alice" {
+		t.Errorf("更换密钥后的查询结果 = %+v, %v", records, err)
+	}
+}
+
+func TestEncryptPlainTransferHistory(t *testing.T) {
+	node := newTestNode(t, "local")
+	// 升级前的记录以明文保存
+	_, err := node.DB.Exec(`
+		INSERT INTO transfers (file_id, file_name, direction, peer_id, peer_name, status, start_time, saved_path)
+		VALUES ('old01', 'secret.txt', 'receive', 'alice-id', 'alice', 'completed', ?, '/tmp/secret.txt')
+	`, time.Now().UTC().Format(searchTimestampLayout))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 尚未加密时仍可查询
+	records, err := node.queryTransferHistory(TransferHistoryFilter{Name: "secret"})
+	if err != nil || len(records) != 1 {
+		t.Fatalf("查询明文记录: %+v, %v", records, err)
+	}
+
+	if err := node.encryptPlainTransferHistory(); err != nil {
+		t.Fatalf("加密旧记录失败: %v", err)
+	}
+	assertNoPlaintextTransfer(t, node, "secret.txt", "alice", "/tmp")
+
+	records, err = node.queryTransferHistory(TransferHistoryFilter{Peer: "alice"})
+	if err != nil || len(records) != 1 {
+		t.Fatalf("查询加密后的记录: %+v, %v", records, err)
+	}
+	if record := records[0]; record.FileName != "secret.txt" || record.SavedPath != "/tmp/secret.txt" {
+		t.Errorf("加密后的记录 = %+v", record)
+	}
+}
+
+func TestReconcileTransferHistory(t *testing.T) {
+	node := newTestNode(t, "local")
+	start := time.Now().Add(-time.Hour)
+	record := func(fileID, status string) {
+		t.Helper()
+		err := node.saveTransferRecord(FileTransferStatus{
+			FileID:    fileID,
+			FileName:  fileID + ".bin",
+			FileSize:  fileChunkSize * 2,
+			Status:    status,
+			Direction: "receive",
+			PeerID:    "alice-id",
+			PeerName:  "alice",
+			StartTime: start,
+			EndTime:   start.Add(time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 模拟启动时从续传状态加载的传输
+	load := func(fileID string) {
+		t.Helper()
+		node.FileTransfers[fileID] = &FileTransferStatus{
+			FileID:    fileID,
+			FileName:  fileID + ".bin",
+			FilePath:  filepath.Join(node.Downloads.Dir, fileID+".bin"),
+			FileSize:  fileChunkSize * 2,
+			Status:    "interrupted",
+			Direction: "receive",
+			PeerID:    "alice-id",
+			PeerName:  "alice",
+			StartTime: start,
+			Resumable: true,
+		}
+		if err := node.saveTransferState(fileID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record("done01", "completed") // 完成后、删除续传状态前退出
+	load("done01")
+	record("bad01", "corrupted")
+	load("bad01")
+	record("run01", "transferring") // 传输中退出
+	load("run01")
+	record("gone01", "interrupted") // 续传状态已丢失
+
+	node.reconcileTransferHistory()
+
+	if _, exists := node.FileTransfers["done01"]; exists {
+		t.Error("已完成的传输被重新加载")
+	}
+	if _, err := os.Stat(transferStatePath("done01")); !os.IsNotExist(err) {
+		t.Errorf("已完成传输的续传状态未删除: %v", err)
+	}
+
+	wantLoaded := map[string]string{"bad01": "corrupted", "run01": "interrupted"}
+	for id, want := range wantLoaded {
+		transfer, exists := node.FileTransfers[id]
+		if !exists {
+			t.Errorf("%s 未恢复", id)
+			continue
+		}
+		if transfer.Status != want {
+			t.Errorf("%s 恢复后的状态 = %s, 期望 %s", id, transfer.Status, want)
+		}
+	}
+
+	wantHistory := map[string]string{
+		"done01": "completed",
+		"bad01":  "corrupted",
+		"run01":  "interrupted",
+		"gone01": "failed",
+	}
+	for id, want := range wantHistory {
+		var status string
+		if err := node.DB.QueryRow("SELECT status FROM transfers WHERE file_id = ?", id).Scan(&status); err != nil {
+			t.Fatal(err)
+		}
+		if status != want {
+			t.Errorf("%s 的历史状态 = %s, 期望 %s", id, status, want)
+		}
+	}
+}
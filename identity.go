@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+const (
+	identityKeyFile = "identity.key"
+	identityPEMType = "LANSHARE ED25519 PRIVATE KEY"
+)
+
+// NodeIdentity结构体 - 节点长期身份密钥
+type NodeIdentity struct {
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+}
+
+// 加载身份密钥，不存在时生成并保存（仅所有者可读写）
+func loadOrCreateIdentity(path string) (*NodeIdentity, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != identityPEMType || len(block.Bytes) != ed25519.SeedSize {
+			return nil, fmt.Errorf("身份密钥文件 %s 格式无效", path)
+		}
+		privateKey := ed25519.NewKeyFromSeed(block.Bytes)
+		return &NodeIdentity{
+			PrivateKey: privateKey,
+			PublicKey:  privateKey.Public().(ed25519.PublicKey),
+		}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("读取身份密钥失败: %v", err)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("生成身份密钥失败: %v", err)
+	}
+
+	encoded := pem.EncodeToMemory(&pem.Block{Type: identityPEMType, Bytes: privateKey.Seed()})
+	// O_EXCL 防止并发启动时互相覆盖
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("保存身份密钥失败: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(encoded); err != nil {
+		return nil, fmt.Errorf("保存身份密钥失败: %v", err)
+	}
+
+	fmt.Printf("已生成新的节点身份密钥: %s\n", path)
+	return &NodeIdentity{PrivateKey: privateKey, PublicKey: publicKey}, nil
+}
+
+// 由公钥派生节点ID（SHA-256前16字节的十六进制）
+func deriveNodeID(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:16])
+}
+
+// 节点ID
+func (identity *NodeIdentity) NodeID() string {
+	return deriveNodeID(identity.PublicKey)
+}
+
+// 公钥指纹，便于人工核对
+func (identity *NodeIdentity) Fingerprint() string {
+	return formatFingerprint(identity.PublicKey)
+}
+
+// 格式化公钥指纹: SHA-256 十六进制，每4位一组
+func formatFingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	encoded := hex.EncodeToString(sum[:])
+	var groups []byte
+	for i := 0; i < len(encoded); i += 4 {
+		if i > 0 {
+			groups = append(groups, ':')
+		}
+		groups = append(groups, encoded[i:i+4]...)
+	}
+	return string(groups)
+}
@@ -0,0 +1,946 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 目录或多文件传输任务
+//
+// 发送方把目录树或多个文件整理成清单（相对路径、大小、权限、修改时间和校验值），
+// 通过 job_request 发给接收方，整个任务只需确认一次。清单中的每个文件对应一个子传输，
+// 沿用单个文件的分块、续传和校验流程；任务记录的进度和状态由子传输汇总。
+const maxJobEntries = 100000
+
+// JobEntry结构体 - 任务清单中的一项
+type JobEntry struct {
+	FileID  string    `json:"fileId,omitempty"` // 该文件对应的子传输ID，目录为空
+	Path    string    `json:"path"`             // 相对路径，以 / 分隔
+	Size    int64     `json:"size"`
+	Mode    uint32    `json:"mode"` // 权限位
+	ModTime time.Time `json:"modTime"`
+	SHA256  string    `json:"sha256,omitempty"`
+	IsDir   bool      `json:"isDir,omitempty"`
+}
+
+// 解析 /send 的路径参数：整体是一个存在的路径时按单个路径处理，否则按空格拆分，可用引号包含空格
+func parseSendPaths(arg string) []string {
+	if _, err := os.Stat(arg); err == nil {
+		return []string{arg}
+	}
+	var paths []string
+	var current strings.Builder
+	var quote rune
+	inToken := false
+	for _, r := range arg {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+			inToken = true
+		case quote == 0 && r == ' ':
+			if inToken {
+				paths = append(paths, current.String())
+				current.Reset()
+				inToken = false
+			}
+		default:
+			current.WriteRune(r)
+			inToken = true
+		}
+	}
+	if inToken {
+		paths = append(paths, current.String())
+	}
+	return paths
+}
+
+// 整理要发送的路径：目录递归展开，符号链接和特殊文件跳过；返回清单和对应的源路径
+func buildJobManifest(paths []string) ([]JobEntry, []string, error) {
+	var entries []JobEntry
+	var sources []string
+	seen := make(map[string]bool)
+
+	add := func(rel, source string, info os.FileInfo) error {
+		// 按不区分大小写判断重名，避免在不区分大小写的文件系统上互相覆盖
+		key := strings.ToLower(rel)
+		if seen[key] {
+			return fmt.Errorf("路径重复: %s", rel)
+		}
+		seen[key] = true
+		if len(entries) >= maxJobEntries {
+			return fmt.Errorf("文件数量超过上限 (%d)", maxJobEntries)
+		}
+		entry := JobEntry{
+			Path:    rel,
+			Mode:    uint32(info.Mode().Perm()),
+			ModTime: info.ModTime(),
+			IsDir:   info.IsDir(),
+		}
+		if !info.IsDir() {
+			entry.Size = info.Size()
+			entry.FileID = generateFileID()
+		}
+		entries = append(entries, entry)
+		sources = append(sources, source)
+		return nil
+	}
+
+	for _, p := range paths {
+		p = filepath.Clean(p)
+		info, err := os.Lstat(p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("文件不存在或无法访问: %s", p)
+		}
+		base := filepath.Base(p)
+		if abs, err := filepath.Abs(p); err == nil {
+			base = filepath.Base(abs)
+		}
+		if base == "." || base == ".." || base == string(filepath.Separator) {
+			return nil, nil, fmt.Errorf("无法确定 %s 的名称", p)
+		}
+
+		if !info.IsDir() {
+			if !info.Mode().IsRegular() {
+				return nil, nil, fmt.Errorf("不支持的文件类型: %s", p)
+			}
+			if err := add(base, p, info); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		root := p
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			// 不跟随符号链接，避免循环或把目录外的文件发送出去
+			if d.Type()&fs.ModeSymlink != 0 || (!d.IsDir() && !info.Mode().IsRegular()) {
+				fmt.Printf("跳过符号链接或特殊文件: %s\n", path)
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			relPath := base
+			if rel != "." {
+				relPath = base + "/" + filepath.ToSlash(rel)
+			}
+			return add(relPath, path, info)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	files := 0
+	for i := range entries {
+		if entries[i].IsDir {
+			continue
+		}
+		hash, err := fileSHA256(sources[i])
+		if err != nil {
+			return nil, nil, fmt.Errorf("计算 %s 的校验值失败: %v", sources[i], err)
+		}
+		entries[i].SHA256 = hash
+		files++
+	}
+	if files == 0 {
+		return nil, nil, fmt.Errorf("没有可发送的文件")
+	}
+	return entries, sources, nil
+}
+
+// 校验清单中的相对路径：不允许绝对路径、盘符、反斜杠和 . / .. 路径段，
+// 每一段按单个文件名清理（返回清理后的本地路径）
+func cleanJobPath(path string) (string, error) {
+	if path == "" || strings.ContainsAny(path, "\\\x00") || strings.HasPrefix(path, "/") || filepath.VolumeName(path) != "" {
+		return "", fmt.Errorf("无效的路径: %q", path)
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		cleaned, err := sanitizeFileName(segment)
+		if err != nil {
+			return "", fmt.Errorf("无效的路径: %q", path)
+		}
+		segments[i] = cleaned
+	}
+	return filepath.Join(segments...), nil
+}
+
+// 确认目录（解析符号链接后）仍位于根目录之内
+func ensureWithinDir(root, dir string) error {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return fmt.Errorf("路径 %s 超出下载目录", dir)
+	}
+	return nil
+}
+
+// 检查收到的任务清单
+func validateJobManifest(request FileTransferRequest) error {
+	if len(request.Manifest) == 0 || len(request.Manifest) > maxJobEntries {
+		return fmt.Errorf("清单为空或文件过多")
+	}
+	seenPaths := make(map[string]bool)
+	seenIDs := make(map[string]bool)
+	var total int64
+	if !validFileID(request.FileID) {
+		return fmt.Errorf("无效的任务ID")
+	}
+	for _, entry := range request.Manifest {
+		rel, err := cleanJobPath(entry.Path)
+		if err != nil {
+			return err
+		}
+		// 清理后的路径不区分大小写重复时会写入同一个文件
+		key := strings.ToLower(filepath.ToSlash(rel))
+		if seenPaths[key] {
+			return fmt.Errorf("路径重复: %s", entry.Path)
+		}
+		seenPaths[key] = true
+		if entry.IsDir {
+			continue
+		}
+		if !validFileID(entry.FileID) || entry.FileID == request.FileID || seenIDs[entry.FileID] || entry.Size < 0 {
+			return fmt.Errorf("清单中的文件 %s 无效", entry.Path)
+		}
+		seenIDs[entry.FileID] = true
+		total += entry.Size
+	}
+	if total != request.FileSize {
+		return fmt.Errorf("清单大小与任务大小不一致")
+	}
+	return nil
+}
+
+// 发送目录或多个文件
+func (node *P2PNode) sendJobRequest(paths []string, targetName string) {
+	// 查找目标用户
+	var targetPeer *Peer
+	node.PeersMutex.RLock()
+	for _, peer := range node.Peers {
+		if peer.Name == targetName {
+			targetPeer = peer
+			break
+		}
+	}
+	node.PeersMutex.RUnlock()
+
+	if targetPeer == nil {
+		fmt.Printf("用户 %s 不在线\n", targetName)
+		return
+	}
+	if !targetPeer.hasCapability(CapabilityFileJobs) {
+		fmt.Printf("%s 的客户端不支持目录或多文件传输\n", targetName)
+		return
+	}
+
+	// 清单包含每个文件的校验值，计算需要较长时间，在后台完成后再发送请求，不阻塞命令行和Web请求
+	go node.offerJob(paths, targetPeer, targetName)
+}
+
+// 生成任务清单并向用户发送传输任务请求
+func (node *P2PNode) offerJob(paths []string, targetPeer *Peer, targetName string) {
+	entries, sources, err := buildJobManifest(paths)
+	if err != nil {
+		fmt.Printf("发送失败: %v\n", err)
+		return
+	}
+
+	jobID := generateFileID()
+	var totalSize int64
+	files := 0
+	firstFile := ""
+	for _, entry := range entries {
+		if !entry.IsDir {
+			totalSize += entry.Size
+			files++
+			if firstFile == "" {
+				firstFile = entry.Path
+			}
+		}
+	}
+	jobName := strings.SplitN(entries[0].Path, "/", 2)[0]
+	if len(paths) > 1 {
+		jobName = fmt.Sprintf("%s 等 %d 个文件", filepath.Base(filepath.FromSlash(firstFile)), files)
+	}
+
+	node.FileTransfersMutex.Lock()
+	job := &FileTransferStatus{
+		FileID:    jobID,
+		FileName:  jobName,
+		FileSize:  totalSize,
+		Status:    "pending",
+		Direction: "send",
+		PeerName:  targetName,
+		PeerID:    targetPeer.ID,
+		StartTime: time.Now(),
+		IsJob:     true,
+		Files:     files,
+		Manifest:  entries,
+	}
+	for i, entry := range entries {
+		if entry.IsDir {
+			continue
+		}
+		job.Children = append(job.Children, entry.FileID)
+		node.FileTransfers[entry.FileID] = &FileTransferStatus{
+			FileID:    entry.FileID,
+			FileName:  entry.Path,
+			FilePath:  sources[i],
+			FileSize:  entry.Size,
+			SHA256:    entry.SHA256,
+			Status:    "pending",
+			Direction: "send",
+			PeerName:  targetName,
+			PeerID:    targetPeer.ID,
+			StartTime: time.Now(),
+
+			TotalChunks:   chunkCount(entry.Size),
+			SourceModTime: entry.ModTime,
+			JobID:         jobID,
+		}
+	}
+	node.FileTransfers[jobID] = job
+	node.FileTransfersMutex.Unlock()
+	node.publishTransfer(jobID, true)
+
+	fmt.Printf("向 %s 发送传输任务: %s (%d 个文件, %s)\n", targetName, jobName, files, formatFileSize(totalSize))
+
+	msg := Message{
+		Type:      "job_request",
+		From:      node.ID,
+		To:        targetPeer.ID,
+		Timestamp: time.Now(),
+		Data: FileTransferRequest{
+			Type:      "job_request",
+			FileID:    jobID,
+			FileName:  jobName,
+			FileSize:  totalSize,
+			Manifest:  entries,
+			From:      node.ID,
+			To:        targetPeer.ID,
+			Timestamp: time.Now(),
+		},
+	}
+	if err := node.sendMessageToPeer(targetPeer, msg); err != nil {
+		fmt.Printf("发送传输任务失败: %v\n", err)
+	}
+}
+
+// 处理传输任务请求
+func (node *P2PNode) handleJobRequest(from string, request FileTransferRequest) {
+	peerName := node.getPeerName(from)
+	err := validateJobManifest(request)
+	if err == nil {
+		request.FileName, err = sanitizeFileName(request.FileName)
+	}
+	if err != nil {
+		fmt.Printf("忽略来自 %s 的无效传输任务: %v\n", peerName, err)
+		return
+	}
+	// 之后只使用清理后的路径
+	manifest := make([]JobEntry, len(request.Manifest))
+	for i, entry := range request.Manifest {
+		rel, _ := cleanJobPath(entry.Path)
+		entry.Path = filepath.ToSlash(rel)
+		manifest[i] = entry
+	}
+	request.Manifest = manifest
+
+	node.FileTransfersMutex.Lock()
+	if _, exists := node.FileTransfers[request.FileID]; exists {
+		node.FileTransfersMutex.Unlock()
+		return
+	}
+	for _, entry := range request.Manifest {
+		if _, exists := node.FileTransfers[entry.FileID]; exists && !entry.IsDir {
+			node.FileTransfersMutex.Unlock()
+			fmt.Printf("忽略来自 %s 的无效传输任务: 文件ID重复\n", peerName)
+			return
+		}
+	}
+	job := &FileTransferStatus{
+		FileID:    request.FileID,
+		FileName:  request.FileName,
+		FileSize:  request.FileSize,
+		Status:    "pending",
+		Direction: "receive",
+		PeerName:  peerName,
+		PeerID:    from,
+		StartTime: time.Now(),
+		IsJob:     true,
+		Manifest:  request.Manifest,
+	}
+	for _, entry := range request.Manifest {
+		if entry.IsDir {
+			continue
+		}
+		job.Files++
+		job.Children = append(job.Children, entry.FileID)
+		node.FileTransfers[entry.FileID] = &FileTransferStatus{
+			FileID:    entry.FileID,
+			FileName:  entry.Path,
+			FileSize:  entry.Size,
+			SHA256:    entry.SHA256,
+			Status:    "pending",
+			Direction: "receive",
+			PeerName:  peerName,
+			PeerID:    from,
+			StartTime: time.Now(),
+
+			SourceModTime: entry.ModTime,
+			JobID:         request.FileID,
+			Mode:          os.FileMode(entry.Mode).Perm(),
+		}
+	}
+	node.FileTransfers[request.FileID] = job
+	snapshot := *job
+	node.FileTransfersMutex.Unlock()
+
+	fmt.Printf("\n收到来自 %s 的传输任务: %s (%d 个文件, %s)\n", peerName, request.FileName, snapshot.Files, formatFileSize(request.FileSize))
+	node.recordTransferChange(request.FileID)
+	// 命中自动接受规则时不再询问用户
+	if node.tryAutoAccept(request.FileID) {
+		return
+	}
+	node.Events.Publish(EventFileRequest, snapshot)
+	if err := checkDiskSpace(node.defaultSaveDir(peerName, request.FileName, true), request.FileSize); err != nil {
+		fmt.Printf("警告: %v\n", err)
+	}
+	fmt.Printf("要接受，请输入: /accept %s\n", request.FileID)
+	fmt.Printf("要拒绝，请输入: /reject %s\n", request.FileID)
+}
+
+// 响应传输任务请求
+func (node *P2PNode) respondToJob(jobID string, accepted bool) error {
+	node.FileTransfersMutex.RLock()
+	job, exists := node.FileTransfers[jobID]
+	if !exists || !job.IsJob || job.Direction != "receive" {
+		node.FileTransfersMutex.RUnlock()
+		return fmt.Errorf("无效的文件传输ID")
+	}
+	peerID := job.PeerID
+	status := job.Status
+	node.FileTransfersMutex.RUnlock()
+
+	if status != "pending" {
+		return fmt.Errorf("该任务已处理（状态: %s）", status)
+	}
+
+	node.PeersMutex.RLock()
+	peer, online := node.Peers[peerID]
+	node.PeersMutex.RUnlock()
+	if !online {
+		return fmt.Errorf("找不到文件发送方")
+	}
+
+	response := FileTransferResponse{
+		Type:      "file_response",
+		FileID:    jobID,
+		Accepted:  accepted,
+		Timestamp: time.Now(),
+	}
+	if accepted {
+		if err := node.prepareJobFiles(jobID); err != nil {
+			return err
+		}
+		response.Message = "传输任务已接受"
+		fmt.Printf("已接受传输任务，准备接收文件...\n")
+	} else {
+		response.Message = "传输任务被拒绝"
+		fmt.Printf("已拒绝传输任务\n")
+		node.recordRejectedTransfer(jobID)
+		node.removeJob(jobID)
+	}
+
+	msg := Message{
+		Type:      "file_response",
+		From:      node.ID,
+		To:        peerID,
+		Timestamp: time.Now(),
+		Data:      response,
+	}
+	return node.sendMessageToPeer(peer, msg)
+}
+
+// 接收方按清单在下载目录下重建目录树，并为每个文件预分配临时文件
+func (node *P2PNode) prepareJobFiles(jobID string) error {
+	node.FileTransfersMutex.RLock()
+	job := node.FileTransfers[jobID]
+	manifest := append([]JobEntry(nil), job.Manifest...)
+	totalSize := job.FileSize
+	downloadDir := job.SaveDir
+	if downloadDir == "" {
+		downloadDir = node.defaultSaveDir(job.PeerName, job.FileName, true)
+	}
+	node.FileTransfersMutex.RUnlock()
+	if err := os.MkdirAll(downloadDir, 0755); err != nil {
+		return fmt.Errorf("创建下载目录失败: %v", err)
+	}
+	if err := checkDiskSpace(downloadDir, totalSize); err != nil {
+		return err
+	}
+	root, err := filepath.EvalSymlinks(downloadDir)
+	if err != nil {
+		return fmt.Errorf("无法访问下载目录: %v", err)
+	}
+
+	// 与下载目录中已有文件或目录同名的顶层条目改用 "名称 (1)"，不合并到已有目录
+	renamed := make(map[string]string)
+	assigned := make(map[string]bool)
+	for i, entry := range manifest {
+		parts := strings.SplitN(entry.Path, "/", 2)
+		top, seen := renamed[parts[0]]
+		if !seen {
+			top, err = uniqueName(downloadDir, parts[0], assigned)
+			if err != nil {
+				return err
+			}
+			renamed[parts[0]] = top
+			assigned[strings.ToLower(top)] = true
+		}
+		parts[0] = top
+		manifest[i].Path = strings.Join(parts, "/")
+	}
+
+	// 先创建目录并确认所有路径都在下载目录之内，再创建文件
+	targets := make([]string, len(manifest))
+	for i, entry := range manifest {
+		rel, err := cleanJobPath(entry.Path)
+		if err != nil {
+			return err
+		}
+		targets[i] = filepath.Join(downloadDir, rel)
+		dir := filepath.Dir(targets[i])
+		if entry.IsDir {
+			dir = targets[i]
+		}
+		// 目录先保证自己可写，全部完成后再设置清单中的权限
+		if err := os.MkdirAll(dir, os.FileMode(entry.Mode).Perm()|0700); err != nil {
+			return fmt.Errorf("创建目录失败: %v", err)
+		}
+		if err := ensureWithinDir(root, dir); err != nil {
+			return err
+		}
+	}
+
+	var created []string
+	cleanup := func() {
+		for _, path := range created {
+			os.Remove(path)
+		}
+	}
+	for i, entry := range manifest {
+		if entry.IsDir {
+			continue
+		}
+		target := targets[i]
+		if entry.Size == 0 {
+			// 空文件无需传输，直接创建
+			file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+			if err != nil {
+				cleanup()
+				return fmt.Errorf("创建文件失败: %v", err)
+			}
+			file.Close()
+			applyFileAttributes(target, os.FileMode(entry.Mode).Perm(), entry.ModTime)
+			continue
+		}
+		// 不跟随已存在的同名链接
+		os.Remove(partFilePath(target))
+		file, err := os.OpenFile(partFilePath(target), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			cleanup()
+			return fmt.Errorf("创建文件失败: %v", err)
+		}
+		created = append(created, partFilePath(target))
+		err = file.Truncate(entry.Size)
+		file.Close()
+		if err != nil {
+			cleanup()
+			return fmt.Errorf("预分配文件失败: %v", err)
+		}
+	}
+
+	node.FileTransfersMutex.Lock()
+	for i, entry := range manifest {
+		if entry.IsDir {
+			continue
+		}
+		child, exists := node.FileTransfers[entry.FileID]
+		if !exists {
+			continue
+		}
+		child.FileName = entry.Path
+		child.FilePath = targets[i]
+		child.TotalChunks = chunkCount(entry.Size)
+		child.ChunkBitmap = make([]byte, (child.TotalChunks+7)/8)
+		if entry.Size == 0 {
+			child.Status = "completed"
+			child.EndTime = time.Now()
+			continue
+		}
+		child.Status = "transferring"
+		child.Resumable = true
+	}
+	job.Manifest = manifest
+	job.FilePath = downloadDir
+	job.Status = "transferring"
+	job.Resumable = true
+	children := append([]string(nil), job.Children...)
+	node.FileTransfersMutex.Unlock()
+
+	node.saveJobStates(jobID, children)
+	node.publishTransfer(jobID, true)
+	return nil
+}
+
+// 保存任务及其未完成文件的续传状态
+func (node *P2PNode) saveJobStates(jobID string, children []string) {
+	if err := node.saveTransferState(jobID); err != nil {
+		fmt.Printf("保存续传状态失败: %v\n", err)
+		return
+	}
+	for _, id := range children {
+		node.FileTransfersMutex.RLock()
+		child, exists := node.FileTransfers[id]
+		done := !exists || child.Status == "completed"
+		node.FileTransfersMutex.RUnlock()
+		if done {
+			continue
+		}
+		if err := node.saveTransferState(id); err != nil {
+			fmt.Printf("保存续传状态失败: %v\n", err)
+			return
+		}
+	}
+}
+
+// 设置接收完成的文件或目录的权限和修改时间
+func applyFileAttributes(path string, mode os.FileMode, modTime time.Time) {
+	if mode != 0 {
+		os.Chmod(path, mode)
+	}
+	if !modTime.IsZero() {
+		os.Chtimes(path, modTime, modTime)
+	}
+}
+
+// 移除任务及其所有文件的记录
+func (node *P2PNode) removeJob(jobID string) {
+	node.FileTransfersMutex.Lock()
+	job, exists := node.FileTransfers[jobID]
+	if !exists {
+		node.FileTransfersMutex.Unlock()
+		return
+	}
+	ids := append([]string{jobID}, job.Children...)
+	for _, id := range ids {
+		delete(node.FileTransfers, id)
+	}
+	node.FileTransfersMutex.Unlock()
+
+	for _, id := range ids {
+		removeTransferState(id)
+		node.Events.Publish(EventTransferRemoved, map[string]string{"fileId": id})
+	}
+}
+
+// 发送方处理任务响应
+func (node *P2PNode) handleJobResponse(response FileTransferResponse) {
+	node.FileTransfersMutex.Lock()
+	job, exists := node.FileTransfers[response.FileID]
+	if !exists || job.Status != "pending" {
+		node.FileTransfersMutex.Unlock()
+		return
+	}
+	if !response.Accepted {
+		node.FileTransfersMutex.Unlock()
+		fmt.Printf("传输任务被拒绝: %s\n", response.Message)
+		node.recordRejectedTransfer(response.FileID)
+		node.removeJob(response.FileID)
+		return
+	}
+	job.Status = "transferring"
+	job.Resumable = true
+	for _, id := range job.Children {
+		if child, exists := node.FileTransfers[id]; exists {
+			child.Resumable = true
+		}
+	}
+	children := append([]string(nil), job.Children...)
+	node.FileTransfersMutex.Unlock()
+
+	fmt.Printf("传输任务已被接受，开始发送: %s\n", job.FileName)
+	node.saveJobStates(response.FileID, children)
+	node.publishTransfer(response.FileID, true)
+	go node.sendJob(response.FileID, children)
+}
+
+// 依次发送任务中的文件；某个文件未能完成时停止，剩余文件由续传继续
+func (node *P2PNode) sendJob(jobID string, children []string) {
+	for _, id := range children {
+		node.FileTransfersMutex.Lock()
+		child, exists := node.FileTransfers[id]
+		if !exists || child.Status != "pending" {
+			node.FileTransfersMutex.Unlock()
+			continue
+		}
+		if child.FileSize == 0 {
+			// 空文件由接收方直接创建
+			child.Status = "completed"
+			child.EndTime = time.Now()
+			node.FileTransfersMutex.Unlock()
+			removeTransferState(id)
+			node.publishTransfer(id, true)
+			continue
+		}
+		child.Status = "transferring"
+		filePath := child.FilePath
+		node.FileTransfersMutex.Unlock()
+		node.publishTransfer(id, true)
+
+		node.sendFile(id, filePath, nil)
+
+		node.FileTransfersMutex.RLock()
+		status := child.Status
+		node.FileTransfersMutex.RUnlock()
+		if status != "completed" && status != "transferring" {
+			return
+		}
+	}
+}
+
+// 续传任务中所有可续传的文件
+func (node *P2PNode) resumeJob(children []string) error {
+	resumed := 0
+	var firstErr error
+	for _, id := range children {
+		node.FileTransfersMutex.RLock()
+		child, exists := node.FileTransfers[id]
+		eligible := exists && child.Resumable && (child.Status == "interrupted" || child.Status == "paused" ||
+			child.Status == "failed" || child.Status == "corrupted")
+		node.FileTransfersMutex.RUnlock()
+		if !eligible {
+			continue
+		}
+		if err := node.requestResume(id); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		resumed++
+	}
+	if resumed == 0 {
+		if firstErr != nil {
+			return firstErr
+		}
+		return fmt.Errorf("该任务没有可续传的文件")
+	}
+	return nil
+}
+
+// 汇总子传输的进度和状态到任务，并按需推送任务的状态
+func (node *P2PNode) refreshJob(jobID string, force bool) {
+	node.FileTransfersMutex.Lock()
+	job, exists := node.FileTransfers[jobID]
+	if !exists || !job.IsJob {
+		node.FileTransfersMutex.Unlock()
+		return
+	}
+	previous := job.Status
+
+	// 重启前已完成的文件没有记录，按已完成计算
+	remaining := int64(0)
+	speed := 0.0
+	rateLimit := int64(0)
+	queued := false
+	var rawBytes, wireBytes int64
+	compression := ""
+	unfinished := 0
+	counts := make(map[string]int)
+	for _, id := range job.Children {
+		child, exists := node.FileTransfers[id]
+		if !exists {
+			continue
+		}
+		counts[child.Status]++
+		rawBytes += child.RawBytes
+		wireBytes += child.WireBytes
+		if child.Compression != "" {
+			compression = child.Compression
+		}
+		if child.Status != "completed" {
+			unfinished++
+			remaining += child.FileSize - child.Progress
+		}
+		if child.Status == "transferring" {
+			speed += child.Speed
+			rateLimit = child.RateLimit
+			queued = queued || child.Queued
+		}
+	}
+	job.Progress = job.FileSize - remaining
+	job.RateLimit = rateLimit
+	job.Queued = queued
+	job.Compression = compression
+	if compression != "" && rawBytes > 0 {
+		job.CompressionRatio = float64(wireBytes) / float64(rawBytes)
+	}
+	job.CompletedFiles = job.Files - unfinished
+	job.Speed = speed
+	if speed > 0 {
+		job.ETA = int64(float64(remaining) / speed)
+	} else {
+		job.ETA = -1
+	}
+
+	if job.Status != "pending" {
+		switch {
+		case unfinished == 0:
+			job.Status = "completed"
+			job.Resumable = false
+		case counts["transferring"] > 0:
+			job.Status = "transferring"
+		case counts["cancelled"] > 0:
+			job.Status = "cancelled"
+			job.Resumable = false
+		case counts["paused"] > 0:
+			job.Status = "paused"
+			job.Resumable = true
+		case counts["interrupted"] > 0:
+			job.Status = "interrupted"
+			job.Resumable = true
+		case counts["corrupted"] > 0:
+			job.Status = "corrupted"
+			job.Resumable = true
+		case counts["failed"] > 0:
+			job.Status = "failed"
+		}
+	}
+	changed := job.Status != previous
+	completed := changed && job.Status == "completed"
+	if completed {
+		job.EndTime = time.Now()
+		if job.Direction == "receive" {
+			job.SavedPath = jobSavedPath(job.FilePath, job.Manifest)
+		}
+	}
+
+	now := time.Now()
+	publish := force || changed || now.Sub(job.LastEventTime) >= transferEventInterval
+	var snapshot FileTransferStatus
+	if publish {
+		job.LastEventTime = now
+		snapshot = *job
+	}
+	node.FileTransfersMutex.Unlock()
+
+	if completed {
+		removeTransferState(jobID)
+		if snapshot.Direction == "receive" {
+			applyJobDirectoryAttributes(snapshot.FilePath, snapshot.Manifest)
+			fmt.Printf("\n传输任务接收完成: %s (%d 个文件)，已保存到 %s\n", snapshot.FileName, snapshot.Files, snapshot.SavedPath)
+		} else {
+			fmt.Printf("传输任务发送完成: %s (%d 个文件)\n", snapshot.FileName, snapshot.Files)
+		}
+	}
+	if changed {
+		node.recordTransferChange(jobID)
+	}
+	if publish {
+		node.Events.Publish(EventTransfer, snapshot)
+	}
+}
+
+// 任务的保存位置：清单只有一个顶层条目时为该目录，否则为保存目录
+func jobSavedPath(downloadDir string, manifest []JobEntry) string {
+	top := ""
+	for _, entry := range manifest {
+		name := strings.SplitN(entry.Path, "/", 2)[0]
+		if top != "" && name != top {
+			return downloadDir
+		}
+		top = name
+	}
+	if top == "" {
+		return downloadDir
+	}
+	return filepath.Join(downloadDir, top)
+}
+
+// 所有文件完成后设置目录的权限和修改时间（由深到浅，写入文件会改变目录的修改时间）
+func applyJobDirectoryAttributes(downloadDir string, manifest []JobEntry) {
+	for i := len(manifest) - 1; i >= 0; i-- {
+		entry := manifest[i]
+		if !entry.IsDir {
+			continue
+		}
+		rel, err := cleanJobPath(entry.Path)
+		if err != nil {
+			continue
+		}
+		applyFileAttributes(filepath.Join(downloadDir, rel), os.FileMode(entry.Mode).Perm(), entry.ModTime)
+	}
+}
+
+// 启动时恢复任务记录，其中的文件由各自的续传状态恢复
+func (node *P2PNode) loadJobState(state TransferResumeState) {
+	job := &FileTransferStatus{
+		FileID:    state.FileID,
+		FileName:  state.FileName,
+		FilePath:  state.FilePath,
+		FileSize:  state.FileSize,
+		Status:    "interrupted",
+		Direction: state.Direction,
+		PeerName:  state.PeerName,
+		PeerID:    state.PeerID,
+		StartTime: state.StartTime,
+		Resumable: true,
+		IsJob:     true,
+		Manifest:  state.Manifest,
+	}
+	for _, entry := range state.Manifest {
+		if !entry.IsDir {
+			job.Files++
+			job.Children = append(job.Children, entry.FileID)
+		}
+	}
+	node.FileTransfersMutex.Lock()
+	node.FileTransfers[state.FileID] = job
+	node.FileTransfersMutex.Unlock()
+}
+
+// 加载续传状态后汇总各任务的进度；文件均已完成的任务直接结束
+func (node *P2PNode) refreshLoadedJobs() {
+	var jobs []string
+	node.FileTransfersMutex.RLock()
+	for id, transfer := range node.FileTransfers {
+		if transfer.IsJob {
+			jobs = append(jobs, id)
+		}
+	}
+	node.FileTransfersMutex.RUnlock()
+
+	for _, id := range jobs {
+		node.refreshJob(id, true)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const knownPeersFile = "known_peers.json"
+
+// 握手签名的域分隔前缀
+const handshakeSignContext = "LANShare-handshake-v1"
+
+// 响应方等待发起方握手确认的最长时间
+const handshakeConfirmTimeout = 10 * time.Second
+
+// KnownPeer结构体 - 首次连接时记录的对端身份（TOFU）
+type KnownPeer struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	IdentityKey []byte    `json:"identityKey"`
+	Fingerprint string    `json:"fingerprint"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+// 身份校验结果
+var (
+	errIdentityDowngrade  = errors.New("已知节点未提供身份签名")
+	errInvalidSignature   = errors.New("握手签名无效")
+	errNodeIDMismatch     = errors.New("节点ID与身份公钥不匹配")
+	errMissingIdentityKey = errors.New("缺少身份公钥")
+	errIdentityChanged    = errors.New("同名用户的身份密钥已变更（严格模式）")
+)
+
+// 握手中的角色，写入签名内容，防止把一方的签名当作另一方的使用
+const (
+	handshakeRoleInitiator = "initiator"
+	handshakeRoleResponder = "responder"
+)
+
+// 计算握手签名内容: 前缀 | 角色 | 节点ID | 发起方临时公钥 | 响应方临时公钥
+// 双方都对包含两个临时公钥的完整握手记录签名
+func handshakeTranscript(role string, nodeID string, initiatorPub []byte, responderPub []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(handshakeSignContext)
+	buf.WriteByte(0)
+	buf.WriteString(role)
+	buf.WriteByte(0)
+	buf.WriteString(nodeID)
+	buf.WriteByte(0)
+	buf.Write(initiatorPub)
+	buf.Write(responderPub)
+	return buf.Bytes()
+}
+
+// 构造握手消息
+// 发起方此时还不知道响应方的临时公钥，只携带身份公钥，签名在 handshake_confirm 中发送；
+// 响应方对完整的握手记录签名
+func (node *P2PNode) buildHandshake(msgType string, ephemeralPub [32]byte, peerEphemeralPub []byte, version int) Message {
+	msg := Message{
+		Type:            msgType,
+		From:            node.ID,
+		Content:         node.Name,
+		Timestamp:       time.Now(),
+		SenderPubKey:    ephemeralPub[:],
+		ProtocolVersion: version,
+		Capabilities:    localCapabilities,
+		IdentityKey:     node.Identity.PublicKey,
+	}
+	if msgType == "handshake_response" {
+		transcript := handshakeTranscript(handshakeRoleResponder, node.ID, peerEphemeralPub, ephemeralPub[:])
+		msg.Signature = ed25519.Sign(node.Identity.PrivateKey, transcript)
+	}
+	return msg
+}
+
+// 构造发起方的握手确认：收到响应后对完整的握手记录签名
+func (node *P2PNode) buildHandshakeConfirm(ephemeralPub [32]byte, peerEphemeralPub []byte) Message {
+	transcript := handshakeTranscript(handshakeRoleInitiator, node.ID, ephemeralPub[:], peerEphemeralPub)
+	return Message{
+		Type:      "handshake_confirm",
+		From:      node.ID,
+		Timestamp: time.Now(),
+		Signature: ed25519.Sign(node.Identity.PrivateKey, transcript),
+	}
+}
+
+// 校验握手消息中的身份公钥与节点ID一致
+func checkHandshakeIdentity(msg Message) error {
+	if len(msg.IdentityKey) != ed25519.PublicKeySize {
+		return errMissingIdentityKey
+	}
+	if deriveNodeID(msg.IdentityKey) != msg.From {
+		return errNodeIDMismatch
+	}
+	return nil
+}
+
+// 校验握手消息的身份签名
+func verifyHandshakeSignature(msg Message, transcript []byte) error {
+	if err := checkHandshakeIdentity(msg); err != nil {
+		return err
+	}
+	if !ed25519.Verify(msg.IdentityKey, transcript, msg.Signature) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+// 查找同名但身份不同的已记录节点（执行 /trust 后旧记录被删除）
+func (node *P2PNode) sameNamePin(name string, id string) *KnownPeer {
+	node.KnownPeersMutex.RLock()
+	defer node.KnownPeersMutex.RUnlock()
+	for _, kp := range node.KnownPeers {
+		if kp.Name == name && kp.ID != id {
+			copied := *kp
+			return &copied
+		}
+	}
+	return nil
+}
+
+// 显示身份变更警告
+func printIdentityWarning(name string, previous *KnownPeer, fingerprint string, strict bool) {
+	fmt.Println("\n###########################################")
+	fmt.Printf("⚠ 警告: 用户 %s 的身份密钥已变更！\n", name)
+	fmt.Printf("  原指纹: %s\n", previous.Fingerprint)
+	fmt.Printf("  新指纹: %s\n", fingerprint)
+	if strict {
+		fmt.Println("  严格模式已拒绝该连接。与对方确认密钥确实更换后，可使用 /strict off 关闭严格模式，")
+		fmt.Printf("  待对方重新连接后用 /verify %s 核对安全码并 /trust %s\n", name, name)
+	} else {
+		fmt.Printf("  请使用 /verify %s 与对方当面核对安全码，确认无误后使用 /trust %s\n", name, name)
+	}
+	fmt.Println("###########################################")
+}
+
+// 认证对端身份并更新已知节点记录
+// 返回错误表示必须拒绝连接；身份变更（同名不同密钥）时默认仅标记警告，每次连接都会检查，
+// 直到用户执行 /trust 删除旧记录；严格模式下直接拒绝连接
+func (node *P2PNode) authenticatePeer(peer *Peer, msg Message, transcript []byte) error {
+	if len(msg.IdentityKey) == 0 && len(msg.Signature) == 0 {
+		// 旧版节点：无法认证，但已记录过身份的节点不允许降级
+		node.KnownPeersMutex.RLock()
+		_, pinned := node.KnownPeers[msg.From]
+		node.KnownPeersMutex.RUnlock()
+		if pinned {
+			return errIdentityDowngrade
+		}
+		peer.Authenticated = false
+		// 使用已记录用户的名字却不提供签名，按身份变更处理
+		if previous := node.sameNamePin(msg.Content, msg.From); previous != nil {
+			printIdentityWarning(msg.Content, previous, "无（未提供身份签名）", node.StrictIdentity)
+			if node.StrictIdentity {
+				return errIdentityChanged
+			}
+			peer.IdentityChanged = true
+			return nil
+		}
+		fmt.Printf("⚠ 警告: 节点 %s 未提供身份签名（旧版客户端），连接未经认证\n", msg.Content)
+		return nil
+	}
+
+	// 签名校验保证节点ID由身份公钥派生，同一ID的记录不会出现不同的指纹
+	if err := verifyHandshakeSignature(msg, transcript); err != nil {
+		return err
+	}
+
+	fingerprint := formatFingerprint(msg.IdentityKey)
+
+	// 同名但不同身份：可能是重装后的新密钥，也可能是冒充
+	previous := node.sameNamePin(msg.Content, msg.From)
+	if previous != nil && node.StrictIdentity {
+		// 严格模式下不记录新身份，连接被拒绝
+		printIdentityWarning(msg.Content, previous, fingerprint, true)
+		return errIdentityChanged
+	}
+
+	node.KnownPeersMutex.Lock()
+	known, exists := node.KnownPeers[msg.From]
+	now := time.Now()
+	if exists {
+		known.Name = msg.Content
+		known.LastSeen = now
+	} else {
+		node.KnownPeers[msg.From] = &KnownPeer{
+			ID:          msg.From,
+			Name:        msg.Content,
+			IdentityKey: msg.IdentityKey,
+			Fingerprint: fingerprint,
+			FirstSeen:   now,
+			LastSeen:    now,
+		}
+	}
+	node.KnownPeersMutex.Unlock()
+
+	if err := node.saveKnownPeers(); err != nil {
+		fmt.Printf("保存已知节点失败: %v\n", err)
+	}
+
+	peer.Authenticated = true
+	peer.IdentityKey = msg.IdentityKey
+	peer.IdentityChanged = previous != nil
+
+	if previous != nil {
+		printIdentityWarning(msg.Content, previous, fingerprint, false)
+	} else if !exists {
+		fmt.Printf("首次连接 %s，已记录身份指纹: %s\n", msg.Content, fingerprint)
+	}
+	return nil
+}
+
+// 信任对端当前身份：清除同名旧记录与变更警告
+func (node *P2PNode) trustPeer(peer *Peer) {
+	node.KnownPeersMutex.Lock()
+	for id, kp := range node.KnownPeers {
+		if kp.Name == peer.Name && id != peer.ID {
+			delete(node.KnownPeers, id)
+		}
+	}
+	node.KnownPeersMutex.Unlock()
+
+	peer.IdentityChanged = false
+	if err := node.saveKnownPeers(); err != nil {
+		fmt.Printf("保存已知节点失败: %v\n", err)
+	}
+}
+
+// 加载已知节点
+func (node *P2PNode) loadKnownPeers() {
+	data, err := os.ReadFile(knownPeersFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("读取已知节点失败: %v\n", err)
+		}
+		return
+	}
+
+	var peers []*KnownPeer
+	if err := json.Unmarshal(data, &peers); err != nil {
+		fmt.Printf("解析已知节点失败: %v\n", err)
+		return
+	}
+
+	node.KnownPeersMutex.Lock()
+	for _, kp := range peers {
+		node.KnownPeers[kp.ID] = kp
+	}
+	node.KnownPeersMutex.Unlock()
+}
+
+// 保存已知节点
+func (node *P2PNode) saveKnownPeers() error {
+	node.KnownPeersMutex.RLock()
+	peers := make([]*KnownPeer, 0, len(node.KnownPeers))
+	for _, kp := range node.KnownPeers {
+		peers = append(peers, kp)
+	}
+	data, err := json.MarshalIndent(peers, "", "  ")
+	node.KnownPeersMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(knownPeersFile, data, 0600)
+}
+
+// 计算双方可口头核对的安全码（与双方顺序无关）
+func computeSafetyCode(keyA, keyB []byte) string {
+	first, second := keyA, keyB
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+	h := sha256.New()
+	h.Write([]byte("LANShare-safety-code"))
+	h.Write(first)
+	h.Write(second)
+	sum := h.Sum(nil)
+
+	groups := make([]string, 0, 6)
+	for i := 0; i < 6; i++ {
+		value := binary.BigEndian.Uint32(sum[i*4:]) % 100000
+		groups = append(groups, fmt.Sprintf("%05d", value))
+	}
+	return strings.Join(groups, " ")
+}
+
+// 显示与指定用户的安全码
+func (node *P2PNode) showSafetyCode(targetName string) {
+	var target *Peer
+	node.PeersMutex.RLock()
+	for _, peer := range node.Peers {
+		if peer.Name == targetName && peer.IsActive {
+			target = peer
+			break
+		}
+	}
+	node.PeersMutex.RUnlock()
+
+	if target == nil {
+		fmt.Printf("错误: 用户 '%s' 不在线或不存在\n", targetName)
+		return
+	}
+	if !target.Authenticated {
+		fmt.Printf("用户 %s 使用旧版客户端，未提供身份密钥，无法验证\n", targetName)
+		return
+	}
+
+	fmt.Printf("与 %s 的安全码:\n", targetName)
+	fmt.Printf("  %s\n", computeSafetyCode(node.Identity.PublicKey, target.IdentityKey))
+	fmt.Printf("对方指纹: %s\n", formatFingerprint(target.IdentityKey))
+	fmt.Println("请与对方当面或电话核对，双方看到的安全码应完全一致")
+	if target.IdentityChanged {
+		fmt.Printf("⚠ 该用户身份密钥已变更，核对无误后可使用 /trust %s\n", targetName)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 创建只用于签名握手的远端节点
+func newRemoteIdentity(t *testing.T, name string) *P2PNode {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &P2PNode{
+		ID:       deriveNodeID(publicKey),
+		Name:     name,
+		Identity: &NodeIdentity{PrivateKey: privateKey, PublicKey: publicKey},
+	}
+}
+
+func randomKey(t *testing.T) [32]byte {
+	t.Helper()
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// 记录一个同名的旧身份
+func pinOldIdentity(t *testing.T, node *P2PNode, name string) *P2PNode {
+	t.Helper()
+	old := newRemoteIdentity(t, name)
+	node.KnownPeers[old.ID] = &KnownPeer{
+		ID:          old.ID,
+		Name:        name,
+		IdentityKey: old.Identity.PublicKey,
+		Fingerprint: formatFingerprint(old.Identity.PublicKey),
+	}
+	return old
+}
+
+func TestHandshakeSignatureCoversBothEphemeralKeys(t *testing.T) {
+	initiator := newRemoteIdentity(t, "initiator")
+	responder := newRemoteIdentity(t, "responder")
+	initiatorPub, responderPub, otherPub := randomKey(t), randomKey(t), randomKey(t)
+
+	// 发起方的握手消息只携带身份公钥，签名在确认消息中
+	hello := initiator.buildHandshake("handshake", initiatorPub, nil, ProtocolVersionCurrent)
+	if len(hello.Signature) != 0 || len(hello.IdentityKey) == 0 {
+		t.Fatalf("发起方握手: 签名 %d 字节, 身份公钥 %d 字节", len(hello.Signature), len(hello.IdentityKey))
+	}
+
+	response := responder.buildHandshake("handshake_response", responderPub, initiatorPub[:], ProtocolVersionCurrent)
+	confirm := hello
+	confirm.Signature = initiator.buildHandshakeConfirm(initiatorPub, responderPub[:]).Signature
+
+	tests := []struct {
+		name       string
+		msg        Message
+		transcript []byte
+		wantErr    error
+	}{
+		{"响应方签名", response,
+			handshakeTranscript(handshakeRoleResponder, responder.ID, initiatorPub[:], responderPub[:]), nil},
+		{"响应方签名-发起方临时公钥被替换", response,
+			handshakeTranscript(handshakeRoleResponder, responder.ID, otherPub[:], responderPub[:]), errInvalidSignature},
+		{"响应方签名-响应方临时公钥被替换", response,
+			handshakeTranscript(handshakeRoleResponder, responder.ID, initiatorPub[:], otherPub[:]), errInvalidSignature},
+		{"发起方确认", confirm,
+			handshakeTranscript(handshakeRoleInitiator, initiator.ID, initiatorPub[:], responderPub[:]), nil},
+		{"发起方确认-发起方临时公钥被替换", confirm,
+			handshakeTranscript(handshakeRoleInitiator, initiator.ID, otherPub[:], responderPub[:]), errInvalidSignature},
+		{"发起方确认-响应方临时公钥被替换", confirm,
+			handshakeTranscript(handshakeRoleInitiator, initiator.ID, initiatorPub[:], otherPub[:]), errInvalidSignature},
+		{"角色互换", confirm,
+			handshakeTranscript(handshakeRoleResponder, initiator.ID, initiatorPub[:], responderPub[:]), errInvalidSignature},
+		{"缺少签名", hello,
+			handshakeTranscript(handshakeRoleInitiator, initiator.ID, initiatorPub[:], responderPub[:]), errInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyHandshakeSignature(tt.msg, tt.transcript); !errors.Is(err, tt.wantErr) {
+				t.Errorf("verifyHandshakeSignature 返回 %v, 期望 %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthenticatePeerIdentityChanged(t *testing.T) {
+	tests := []struct {
+		name        string
+		strict      bool
+		wantErr     error
+		wantChanged bool
+		wantPinned  bool
+	}{
+		{"默认仅警告", false, nil, true, true},
+		{"严格模式拒绝连接", true, errIdentityChanged, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := newTestNode(t, "local")
+			node.StrictIdentity = tt.strict
+			pinOldIdentity(t, node, "alice")
+
+			remote := newRemoteIdentity(t, "alice")
+			initiatorPub, responderPub := randomKey(t), randomKey(t)
+			msg := remote.buildHandshake("handshake_response", responderPub, initiatorPub[:], ProtocolVersionCurrent)
+			transcript := handshakeTranscript(handshakeRoleResponder, remote.ID, initiatorPub[:], responderPub[:])
+
+			peer := &Peer{}
+			err := node.authenticatePeer(peer, msg, transcript)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("authenticatePeer 返回 %v, 期望 %v", err, tt.wantErr)
+			}
+			if peer.IdentityChanged != tt.wantChanged {
+				t.Errorf("IdentityChanged = %v, 期望 %v", peer.IdentityChanged, tt.wantChanged)
+			}
+			// 被拒绝的新身份不应写入已知节点
+			if _, pinned := node.KnownPeers[remote.ID]; pinned != tt.wantPinned {
+				t.Errorf("新身份已记录 = %v, 期望 %v", pinned, tt.wantPinned)
+			}
+		})
+	}
+}
+
+func TestAuthenticateLegacyPeerUsingPinnedName(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		node := newTestNode(t, "local")
+		node.StrictIdentity = strict
+		pinOldIdentity(t, node, "alice")
+
+		// 旧版客户端不提供身份签名，却使用了已记录的用户名
+		msg := Message{Type: "handshake", From: "legacy-id", Content: "alice"}
+		peer := &Peer{}
+		err := node.authenticatePeer(peer, msg, nil)
+		if strict {
+			if !errors.Is(err, errIdentityChanged) {
+				t.Errorf("严格模式下 authenticatePeer 返回 %v, 期望 errIdentityChanged", err)
+			}
+			continue
+		}
+		if err != nil || !peer.IdentityChanged || peer.Authenticated {
+			t.Errorf("authenticatePeer = %v, IdentityChanged=%v Authenticated=%v, 期望仅标记身份变更",
+				err, peer.IdentityChanged, peer.Authenticated)
+		}
+	}
+}
+
+func TestIdentityChangedBlocksAutoAccept(t *testing.T) {
+	for _, changed := range []bool{true, false} {
+		node := newTestNode(t, "local")
+
+		local, remote := net.Pipe()
+		defer local.Close()
+		defer remote.Close()
+		go io.Copy(io.Discard, remote)
+
+		node.Peers["alice-id"] = &Peer{
+			ID:              "alice-id",
+			Name:            "alice",
+			Conn:            local,
+			IsActive:        true,
+			ProtocolVersion: ProtocolVersionLegacy,
+			SharedKey:       make([]byte, 32),
+			Authenticated:   true,
+			IdentityChanged: changed,
+		}
+		node.AutoAcceptRules = []*AutoAcceptRule{{ID: 1, PeerID: "alice-id", PeerName: "alice"}}
+
+		node.handleFileTransferRequest(FileTransferRequest{
+			Type:      "file_request",
+			FileID:    "autoaccept01",
+			FileName:  "a.txt",
+			FileSize:  10,
+			From:      "alice-id",
+			Timestamp: time.Now(),
+		})
+
+		node.FileTransfersMutex.RLock()
+		status := node.FileTransfers["autoaccept01"].Status
+		node.FileTransfersMutex.RUnlock()
+
+		want := "transferring"
+		if changed {
+			want = "pending"
+		}
+		if status != want {
+			t.Errorf("身份变更=%v 时请求状态 = %s, 期望 %s", changed, status, want)
+		}
+	}
+}
@@ -29,7 +29,13 @@ func NewP2PNode(name string, webEnabled bool, localIP string) *P2PNode {
 	if localIP == "" {
 		localIP = getLocalIP()
 	}
-	nodeID := fmt.Sprintf("%s_%d", localIP, time.Now().Unix())
+	// 加载长期身份，节点ID由公钥派生
+	identity, err := loadOrCreateIdentity(identityKeyFile)
+	if err != nil {
+		fmt.Printf("加载身份密钥失败: %v\n", err)
+		os.Exit(1)
+	}
+	nodeID := identity.NodeID()
 	address := fmt.Sprintf("%s:%d", localIP, 8888)
 	
 	node := &P2PNode{
@@ -38,6 +44,7 @@ func NewP2PNode(name string, webEnabled bool, localIP string) *P2PNode {
 		Name:          name,
 		ID:            nodeID,
 		Address:       address,
+		Identity:      identity,
 		Peers:         make(map[string]*Peer),
 		MessageChan:   make(chan Message, 100),
 		Running:       false,
@@ -46,9 +53,17 @@ func NewP2PNode(name string, webEnabled bool, localIP string) *P2PNode {
 		Messages:      make([]ChatMessage, 0),
 		WebEnabled:    webEnabled,
 		FileTransfers: make(map[string]*FileTransferStatus),
+		DataChannels:  make(map[string]*pendingDataChannel),
 		ACLs:          make(map[string]map[string]bool),
 		ACLMutex:      sync.RWMutex{},
+		KnownPeers:    make(map[string]*KnownPeer),
+		Events:        newEventBus(),
 	}
+	node.loadKnownPeers()
+	node.loadAutoAcceptRules()
+	node.loadDownloadConfig()
+	node.loadRateLimits()
+	node.loadTransferStates()
 
 	// 初始化数据库
 	db, err := sql.Open("sqlite3", "message.db")
@@ -59,34 +74,9 @@ func NewP2PNode(name string, webEnabled bool, localIP string) *P2PNode {
 	}
 	node.DB = db
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS messages (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-			sender TEXT NOT NULL,
-			recipient TEXT,
-			content BLOB NOT NULL,
-			nonce BLOB,
-			is_private BOOLEAN DEFAULT FALSE,
-			is_own BOOLEAN DEFAULT FALSE,
-			message_type TEXT DEFAULT 'text',
-			message_id TEXT,
-			reply_to_id TEXT,
-			reply_to_content TEXT,
-			reply_to_sender TEXT,
-			file_name TEXT,
-			file_size INTEGER DEFAULT 0,
-			file_type TEXT,
-			file_url TEXT,
-			file_data TEXT
-		);
-		CREATE INDEX IF NOT EXISTS idx_timestamp ON messages(timestamp DESC);
-		CREATE INDEX IF NOT EXISTS idx_chat ON messages(recipient, is_private);
-		CREATE INDEX IF NOT EXISTS idx_message_type ON messages(message_type);
-		CREATE INDEX IF NOT EXISTS idx_message_id ON messages(message_id);
-	`)
-	if err != nil {
-		fmt.Printf("创建数据库表失败: %v\n", err)
+	// 执行数据库迁移，旧数据库会逐步升级到当前版本
+	if _, err := migrateSchema(db); err != nil {
+		fmt.Printf("数据库迁移失败: %v，本次运行不保存历史记录\n", err)
 		db.Close()
 		node.DB = nil
 		return node
@@ -97,9 +87,35 @@ func NewP2PNode(name string, webEnabled bool, localIP string) *P2PNode {
 	if err != nil {
 		fmt.Printf("清理旧消息失败: %v\n", err)
 	}
+	_, err = db.Exec("DELETE FROM message_tokens WHERE message_rowid NOT IN (SELECT id FROM messages)")
+	if err != nil {
+		fmt.Printf("清理搜索索引失败: %v\n", err)
+	}
+
+	// 加载数据库密钥（口令或密钥文件）
+	if err := node.initDBKey(); err != nil {
+		fmt.Printf("加载数据库密钥失败: %v，本次运行不保存历史记录\n", err)
+		db.Close()
+		node.DB = nil
+		return node
+	}
+
+	// 索引格式变化或旧数据库首次启用搜索时重建索引
+	if version, _ := getSetting(db, settingSearchIndex); version != searchIndexVersion {
+		if err := node.rebuildSearchIndex(); err != nil {
+			fmt.Printf("建立搜索索引失败: %v\n", err)
+		}
+	}
+
+	// 升级前以明文保存的传输历史
+	if err := node.encryptPlainTransferHistory(); err != nil {
+		fmt.Printf("加密传输历史失败: %v\n", err)
+	}
 
 	// Now load history with proper key
 	node.loadHistoryFromDB()
+	// 启动前中断的传输已从续传状态恢复，同步到传输历史
+	node.reconcileTransferHistory()
 
 	// 设置 WAL 模式以提高并发
 	_, err = db.Exec("PRAGMA journal_mode=WAL;")
@@ -114,56 +130,38 @@ func NewP2PNode(name string, webEnabled bool, localIP string) *P2PNode {
 	return node
 }
 
-// ACL 方法实现
-func (node *P2PNode) isBlocked(targetAddress string) bool {
+// ACL 方法实现（以节点ID为键，不受IP变化影响）
+func (node *P2PNode) isBlocked(peerID string) bool {
 	node.ACLMutex.RLock()
 	defer node.ACLMutex.RUnlock()
-	if acl, exists := node.ACLs[node.Address]; exists {
-		if val, ok := acl[targetAddress]; ok {
+	if acl, exists := node.ACLs[node.ID]; exists {
+		if val, ok := acl[peerID]; ok {
 			return !val
 		}
 	}
 	return false
 }
 
-func (node *P2PNode) blockUser(targetAddress string) {
+func (node *P2PNode) blockUser(peerID string) {
 	node.ACLMutex.Lock()
 	defer node.ACLMutex.Unlock()
-	if node.ACLs[node.Address] == nil {
-		node.ACLs[node.Address] = make(map[string]bool)
+	if node.ACLs[node.ID] == nil {
+		node.ACLs[node.ID] = make(map[string]bool)
 	}
-	node.ACLs[node.Address][targetAddress] = false
-	// 查找用户名显示
-	displayName := targetAddress
-	node.PeersMutex.RLock()
-	for _, peer := range node.Peers {
-		if peer.Address == targetAddress {
-			displayName = peer.Name
-			break
-		}
-	}
-	node.PeersMutex.RUnlock()
-	fmt.Printf("已屏蔽用户 %s (%s)\n", displayName, targetAddress)
+	node.ACLs[node.ID][peerID] = false
+	fmt.Printf("已屏蔽用户 %s (%s)\n", node.getPeerName(peerID), peerID)
+	node.Events.Publish(EventACL, nil)
 }
 
-func (node *P2PNode) unblockUser(targetAddress string) {
+func (node *P2PNode) unblockUser(peerID string) {
 	node.ACLMutex.Lock()
 	defer node.ACLMutex.Unlock()
-	if node.ACLs[node.Address] == nil {
-		node.ACLs[node.Address] = make(map[string]bool)
-	}
-	node.ACLs[node.Address][targetAddress] = true
-	// 查找用户名显示
-	displayName := targetAddress
-	node.PeersMutex.RLock()
-	for _, peer := range node.Peers {
-		if peer.Address == targetAddress {
-			displayName = peer.Name
-			break
-		}
+	if node.ACLs[node.ID] == nil {
+		node.ACLs[node.ID] = make(map[string]bool)
 	}
-	node.PeersMutex.RUnlock()
-	fmt.Printf("已解除屏蔽用户 %s (%s)\n", displayName, targetAddress)
+	node.ACLs[node.ID][peerID] = true
+	fmt.Printf("已解除屏蔽用户 %s (%s)\n", node.getPeerName(peerID), peerID)
+	node.Events.Publish(EventACL, nil)
 }
 
 func (node *P2PNode) showACL() {
@@ -171,21 +169,11 @@ func (node *P2PNode) showACL() {
 	defer node.ACLMutex.RUnlock()
 	
 	fmt.Println("屏蔽列表:")
-	if acl, exists := node.ACLs[node.Address]; exists {
+	if acl, exists := node.ACLs[node.ID]; exists {
 		blocked := 0
-		for addr, allowed := range acl {
+		for peerID, allowed := range acl {
 			if !allowed {
-				// 查找用户名
-				displayName := addr
-				node.PeersMutex.RLock()
-				for _, peer := range node.Peers {
-					if peer.Address == addr {
-						displayName = peer.Name
-						break
-					}
-				}
-				node.PeersMutex.RUnlock()
-				fmt.Printf(" - %s (%s)\n", displayName, addr)
+				fmt.Printf(" - %s (%s)\n", node.getPeerName(peerID), peerID)
 				blocked++
 			}
 		}
@@ -197,6 +185,31 @@ func (node *P2PNode) showACL() {
 	}
 }
 
+// 根据用户名解析节点ID：优先查找已连接的节点，其次查找历史记录
+func (node *P2PNode) resolvePeerID(name string) string {
+	node.PeersMutex.RLock()
+	for id, peer := range node.Peers {
+		if peer.Name == name {
+			node.PeersMutex.RUnlock()
+			return id
+		}
+	}
+	node.PeersMutex.RUnlock()
+
+	if node.DB != nil {
+		var peerID string
+		err := node.DB.QueryRow(`
+			SELECT sender_id FROM messages
+			WHERE sender = ? AND is_own = FALSE AND sender_id IS NOT NULL
+			ORDER BY timestamp DESC LIMIT 1
+		`, name).Scan(&peerID)
+		if err == nil {
+			return peerID
+		}
+	}
+	return ""
+}
+
 // 启动P2P节点
 func (node *P2PNode) Start() error {
 	// 启动TCP监听器
@@ -209,6 +222,7 @@ func (node *P2PNode) Start() error {
 
 	fmt.Printf("P2P节点启动成功: %s:%d\n", node.LocalIP, node.LocalPort)
 	fmt.Printf("节点ID: %s\n", node.ID)
+	fmt.Printf("身份指纹: %s\n", node.Identity.Fingerprint())
 	fmt.Printf("用户名: %s\n", node.Name)
 
 	// 启动Web GUI
@@ -239,10 +253,22 @@ func (node *P2PNode) showCommandHelp() {
 	fmt.Println("命令说明:")
 	fmt.Println("  直接输入消息 - 公聊")
 	fmt.Println("  /to <用户名> <消息> - 私聊")
-	fmt.Println("  /send <用户名> <文件路径> - 发送文件")
-	fmt.Println("  /accept <文件ID> - 接受文件")
+	fmt.Println("  /send <用户名> <路径> [路径...] - 发送文件、目录或多个文件")
+	fmt.Println("  /sendall <文件路径> - 把文件发给所有在线用户")
+	fmt.Println("  /accept <文件ID> [保存位置] - 接受文件，可指定保存目录或文件路径")
 	fmt.Println("  /reject <文件ID> - 拒绝文件")
 	fmt.Println("  /transfers - 查看文件传输列表")
+	fmt.Println("  /transfers --all [peer:用户] [status:状态] [dir:send|receive] [after:日期] [before:日期] [limit:条数] [文件名] - 查看传输历史")
+	fmt.Println("  /pause <文件ID> - 暂停文件传输")
+	fmt.Println("  /resume <文件ID> - 继续已暂停或已中断的文件传输")
+	fmt.Println("  /cancel <文件ID> - 取消文件传输并删除未完成的文件")
+	fmt.Println("  /autoaccept [list] - 查看自动接受规则")
+	fmt.Println("  /autoaccept add <用户名> [ext=.zip,.log] [max=500MB] [minfree=10GB] [dir=目录] - 自动接受该用户的文件")
+	fmt.Println("  /autoaccept remove <编号> - 删除自动接受规则")
+	fmt.Println("  /downloads [dir <目录>] [images <目录>] [subfolder none|peer|type] - 查看或修改下载目录")
+	fmt.Println("  /limit [up <速度>] [down <速度>] [max <数量>] - 查看或修改全局限速和同时发送数")
+	fmt.Println("  /limit peer <用户名> [up <速度>] [down <速度>]|off - 为单个用户限速")
+	fmt.Println("  /priority <文件ID> high|normal|low - 调整发送的优先级")
 	fmt.Println("  /list - 查看在线用户")
 	fmt.Println("  /name <新名称> - 更改用户名")
 	fmt.Println("  /web [端口] - 打开Web界面 (默认8080)")
@@ -251,7 +277,14 @@ func (node *P2PNode) showCommandHelp() {
 	fmt.Println("  /block <用户名> - 屏蔽用户")
 	fmt.Println("  /unblock <用户名> - 解除屏蔽")
 	fmt.Println("  /acl - 查看屏蔽列表")
+	fmt.Println("  /verify <用户名> - 显示与对方核对的安全码")
+	fmt.Println("  /trust <用户名> - 信任对方变更后的身份密钥")
+	fmt.Println("  /strict [on|off] - 查看或切换严格模式（身份密钥变更时拒绝连接）")
+	fmt.Println("  /diag - 查看连接诊断（会话密钥、被拒绝的重放帧等）")
 	fmt.Println("  /history [用户名] [数量] - 查看历史消息 (默认20条)")
+	fmt.Println("  /search [from:用户] [in:会话] [type:类型] [after:日期] [before:日期] <关键词> - 搜索历史消息")
+	fmt.Println("  /context <#编号> [条数] - 查看搜索结果的上下文")
+	fmt.Println("  /dbpasswd [-keyfile] - 更换历史记录密钥（口令或密钥文件）并重新加密")
 	fmt.Println("  /help - 显示帮助信息")
 	fmt.Println("  /quit - 退出程序")
 	fmt.Println("===========================================")
@@ -291,7 +324,7 @@ func (node *P2PNode) startCLI() {
 				Timestamp: time.Now(),
 			}
 			node.broadcastMessage(msg)
-			node.addChatMessage("我", "all", text, true, false)
+			node.addChatMessage("我", "all", "all", text, true, false)
 		}
 	}
 
@@ -316,12 +349,11 @@ func (node *P2PNode) handleCommand(command string) {
 		message := strings.Join(parts[2:], " ")
 		
 		// 查找目标用户
-		var targetID, targetAddress string
+		var targetID string
 		node.PeersMutex.RLock()
 		for id, peer := range node.Peers {
 			if peer.Name == targetName && peer.IsActive {
 				targetID = id
-				targetAddress = peer.Address
 				break
 			}
 		}
@@ -333,7 +365,7 @@ func (node *P2PNode) handleCommand(command string) {
 			return
 		}
 
-		if node.isBlocked(targetAddress) {
+		if node.isBlocked(targetID) {
 			fmt.Printf("错误: 用户 '%s' 被屏蔽，无法发送私聊\n", targetName)
 			fmt.Println("提示: 使用 /unblock 命令解除屏蔽")
 			return
@@ -349,7 +381,7 @@ func (node *P2PNode) handleCommand(command string) {
 		
 		if peer, exists := node.Peers[targetID]; exists {
 			node.sendMessageToPeer(peer, msg)
-			node.addChatMessage(node.Name, targetName, message, true, true)
+			node.addChatMessage(node.Name, targetName, targetID, message, true, true)
 		}
 		
 	case "/list":
@@ -359,11 +391,16 @@ func (node *P2PNode) handleCommand(command string) {
 		node.PeersMutex.RLock()
 		for _, peer := range node.Peers {
 			if peer.IsActive {
-				blocked := node.isBlocked(peer.Address)
+				blocked := node.isBlocked(peer.ID)
 				status := ""
 				if blocked {
 					status = " (屏蔽)"
 				}
+				if peer.IdentityChanged {
+					status += " (⚠ 身份变更)"
+				} else if !peer.Authenticated {
+					status += " (未验证)"
+				}
 				fmt.Printf("  %s%s (%s)\n", peer.Name, status, peer.Address)
 			}
 		}
@@ -377,6 +414,11 @@ func (node *P2PNode) handleCommand(command string) {
 		oldName := node.Name
 		node.Name = parts[1]
 		fmt.Printf("用户名已从 %s 更改为 %s\n", oldName, node.Name)
+		node.Events.Publish(EventPeerRenamed, map[string]string{
+			"id":      node.ID,
+			"oldName": oldName,
+			"name":    node.Name,
+		})
 
 		// 广播名称更新消息
 		updateMsg := Message{
@@ -418,22 +460,22 @@ func (node *P2PNode) handleCommand(command string) {
 			return
 		}
 		targetName := parts[1]
-		// 查找目标地址
-		var targetAddress string
+		// 查找目标节点ID
+		var targetID string
 		node.PeersMutex.RLock()
-		for _, peer := range node.Peers {
+		for id, peer := range node.Peers {
 			if peer.Name == targetName && peer.IsActive {
-				targetAddress = peer.Address
+				targetID = id
 				break
 			}
 		}
 		node.PeersMutex.RUnlock()
 		
-		if targetAddress == "" {
+		if targetID == "" {
 			fmt.Printf("用户 %s 不在线，无法屏蔽\n", targetName)
 			return
 		}
-		node.blockUser(targetAddress)
+		node.blockUser(targetID)
 		
 	case "/unblock":
 		if len(parts) < 2 {
@@ -441,43 +483,145 @@ func (node *P2PNode) handleCommand(command string) {
 			return
 		}
 		targetName := parts[1]
-		// 查找目标地址
-		var targetAddress string
+		// 查找目标节点ID
+		var targetID string
 		node.PeersMutex.RLock()
-		for _, peer := range node.Peers {
+		for id, peer := range node.Peers {
 			if peer.Name == targetName && peer.IsActive {
-				targetAddress = peer.Address
+				targetID = id
 				break
 			}
 		}
 		node.PeersMutex.RUnlock()
 		
-		if targetAddress == "" {
+		if targetID == "" {
 			fmt.Printf("用户 %s 不在线，但仍可解除屏蔽\n", targetName)
-			// 尝试直接用用户名作为地址（向后兼容，但不推荐）
+			// 离线用户可直接使用 /acl 中显示的节点ID
 			node.unblockUser(targetName)
 			return
 		}
-		node.unblockUser(targetAddress)
+		node.unblockUser(targetID)
 		
 	case "/acl":
 		node.showACL()
+
+	case "/search":
+		if len(parts) < 2 {
+			fmt.Println("用法: /search [from:用户] [in:all|用户] [type:text|image|file|reply] [after:YYYY-MM-DD] [before:YYYY-MM-DD] <关键词>")
+			return
+		}
+		node.runSearchCommand(parts[1:])
+
+	case "/context":
+		if len(parts) < 2 {
+			fmt.Println("用法: /context <#编号> [条数]")
+			return
+		}
+		id, err := strconv.ParseInt(strings.TrimPrefix(parts[1], "#"), 10, 64)
+		if err != nil {
+			fmt.Println("错误: 无效的消息编号")
+			return
+		}
+		radius := searchDefaultContext
+		if len(parts) > 2 {
+			if r, err := strconv.Atoi(parts[2]); err == nil && r > 0 {
+				radius = r
+			}
+		}
+		node.showMessageContext(id, radius)
+
+	case "/dbpasswd":
+		// 口令不在命令中给出，避免回显和留在终端历史中
+		if len(parts) > 2 || (len(parts) == 2 && parts[1] != "-keyfile") {
+			fmt.Println("用法: /dbpasswd          按提示输入口令（不回显），使用口令保护历史记录")
+			fmt.Println("      /dbpasswd -keyfile  改用随机密钥文件 " + dbKeyFile)
+			return
+		}
+		passphrase := ""
+		if len(parts) == 1 {
+			var err error
+			if passphrase, err = readNewPassphrase(); err != nil {
+				fmt.Printf("更换数据库密钥失败: %v\n", err)
+				return
+			}
+		}
+		if err := node.changeDBKey(passphrase); err != nil {
+			fmt.Printf("更换数据库密钥失败: %v\n", err)
+			return
+		}
+		if passphrase != "" {
+			fmt.Printf("历史记录已改用口令保护，启动时需输入口令或设置环境变量 %s\n", dbPassphraseEnv)
+		} else {
+			fmt.Printf("历史记录已改用密钥文件 %s 保护\n", dbKeyFile)
+		}
+
+	case "/diag":
+		node.showDiagnostics()
+
+	case "/verify":
+		if len(parts) < 2 {
+			fmt.Println("用法: /verify <用户名>")
+			return
+		}
+		node.showSafetyCode(parts[1])
+
+	case "/trust":
+		if len(parts) < 2 {
+			fmt.Println("用法: /trust <用户名>")
+			return
+		}
+		var target *Peer
+		node.PeersMutex.RLock()
+		for _, peer := range node.Peers {
+			if peer.Name == parts[1] && peer.IsActive {
+				target = peer
+				break
+			}
+		}
+		node.PeersMutex.RUnlock()
+		if target == nil || !target.Authenticated {
+			fmt.Printf("错误: 用户 '%s' 不在线或未提供身份密钥\n", parts[1])
+			return
+		}
+		node.trustPeer(target)
+		fmt.Printf("已信任 %s 的当前身份: %s\n", target.Name, formatFingerprint(target.IdentityKey))
+
+	case "/strict":
+		if len(parts) >= 2 {
+			switch parts[1] {
+			case "on":
+				node.StrictIdentity = true
+			case "off":
+				node.StrictIdentity = false
+			default:
+				fmt.Println("用法: /strict [on|off]")
+				return
+			}
+		}
+		if node.StrictIdentity {
+			fmt.Println("严格模式: 开启（同名用户的身份密钥变更时拒绝连接）")
+		} else {
+			fmt.Println("严格模式: 关闭（身份密钥变更时仅警告，不自动接受文件）")
+		}
 		
 	case "/send":
 		if len(parts) < 3 {
-			fmt.Println("用法: /send <用户名> <文件路径>")
+			fmt.Println("用法: /send <用户名> <路径> [路径...]（路径含空格时加引号）")
 			return
 		}
 		targetName := parts[1]
-		filePath := strings.Join(parts[2:], " ")
+		paths := parseSendPaths(strings.Join(parts[2:], " "))
+		if len(paths) == 0 {
+			fmt.Println("用法: /send <用户名> <路径> [路径...]（路径含空格时加引号）")
+			return
+		}
 		
 		// 查找目标用户
-		var targetID, targetAddress string
+		var targetID string
 		node.PeersMutex.RLock()
 		for id, peer := range node.Peers {
 			if peer.Name == targetName && peer.IsActive {
 				targetID = id
-				targetAddress = peer.Address
 				break
 			}
 		}
@@ -489,29 +633,122 @@ func (node *P2PNode) handleCommand(command string) {
 			return
 		}
 
-		if node.isBlocked(targetAddress) {
+		if node.isBlocked(targetID) {
 			fmt.Printf("错误: 用户 '%s' 被屏蔽，无法发送文件\n", targetName)
 			fmt.Println("提示: 使用 /unblock 命令解除屏蔽")
 			return
 		}
-		node.sendFileTransferRequest(filePath, targetName)
+		// 目录或多个文件作为一个任务发送
+		if info, err := os.Stat(paths[0]); len(paths) == 1 && (err != nil || !info.IsDir()) {
+			node.sendFileTransferRequest(paths[0], targetName)
+		} else {
+			node.sendJobRequest(paths, targetName)
+		}
+
+	case "/sendall":
+		paths := parseSendPaths(strings.Join(parts[1:], " "))
+		if len(paths) != 1 {
+			fmt.Println("用法: /sendall <文件路径>（路径含空格时加引号）")
+			return
+		}
+		node.sendBroadcast(paths[0], nil)
 		
 	case "/transfers":
+		if len(parts) > 1 && parts[1] == "--all" {
+			node.showTransferHistory(parts[2:])
+			return
+		}
 		node.showFileTransfers()
 
 	case "/accept":
 		if len(parts) < 2 {
-			fmt.Println("用法: /accept <文件ID>")
+			fmt.Println("用法: /accept <文件ID> [保存位置]")
 			return
 		}
-		node.respondToFileTransfer(parts[1], true)
+		if len(parts) > 2 {
+			// 保存位置可以包含空格
+			path := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(command, "/accept")), parts[1]))
+			if paths := parseSendPaths(path); len(paths) == 1 {
+				path = paths[0]
+			}
+			if err := node.setSaveLocation(parts[1], path); err != nil {
+				fmt.Printf("接受文件传输失败: %v\n", err)
+				return
+			}
+		}
+		if err := node.respondToFileTransfer(parts[1], true); err != nil {
+			if len(parts) > 2 {
+				node.clearSaveLocation(parts[1])
+			}
+			fmt.Printf("接受文件传输失败: %v\n", err)
+		}
 
 	case "/reject":
 		if len(parts) < 2 {
 			fmt.Println("用法: /reject <文件ID>")
 			return
 		}
-		node.respondToFileTransfer(parts[1], false)
+		if err := node.respondToFileTransfer(parts[1], false); err != nil {
+			fmt.Printf("拒绝文件传输失败: %v\n", err)
+		}
+
+	case "/resume":
+		if len(parts) < 2 {
+			fmt.Println("用法: /resume <文件ID>")
+			return
+		}
+		if err := node.requestResume(parts[1]); err != nil {
+			fmt.Printf("续传失败: %v\n", err)
+			return
+		}
+		fmt.Println("已发送续传请求")
+
+	case "/pause":
+		if len(parts) < 2 {
+			fmt.Println("用法: /pause <文件ID>")
+			return
+		}
+		if err := node.pauseTransfer(parts[1]); err != nil {
+			fmt.Printf("暂停失败: %v\n", err)
+			return
+		}
+		fmt.Printf("已暂停，继续请输入: /resume %s\n", parts[1])
+
+	case "/cancel":
+		if len(parts) < 2 {
+			fmt.Println("用法: /cancel <文件ID>")
+			return
+		}
+		if err := node.cancelTransfer(parts[1]); err != nil {
+			fmt.Printf("取消失败: %v\n", err)
+			return
+		}
+		fmt.Println("已取消文件传输")
+
+	case "/downloads":
+		node.handleDownloadsCommand(strings.TrimSpace(strings.TrimPrefix(command, "/downloads")))
+
+	case "/limit":
+		node.handleLimitCommand(parts[1:])
+
+	case "/priority":
+		if len(parts) < 3 {
+			fmt.Println("用法: /priority <文件ID> high|normal|low")
+			return
+		}
+		priority, err := parsePriority(parts[2])
+		if err != nil {
+			fmt.Printf("错误: %v\n", err)
+			return
+		}
+		if err := node.setTransferPriority(parts[1], priority); err != nil {
+			fmt.Printf("修改优先级失败: %v\n", err)
+			return
+		}
+		fmt.Printf("已将优先级设为%s\n", priorityText(priority))
+
+	case "/autoaccept":
+		node.handleAutoAcceptCommand(strings.TrimSpace(strings.TrimPrefix(command, "/autoaccept")))
 		
 	case "/webstatus":
 		if node.WebEnabled {
@@ -555,18 +792,23 @@ func (node *P2PNode) handleCommand(command string) {
 				LIMIT ?
 			`, limit)
 		} else {
+			peerID := node.resolvePeerID(chatId)
 			rows, err = node.DB.Query(`
 				SELECT sender, recipient, content, nonce, is_private, is_own, timestamp,
 					   message_type, message_id, reply_to_id, reply_to_content, reply_to_sender,
 					   file_name, file_size, file_type
 				FROM messages
 				WHERE is_private = TRUE AND (
-					(sender = ? AND recipient = ?) OR
-					(sender = ? AND recipient = ?)
+					(sender_id = ? AND recipient_id = ?) OR
+					(sender_id = ? AND recipient_id = ?) OR
+					(sender_id IS NULL AND (
+						(sender = ? AND recipient = ?) OR
+						(sender = ? AND recipient = ?)
+					))
 				)
 				ORDER BY timestamp DESC
 				LIMIT ?
-			`, node.Name, chatId, chatId, node.Name, limit)
+			`, node.ID, peerID, peerID, node.ID, node.Name, chatId, chatId, node.Name, limit)
 		}
 
 		if err != nil {
@@ -593,7 +835,7 @@ func (node *P2PNode) handleCommand(command string) {
 			}
 
 			// 解密
-			plaintext, err := decryptMessage(node.LocalDBKey, content, nonce)
+			plaintext, err := node.decryptFromDB(content, nonce)
 			if err != nil {
 				fmt.Printf("解密消息失败: %v\n", err)
 				continue
@@ -654,6 +896,7 @@ func (node *P2PNode) cleanupMemory() {
 
 	for _, id := range toDelete {
 		delete(node.FileTransfers, id)
+		node.Events.Publish(EventTransferRemoved, map[string]string{"fileId": id})
 	}
 
 	if len(toDelete) > 0 {
@@ -722,7 +965,7 @@ func (node *P2PNode) loadHistoryFromDB() {
 			continue
 		}
 
-		plaintext, err := decryptMessage(node.LocalDBKey, content, nonce)
+		plaintext, err := node.decryptFromDB(content, nonce)
 		if err != nil {
 			fmt.Printf("解密历史消息失败: %v\n", err)
 			continue
@@ -762,9 +1005,11 @@ func main() {
 	var name string
 	var cliMode bool
 	var showHelp bool
+	var strictIdentity bool
 	
 	flag.StringVar(&name, "name", "", "指定用户名")
 	flag.BoolVar(&cliMode, "cli", false, "仅使用命令行模式")
+	flag.BoolVar(&strictIdentity, "strict-identity", false, "同名用户的身份密钥变更时拒绝连接")
 	flag.BoolVar(&showHelp, "help", false, "显示此帮助信息")
 	flag.Parse()
 
@@ -778,6 +1023,7 @@ func main() {
 		fmt.Println("选项:")
 		fmt.Println("  -name string    指定用户名")
 		fmt.Println("  -cli            仅使用命令行模式")
+		fmt.Println("  -strict-identity  同名用户的身份密钥变更时拒绝连接（默认仅警告）")
 		fmt.Println("  -help           显示此帮助信息")
 		fmt.Println()
 		fmt.Println("示例:")
@@ -828,6 +1074,7 @@ func main() {
 	}
 
 	node := NewP2PNode(name, webMode, localIP)
+	node.StrictIdentity = strictIdentity
 	
 	if webMode {
 		fmt.Print("请输入Web端口 (默认8080): ")
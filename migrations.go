@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// 数据库迁移步骤
+//
+// 每个步骤在独立事务中执行，成功后写入 schema_version 表。
+// 新增表结构变更时在列表末尾追加步骤，已发布的步骤不可修改或重排。
+type schemaMigration struct {
+	Version     int
+	Description string
+	Apply       func(tx *sql.Tx) error
+}
+
+var schemaMigrations = []schemaMigration{
+	{
+		Version:     1,
+		Description: "创建消息表",
+		Apply: func(tx *sql.Tx) error {
+			// 使用 IF NOT EXISTS，兼容引入迁移前已存在的数据库
+			_, err := tx.Exec(`
+				CREATE TABLE IF NOT EXISTS messages (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+					sender TEXT NOT NULL,
+					recipient TEXT,
+					content BLOB NOT NULL,
+					nonce BLOB,
+					is_private BOOLEAN DEFAULT FALSE,
+					is_own BOOLEAN DEFAULT FALSE,
+					message_type TEXT DEFAULT 'text',
+					message_id TEXT,
+					reply_to_id TEXT,
+					reply_to_content TEXT,
+					reply_to_sender TEXT,
+					file_name TEXT,
+					file_size INTEGER DEFAULT 0,
+					file_type TEXT,
+					file_url TEXT,
+					file_data TEXT
+				);
+				CREATE INDEX IF NOT EXISTS idx_timestamp ON messages(timestamp DESC);
+				CREATE INDEX IF NOT EXISTS idx_chat ON messages(recipient, is_private);
+				CREATE INDEX IF NOT EXISTS idx_message_type ON messages(message_type);
+				CREATE INDEX IF NOT EXISTS idx_message_id ON messages(message_id);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     2,
+		Description: "消息记录发送方和接收方的节点ID",
+		Apply: func(tx *sql.Tx) error {
+			if err := addColumnIfMissing(tx, "messages", "sender_id", "TEXT"); err != nil {
+				return err
+			}
+			if err := addColumnIfMissing(tx, "messages", "recipient_id", "TEXT"); err != nil {
+				return err
+			}
+			_, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_chat_id ON messages(sender_id, recipient_id)")
+			return err
+		},
+	},
+	{
+		Version:     3,
+		Description: "创建设置表（数据库密钥参数）",
+		Apply: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				CREATE TABLE IF NOT EXISTS settings (
+					key TEXT PRIMARY KEY,
+					value TEXT NOT NULL
+				)
+			`)
+			return err
+		},
+	},
+	{
+		Version:     4,
+		Description: "创建搜索索引表",
+		Apply: func(tx *sql.Tx) error {
+			// 令牌为词语的HMAC，不含明文；内容由 rebuildSearchIndex 填充
+			_, err := tx.Exec(`
+				CREATE TABLE IF NOT EXISTS message_tokens (
+					token BLOB NOT NULL,
+					message_rowid INTEGER NOT NULL
+				);
+				CREATE INDEX IF NOT EXISTS idx_token ON message_tokens(token);
+				CREATE INDEX IF NOT EXISTS idx_token_message ON message_tokens(message_rowid);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     5,
+		Description: "创建传输历史表",
+		Apply: func(tx *sql.Tx) error {
+			// 时间以UTC字符串保存；未结束的传输 end_time 为 NULL
+			_, err := tx.Exec(`
+				CREATE TABLE IF NOT EXISTS transfers (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					file_id TEXT NOT NULL UNIQUE,
+					file_name TEXT NOT NULL,
+					file_size INTEGER DEFAULT 0,
+					sha256 TEXT,
+					direction TEXT NOT NULL,
+					peer_id TEXT,
+					peer_name TEXT,
+					peer_fingerprint TEXT,
+					status TEXT NOT NULL,
+					is_job BOOLEAN DEFAULT FALSE,
+					files INTEGER DEFAULT 0,
+					broadcast_id TEXT,
+					transferred INTEGER DEFAULT 0,
+					start_time DATETIME NOT NULL,
+					end_time DATETIME,
+					duration REAL DEFAULT 0,
+					avg_speed REAL DEFAULT 0,
+					saved_path TEXT,
+					updated_at DATETIME
+				);
+				CREATE INDEX IF NOT EXISTS idx_transfer_start ON transfers(start_time DESC);
+				CREATE INDEX IF NOT EXISTS idx_transfer_peer ON transfers(peer_id);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     6,
+		Description: "传输历史的文件名、用户名和保存路径加密保存",
+		Apply: func(tx *sql.Tx) error {
+			// 加密后的字段保存在 details 中，原明文列留空；已有记录在加载密钥后由 encryptPlainTransferHistory 加密
+			if err := addColumnIfMissing(tx, "transfers", "details", "BLOB"); err != nil {
+				return err
+			}
+			return addColumnIfMissing(tx, "transfers", "details_nonce", "BLOB")
+		},
+	},
+}
+
+// 执行数据库迁移，返回迁移后的版本
+func migrateSchema(db *sql.DB) (int, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			description TEXT,
+			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("创建版本表失败: %v", err)
+	}
+
+	current, err := currentSchemaVersion(db)
+	if err != nil {
+		return 0, fmt.Errorf("读取数据库版本失败: %v", err)
+	}
+
+	latest := schemaMigrations[len(schemaMigrations)-1].Version
+	if current > latest {
+		return current, fmt.Errorf("数据库版本 %d 高于程序支持的版本 %d，请升级程序", current, latest)
+	}
+
+	for _, m := range schemaMigrations {
+		if m.Version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return current, fmt.Errorf("迁移到版本 %d (%s) 失败: %v", m.Version, m.Description, err)
+		}
+		current = m.Version
+		fmt.Printf("数据库已升级到版本 %d: %s\n", m.Version, m.Description)
+	}
+	return current, nil
+}
+
+// 读取当前数据库版本，未迁移过时为0
+func currentSchemaVersion(db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// 在事务中执行单个迁移步骤并记录版本
+func applyMigration(db *sql.DB, m schemaMigration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.Apply(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_version (version, description) VALUES (?, ?)", m.Version, m.Description); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 列不存在时添加（SQLite 不支持 ADD COLUMN IF NOT EXISTS）
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
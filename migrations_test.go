@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 引入迁移前的 messages 表结构
+const baselineMessagesSchema = `
+	CREATE TABLE messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+		sender TEXT NOT NULL,
+		recipient TEXT,
+		content BLOB NOT NULL,
+		nonce BLOB,
+		is_private BOOLEAN DEFAULT FALSE,
+		is_own BOOLEAN DEFAULT FALSE,
+		message_type TEXT DEFAULT 'text',
+		message_id TEXT,
+		reply_to_id TEXT,
+		reply_to_content TEXT,
+		reply_to_sender TEXT,
+		file_name TEXT,
+		file_size INTEGER DEFAULT 0,
+		file_type TEXT,
+		file_url TEXT,
+		file_data TEXT
+	);
+	CREATE INDEX idx_timestamp ON messages(timestamp DESC);
+`
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func latestSchemaVersion() int {
+	return schemaMigrations[len(schemaMigrations)-1].Version
+}
+
+func tableColumns(t *testing.T, db *sql.DB, table string) map[string]bool {
+	t.Helper()
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			t.Fatal(err)
+		}
+		columns[name] = true
+	}
+	return columns
+}
+
+func tableExists(t *testing.T, db *sql.DB, table string) bool {
+	t.Helper()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count > 0
+}
+
+func TestMigrateFreshDatabase(t *testing.T) {
+	db := openTestDB(t)
+
+	version, err := migrateSchema(db)
+	if err != nil {
+		t.Fatalf("迁移失败: %v", err)
+	}
+	if version != latestSchemaVersion() {
+		t.Errorf("迁移后版本 = %d, 期望 %d", version, latestSchemaVersion())
+	}
+	for _, table := range []string{"messages", "settings", "message_tokens", "transfers"} {
+		if !tableExists(t, db, table) {
+			t.Errorf("缺少表 %s", table)
+		}
+	}
+	columns := tableColumns(t, db, "messages")
+	if !columns["sender_id"] || !columns["recipient_id"] {
+		t.Errorf("messages 表缺少节点ID列: %v", columns)
+	}
+
+	var steps int
+	if err := db.QueryRow("SELECT COUNT(*) FROM schema_version").Scan(&steps); err != nil {
+		t.Fatal(err)
+	}
+	if steps != len(schemaMigrations) {
+		t.Errorf("schema_version 记录了 %d 个步骤, 期望 %d", steps, len(schemaMigrations))
+	}
+}
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.Exec(baselineMessagesSchema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO messages (sender, content, message_id) VALUES (?, ?, ?)", "alice", []byte("hello"), "m1"); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := migrateSchema(db)
+	if err != nil {
+		t.Fatalf("迁移失败: %v", err)
+	}
+	if version != latestSchemaVersion() {
+		t.Errorf("迁移后版本 = %d, 期望 %d", version, latestSchemaVersion())
+	}
+
+	columns := tableColumns(t, db, "messages")
+	if !columns["sender_id"] || !columns["recipient_id"] {
+		t.Errorf("旧表未添加节点ID列: %v", columns)
+	}
+
+	// 原有数据保留，新列为空
+	var sender string
+	var senderID sql.NullString
+	if err := db.QueryRow("SELECT sender, sender_id FROM messages WHERE message_id = 'm1'").Scan(&sender, &senderID); err != nil {
+		t.Fatalf("读取旧消息失败: %v", err)
+	}
+	if sender != "alice" || senderID.Valid {
+		t.Errorf("旧消息 = (%q, %v), 期望 (alice, NULL)", sender, senderID)
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := migrateSchema(db); err != nil {
+		t.Fatalf("首次迁移失败: %v", err)
+	}
+	version, err := migrateSchema(db)
+	if err != nil {
+		t.Fatalf("重复迁移失败: %v", err)
+	}
+	if version != latestSchemaVersion() {
+		t.Errorf("重复迁移后版本 = %d, 期望 %d", version, latestSchemaVersion())
+	}
+
+	var steps int
+	if err := db.QueryRow("SELECT COUNT(*) FROM schema_version").Scan(&steps); err != nil {
+		t.Fatal(err)
+	}
+	if steps != len(schemaMigrations) {
+		t.Errorf("重复迁移后 schema_version 有 %d 条记录, 期望 %d", steps, len(schemaMigrations))
+	}
+}
+
+func TestAddColumnIfMissing(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.Exec("CREATE TABLE items (id INTEGER PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := addColumnIfMissing(tx, "items", "label", "TEXT"); err != nil {
+			tx.Rollback()
+			t.Fatalf("第 %d 次添加列失败: %v", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !tableColumns(t, db, "items")["label"] {
+		t.Error("未添加 label 列")
+	}
+}
+
+func TestMigrateFailedStepRollsBack(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := migrateSchema(db); err != nil {
+		t.Fatalf("迁移失败: %v", err)
+	}
+	before := latestSchemaVersion()
+
+	original := schemaMigrations
+	defer func() { schemaMigrations = original }()
+	schemaMigrations = append(append([]schemaMigration(nil), original...), schemaMigration{
+		Version:     before + 1,
+		Description: "测试失败的步骤",
+		Apply: func(tx *sql.Tx) error {
+			if _, err := tx.Exec("CREATE TABLE half_done (id INTEGER)"); err != nil {
+				return err
+			}
+			if err := addColumnIfMissing(tx, "messages", "half_column", "TEXT"); err != nil {
+				return err
+			}
+			return errors.New("模拟失败")
+		},
+	})
+
+	version, err := migrateSchema(db)
+	if err == nil || !strings.Contains(err.Error(), "模拟失败") {
+		t.Fatalf("期望迁移失败, 得到 %v", err)
+	}
+	if version != before {
+		t.Errorf("失败后返回版本 = %d, 期望 %d", version, before)
+	}
+
+	current, err := currentSchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != before {
+		t.Errorf("失败后 schema_version = %d, 期望 %d", current, before)
+	}
+	if tableExists(t, db, "half_done") {
+		t.Error("失败步骤创建的表未回滚")
+	}
+	if tableColumns(t, db, "messages")["half_column"] {
+		t.Error("失败步骤添加的列未回滚")
+	}
+}
+
+func TestMigrateRejectsNewerDatabase(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := migrateSchema(db); err != nil {
+		t.Fatalf("迁移失败: %v", err)
+	}
+	newer := latestSchemaVersion() + 1
+	if _, err := db.Exec("INSERT INTO schema_version (version, description) VALUES (?, ?)", newer, "未来的版本"); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := migrateSchema(db)
+	if err == nil {
+		t.Fatal("高于程序支持版本的数据库未被拒绝")
+	}
+	if version != newer {
+		t.Errorf("返回版本 = %d, 期望 %d", version, newer)
+	}
+}
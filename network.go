@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -81,7 +83,7 @@ func (node *P2PNode) connectToPeer(ip string, port int, id, name string) {
 		return
 	}
 
-	address := fmt.Sprintf("%s:%d", ip, port)
+	address := net.JoinHostPort(ip, strconv.Itoa(port))
 	maxRetries := 3
 	baseDelay := 1 * time.Second
 
@@ -105,6 +107,7 @@ func (node *P2PNode) connectToPeer(ip string, port int, id, name string) {
 			Name:     name,
 			Address:  address,
 			Conn:     conn,
+			Reader:   bufio.NewReader(conn),
 			IsActive: true,
 			LastSeen: time.Now(),
 			IP:       ip,
@@ -127,13 +130,7 @@ func (node *P2PNode) connectToPeer(ip string, port int, id, name string) {
 		peer.PrivateKey = privateKey
 		peer.PublicKey = publicKey
 
-		handshakeMsg := Message{
-			Type:        "handshake",
-			From:        node.ID,
-			Content:     node.Name,
-			Timestamp:   time.Now(),
-			SenderPubKey: publicKey[:],
-		}
+		handshakeMsg := node.buildHandshake("handshake", publicKey, nil, ProtocolVersionCurrent)
 		node.sendMessageToPeer(peer, handshakeMsg)
 
 		go node.handlePeerConnection(peer)
@@ -158,10 +155,19 @@ func (node *P2PNode) acceptConnections() {
 
 // 处理传入连接
 func (node *P2PNode) handleIncomingConnection(conn net.Conn) {
-	decoder := json.NewDecoder(conn)
-	var handshakeMsg Message
-	
-	if err := decoder.Decode(&handshakeMsg); err != nil {
+	peer := &Peer{
+		Conn:   conn,
+		Reader: bufio.NewReader(conn),
+	}
+
+	// 文件数据连接以认证帧开头，不走握手流程
+	if header, err := peer.Reader.Peek(3); err == nil && header[0] == frameMagic && header[2] == FrameTypeDataHello {
+		node.acceptDataConnection(conn, peer.Reader)
+		return
+	}
+
+	handshakeMsg, err := node.readPeerMessage(peer)
+	if err != nil {
 		conn.Close()
 		return
 	}
@@ -180,8 +186,18 @@ func (node *P2PNode) handleIncomingConnection(conn net.Conn) {
 		return
 	}
 
-	peer := &Peer{
-		Conn: conn,
+	// 旧版节点没有身份密钥，无需等待握手确认，直接核对已记录的身份；
+	// 新版节点的签名在握手确认中验证，这里先拒绝节点ID与身份公钥不符的请求
+	signed := len(handshakeMsg.IdentityKey) > 0
+	if signed {
+		err = checkHandshakeIdentity(handshakeMsg)
+	} else {
+		err = node.authenticatePeer(peer, handshakeMsg, nil)
+	}
+	if err != nil {
+		fmt.Printf("拒绝来自 %s (%s) 的连接: %v\n", handshakeMsg.Content, conn.RemoteAddr(), err)
+		conn.Close()
+		return
 	}
 
 	// 生成自己的密钥对
@@ -194,9 +210,10 @@ func (node *P2PNode) handleIncomingConnection(conn net.Conn) {
 	peer.PrivateKey = privateKey
 	peer.PublicKey = publicKey
 
-	// 派生共享密钥
+	// 派生共享密钥，随后丢弃临时私钥
 	shared := deriveSharedKey(privateKey, remotePubKey)
-	peer.SharedKey = shared[:]
+	peer.Session = newSecureSession(shared, false)
+	peer.PrivateKey = [32]byte{}
 
 	peer.ID = handshakeMsg.From
 	peer.Name = handshakeMsg.Content
@@ -204,6 +221,9 @@ func (node *P2PNode) handleIncomingConnection(conn net.Conn) {
 	peer.IsActive = true
 	peer.LastSeen = time.Now()
 	peer.ReconnectAttempts = 0
+	peer.ProtocolVersion = negotiateProtocolVersion(handshakeMsg.ProtocolVersion)
+	peer.Capabilities = negotiateCapabilities(handshakeMsg.Capabilities)
+	peer.retainSharedKey(&shared)
 
 	// 解析IP和端口
 	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
@@ -211,23 +231,50 @@ func (node *P2PNode) handleIncomingConnection(conn net.Conn) {
 		peer.Port = addr.Port
 	}
 
+	// 先发送握手响应再登记节点，确保对方收到响应前不会收到加密消息
+	responseMsg := node.buildHandshake("handshake_response", publicKey, handshakeMsg.SenderPubKey, peer.ProtocolVersion)
+	if err := node.sendMessageToPeer(peer, responseMsg); err != nil {
+		fmt.Printf("发送握手响应失败: %v\n", err)
+		conn.Close()
+		return
+	}
+
+	// 发起方收到响应后对包含双方临时公钥的握手记录签名，验证通过才登记节点
+	if signed {
+		if err := node.awaitHandshakeConfirm(peer, handshakeMsg, publicKey); err != nil {
+			fmt.Printf("拒绝来自 %s (%s) 的连接: %v\n", handshakeMsg.Content, conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+
 	node.PeersMutex.Lock()
 	node.Peers[peer.ID] = peer
 	node.PeersMutex.Unlock()
 
 	fmt.Printf("接受来自节点的连接: %s (%s)\n", peer.Name, peer.Address)
+	node.publishPeerEvent(EventPeerJoined, peer)
+	go node.resumeInterruptedTransfers(peer)
 
-	// 发送握手响应
-	responseMsg := Message{
-		Type:        "handshake_response",
-		From:        node.ID,
-		Content:     node.Name,
-		Timestamp:   time.Now(),
-		SenderPubKey: publicKey[:],
+	go node.handlePeerConnection(peer)
+}
+
+// 读取发起方的握手确认并验证其身份签名
+func (node *P2PNode) awaitHandshakeConfirm(peer *Peer, handshakeMsg Message, publicKey [32]byte) error {
+	peer.Conn.SetReadDeadline(time.Now().Add(handshakeConfirmTimeout))
+	confirm, err := node.readPeerMessage(peer)
+	peer.Conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("未收到握手确认: %v", err)
+	}
+	if confirm.Type != "handshake_confirm" || confirm.From != handshakeMsg.From {
+		return fmt.Errorf("握手确认无效")
 	}
-	node.sendMessageToPeer(peer, responseMsg)
 
-	go node.handlePeerConnection(peer)
+	signedMsg := handshakeMsg
+	signedMsg.Signature = confirm.Signature
+	transcript := handshakeTranscript(handshakeRoleInitiator, handshakeMsg.From, handshakeMsg.SenderPubKey, publicKey[:])
+	return node.authenticatePeer(peer, signedMsg, transcript)
 }
 
 // 处理对等节点连接（带重连机制）
@@ -236,14 +283,18 @@ func (node *P2PNode) handlePeerConnection(peer *Peer) {
 		peer.Conn.Close()
 	}()
 
+	rejected := false
 	for node.Running {
-		decoder := json.NewDecoder(peer.Conn)
-
 		// 读取消息循环
 		for node.Running {
-			var msg Message
-			if err := decoder.Decode(&msg); err != nil {
-				if err != io.EOF && err.Error() != "use of closed network connection" {
+			msg, err := node.readPeerMessage(peer)
+			if errors.Is(err, errFrameDropped) {
+				// 重放或过期的帧已被整帧读出，丢弃后连接仍可继续使用
+				fmt.Printf("丢弃来自 %s 的加密帧: %v\n", peer.Name, err)
+				continue
+			}
+			if err != nil {
+				if err != io.EOF && !errors.Is(err, net.ErrClosed) {
 					fmt.Printf("从节点 %s 读取消息失败: %v\n", peer.Name, err)
 				}
 				break
@@ -251,11 +302,35 @@ func (node *P2PNode) handlePeerConnection(peer *Peer) {
 
 			peer.LastSeen = time.Now()
 			peer.ReconnectAttempts = 0 // 重置重连计数
+
+			// 握手响应需在读取下一条消息前处理，后续消息的编码依赖协商结果
+			if msg.Type == "handshake_response" {
+				if err := node.completeHandshake(peer, msg); err != nil {
+					fmt.Printf("拒绝与 %s 的连接: %v\n", peer.Name, err)
+					rejected = true
+					break
+				}
+				node.publishPeerEvent(EventPeerJoined, peer)
+				go node.resumeInterruptedTransfers(peer)
+				continue
+			}
+			// 密钥更新同样需要在读取下一帧之前完成
+			if msg.Type == "rekey" || msg.Type == "rekey_ack" {
+				if err := node.handleRekey(peer, msg); err != nil {
+					fmt.Printf("与 %s 更新会话密钥失败: %v\n", peer.Name, err)
+					break
+				}
+				continue
+			}
 			node.MessageChan <- msg
 		}
 
-		// 连接断开，尝试重连
-		if !node.Running {
+		node.publishPeerEvent(EventPeerLeft, peer)
+		node.interruptTransfers(peer)
+
+		// 连接断开，尝试重连（身份校验失败时不重连）
+		if !node.Running || rejected {
+			peer.IsActive = false
 			break
 		}
 
@@ -288,6 +363,10 @@ func (node *P2PNode) handlePeerConnection(peer *Peer) {
 
 			// 重连成功
 			peer.Conn = conn
+			peer.Reader = bufio.NewReader(conn)
+			peer.ProtocolVersion = 0 // 等待新的握手响应
+			peer.SharedKey = nil
+			peer.Session = nil
 			peer.IsActive = true
 			peer.LastSeen = time.Now()
 
@@ -303,13 +382,7 @@ func (node *P2PNode) handlePeerConnection(peer *Peer) {
 			peer.PrivateKey = privateKey
 			peer.PublicKey = publicKey
 
-			handshakeMsg := Message{
-				Type:        "handshake",
-				From:        node.ID,
-				Content:     node.Name,
-				Timestamp:   time.Now(),
-				SenderPubKey: publicKey[:],
-			}
+			handshakeMsg := node.buildHandshake("handshake", publicKey, nil, ProtocolVersionCurrent)
 
 			if err := node.sendMessageToPeer(peer, handshakeMsg); err != nil {
 				fmt.Printf("重连握手失败: %v\n", err)
@@ -379,48 +452,46 @@ func (node *P2PNode) handleMessages() {
 			senderName := node.getPeerName(msg.From)
 			if msg.To == "" || msg.To == "all" {
 				// 公聊消息
-				if node.isBlocked(senderPeer.Address) {
+				if node.isBlocked(senderPeer.ID) {
 					continue
 				}
 				fileURL := node.processReceivedFile(msg)
-				node.addChatMessageWithType(senderName, "all", content, false, false,
+				node.addChatMessageWithType(senderName, senderPeer.ID, "all", "all", content, false, false,
 					msg.MessageType, msg.MessageID, msg.ReplyToID, msg.ReplyToContent, msg.ReplyToSender,
 					msg.FileName, msg.FileSize, msg.FileType, fileURL)
 			} else if msg.To == node.ID {
 				// 私聊消息
-				if node.isBlocked(senderPeer.Address) {
+				if node.isBlocked(senderPeer.ID) {
 					continue
 				}
 				fileURL := node.processReceivedFile(msg)
-				node.addChatMessageWithType(senderName, node.Name, content, false, true,
+				node.addChatMessageWithType(senderName, senderPeer.ID, node.Name, node.ID, content, false, true,
 					msg.MessageType, msg.MessageID, msg.ReplyToID, msg.ReplyToContent, msg.ReplyToSender,
 					msg.FileName, msg.FileSize, msg.FileType, fileURL)
 			}
 		case "handshake":
 			// 握手消息已在连接处理中处理
 		case "handshake_response":
-			// 握手响应 - 派生共享密钥
-			node.PeersMutex.Lock()
-			var peer *Peer
-			var exists bool
-			peer, exists = node.Peers[msg.From]
-			if exists && len(msg.SenderPubKey) == 32 {
-				var remotePub [32]byte
-				copy(remotePub[:], msg.SenderPubKey)
-				shared := deriveSharedKey(peer.PrivateKey, remotePub)
-				peer.SharedKey = shared[:]
-				fmt.Printf("与 %s 建立加密连接\n", peer.Name)
-			}
-			node.PeersMutex.Unlock()
+			// 握手响应已在连接读取循环中处理
 		case "file_request":
 			// 文件传输请求
 			if data, ok := msg.Data.(map[string]interface{}); ok {
 				jsonData, _ := json.Marshal(data)
 				var request FileTransferRequest
 				if err := json.Unmarshal(jsonData, &request); err == nil {
+					request.From = msg.From
 					node.handleFileTransferRequest(request)
 				}
 			}
+		case "job_request":
+			// 目录或多文件传输任务请求
+			if data, ok := msg.Data.(map[string]interface{}); ok {
+				jsonData, _ := json.Marshal(data)
+				var request FileTransferRequest
+				if err := json.Unmarshal(jsonData, &request); err == nil {
+					node.handleJobRequest(msg.From, request)
+				}
+			}
 		case "file_response":
 			// 文件传输响应
 			if data, ok := msg.Data.(map[string]interface{}); ok {
@@ -430,9 +501,67 @@ func (node *P2PNode) handleMessages() {
 					node.handleFileTransferResponse(response)
 				}
 			}
+		case "file_resume":
+			// 断点续传请求
+			if data, ok := msg.Data.(map[string]interface{}); ok {
+				jsonData, _ := json.Marshal(data)
+				var resume FileResume
+				if err := json.Unmarshal(jsonData, &resume); err == nil {
+					node.handleFileResume(msg.From, resume)
+				}
+			}
+		case "file_resume_response":
+			// 断点续传响应
+			if data, ok := msg.Data.(map[string]interface{}); ok {
+				jsonData, _ := json.Marshal(data)
+				var response FileTransferResponse
+				if err := json.Unmarshal(jsonData, &response); err == nil {
+					node.handleFileResumeResponse(msg.From, response)
+				}
+			}
+		case "file_ack":
+			// 文件块确认
+			if data, ok := msg.Data.(map[string]interface{}); ok {
+				jsonData, _ := json.Marshal(data)
+				var ack FileAck
+				if err := json.Unmarshal(jsonData, &ack); err == nil {
+					node.handleFileAck(msg.From, ack)
+				}
+			}
+		case "file_sent":
+			// 发送方已发完全部数据块
+			if data, ok := msg.Data.(map[string]interface{}); ok {
+				jsonData, _ := json.Marshal(data)
+				var notice FileTransferResponse
+				if err := json.Unmarshal(jsonData, &notice); err == nil {
+					node.handleFileSent(msg.From, notice)
+				}
+			}
+		case "file_pause", "file_cancel":
+			// 对方暂停或取消了传输
+			if data, ok := msg.Data.(map[string]interface{}); ok {
+				jsonData, _ := json.Marshal(data)
+				var control TransferControl
+				if err := json.Unmarshal(jsonData, &control); err == nil {
+					control.Type = msg.Type
+					node.handleTransferControl(msg.From, control)
+				}
+			}
+		case "data_open":
+			// 发送方请求建立数据连接
+			if data, ok := msg.Data.(map[string]interface{}); ok {
+				jsonData, _ := json.Marshal(data)
+				var open DataChannelOpen
+				if err := json.Unmarshal(jsonData, &open); err == nil {
+					node.handleDataChannelOpen(msg.From, open)
+				}
+			}
 		case "file_chunk":
 			// 文件数据块
-			if data, ok := msg.Data.(map[string]interface{}); ok {
+			if chunk, ok := msg.Data.(FileChunk); ok {
+				// 二进制帧已解码为FileChunk
+				node.handleFileChunk(chunk)
+			} else if data, ok := msg.Data.(map[string]interface{}); ok {
 				jsonData, _ := json.Marshal(data)
 				var chunk FileChunk
 				if err := json.Unmarshal(jsonData, &chunk); err == nil {
@@ -446,6 +575,11 @@ func (node *P2PNode) handleMessages() {
 				oldName := peer.Name
 				peer.Name = msg.Content
 				fmt.Printf("用户 %s 已更名为 %s\n", oldName, peer.Name)
+				node.Events.Publish(EventPeerRenamed, map[string]string{
+					"id":      peer.ID,
+					"oldName": oldName,
+					"name":    peer.Name,
+				})
 			}
 			node.PeersMutex.Unlock()
 			}
@@ -455,6 +589,45 @@ func (node *P2PNode) handleMessages() {
 	}
 }
 
+// 完成握手 - 验证对端身份，派生共享密钥并记录协商的协议版本
+func (node *P2PNode) completeHandshake(peer *Peer, msg Message) error {
+	if len(msg.SenderPubKey) != 32 {
+		return fmt.Errorf("无效的临时公钥")
+	}
+	if msg.From != peer.ID {
+		return fmt.Errorf("响应方节点ID不符 (期望 %s, 实际 %s)", peer.ID, msg.From)
+	}
+	transcript := handshakeTranscript(handshakeRoleResponder, msg.From, peer.PublicKey[:], msg.SenderPubKey)
+	if err := node.authenticatePeer(peer, msg, transcript); err != nil {
+		return err
+	}
+
+	// 握手确认必须是会话建立后的第一条消息，写入完成前不允许其他消息抢先发送
+	peer.WriteMutex.Lock()
+	defer peer.WriteMutex.Unlock()
+
+	node.PeersMutex.Lock()
+	var remotePub [32]byte
+	copy(remotePub[:], msg.SenderPubKey)
+	shared := deriveSharedKey(peer.PrivateKey, remotePub)
+	peer.Session = newSecureSession(shared, true)
+	peer.PrivateKey = [32]byte{} // 丢弃临时私钥
+	peer.ProtocolVersion = negotiateProtocolVersion(msg.ProtocolVersion)
+	peer.Capabilities = negotiateCapabilities(msg.Capabilities)
+	peer.retainSharedKey(&shared)
+	node.PeersMutex.Unlock()
+
+	// 旧版响应方没有身份密钥，也不会等待确认
+	if len(msg.IdentityKey) > 0 {
+		confirm := node.buildHandshakeConfirm(peer.PublicKey, msg.SenderPubKey)
+		if err := node.writePeerMessageLocked(peer, confirm); err != nil {
+			return fmt.Errorf("发送握手确认失败: %v", err)
+		}
+	}
+	fmt.Printf("与 %s 建立加密连接 (协议 v%d)\n", peer.Name, peer.ProtocolVersion)
+	return nil
+}
+
 // 获取对等节点名称
 func (node *P2PNode) getPeerName(peerID string) string {
 	node.PeersMutex.RLock()
@@ -468,8 +641,14 @@ func (node *P2PNode) getPeerName(peerID string) string {
 
 // 发送消息到对等节点
 func (node *P2PNode) sendMessageToPeer(peer *Peer, msg Message) error {
-	if len(peer.SharedKey) > 0 && msg.Type == "chat" {
-		// 加密聊天消息
+	isHandshake := msg.Type == "handshake" || msg.Type == "handshake_response"
+	if !isHandshake && len(peer.SharedKey) == 0 && peer.Session == nil {
+		// 握手完成前不发送任何消息，避免明文泄露
+		return fmt.Errorf("与 %s 的加密握手尚未完成", peer.Name)
+	}
+
+	if !peer.sealsEnvelope() && len(peer.SharedKey) > 0 && msg.Type == "chat" {
+		// 旧版节点：仅加密聊天内容
 		plaintext := []byte(msg.Content)
 		ciphertext, nonce, err := encryptMessage([32]byte(peer.SharedKey), plaintext)
 		if err != nil {
@@ -481,8 +660,7 @@ func (node *P2PNode) sendMessageToPeer(peer *Peer, msg Message) error {
 		msg.Content = "" // 清空明文
 	}
 
-	encoder := json.NewEncoder(peer.Conn)
-	return encoder.Encode(msg)
+	return node.writePeerMessage(peer, msg)
 }
 
 // 广播消息到所有对等节点
@@ -570,7 +748,7 @@ func (node *P2PNode) processReceivedFile(msg Message) string {
 		}
 
 		// 创建images目录
-		imageDir := "images"
+		imageDir := node.imageDir()
 		if err := os.MkdirAll(imageDir, 0755); err != nil {
 			fmt.Printf("创建图片目录失败: %v\n", err)
 			return ""
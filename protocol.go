@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// 协议版本
+//
+// v1: 旧版协议，每条消息为一行JSON（json.Encoder输出，以换行结尾）
+// v2: 带长度前缀的二进制帧，文件块以原始字节传输
+const (
+	ProtocolVersionLegacy  = 1
+	ProtocolVersionFramed  = 2
+	ProtocolVersionCurrent = ProtocolVersionFramed
+)
+
+// 能力标识 - 在握手阶段交换，双方取交集
+const (
+	CapabilityBinaryChunks    = "binary_chunks"    // 文件块使用二进制帧传输
+	CapabilitySealedEnvelope  = "sealed_envelope"  // 握手后所有消息整体加密
+	CapabilityResume          = "resume"           // 文件传输支持断点续传
+	CapabilityFileAck         = "file_ack"         // 文件块确认与滑动窗口流控
+	CapabilityDataChannel     = "data_channel"     // 文件块通过独立的数据连接传输
+	CapabilityFileJobs        = "file_jobs"        // 目录或多文件作为一个任务传输
+	CapabilityTransferControl = "transfer_control" // 传输可由任一方暂停或取消
+	CapabilityCompression     = "deflate"          // 文件块和较大的消息使用 DEFLATE 压缩
+	CapabilityDeferredHash    = "deferred_hash"    // 文件校验值可在发送完成通知中提供
+)
+
+// 本节点支持的能力列表
+var localCapabilities = []string{
+	CapabilityBinaryChunks,
+	CapabilitySealedEnvelope,
+	CapabilityResume,
+	CapabilityFileAck,
+	CapabilityDataChannel,
+	CapabilityFileJobs,
+	CapabilityTransferControl,
+	CapabilityCompression,
+	CapabilityDeferredHash,
+}
+
+// 帧类型
+const (
+	FrameTypeJSON       byte = 0x01 // JSON编码的Message
+	FrameTypeFileChunk  byte = 0x02 // 文件数据块：头部JSON + 原始字节
+	FrameTypeSealed     byte = 0x03 // 加密信封：内含上述任一类型的帧
+	FrameTypeDataHello  byte = 0x04 // 数据连接的认证帧
+	FrameTypeDataChunk  byte = 0x05 // 数据连接上的加密文件块
+	FrameTypeCompressed byte = 0x06 // 压缩的帧：原帧类型(1) + DEFLATE 压缩的负载
+)
+
+// 帧头格式: magic(1) | version(1) | type(1) | flags(1) | length(4, 大端)
+const (
+	frameMagic      byte = 0xA7 // 不可能是JSON文本的首字节，用于区分新旧协议
+	frameHeaderSize      = 8
+	maxFrameSize         = 16 << 20 // 单帧最大16MB
+)
+
+// Frame结构体 - 解析后的二进制帧
+type Frame struct {
+	Version byte
+	Type    byte
+	Flags   byte
+	Payload []byte
+}
+
+// 写入一个帧
+func writeFrame(w io.Writer, frameType byte, flags byte, payload []byte) error {
+	if len(payload) > maxFrameSize {
+		return fmt.Errorf("帧过大: %d 字节", len(payload))
+	}
+	header := make([]byte, frameHeaderSize)
+	header[0] = frameMagic
+	header[1] = ProtocolVersionCurrent
+	header[2] = frameType
+	header[3] = flags
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+
+	// 合并为一次写入，避免帧头与负载被拆分
+	buf := make([]byte, 0, frameHeaderSize+len(payload))
+	buf = append(buf, header...)
+	buf = append(buf, payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// 读取一个帧（调用方需确认下一个字节为frameMagic）
+func readFrame(r *bufio.Reader) (Frame, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Frame{}, err
+	}
+	if header[0] != frameMagic {
+		return Frame{}, fmt.Errorf("无效的帧头: 0x%02x", header[0])
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if length > maxFrameSize {
+		return Frame{}, fmt.Errorf("帧过大: %d 字节", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Frame{}, err
+	}
+	return Frame{
+		Version: header[1],
+		Type:    header[2],
+		Flags:   header[3],
+		Payload: payload,
+	}, nil
+}
+
+// 协商协议版本 - 取双方支持的最高公共版本，未声明版本的对端视为旧版
+func negotiateProtocolVersion(remoteVersion int) int {
+	if remoteVersion < ProtocolVersionLegacy {
+		return ProtocolVersionLegacy
+	}
+	if remoteVersion > ProtocolVersionCurrent {
+		return ProtocolVersionCurrent
+	}
+	return remoteVersion
+}
+
+// 协商能力 - 返回双方都支持的能力集合
+func negotiateCapabilities(remoteCaps []string) map[string]bool {
+	local := make(map[string]bool, len(localCapabilities))
+	for _, c := range localCapabilities {
+		local[c] = true
+	}
+	common := make(map[string]bool)
+	for _, c := range remoteCaps {
+		if local[c] {
+			common[c] = true
+		}
+	}
+	return common
+}
+
+// 判断对端是否支持某项能力
+func (peer *Peer) hasCapability(capability string) bool {
+	return peer.Capabilities != nil && peer.Capabilities[capability]
+}
+
+// 编码文件块负载: 头部长度(2) | 头部JSON | 原始数据
+func encodeFileChunkPayload(chunk FileChunk) ([]byte, error) {
+	raw := chunk.Data
+	if chunk.Encrypted {
+		raw = chunk.Ciphertext
+	}
+	chunk.Data = nil
+	chunk.Ciphertext = nil
+
+	header, err := json.Marshal(chunk)
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > 0xFFFF {
+		return nil, fmt.Errorf("文件块头部过大: %d 字节", len(header))
+	}
+
+	payload := make([]byte, 2, 2+len(header)+len(raw))
+	binary.BigEndian.PutUint16(payload, uint16(len(header)))
+	payload = append(payload, header...)
+	payload = append(payload, raw...)
+	return payload, nil
+}
+
+// 解码文件块负载
+func decodeFileChunkPayload(payload []byte) (FileChunk, error) {
+	var chunk FileChunk
+	if len(payload) < 2 {
+		return chunk, fmt.Errorf("文件块负载过短")
+	}
+	headerLen := int(binary.BigEndian.Uint16(payload))
+	if len(payload) < 2+headerLen {
+		return chunk, fmt.Errorf("文件块头部不完整")
+	}
+	if err := json.Unmarshal(payload[2:2+headerLen], &chunk); err != nil {
+		return chunk, err
+	}
+	raw := payload[2+headerLen:]
+	if chunk.Encrypted {
+		chunk.Ciphertext = raw
+	} else {
+		chunk.Data = raw
+	}
+	return chunk, nil
+}
+
+// 从对等节点读取下一条消息，自动识别二进制帧和旧版JSON行
+func (node *P2PNode) readPeerMessage(peer *Peer) (Message, error) {
+	var msg Message
+
+	first, err := peer.Reader.Peek(1)
+	if err != nil {
+		return msg, err
+	}
+
+	if first[0] != frameMagic {
+		if peer.sealsEnvelope() {
+			return msg, fmt.Errorf("拒绝未加密的JSON消息")
+		}
+		// 旧版协议：json.Encoder 输出的每条消息以换行结尾
+		line, err := peer.Reader.ReadBytes('\n')
+		if err != nil {
+			return msg, err
+		}
+		err = json.Unmarshal(line, &msg)
+		return msg, err
+	}
+
+	frame, err := readFrame(peer.Reader)
+	if err != nil {
+		return msg, err
+	}
+
+	frameType, payload := frame.Type, frame.Payload
+	if frameType == FrameTypeSealed {
+		if peer.Session == nil {
+			return msg, fmt.Errorf("收到加密帧但会话密钥尚未建立")
+		}
+		frameType, payload, err = peer.Session.open(payload)
+		if err != nil {
+			peer.FrameStats.record(err)
+			return msg, err
+		}
+	} else if peer.sealsEnvelope() {
+		// 已协商加密信封后不再接受明文帧，防止降级和注入
+		return msg, fmt.Errorf("拒绝未加密的帧 (类型 0x%02x)", frameType)
+	}
+
+	return node.decodeFrame(peer, frameType, payload)
+}
+
+// 将帧负载解码为消息
+func (node *P2PNode) decodeFrame(peer *Peer, frameType byte, payload []byte) (Message, error) {
+	var msg Message
+	switch frameType {
+	case FrameTypeJSON:
+		err := json.Unmarshal(payload, &msg)
+		return msg, err
+	case FrameTypeFileChunk:
+		chunk, err := decodeFileChunkPayload(payload)
+		if err != nil {
+			return msg, err
+		}
+		msg = Message{
+			Type:      "file_chunk",
+			From:      peer.ID,
+			To:        node.ID,
+			Timestamp: chunk.Timestamp,
+			Data:      chunk,
+		}
+		return msg, nil
+	case FrameTypeCompressed:
+		if !peer.hasCapability(CapabilityCompression) {
+			return msg, fmt.Errorf("对方未协商压缩却发送了压缩帧")
+		}
+		innerType, data, err := decompressFrame(payload)
+		if err != nil {
+			return msg, err
+		}
+		return node.decodeFrame(peer, innerType, data)
+	default:
+		return msg, fmt.Errorf("未知的帧类型: 0x%02x", frameType)
+	}
+}
+
+// 向对等节点写入一条消息，根据协商的协议版本选择编码方式
+func (node *P2PNode) writePeerMessage(peer *Peer, msg Message) error {
+	peer.WriteMutex.Lock()
+	err := node.writePeerMessageLocked(peer, msg)
+	peer.WriteMutex.Unlock()
+
+	// 达到阈值后自动更新会话密钥
+	if err == nil && peer.sealsEnvelope() && peer.Session.shouldRekey() {
+		go node.initiateRekey(peer)
+	}
+	return err
+}
+
+// 写入消息（调用方需持有 peer.WriteMutex）
+func (node *P2PNode) writePeerMessageLocked(peer *Peer, msg Message) error {
+	// 握手消息始终使用JSON，保证旧版节点可以解析
+	if peer.ProtocolVersion < ProtocolVersionFramed || msg.Type == "handshake" || msg.Type == "handshake_response" {
+		return json.NewEncoder(peer.Conn).Encode(msg)
+	}
+
+	frameType, payload, err := encodeMessageFrame(peer, msg)
+	if err != nil {
+		return err
+	}
+
+	if peer.sealsEnvelope() {
+		payload, err = peer.Session.seal(frameType, payload)
+		if err != nil {
+			return err
+		}
+		frameType = FrameTypeSealed
+	}
+	return writeFrame(peer.Conn, frameType, 0, payload)
+}
+
+// 将消息编码为帧类型和负载
+func encodeMessageFrame(peer *Peer, msg Message) (byte, []byte, error) {
+	if msg.Type == "file_chunk" && peer.hasCapability(CapabilityBinaryChunks) {
+		if chunk, ok := msg.Data.(FileChunk); ok {
+			payload, err := encodeFileChunkPayload(chunk)
+			return FrameTypeFileChunk, payload, err
+		}
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return FrameTypeJSON, payload, err
+	}
+	// 较大的消息（如内嵌图片）压缩后发送
+	if len(payload) >= compressMessageThreshold && peer.hasCapability(CapabilityCompression) {
+		if compressed, ok := compressFrame(FrameTypeJSON, payload); ok {
+			return FrameTypeCompressed, compressed, nil
+		}
+	}
+	return FrameTypeJSON, payload, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFrameHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		frameType byte
+		flags     byte
+		payload   []byte
+	}{
+		{"空负载", FrameTypeJSON, 0, nil},
+		{"JSON 消息", FrameTypeJSON, 0, []byte(`{"type":"chat"}`)},
+		{"文件块带标志", FrameTypeFileChunk, 0x5A, bytes.Repeat([]byte{0xFF}, 300)},
+		{"多字节长度", FrameTypeSealed, 0, make([]byte, 0x010203)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeFrame(&buf, tt.frameType, tt.flags, tt.payload); err != nil {
+				t.Fatalf("writeFrame 返回错误: %v", err)
+			}
+
+			raw := buf.Bytes()
+			if len(raw) != frameHeaderSize+len(tt.payload) {
+				t.Fatalf("帧长度 = %d, 期望 %d", len(raw), frameHeaderSize+len(tt.payload))
+			}
+			if raw[0] != frameMagic {
+				t.Errorf("magic = 0x%02x, 期望 0x%02x", raw[0], frameMagic)
+			}
+			if raw[1] != ProtocolVersionCurrent {
+				t.Errorf("版本 = %d, 期望 %d", raw[1], ProtocolVersionCurrent)
+			}
+			if raw[2] != tt.frameType || raw[3] != tt.flags {
+				t.Errorf("类型/标志 = 0x%02x/0x%02x, 期望 0x%02x/0x%02x", raw[2], raw[3], tt.frameType, tt.flags)
+			}
+			// 长度字段为大端序
+			want := make([]byte, 4)
+			binary.BigEndian.PutUint32(want, uint32(len(tt.payload)))
+			if !bytes.Equal(raw[4:frameHeaderSize], want) {
+				t.Errorf("长度字段 = % x, 期望 % x", raw[4:frameHeaderSize], want)
+			}
+
+			frame, err := readFrame(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatalf("readFrame 返回错误: %v", err)
+			}
+			if frame.Version != ProtocolVersionCurrent || frame.Type != tt.frameType || frame.Flags != tt.flags {
+				t.Errorf("读取的帧头 = %d/0x%02x/0x%02x", frame.Version, frame.Type, frame.Flags)
+			}
+			if !bytes.Equal(frame.Payload, tt.payload) {
+				t.Errorf("负载不一致: 长度 %d, 期望 %d", len(frame.Payload), len(tt.payload))
+			}
+		})
+	}
+}
+
+func TestReadFrameRejectsInvalidHeader(t *testing.T) {
+	header := func(magic byte, length uint32) []byte {
+		h := []byte{magic, ProtocolVersionCurrent, FrameTypeJSON, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(h[4:], length)
+		return h
+	}
+
+	tests := []struct {
+		name    string
+		input   []byte
+		wantErr string
+	}{
+		{"错误的 magic", append(header('{', 2), "{}"...), "无效的帧头"},
+		{"长度超过上限", header(frameMagic, maxFrameSize+1), "帧过大"},
+		{"长度字段最大值", header(frameMagic, 0xFFFFFFFF), "帧过大"},
+		{"帧头不完整", []byte{frameMagic, ProtocolVersionCurrent, FrameTypeJSON}, "EOF"},
+		{"负载不完整", append(header(frameMagic, 10), "abc"...), "EOF"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readFrame(bufio.NewReader(bytes.NewReader(tt.input)))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("readFrame 返回 %v, 期望包含 %q 的错误", err, tt.wantErr)
+			}
+		})
+	}
+
+	// 长度恰好等于上限的帧头是合法的，只是负载不完整
+	if _, err := readFrame(bufio.NewReader(bytes.NewReader(header(frameMagic, maxFrameSize)))); err == nil || strings.Contains(err.Error(), "帧过大") {
+		t.Errorf("长度等于上限的帧被拒绝: %v", err)
+	}
+	if err := writeFrame(&bytes.Buffer{}, FrameTypeJSON, 0, make([]byte, maxFrameSize+1)); err == nil {
+		t.Error("writeFrame 未拒绝超过上限的负载")
+	}
+}
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	tests := []struct {
+		remote, want int
+	}{
+		{0, ProtocolVersionLegacy}, // 未声明版本的旧版节点
+		{ProtocolVersionLegacy, ProtocolVersionLegacy},
+		{ProtocolVersionFramed, ProtocolVersionFramed},
+		{ProtocolVersionCurrent + 1, ProtocolVersionCurrent},
+	}
+	for _, tt := range tests {
+		if got := negotiateProtocolVersion(tt.remote); got != tt.want {
+			t.Errorf("negotiateProtocolVersion(%d) = %d, 期望 %d", tt.remote, got, tt.want)
+		}
+	}
+}
+
+func TestReadPeerMessageLegacyFallback(t *testing.T) {
+	var stream bytes.Buffer
+	// 旧版节点发送的 JSON 行，与新版的二进制帧混合出现在同一连接上
+	json.NewEncoder(&stream).Encode(Message{Type: "chat", Content: "legacy 1"})
+	json.NewEncoder(&stream).Encode(Message{Type: "chat", Content: "legacy 2"})
+	payload, _ := json.Marshal(Message{Type: "chat", Content: "framed"})
+	writeFrame(&stream, FrameTypeJSON, 0, payload)
+	json.NewEncoder(&stream).Encode(Message{Type: "chat", Content: "legacy 3"})
+
+	node := &P2PNode{ID: "local"}
+	peer := &Peer{ID: "remote", Reader: bufio.NewReader(&stream), ProtocolVersion: ProtocolVersionLegacy}
+	for _, want := range []string{"legacy 1", "legacy 2", "framed", "legacy 3"} {
+		msg, err := node.readPeerMessage(peer)
+		if err != nil {
+			t.Fatalf("读取 %q 失败: %v", want, err)
+		}
+		if msg.Content != want {
+			t.Errorf("消息内容 = %q, 期望 %q", msg.Content, want)
+		}
+	}
+
+	// 协商加密信封后不再接受 JSON 行
+	sealed, _ := newSessionPair(t)
+	stream.Reset()
+	json.NewEncoder(&stream).Encode(Message{Type: "chat", Content: "injected"})
+	peer = &Peer{
+		ID:              "remote",
+		Reader:          bufio.NewReader(&stream),
+		ProtocolVersion: ProtocolVersionFramed,
+		Capabilities:    map[string]bool{CapabilitySealedEnvelope: true},
+		Session:         sealed,
+	}
+	if msg, err := node.readPeerMessage(peer); err == nil {
+		t.Errorf("加密信封下接受了未加密的 JSON 行: %+v", msg)
+	}
+}
+
+func TestWritePeerMessageLegacyPeer(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	node := &P2PNode{ID: "local"}
+	peer := &Peer{ID: "remote", Conn: local, ProtocolVersion: ProtocolVersionLegacy}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- node.writePeerMessage(peer, Message{Type: "chat", Content: "hello"})
+	}()
+
+	// 旧版节点按行读取 JSON
+	line, err := bufio.NewReader(remote).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("读取失败: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("writePeerMessage 返回错误: %v", err)
+	}
+	if line[0] == frameMagic {
+		t.Fatal("向旧版节点发送了二进制帧")
+	}
+	var msg Message
+	if err := json.Unmarshal(line, &msg); err != nil || msg.Content != "hello" {
+		t.Errorf("旧版节点解析结果 = %+v, %v", msg, err)
+	}
+}
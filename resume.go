@@ -0,0 +1,545 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 断点续传
+//
+// 接收方按块号记录已写入的块（位图），并定期连同已连续接收的字节数保存到
+// transfer_state/<文件ID>.json；发送方同样保存源文件路径，以便任一方重启后续传。
+// 连接恢复后由接收方发送 file_resume 报告位图，发送方只补发缺失的块。
+const (
+	transferStateDir   = "transfer_state"
+	resumeSaveInterval = 16 // 每接收多少块保存一次续传状态
+	maxMissingRetries  = 3  // 发送方发完后仍缺块时最多请求补发的次数
+	partFileSuffix     = ".part"
+)
+
+// TransferResumeState结构体 - 持久化的续传状态
+type TransferResumeState struct {
+	FileID        string    `json:"fileId"`
+	FileName      string    `json:"fileName"`
+	FilePath      string    `json:"filePath"` // 发送方的源文件或接收方的保存路径
+	FileSize      int64     `json:"fileSize"`
+	SHA256        string    `json:"sha256,omitempty"`
+	HashPending   bool      `json:"hashPending,omitempty"` // 校验值尚未计算完成或尚未收到
+	Direction     string    `json:"direction"`
+	PeerID        string    `json:"peerId"`
+	PeerName      string    `json:"peerName"`
+	ChunkSize     int       `json:"chunkSize"`
+	TotalChunks   int       `json:"totalChunks"`
+	Bitmap        []byte    `json:"bitmap,omitempty"` // 接收方已写入的块
+	Offset        int64     `json:"offset"`           // 从文件开头起连续已接收的字节数
+	SourceModTime time.Time `json:"sourceModTime,omitempty"`
+	StartTime     time.Time `json:"startTime"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+
+	// 目录或多文件任务
+	IsJob    bool       `json:"isJob,omitempty"`
+	Manifest []JobEntry `json:"manifest,omitempty"` // 任务的文件清单
+	JobID    string     `json:"jobId,omitempty"`    // 文件所属的任务
+	Mode     uint32     `json:"mode,omitempty"`     // 接收完成后设置的权限
+
+	Paused bool `json:"paused,omitempty"` // 已暂停，重新连接后不自动续传
+
+	BroadcastID string `json:"broadcastId,omitempty"` // 所属的群发记录
+}
+
+// 计算文件的块数
+func chunkCount(fileSize int64) int {
+	return int((fileSize + fileChunkSize - 1) / fileChunkSize)
+}
+
+// 位图中第 chunkNum 块（从1开始）是否已接收
+func bitmapHas(bitmap []byte, chunkNum int) bool {
+	i := chunkNum - 1
+	if i < 0 || i/8 >= len(bitmap) {
+		return false
+	}
+	return bitmap[i/8]&(1<<uint(i%8)) != 0
+}
+
+// 在位图中标记第 chunkNum 块
+func bitmapSet(bitmap []byte, chunkNum int) {
+	i := chunkNum - 1
+	if i >= 0 && i/8 < len(bitmap) {
+		bitmap[i/8] |= 1 << uint(i%8)
+	}
+}
+
+// 第 chunkNum 块的长度（最后一块可能不足一整块）
+func chunkLength(fileSize int64, chunkNum int) int64 {
+	start := int64(chunkNum-1) * fileChunkSize
+	if remaining := fileSize - start; remaining < fileChunkSize {
+		return remaining
+	}
+	return fileChunkSize
+}
+
+// 统计位图中已接收的块数和字节数
+func bitmapReceived(bitmap []byte, fileSize int64) (int, int64) {
+	chunks, bytes := 0, int64(0)
+	for n := 1; n <= chunkCount(fileSize); n++ {
+		if bitmapHas(bitmap, n) {
+			chunks++
+			bytes += chunkLength(fileSize, n)
+		}
+	}
+	return chunks, bytes
+}
+
+// 计算从文件开头起连续已接收的字节数
+func bitmapOffset(bitmap []byte, fileSize int64) int64 {
+	offset := int64(0)
+	for n := 1; n <= chunkCount(fileSize); n++ {
+		if !bitmapHas(bitmap, n) {
+			break
+		}
+		offset += chunkLength(fileSize, n)
+	}
+	return offset
+}
+
+func transferStatePath(fileID string) string {
+	return filepath.Join(transferStateDir, fileID+".json")
+}
+
+// 接收中的临时文件，全部块到齐并校验通过后重命名为目标文件
+func partFilePath(path string) string {
+	return path + partFileSuffix
+}
+
+// 保存续传状态（先写临时文件再重命名）
+func (node *P2PNode) saveTransferState(fileID string) error {
+	node.FileTransfersMutex.RLock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists {
+		node.FileTransfersMutex.RUnlock()
+		return nil
+	}
+	state := TransferResumeState{
+		FileID:        transfer.FileID,
+		FileName:      transfer.FileName,
+		FilePath:      transfer.FilePath,
+		FileSize:      transfer.FileSize,
+		SHA256:        transfer.SHA256,
+		HashPending:   transfer.HashPending,
+		Direction:     transfer.Direction,
+		PeerID:        transfer.PeerID,
+		PeerName:      transfer.PeerName,
+		ChunkSize:     fileChunkSize,
+		TotalChunks:   transfer.TotalChunks,
+		Bitmap:        append([]byte(nil), transfer.ChunkBitmap...),
+		Offset:        bitmapOffset(transfer.ChunkBitmap, transfer.FileSize),
+		SourceModTime: transfer.SourceModTime,
+		StartTime:     transfer.StartTime,
+		UpdatedAt:     time.Now(),
+		IsJob:         transfer.IsJob,
+		Manifest:      transfer.Manifest,
+		JobID:         transfer.JobID,
+		Mode:          uint32(transfer.Mode),
+		Paused:        transfer.Status == "paused",
+		BroadcastID:   transfer.BroadcastID,
+	}
+	node.FileTransfersMutex.RUnlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(transferStateDir, 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(transferStatePath(fileID), data, 0600)
+}
+
+// 删除续传状态（传输完成或无法续传时）
+func removeTransferState(fileID string) {
+	if err := os.Remove(transferStatePath(fileID)); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("删除续传状态失败: %v\n", err)
+	}
+}
+
+// 启动时加载未完成的传输，标记为已中断
+func (node *P2PNode) loadTransferStates() {
+	entries, err := os.ReadDir(transferStateDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("读取续传状态失败: %v\n", err)
+		}
+		return
+	}
+
+	loaded := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(transferStateDir, entry.Name()))
+		if err != nil {
+			fmt.Printf("读取续传状态失败: %v\n", err)
+			continue
+		}
+		var state TransferResumeState
+		if err := json.Unmarshal(data, &state); err != nil || state.FileID == "" {
+			fmt.Printf("解析续传状态 %s 失败，已忽略\n", entry.Name())
+			continue
+		}
+		if state.ChunkSize != fileChunkSize {
+			// 块大小不同的旧记录无法按块号续传
+			removeTransferState(state.FileID)
+			continue
+		}
+
+		if state.IsJob {
+			node.loadJobState(state)
+			loaded++
+			continue
+		}
+
+		bitmap := make([]byte, (chunkCount(state.FileSize)+7)/8)
+		if state.Direction == "receive" {
+			// 只信任已写入磁盘的部分：临时文件缺失或被截断时丢弃超出部分的记录
+			if info, err := os.Stat(partFilePath(state.FilePath)); err == nil {
+				for n := 1; n <= chunkCount(state.FileSize); n++ {
+					end := int64(n-1)*fileChunkSize + chunkLength(state.FileSize, n)
+					if bitmapHas(state.Bitmap, n) && end <= info.Size() {
+						bitmapSet(bitmap, n)
+					}
+				}
+			}
+		}
+		chunks, received := bitmapReceived(bitmap, state.FileSize)
+		status := "interrupted"
+		if state.Paused {
+			status = "paused"
+		}
+
+		node.FileTransfersMutex.Lock()
+		transfer := &FileTransferStatus{
+			FileID:         state.FileID,
+			FileName:       state.FileName,
+			FilePath:       state.FilePath,
+			FileSize:       state.FileSize,
+			SHA256:         state.SHA256,
+			HashPending:    state.HashPending,
+			Progress:       received,
+			Status:         status,
+			Direction:      state.Direction,
+			PeerName:       state.PeerName,
+			PeerID:         state.PeerID,
+			StartTime:      state.StartTime,
+			ChunkBitmap:    bitmap,
+			ReceivedChunks: chunks,
+			TotalChunks:    chunkCount(state.FileSize),
+			Resumable:      true,
+			SourceModTime:  state.SourceModTime,
+			JobID:          state.JobID,
+			Mode:           os.FileMode(state.Mode).Perm(),
+			BroadcastID:    state.BroadcastID,
+		}
+		rehash := state.Direction == "send" && state.HashPending
+		if rehash {
+			transfer.deferHash()
+		}
+		node.FileTransfers[state.FileID] = transfer
+		node.FileTransfersMutex.Unlock()
+		if rehash {
+			// 退出前校验值尚未算完，重新在后台计算
+			node.hashOutgoingFile(state.FilePath, state.FileID)
+		}
+		if state.JobID == "" && !state.Paused {
+			loaded++
+		}
+	}
+	node.refreshLoadedJobs()
+	node.refreshLoadedBroadcasts()
+	if loaded > 0 {
+		fmt.Printf("发现 %d 个未完成的文件传输，对方上线后将自动续传（/transfers 查看）\n", loaded)
+	}
+}
+
+// 对端断开时将进行中的传输标记为已中断并保存续传状态
+func (node *P2PNode) interruptTransfers(peer *Peer) {
+	resumable := peer.hasCapability(CapabilityResume)
+
+	var interrupted []string
+	files := 0
+	node.FileTransfersMutex.Lock()
+	for id, transfer := range node.FileTransfers {
+		if transfer.PeerID != peer.ID || transfer.Status != "transferring" {
+			continue
+		}
+		if resumable {
+			transfer.Status = "interrupted"
+			transfer.Resumable = true
+		} else {
+			transfer.Status = "failed"
+			transfer.EndTime = time.Now()
+		}
+		interrupted = append(interrupted, id)
+		if !transfer.IsJob {
+			files++
+		}
+	}
+	node.FileTransfersMutex.Unlock()
+
+	for _, id := range interrupted {
+		if resumable {
+			if err := node.saveTransferState(id); err != nil {
+				fmt.Printf("保存续传状态失败: %v\n", err)
+			}
+		}
+		node.publishTransfer(id, true)
+	}
+	if files > 0 && resumable {
+		fmt.Printf("与 %s 的 %d 个文件传输已中断，重新连接后将自动续传\n", peer.Name, files)
+	}
+}
+
+// 对端重新上线后，由接收方发起续传
+func (node *P2PNode) resumeInterruptedTransfers(peer *Peer) {
+	if !peer.hasCapability(CapabilityResume) {
+		return
+	}
+
+	var pending []string
+	node.FileTransfersMutex.RLock()
+	for id, transfer := range node.FileTransfers {
+		// 任务记录本身不续传，由其中的文件各自续传
+		if transfer.IsJob {
+			continue
+		}
+		if transfer.PeerID == peer.ID && transfer.Direction == "receive" && transfer.Status == "interrupted" {
+			pending = append(pending, id)
+		}
+	}
+	node.FileTransfersMutex.RUnlock()
+
+	for _, id := range pending {
+		if err := node.requestResume(id); err != nil {
+			fmt.Printf("续传 %s 失败: %v\n", id, err)
+		}
+	}
+}
+
+// 请求续传：接收方报告已收到的块；发送方请求接收方报告
+func (node *P2PNode) requestResume(fileID string) error {
+	node.FileTransfersMutex.Lock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists {
+		node.FileTransfersMutex.Unlock()
+		return fmt.Errorf("无效的文件传输ID")
+	}
+	if transfer.IsJob || transfer.IsBroadcast {
+		children := append([]string(nil), transfer.Children...)
+		node.FileTransfersMutex.Unlock()
+		return node.resumeJob(children)
+	}
+	if !transfer.Resumable || (transfer.Status != "interrupted" && transfer.Status != "paused" &&
+		transfer.Status != "failed" && transfer.Status != "corrupted") {
+		node.FileTransfersMutex.Unlock()
+		return fmt.Errorf("该传输当前不可续传（状态: %s）", transfer.Status)
+	}
+	transfer.MissingRetries = 0
+	node.FileTransfersMutex.Unlock()
+	return node.sendFileResume(fileID)
+}
+
+// 接收方续传前确认临时文件存在；临时文件已被删除时重新预分配并从头接收
+func (node *P2PNode) ensurePartFile(fileID string) error {
+	node.FileTransfersMutex.Lock()
+	defer node.FileTransfersMutex.Unlock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists || transfer.Direction != "receive" || transfer.IsJob || transfer.FilePath == "" {
+		return nil
+	}
+	partPath := partFilePath(transfer.FilePath)
+	if _, err := os.Lstat(partPath); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(partPath), 0755); err != nil {
+		return fmt.Errorf("创建下载目录失败: %v", err)
+	}
+	file, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("创建文件失败: %v", err)
+	}
+	err = file.Truncate(transfer.FileSize)
+	file.Close()
+	if err != nil {
+		os.Remove(partPath)
+		return fmt.Errorf("预分配文件失败: %v", err)
+	}
+	transfer.ChunkBitmap = make([]byte, (chunkCount(transfer.FileSize)+7)/8)
+	transfer.ReceivedChunks = 0
+	transfer.Progress = 0
+	return nil
+}
+
+// 发送 file_resume：接收方附带已收到的块，发送方据此只补发缺失的块
+func (node *P2PNode) sendFileResume(fileID string) error {
+	if err := node.ensurePartFile(fileID); err != nil {
+		return err
+	}
+	node.FileTransfersMutex.RLock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists {
+		node.FileTransfersMutex.RUnlock()
+		return fmt.Errorf("无效的文件传输ID")
+	}
+	resume := FileResume{
+		Type:      "file_resume",
+		FileID:    fileID,
+		FileName:  transfer.FileName,
+		FileSize:  transfer.FileSize,
+		ChunkSize: fileChunkSize,
+		Timestamp: time.Now(),
+	}
+	if transfer.Direction == "receive" {
+		resume.Bitmap = append([]byte(nil), transfer.ChunkBitmap...)
+		resume.Offset = bitmapOffset(transfer.ChunkBitmap, transfer.FileSize)
+	}
+	peerID := transfer.PeerID
+	node.FileTransfersMutex.RUnlock()
+
+	node.PeersMutex.RLock()
+	peer, online := node.Peers[peerID]
+	node.PeersMutex.RUnlock()
+	if !online || !peer.IsActive {
+		return fmt.Errorf("对方不在线，重新连接后将自动续传")
+	}
+	if !peer.hasCapability(CapabilityResume) {
+		return fmt.Errorf("对方客户端不支持断点续传")
+	}
+
+	msg := Message{
+		Type:      "file_resume",
+		From:      node.ID,
+		To:        peerID,
+		Timestamp: time.Now(),
+		Data:      resume,
+	}
+	return node.sendMessageToPeer(peer, msg)
+}
+
+// 处理续传请求
+func (node *P2PNode) handleFileResume(from string, resume FileResume) {
+	node.FileTransfersMutex.RLock()
+	transfer, exists := node.FileTransfers[resume.FileID]
+	if !exists || transfer.PeerID != from || transfer.IsJob {
+		node.FileTransfersMutex.RUnlock()
+		node.sendResumeResponse(from, resume.FileID, false, "找不到该文件传输")
+		return
+	}
+	if transfer.Status == "cancelled" {
+		node.FileTransfersMutex.RUnlock()
+		node.sendResumeResponse(from, resume.FileID, false, "该传输已取消")
+		return
+	}
+	direction := transfer.Direction
+	filePath := transfer.FilePath
+	fileSize := transfer.FileSize
+	modTime := transfer.SourceModTime
+	node.FileTransfersMutex.RUnlock()
+
+	if direction == "receive" {
+		// 发送方请求续传：报告本地已收到的块
+		node.FileTransfersMutex.Lock()
+		transfer.Resumable = true
+		if transfer.Status == "transferring" {
+			transfer.Status = "interrupted"
+		}
+		node.FileTransfersMutex.Unlock()
+		if err := node.requestResume(resume.FileID); err != nil {
+			fmt.Printf("续传 %s 失败: %v\n", transfer.FileName, err)
+		}
+		return
+	}
+
+	// 接收方报告了已收到的块：校验源文件未被修改后补发缺失的块
+	if resume.ChunkSize != fileChunkSize || resume.FileSize != fileSize {
+		node.sendResumeResponse(from, resume.FileID, false, "文件块大小或文件大小不一致")
+		return
+	}
+	info, err := os.Stat(filePath)
+	if err != nil || info.Size() != fileSize || (!modTime.IsZero() && !info.ModTime().Equal(modTime)) {
+		node.sendResumeResponse(from, resume.FileID, false, "源文件已被修改或删除")
+		node.FileTransfersMutex.Lock()
+		transfer.Status = "failed"
+		transfer.Resumable = false
+		transfer.EndTime = time.Now()
+		node.FileTransfersMutex.Unlock()
+		removeTransferState(resume.FileID)
+		node.publishTransfer(resume.FileID, true)
+		return
+	}
+
+	_, received := bitmapReceived(resume.Bitmap, fileSize)
+	node.FileTransfersMutex.Lock()
+	transfer.Status = "transferring"
+	transfer.Progress = received
+	transfer.LastUpdateTime = time.Now()
+	node.FileTransfersMutex.Unlock()
+	node.publishTransfer(resume.FileID, true)
+
+	fmt.Printf("从 %s 处继续发送文件: %s\n", formatFileSize(resume.Offset), transfer.FileName)
+	node.sendResumeResponse(from, resume.FileID, true, fmt.Sprintf("从 %d 字节处继续", resume.Offset))
+	go node.sendFile(resume.FileID, filePath, resume.Bitmap)
+}
+
+// 发送续传响应
+func (node *P2PNode) sendResumeResponse(peerID string, fileID string, accepted bool, message string) {
+	node.PeersMutex.RLock()
+	peer, exists := node.Peers[peerID]
+	node.PeersMutex.RUnlock()
+	if !exists {
+		return
+	}
+	msg := Message{
+		Type:      "file_resume_response",
+		From:      node.ID,
+		To:        peerID,
+		Timestamp: time.Now(),
+		Data: FileTransferResponse{
+			Type:      "file_resume_response",
+			FileID:    fileID,
+			Accepted:  accepted,
+			Message:   message,
+			Timestamp: time.Now(),
+		},
+	}
+	node.sendMessageToPeer(peer, msg)
+}
+
+// 处理续传响应
+func (node *P2PNode) handleFileResumeResponse(from string, response FileTransferResponse) {
+	node.FileTransfersMutex.Lock()
+	transfer, exists := node.FileTransfers[response.FileID]
+	if !exists || transfer.PeerID != from || transfer.Status == "cancelled" {
+		node.FileTransfersMutex.Unlock()
+		return
+	}
+	if response.Accepted {
+		transfer.Status = "transferring"
+		transfer.LastUpdateTime = time.Now()
+		fmt.Printf("继续接收文件 %s: %s\n", transfer.FileName, response.Message)
+	} else {
+		transfer.Status = "failed"
+		transfer.Resumable = false
+		transfer.EndTime = time.Now()
+		fmt.Printf("文件 %s 无法续传: %s\n", transfer.FileName, response.Message)
+	}
+	node.FileTransfersMutex.Unlock()
+
+	if !response.Accepted {
+		removeTransferState(response.FileID)
+	}
+	node.publishTransfer(response.FileID, true)
+}
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// 历史消息全文搜索
+//
+// 消息内容加密存储，因此索引中不保存明文词语：每个词经 HMAC（密钥由数据库密钥派生）
+// 转换为不可逆的令牌后写入 message_tokens 表。搜索时对关键词做同样的转换，
+// 按令牌找出候选消息，解密后再逐条核对并生成摘要。
+//
+// 分词规则：
+//   - 拉丁字母和数字按单词切分，同时索引长度不少于3的前缀，支持前缀搜索
+//   - 中日韩文字按单字和相邻两字索引，支持任意长度的中文词语
+const (
+	searchIndexVersion    = "1"
+	settingSearchIndex    = "search_index_version"
+	searchTokenSize       = 16
+	searchMinPrefixLen    = 3
+	searchMaxPrefixLen    = 32
+	searchDefaultLimit    = 20
+	searchMaxLimit        = 100
+	searchSnippetRadius   = 30 // 摘要中命中位置前后保留的字符数
+	searchDefaultContext  = 5  // 跳转到上下文时前后显示的消息数
+	searchMaxContext      = 50
+	searchDateLayout      = "2006-01-02"
+	searchTimestampLayout = "2006-01-02 15:04:05"
+)
+
+// SearchFilter结构体 - 搜索条件
+type SearchFilter struct {
+	Query        string
+	Sender       string // 发送者用户名，"我" 表示自己发送的消息
+	Conversation string // "all" 表示公聊，否则为私聊对象的用户名
+	MessageType  string
+	Since        time.Time // 包含
+	Until        time.Time // 不包含
+	Limit        int
+}
+
+// SnippetSegment结构体 - 摘要片段，Match 为 true 的片段需要高亮
+type SnippetSegment struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match"`
+}
+
+// SearchResult结构体 - 单条搜索结果
+type SearchResult struct {
+	ID           int64            `json:"id"`
+	Sender       string           `json:"sender"`
+	Recipient    string           `json:"recipient"`
+	Conversation string           `json:"conversation"`
+	Timestamp    time.Time        `json:"timestamp"`
+	MessageType  string           `json:"messageType"`
+	IsPrivate    bool             `json:"isPrivate"`
+	IsOwn        bool             `json:"isOwn"`
+	FileName     string           `json:"fileName,omitempty"`
+	Snippet      []SnippetSegment `json:"snippet"`
+}
+
+// ContextMessage结构体 - 跳转到上下文时返回的消息
+type ContextMessage struct {
+	ID          int64     `json:"id"`
+	Sender      string    `json:"sender"`
+	Recipient   string    `json:"recipient"`
+	Content     string    `json:"content"`
+	Timestamp   time.Time `json:"timestamp"`
+	MessageType string    `json:"messageType"`
+	IsOwn       bool      `json:"isOwn"`
+	FileName    string    `json:"fileName,omitempty"`
+	IsTarget    bool      `json:"isTarget"` // 是否为搜索命中的消息
+}
+
+// 可执行SQL语句的对象（*sql.DB 或 *sql.Tx）
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// 由数据库密钥派生索引密钥，与消息加密密钥相互独立
+func searchIndexKey(dbKey [32]byte) []byte {
+	mac := hmac.New(sha256.New, dbKey[:])
+	mac.Write([]byte("LANShare-search-index"))
+	return mac.Sum(nil)
+}
+
+// 将词语转换为索引令牌
+func blindToken(indexKey []byte, term string) []byte {
+	mac := hmac.New(sha256.New, indexKey)
+	mac.Write([]byte(term))
+	return mac.Sum(nil)[:searchTokenSize]
+}
+
+// 是否为按字索引的文字（中日韩）
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r)
+}
+
+// 切分文本：返回拉丁单词和中日韩连续片段（均已转为小写）
+func splitSearchText(text string) (words []string, cjkRuns []string) {
+	var word, cjk []rune
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, string(word))
+			word = word[:0]
+		}
+		if len(cjk) > 0 {
+			cjkRuns = append(cjkRuns, string(cjk))
+			cjk = cjk[:0]
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case isCJK(r):
+			if len(word) > 0 {
+				flush()
+			}
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if len(cjk) > 0 {
+				flush()
+			}
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return words, cjkRuns
+}
+
+// 中日韩片段的单字和相邻两字
+func cjkTerms(run string, withUnigrams bool) []string {
+	runes := []rune(run)
+	var terms []string
+	if len(runes) == 1 || withUnigrams {
+		for _, r := range runes {
+			terms = append(terms, string(r))
+		}
+	}
+	for i := 0; i+1 < len(runes); i++ {
+		terms = append(terms, string(runes[i:i+2]))
+	}
+	return terms
+}
+
+// 生成写入索引的词语（去重）
+func indexTerms(text string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	add := func(term string) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+
+	words, cjkRuns := splitSearchText(text)
+	for _, word := range words {
+		add(word)
+		runes := []rune(word)
+		for n := searchMinPrefixLen; n < len(runes) && n <= searchMaxPrefixLen; n++ {
+			add(string(runes[:n]))
+		}
+	}
+	for _, run := range cjkRuns {
+		for _, term := range cjkTerms(run, true) {
+			add(term)
+		}
+	}
+	return terms
+}
+
+// 生成查询使用的词语（去重）
+func queryTerms(query string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	add := func(term string) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+
+	words, cjkRuns := splitSearchText(query)
+	for _, word := range words {
+		runes := []rune(word)
+		if len(runes) > searchMaxPrefixLen {
+			runes = runes[:searchMaxPrefixLen]
+		}
+		add(string(runes))
+	}
+	for _, run := range cjkRuns {
+		for _, term := range cjkTerms(run, false) {
+			add(term)
+		}
+	}
+	return terms
+}
+
+// 消息中参与搜索的文本
+func searchableText(content, fileName string) string {
+	if strings.HasPrefix(content, "emoji:") {
+		content = ""
+	}
+	if fileName != "" && !strings.Contains(content, fileName) {
+		return content + " " + fileName
+	}
+	return content
+}
+
+// 为一条消息写入索引
+func indexMessage(exec sqlExecer, indexKey []byte, rowID int64, content, fileName string) error {
+	for _, term := range indexTerms(searchableText(content, fileName)) {
+		if _, err := exec.Exec("INSERT INTO message_tokens (token, message_rowid) VALUES (?, ?)",
+			blindToken(indexKey, term), rowID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 重建全部索引（索引格式升级或首次启用搜索时）
+func (node *P2PNode) rebuildSearchIndex() error {
+	node.DBKeyMutex.RLock()
+	defer node.DBKeyMutex.RUnlock()
+
+	tx, err := node.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM message_tokens"); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT id, content, nonce, COALESCE(file_name, '') FROM messages")
+	if err != nil {
+		return err
+	}
+	type plainRow struct {
+		id       int64
+		content  string
+		fileName string
+	}
+	var plain []plainRow
+	for rows.Next() {
+		var id int64
+		var content, nonce []byte
+		var fileName string
+		if err := rows.Scan(&id, &content, &nonce, &fileName); err != nil {
+			rows.Close()
+			return err
+		}
+		plaintext, err := decryptMessage(node.LocalDBKey, content, nonce)
+		if err != nil {
+			continue
+		}
+		plain = append(plain, plainRow{id, string(plaintext), fileName})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	indexKey := searchIndexKey(node.LocalDBKey)
+	for _, row := range plain {
+		if err := indexMessage(tx, indexKey, row.id, row.content, row.fileName); err != nil {
+			return err
+		}
+	}
+	if err := setSettingTx(tx, settingSearchIndex, searchIndexVersion); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(plain) > 0 {
+		fmt.Printf("已为 %d 条历史消息建立搜索索引\n", len(plain))
+	}
+	return nil
+}
+
+// 搜索历史消息
+func (node *P2PNode) searchMessages(filter SearchFilter) ([]SearchResult, error) {
+	if node.DB == nil {
+		return nil, fmt.Errorf("数据库未启用")
+	}
+	terms := queryTerms(filter.Query)
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("请输入搜索关键词")
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = searchDefaultLimit
+	}
+	if limit > searchMaxLimit {
+		limit = searchMaxLimit
+	}
+
+	node.DBKeyMutex.RLock()
+	defer node.DBKeyMutex.RUnlock()
+	indexKey := searchIndexKey(node.LocalDBKey)
+
+	// 候选消息：包含全部查询令牌
+	placeholders := make([]string, len(terms))
+	args := make([]interface{}, 0, len(terms)+8)
+	for i, term := range terms {
+		placeholders[i] = "?"
+		args = append(args, blindToken(indexKey, term))
+	}
+	args = append(args, len(terms))
+
+	query := `
+		SELECT id, sender, recipient, content, nonce, is_private, is_own, timestamp,
+			   COALESCE(message_type, 'text'), COALESCE(file_name, '')
+		FROM messages
+		WHERE id IN (
+			SELECT message_rowid FROM message_tokens
+			WHERE token IN (` + strings.Join(placeholders, ",") + `)
+			GROUP BY message_rowid
+			HAVING COUNT(DISTINCT token) = ?
+		)`
+
+	if filter.Sender != "" {
+		if filter.Sender == "我" || filter.Sender == node.Name {
+			query += " AND is_own = TRUE"
+		} else {
+			query += " AND is_own = FALSE AND (sender_id = ? OR sender = ?)"
+			args = append(args, node.resolvePeerID(filter.Sender), filter.Sender)
+		}
+	}
+	if filter.Conversation == "all" {
+		query += " AND recipient = 'all' AND is_private = FALSE"
+	} else if filter.Conversation != "" {
+		peerID := node.resolvePeerID(filter.Conversation)
+		query += ` AND is_private = TRUE AND (
+			(sender_id = ? AND recipient_id = ?) OR
+			(sender_id = ? AND recipient_id = ?) OR
+			(sender_id IS NULL AND (
+				(sender = ? AND recipient = ?) OR
+				(sender = ? AND recipient = ?)
+			))
+		)`
+		args = append(args, node.ID, peerID, peerID, node.ID,
+			node.Name, filter.Conversation, filter.Conversation, node.Name)
+	}
+	if filter.MessageType != "" {
+		query += " AND message_type = ?"
+		args = append(args, filter.MessageType)
+	}
+	// 时间戳以UTC保存
+	if !filter.Since.IsZero() {
+		query += " AND timestamp >= ?"
+		args = append(args, filter.Since.UTC().Format(searchTimestampLayout))
+	}
+	if !filter.Until.IsZero() {
+		query += " AND timestamp < ?"
+		args = append(args, filter.Until.UTC().Format(searchTimestampLayout))
+	}
+	query += " ORDER BY timestamp DESC, id DESC"
+
+	rows, err := node.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	phrases := queryPhrases(filter.Query)
+	var results []SearchResult
+	for rows.Next() && len(results) < limit {
+		var result SearchResult
+		var content, nonce []byte
+		if err := rows.Scan(&result.ID, &result.Sender, &result.Recipient, &content, &nonce,
+			&result.IsPrivate, &result.IsOwn, &result.Timestamp, &result.MessageType, &result.FileName); err != nil {
+			continue
+		}
+		plaintext, err := decryptMessage(node.LocalDBKey, content, nonce)
+		if err != nil {
+			continue
+		}
+
+		// 令牌可能组合命中（如不相邻的两字），解密后逐条核对
+		text := searchableText(string(plaintext), result.FileName)
+		snippet, ok := buildSnippet(text, phrases)
+		if !ok {
+			continue
+		}
+		result.Snippet = snippet
+		result.Conversation = "all"
+		if result.IsPrivate {
+			if result.IsOwn {
+				result.Conversation = result.Recipient
+			} else {
+				result.Conversation = result.Sender
+			}
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// 查询中需要逐字匹配的词（小写，按空白切分）
+func queryPhrases(query string) []string {
+	var phrases []string
+	for _, field := range strings.Fields(strings.ToLower(query)) {
+		// 去掉首尾标点，如 "链接，" 或 "(demo)"
+		field = strings.TrimFunc(field, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		if field != "" {
+			phrases = append(phrases, field)
+		}
+	}
+	return phrases
+}
+
+var snippetWhitespace = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ", "\t", " ")
+
+// 生成带高亮的摘要；任一查询词不在文本中时返回 false
+func buildSnippet(text string, phrases []string) ([]SnippetSegment, bool) {
+	runes := []rune(text)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	matched := make([]bool, len(runes))
+	first := len(runes)
+	for _, phrase := range phrases {
+		target := []rune(phrase)
+		found := false
+		for i := 0; i+len(target) <= len(lower); i++ {
+			if string(lower[i:i+len(target)]) != phrase {
+				continue
+			}
+			found = true
+			for j := i; j < i+len(target); j++ {
+				matched[j] = true
+			}
+			if i < first {
+				first = i
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+
+	start := first - searchSnippetRadius
+	if start < 0 {
+		start = 0
+	}
+	end := first + searchSnippetRadius*3
+	if end > len(runes) {
+		end = len(runes)
+	}
+
+	var segments []SnippetSegment
+	if start > 0 {
+		segments = append(segments, SnippetSegment{Text: "…"})
+	}
+	for i := start; i < end; {
+		j := i
+		for j < end && matched[j] == matched[i] {
+			j++
+		}
+		// 摘要显示为单行
+		text := snippetWhitespace.Replace(string(runes[i:j]))
+		segments = append(segments, SnippetSegment{Text: text, Match: matched[i]})
+		i = j
+	}
+	if end < len(runes) {
+		segments = append(segments, SnippetSegment{Text: "…"})
+	}
+	return segments, true
+}
+
+// 获取某条消息所在会话的前后消息
+func (node *P2PNode) messageContext(id int64, radius int) ([]ContextMessage, error) {
+	if node.DB == nil {
+		return nil, fmt.Errorf("数据库未启用")
+	}
+	if radius <= 0 {
+		radius = searchDefaultContext
+	}
+	if radius > searchMaxContext {
+		radius = searchMaxContext
+	}
+
+	var isPrivate bool
+	var senderID, recipientID sql.NullString
+	var sender, recipient string
+	err := node.DB.QueryRow(`
+		SELECT is_private, sender_id, recipient_id, sender, recipient
+		FROM messages WHERE id = ?
+	`, id).Scan(&isPrivate, &senderID, &recipientID, &sender, &recipient)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("消息 #%d 不存在", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 与目标消息同一会话的条件
+	var where string
+	var args []interface{}
+	if !isPrivate {
+		where = "recipient = 'all' AND is_private = FALSE"
+	} else if senderID.Valid && recipientID.Valid {
+		where = `is_private = TRUE AND (
+			(sender_id = ? AND recipient_id = ?) OR (sender_id = ? AND recipient_id = ?))`
+		args = []interface{}{senderID.String, recipientID.String, recipientID.String, senderID.String}
+	} else {
+		where = `is_private = TRUE AND (
+			(sender = ? AND recipient = ?) OR (sender = ? AND recipient = ?))`
+		args = []interface{}{sender, recipient, recipient, sender}
+	}
+
+	query := `
+		SELECT * FROM (
+			SELECT id, sender, recipient, content, nonce, timestamp,
+				   COALESCE(message_type, 'text'), is_own, COALESCE(file_name, '')
+			FROM messages WHERE ` + where + ` AND id < ?
+			ORDER BY id DESC LIMIT ?
+		)
+		UNION ALL
+		SELECT * FROM (
+			SELECT id, sender, recipient, content, nonce, timestamp,
+				   COALESCE(message_type, 'text'), is_own, COALESCE(file_name, '')
+			FROM messages WHERE ` + where + ` AND id >= ?
+			ORDER BY id ASC LIMIT ?
+		)
+		ORDER BY id ASC`
+	queryArgs := append(append([]interface{}{}, args...), id, radius)
+	queryArgs = append(queryArgs, args...)
+	queryArgs = append(queryArgs, id, radius+1)
+
+	rows, err := node.DB.Query(query, queryArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []ContextMessage
+	for rows.Next() {
+		var msg ContextMessage
+		var content, nonce []byte
+		if err := rows.Scan(&msg.ID, &msg.Sender, &msg.Recipient, &content, &nonce,
+			&msg.Timestamp, &msg.MessageType, &msg.IsOwn, &msg.FileName); err != nil {
+			continue
+		}
+		plaintext, err := node.decryptFromDB(content, nonce)
+		if err != nil {
+			continue
+		}
+		msg.Content = string(plaintext)
+		msg.IsTarget = msg.ID == id
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// 解析命令行搜索参数: from:用户 in:会话 type:类型 after:日期 before:日期，其余为关键词
+func parseSearchArgs(args []string) (SearchFilter, error) {
+	var filter SearchFilter
+	var terms []string
+	for _, arg := range args {
+		key, value, found := strings.Cut(arg, ":")
+		if !found || value == "" {
+			terms = append(terms, arg)
+			continue
+		}
+		switch key {
+		case "from":
+			filter.Sender = value
+		case "in":
+			filter.Conversation = value
+		case "type":
+			filter.MessageType = value
+		case "after", "before":
+			date, err := time.ParseInLocation(searchDateLayout, value, time.Local)
+			if err != nil {
+				return filter, fmt.Errorf("日期格式应为 YYYY-MM-DD: %s", value)
+			}
+			if key == "after" {
+				filter.Since = date
+			} else {
+				filter.Until = date.AddDate(0, 0, 1) // 包含当天
+			}
+		default:
+			// 关键词本身可能包含冒号（如链接）
+			terms = append(terms, arg)
+		}
+	}
+	filter.Query = strings.Join(terms, " ")
+	return filter, nil
+}
+
+// 将摘要渲染为命令行文本，命中部分用【】标出
+func formatSnippet(segments []SnippetSegment) string {
+	var b strings.Builder
+	for _, segment := range segments {
+		if segment.Match {
+			b.WriteString("【" + segment.Text + "】")
+		} else {
+			b.WriteString(segment.Text)
+		}
+	}
+	return b.String()
+}
+
+// 命令行搜索
+func (node *P2PNode) runSearchCommand(args []string) {
+	filter, err := parseSearchArgs(args)
+	if err != nil {
+		fmt.Printf("错误: %v\n", err)
+		return
+	}
+	results, err := node.searchMessages(filter)
+	if err != nil {
+		fmt.Printf("搜索失败: %v\n", err)
+		return
+	}
+	if len(results) == 0 {
+		fmt.Println("没有找到匹配的消息")
+		return
+	}
+
+	fmt.Printf("找到 %d 条消息:\n", len(results))
+	for _, result := range results {
+		where := "公聊"
+		if result.IsPrivate {
+			where = "私聊 " + result.Conversation
+		}
+		sender := result.Sender
+		if result.IsOwn {
+			sender = "我"
+		}
+		fmt.Printf("  #%d [%s] %s (%s): %s\n", result.ID,
+			result.Timestamp.Local().Format("2006-01-02 15:04"), sender, where, formatSnippet(result.Snippet))
+	}
+	fmt.Println("使用 /context <#编号> 查看消息上下文")
+}
+
+// 命令行显示消息上下文
+func (node *P2PNode) showMessageContext(id int64, radius int) {
+	messages, err := node.messageContext(id, radius)
+	if err != nil {
+		fmt.Printf("获取上下文失败: %v\n", err)
+		return
+	}
+	for _, msg := range messages {
+		marker := "  "
+		if msg.IsTarget {
+			marker = "> "
+		}
+		sender := msg.Sender
+		if msg.IsOwn {
+			sender = "我"
+		}
+		content := msg.Content
+		if strings.HasPrefix(content, "emoji:") {
+			content = "[表情]"
+		}
+		fmt.Printf("%s#%d [%s] %s: %s\n", marker, msg.ID,
+			msg.Timestamp.Local().Format("2006-01-02 15:04:05"), sender, content)
+	}
+}
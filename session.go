@@ -0,0 +1,529 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// 自动重新协商密钥的阈值（任一达到即触发）
+const (
+	rekeyMessageThreshold = 10000         // 每个epoch最多发送的消息数
+	rekeyByteThreshold    = 256 << 20     // 每个epoch最多发送的字节数
+	rekeyInterval         = 1 * time.Hour // 每个epoch的最长使用时间
+)
+
+// 加密帧头: epoch(4) | 序号(8)，其后为AEAD密文；帧头作为附加认证数据
+const sealedHeaderSize = 12
+
+// 重放保护参数
+const (
+	replayWindowSize = 64   // 接收窗口：允许迟到的最大序号差
+	maxSkippedKeys   = 1024 // 单次最多跳过的序号数，防止恶意大序号耗尽资源
+)
+
+// 被丢弃的加密帧，连接可以继续使用
+var errFrameDropped = errors.New("加密帧已丢弃")
+
+// 帧被丢弃的原因
+var (
+	errReplayedFrame = fmt.Errorf("%w: 重复的序号", errFrameDropped)
+	errStaleFrame    = fmt.Errorf("%w: 序号已超出接收窗口", errFrameDropped)
+	errForgedFrame   = fmt.Errorf("%w: 认证失败", errFrameDropped)
+)
+
+// receiveChain结构体 - 单个epoch的接收状态
+type receiveChain struct {
+	chain   [32]byte            // 下一个序号对应的链密钥
+	next    uint64              // 下一个期望的序号
+	skipped map[uint64][32]byte // 窗口内尚未收到的序号及其消息密钥
+}
+
+func newReceiveChain(chain [32]byte) *receiveChain {
+	return &receiveChain{chain: chain, skipped: make(map[uint64][32]byte)}
+}
+
+// 清除接收状态中的全部密钥
+func (rc *receiveChain) wipe() {
+	rc.chain = [32]byte{}
+	for seq := range rc.skipped {
+		delete(rc.skipped, seq)
+	}
+}
+
+// SessionStats结构体 - 加密帧的拒绝统计（原子计数）
+type SessionStats struct {
+	ReplayRejected uint64 `json:"replayRejected"` // 重复序号
+	StaleRejected  uint64 `json:"staleRejected"`  // 序号过旧
+	AuthFailed     uint64 `json:"authFailed"`     // 认证失败（篡改或伪造）
+}
+
+// 记录一次被拒绝的帧
+func (stats *SessionStats) record(err error) {
+	switch {
+	case errors.Is(err, errReplayedFrame):
+		atomic.AddUint64(&stats.ReplayRejected, 1)
+	case errors.Is(err, errStaleFrame):
+		atomic.AddUint64(&stats.StaleRejected, 1)
+	case errors.Is(err, errForgedFrame):
+		atomic.AddUint64(&stats.AuthFailed, 1)
+	}
+}
+
+// 读取统计快照
+func (stats *SessionStats) snapshot() SessionStats {
+	return SessionStats{
+		ReplayRejected: atomic.LoadUint64(&stats.ReplayRejected),
+		StaleRejected:  atomic.LoadUint64(&stats.StaleRejected),
+		AuthFailed:     atomic.LoadUint64(&stats.AuthFailed),
+	}
+}
+
+// SecureSession结构体 - 会话密钥状态
+//
+// 握手得到的共享密钥经HKDF派生出根密钥，再按连接方向派生两条链密钥。
+// 每条消息使用链密钥派生的一次性消息密钥，随后链密钥前移并覆盖旧值，
+// 因此泄露当前状态无法解密之前的消息。达到阈值后双方交换新的临时公钥，
+// 将新的DH结果混入根密钥并进入下一个epoch。
+type SecureSession struct {
+	mutex sync.Mutex
+
+	initiator bool // 是否为连接发起方，决定链密钥方向
+	epoch     uint32
+	rootKey   [32]byte
+	sendChain [32]byte
+	sendSeq   uint64 // 当前epoch下一条发送消息的序号
+	recv      *receiveChain
+
+	// 上一个epoch的接收链，用于接收切换期间仍在途中的消息
+	prevRecv *receiveChain
+
+	// 当前epoch的发送统计
+	sentMessages uint64
+	sentBytes    uint64
+	epochStart   time.Time
+
+	// 本端发起、尚未确认的密钥更新
+	rekeyPending    bool
+	rekeyPrivateKey [32]byte
+}
+
+// 由握手共享密钥创建会话
+func newSecureSession(shared [32]byte, initiator bool) *SecureSession {
+	session := &SecureSession{initiator: initiator}
+	root := hkdfExpand(shared[:], nil, "LANShare-session-root")
+	session.installRoot(root)
+	return session
+}
+
+// HKDF-SHA256 派生32字节密钥
+func hkdfExpand(secret, salt []byte, info string) [32]byte {
+	var out [32]byte
+	reader := hkdf.New(sha256.New, secret, salt, []byte(info))
+	if _, err := io.ReadFull(reader, out[:]); err != nil {
+		panic(err) // HKDF 输出32字节不会失败
+	}
+	return out
+}
+
+// 链密钥前移：返回本条消息的密钥，并用下一个链密钥覆盖当前值
+func ratchetStep(chain *[32]byte) [32]byte {
+	mac := hmac.New(sha256.New, chain[:])
+	mac.Write([]byte{0x01})
+	var messageKey [32]byte
+	copy(messageKey[:], mac.Sum(nil))
+
+	mac = hmac.New(sha256.New, chain[:])
+	mac.Write([]byte{0x02})
+	copy(chain[:], mac.Sum(nil))
+	return messageKey
+}
+
+// 安装新的根密钥并派生双向链密钥（调用方需持有锁或处于初始化阶段）
+func (session *SecureSession) installRoot(root [32]byte) {
+	initiatorChain := hkdfExpand(root[:], nil, "LANShare-chain-initiator")
+	responderChain := hkdfExpand(root[:], nil, "LANShare-chain-responder")
+
+	session.rootKey = root
+	if session.initiator {
+		session.sendChain = initiatorChain
+		session.recv = newReceiveChain(responderChain)
+	} else {
+		session.sendChain = responderChain
+		session.recv = newReceiveChain(initiatorChain)
+	}
+	session.sendSeq = 0
+	session.sentMessages = 0
+	session.sentBytes = 0
+	session.epochStart = time.Now()
+}
+
+// 加密帧: 负载 = epoch(4) | 序号(8) | AEAD(内层帧类型(1) | 内层负载)
+// 每条消息的密钥只使用一次，因此nonce固定为零
+func (session *SecureSession) seal(innerType byte, innerPayload []byte) ([]byte, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	messageKey := ratchetStep(&session.sendChain)
+	aead, err := newSessionAEAD(messageKey[:])
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, 0, 1+len(innerPayload))
+	plaintext = append(plaintext, innerType)
+	plaintext = append(plaintext, innerPayload...)
+
+	header := make([]byte, sealedHeaderSize)
+	binary.BigEndian.PutUint32(header, session.epoch)
+	binary.BigEndian.PutUint64(header[4:], session.sendSeq)
+	session.sendSeq++
+
+	nonce := make([]byte, aead.NonceSize())
+	sealed := aead.Seal(header, nonce, plaintext, sealedAD(header))
+
+	session.sentMessages++
+	session.sentBytes += uint64(len(innerPayload))
+	return sealed, nil
+}
+
+// 解密帧，返回内层帧类型和负载
+func (session *SecureSession) open(payload []byte) (byte, []byte, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if len(payload) < sealedHeaderSize+1 {
+		return 0, nil, fmt.Errorf("加密帧过短")
+	}
+	header := payload[:sealedHeaderSize]
+	epoch := binary.BigEndian.Uint32(header)
+	seq := binary.BigEndian.Uint64(header[4:])
+
+	var rc *receiveChain
+	switch {
+	case epoch == session.epoch:
+		rc = session.recv
+	case epoch+1 == session.epoch && session.prevRecv != nil:
+		rc = session.prevRecv
+	case epoch < session.epoch:
+		return 0, nil, errStaleFrame
+	default:
+		return 0, nil, fmt.Errorf("%w: 未知的epoch %d (当前 %d)", errForgedFrame, epoch, session.epoch)
+	}
+
+	plaintext, err := rc.open(seq, payload[sealedHeaderSize:], sealedAD(header))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(plaintext) == 0 {
+		return 0, nil, fmt.Errorf("加密帧内容为空")
+	}
+
+	// 对端已切换到当前epoch，旧接收链不再需要
+	if epoch == session.epoch && session.prevRecv != nil {
+		session.prevRecv.wipe()
+		session.prevRecv = nil
+	}
+	return plaintext[0], plaintext[1:], nil
+}
+
+// 按序号解密，拒绝重复和超出窗口的帧
+func (rc *receiveChain) open(seq uint64, ciphertext, ad []byte) ([]byte, error) {
+	if seq < rc.next {
+		messageKey, ok := rc.skipped[seq]
+		if !ok {
+			if rc.next-seq > replayWindowSize {
+				return nil, errStaleFrame
+			}
+			return nil, errReplayedFrame
+		}
+		plaintext, err := openWithMessageKey(messageKey, ciphertext, ad)
+		if err != nil {
+			return nil, err
+		}
+		delete(rc.skipped, seq)
+		return plaintext, nil
+	}
+
+	if seq-rc.next > maxSkippedKeys {
+		return nil, fmt.Errorf("%w: 序号跳跃过大 (%d)", errForgedFrame, seq-rc.next)
+	}
+
+	// 先在副本上前移链密钥，认证成功后才提交，避免伪造帧打乱状态
+	next := rc.chain
+	skipped := make(map[uint64][32]byte)
+	for i := rc.next; i < seq; i++ {
+		skipped[i] = ratchetStep(&next)
+	}
+	messageKey := ratchetStep(&next)
+	plaintext, err := openWithMessageKey(messageKey, ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.chain = next
+	rc.next = seq + 1
+	for i, key := range skipped {
+		rc.skipped[i] = key
+	}
+	// 丢弃已滑出窗口的密钥
+	for i := range rc.skipped {
+		if rc.next-i > replayWindowSize {
+			delete(rc.skipped, i)
+		}
+	}
+	return plaintext, nil
+}
+
+// 使用一次性消息密钥解密
+func openWithMessageKey(messageKey [32]byte, ciphertext, ad []byte) ([]byte, error) {
+	aead, err := newSessionAEAD(messageKey[:])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	plaintext, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, errForgedFrame
+	}
+	return plaintext, nil
+}
+
+// 加密帧的附加认证数据，绑定协议版本、帧类型和帧头
+func sealedAD(header []byte) []byte {
+	ad := []byte{frameMagic, ProtocolVersionCurrent, FrameTypeSealed}
+	return append(ad, header...)
+}
+
+// 是否达到自动更新密钥的阈值
+func (session *SecureSession) shouldRekey() bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.rekeyPending {
+		return false
+	}
+	return session.sentMessages >= rekeyMessageThreshold ||
+		session.sentBytes >= rekeyByteThreshold ||
+		time.Since(session.epochStart) >= rekeyInterval
+}
+
+// 开始一次密钥更新，返回本端新的临时公钥；已有未完成的更新时返回false
+func (session *SecureSession) beginRekey() ([32]byte, bool, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.rekeyPending {
+		return [32]byte{}, false, nil
+	}
+	privateKey, publicKey, err := generateECDHKeyPair()
+	if err != nil {
+		return [32]byte{}, false, err
+	}
+	session.rekeyPending = true
+	session.rekeyPrivateKey = privateKey
+	return publicKey, true, nil
+}
+
+// 进入下一个epoch：将新的DH结果混入根密钥，保留旧接收链以处理在途消息
+func (session *SecureSession) advanceEpoch(dhShared [32]byte) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	newRoot := hkdfExpand(dhShared[:], session.rootKey[:], "LANShare-rekey")
+	if session.prevRecv != nil {
+		session.prevRecv.wipe()
+	}
+	session.prevRecv = session.recv
+	session.epoch++
+	session.installRoot(newRoot)
+
+	session.rekeyPending = false
+	session.rekeyPrivateKey = [32]byte{}
+}
+
+// 当前epoch
+func (session *SecureSession) currentEpoch() uint32 {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.epoch
+}
+
+// SessionStatus结构体 - 会话状态快照，用于诊断
+type SessionStatus struct {
+	Epoch        uint32 `json:"epoch"`
+	SentMessages uint64 `json:"sentMessages"`
+	SentBytes    uint64 `json:"sentBytes"`
+	NextSendSeq  uint64 `json:"nextSendSeq"`
+	NextRecvSeq  uint64 `json:"nextRecvSeq"`
+	PendingSeqs  int    `json:"pendingSeqs"` // 窗口内尚未到达的序号数
+	EpochAge     string `json:"epochAge"`
+}
+
+// 读取会话状态快照
+func (session *SecureSession) status() SessionStatus {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return SessionStatus{
+		Epoch:        session.epoch,
+		SentMessages: session.sentMessages,
+		SentBytes:    session.sentBytes,
+		NextSendSeq:  session.sendSeq,
+		NextRecvSeq:  session.recv.next,
+		PendingSeqs:  len(session.recv.skipped),
+		EpochAge:     time.Since(session.epochStart).Round(time.Second).String(),
+	}
+}
+
+// 显示所有在线节点的连接诊断信息
+func (node *P2PNode) showDiagnostics() {
+	node.PeersMutex.RLock()
+	peers := make([]*Peer, 0, len(node.Peers))
+	for _, peer := range node.Peers {
+		if peer.IsActive {
+			peers = append(peers, peer)
+		}
+	}
+	node.PeersMutex.RUnlock()
+
+	if len(peers) == 0 {
+		fmt.Println("当前没有在线节点")
+		return
+	}
+
+	fmt.Println("连接诊断:")
+	for _, peer := range peers {
+		fmt.Printf("  %s (%s)\n", peer.Name, peer.Address)
+		fmt.Printf("    协议版本: v%d  加密信封: %v\n", peer.ProtocolVersion, peer.sealsEnvelope())
+		if peer.sealsEnvelope() {
+			status := peer.Session.status()
+			fmt.Printf("    epoch: %d (已使用 %s)  已发送: %d 条 / %d 字节\n",
+				status.Epoch, status.EpochAge, status.SentMessages, status.SentBytes)
+			fmt.Printf("    序号: 下一发送 %d  下一接收 %d  窗口内待到达 %d\n",
+				status.NextSendSeq, status.NextRecvSeq, status.PendingSeqs)
+		}
+		stats := peer.FrameStats.snapshot()
+		fmt.Printf("    拒绝的帧: 重放 %d  过旧 %d  认证失败 %d\n",
+			stats.ReplayRejected, stats.StaleRejected, stats.AuthFailed)
+	}
+}
+
+// 创建会话使用的AES-GCM
+func newSessionAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("会话密钥长度无效: %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 是否对该对端使用加密信封（需双方支持且握手已完成）
+func (peer *Peer) sealsEnvelope() bool {
+	return peer.ProtocolVersion >= ProtocolVersionFramed &&
+		peer.hasCapability(CapabilitySealedEnvelope) &&
+		peer.Session != nil
+}
+
+// 握手完成后处理共享密钥：使用加密信封的节点只需要会话密钥，共享密钥随即清除；
+// 旧版节点仍用它逐条加密聊天内容和文件块
+func (peer *Peer) retainSharedKey(shared *[32]byte) {
+	if peer.sealsEnvelope() {
+		peer.SharedKey = nil
+	} else {
+		peer.SharedKey = append([]byte(nil), shared[:]...)
+	}
+	*shared = [32]byte{}
+}
+
+// 发起密钥更新
+func (node *P2PNode) initiateRekey(peer *Peer) {
+	session := peer.Session
+	if session == nil {
+		return
+	}
+	publicKey, started, err := session.beginRekey()
+	if err != nil {
+		fmt.Printf("生成密钥更新公钥失败: %v\n", err)
+		return
+	}
+	if !started {
+		return
+	}
+
+	msg := Message{
+		Type:         "rekey",
+		From:         node.ID,
+		Timestamp:    time.Now(),
+		SenderPubKey: publicKey[:],
+	}
+	if err := node.sendMessageToPeer(peer, msg); err != nil {
+		fmt.Printf("发送密钥更新请求失败: %v\n", err)
+	}
+}
+
+// 处理密钥更新消息（在连接读取循环中同步调用，保证后续帧使用正确的epoch）
+func (node *P2PNode) handleRekey(peer *Peer, msg Message) error {
+	session := peer.Session
+	if session == nil || len(msg.SenderPubKey) != 32 {
+		return fmt.Errorf("无效的密钥更新消息")
+	}
+	var remotePub [32]byte
+	copy(remotePub[:], msg.SenderPubKey)
+
+	switch msg.Type {
+	case "rekey":
+		session.mutex.Lock()
+		pending := session.rekeyPending
+		session.mutex.Unlock()
+		// 双方同时发起时，节点ID较小的一方的请求优先
+		if pending && node.ID < peer.ID {
+			return nil
+		}
+
+		privateKey, publicKey, err := generateECDHKeyPair()
+		if err != nil {
+			return err
+		}
+		shared := deriveSharedKey(privateKey, remotePub)
+
+		// 确认消息仍使用旧epoch发送，发送后立即切换，两步之间不允许其他写入
+		ack := Message{
+			Type:         "rekey_ack",
+			From:         node.ID,
+			Timestamp:    time.Now(),
+			SenderPubKey: publicKey[:],
+		}
+		peer.WriteMutex.Lock()
+		err = node.writePeerMessageLocked(peer, ack)
+		if err == nil {
+			session.advanceEpoch(shared)
+		}
+		peer.WriteMutex.Unlock()
+		return err
+
+	case "rekey_ack":
+		session.mutex.Lock()
+		pending := session.rekeyPending
+		privateKey := session.rekeyPrivateKey
+		session.mutex.Unlock()
+		if !pending {
+			return nil
+		}
+		shared := deriveSharedKey(privateKey, remotePub)
+		peer.WriteMutex.Lock()
+		session.advanceEpoch(shared)
+		peer.WriteMutex.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// 由同一共享密钥创建发起方和响应方会话
+func newSessionPair(t *testing.T) (*SecureSession, *SecureSession) {
+	t.Helper()
+	var shared [32]byte
+	if _, err := rand.Read(shared[:]); err != nil {
+		t.Fatal(err)
+	}
+	return newSecureSession(shared, true), newSecureSession(shared, false)
+}
+
+// 模拟一次完整的密钥更新：a 发起，b 确认
+func rekeySessions(t *testing.T, a, b *SecureSession) {
+	t.Helper()
+	publicKey, started, err := a.beginRekey()
+	if err != nil || !started {
+		t.Fatalf("beginRekey = %v, %v", started, err)
+	}
+	privateKey, ackKey, err := generateECDHKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.advanceEpoch(deriveSharedKey(privateKey, publicKey))
+	a.advanceEpoch(deriveSharedKey(a.rekeyPrivateKey, ackKey))
+}
+
+func mustSeal(t *testing.T, session *SecureSession, payload string) []byte {
+	t.Helper()
+	sealed, err := session.seal(FrameTypeJSON, []byte(payload))
+	if err != nil {
+		t.Fatalf("seal 返回错误: %v", err)
+	}
+	return sealed
+}
+
+func TestSecureSessionRoundTrip(t *testing.T) {
+	a, b := newSessionPair(t)
+
+	for _, tt := range []struct {
+		name     string
+		from, to *SecureSession
+	}{
+		{"发起方到响应方", a, b},
+		{"响应方到发起方", b, a},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, want := range []string{"hello", "", "第三条消息"} {
+				innerType, inner, err := tt.to.open(mustSeal(t, tt.from, want))
+				if err != nil {
+					t.Fatalf("第 %d 条消息解密失败: %v", i, err)
+				}
+				if innerType != FrameTypeJSON || string(inner) != want {
+					t.Errorf("解密结果 = 0x%02x %q, 期望 0x%02x %q", innerType, inner, FrameTypeJSON, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSecureSessionMessageKeyPerFrame(t *testing.T) {
+	a, b := newSessionPair(t)
+
+	first := mustSeal(t, a, "same")
+	second := mustSeal(t, a, "same")
+
+	if seq := binary.BigEndian.Uint64(first[4:sealedHeaderSize]); seq != 0 {
+		t.Errorf("第一帧序号 = %d, 期望 0", seq)
+	}
+	if seq := binary.BigEndian.Uint64(second[4:sealedHeaderSize]); seq != 1 {
+		t.Errorf("第二帧序号 = %d, 期望 1", seq)
+	}
+	// nonce 固定为零，相同明文得到不同密文说明每帧使用了不同的消息密钥
+	if bytes.Equal(first[sealedHeaderSize:], second[sealedHeaderSize:]) {
+		t.Fatal("相同明文的两帧密文相同，消息密钥被重复使用")
+	}
+
+	// 把第二帧的密文放到第一帧的帧头下，使用第一帧的密钥无法解密
+	spliced := append(append([]byte(nil), first[:sealedHeaderSize]...), second[sealedHeaderSize:]...)
+	if _, _, err := b.open(spliced); !errors.Is(err, errForgedFrame) {
+		t.Errorf("交换密文后 open 返回 %v, 期望认证失败", err)
+	}
+
+	// 链密钥前移后不会回到之前的值
+	chain := a.sendChain
+	keys := make(map[[32]byte]bool)
+	for i := 0; i < 100; i++ {
+		key := ratchetStep(&chain)
+		if keys[key] {
+			t.Fatalf("第 %d 步得到了重复的消息密钥", i)
+		}
+		keys[key] = true
+	}
+}
+
+func TestSecureSessionRekeyAfterThreshold(t *testing.T) {
+	a, b := newSessionPair(t)
+
+	if a.shouldRekey() {
+		t.Fatal("新会话不应立即触发密钥更新")
+	}
+	a.mutex.Lock()
+	a.sentMessages = rekeyMessageThreshold - 1
+	a.mutex.Unlock()
+	if _, _, err := b.open(mustSeal(t, a, "last before threshold")); err != nil {
+		t.Fatalf("解密失败: %v", err)
+	}
+	if !a.shouldRekey() {
+		t.Fatalf("发送 %d 条消息后未触发密钥更新", rekeyMessageThreshold)
+	}
+
+	// 发起方在切换前发出、响应方切换后才收到的帧
+	inFlight := mustSeal(t, a, "in flight")
+
+	rekeySessions(t, a, b)
+	if a.currentEpoch() != 1 || b.currentEpoch() != 1 {
+		t.Fatalf("epoch = %d/%d, 期望 1/1", a.currentEpoch(), b.currentEpoch())
+	}
+	if a.shouldRekey() {
+		t.Error("密钥更新后发送统计未重置")
+	}
+
+	if _, inner, err := b.open(inFlight); err != nil || string(inner) != "in flight" {
+		t.Errorf("旧 epoch 的在途帧 = %q, %v, 期望正常解密", inner, err)
+	}
+	for _, tt := range []struct {
+		from, to *SecureSession
+		payload  string
+	}{
+		{a, b, "after rekey a->b"},
+		{b, a, "after rekey b->a"},
+	} {
+		sealed := mustSeal(t, tt.from, tt.payload)
+		if epoch := binary.BigEndian.Uint32(sealed); epoch != 1 {
+			t.Errorf("新帧的 epoch = %d, 期望 1", epoch)
+		}
+		if _, inner, err := tt.to.open(sealed); err != nil || string(inner) != tt.payload {
+			t.Errorf("密钥更新后解密 = %q, %v, 期望 %q", inner, err, tt.payload)
+		}
+	}
+
+	// 对端发出新 epoch 的帧后，旧接收链被清除
+	if b.prevRecv != nil {
+		t.Error("收到新 epoch 的帧后旧接收链未清除")
+	}
+	if _, _, err := b.open(inFlight); !errors.Is(err, errStaleFrame) {
+		t.Errorf("旧接收链清除后旧 epoch 的帧返回 %v, 期望 errStaleFrame", err)
+	}
+}
+
+func TestSecureSessionHeaderTampering(t *testing.T) {
+	a, b := newSessionPair(t)
+	// 先切换一次 epoch，使篡改后的 epoch 仍能找到接收链，从而由 AEAD 判定
+	rekeySessions(t, a, b)
+
+	tests := []struct {
+		name   string
+		tamper func(header []byte)
+	}{
+		{"epoch", func(header []byte) { binary.BigEndian.PutUint32(header, 0) }},
+		{"序号", func(header []byte) { binary.BigEndian.PutUint64(header[4:], 3) }},
+		{"序号最高位", func(header []byte) { header[4] ^= 0x80 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed := mustSeal(t, a, "payload")
+			tampered := append([]byte(nil), sealed...)
+			tt.tamper(tampered[:sealedHeaderSize])
+
+			if _, _, err := b.open(tampered); !errors.Is(err, errForgedFrame) {
+				t.Fatalf("篡改 %s 后 open 返回 %v, 期望认证失败", tt.name, err)
+			}
+			// 认证失败不应改变接收状态，原帧仍可解密
+			if _, inner, err := b.open(sealed); err != nil || string(inner) != "payload" {
+				t.Errorf("篡改帧被拒绝后原帧 = %q, %v, 期望正常解密", inner, err)
+			}
+		})
+	}
+
+	// 使用正确的消息密钥但附加认证数据不同，同样无法解密
+	var chain [32]byte
+	copy(chain[:], bytes.Repeat([]byte{0x42}, 32))
+	messageKey := ratchetStep(&chain)
+	aead, err := newSessionAEAD(messageKey[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, sealedHeaderSize)
+	binary.BigEndian.PutUint32(header, 7)
+	binary.BigEndian.PutUint64(header[4:], 9)
+	ciphertext := aead.Seal(nil, make([]byte, aead.NonceSize()), []byte("x"), sealedAD(header))
+	if _, err := openWithMessageKey(messageKey, ciphertext, sealedAD(header)); err != nil {
+		t.Fatalf("未篡改的附加认证数据解密失败: %v", err)
+	}
+	for i := range header {
+		changed := append([]byte(nil), header...)
+		changed[i] ^= 0x01
+		if _, err := openWithMessageKey(messageKey, ciphertext, sealedAD(changed)); !errors.Is(err, errForgedFrame) {
+			t.Errorf("帧头第 %d 字节被修改后返回 %v, 期望认证失败", i, err)
+		}
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	type delivery struct {
+		seq    uint64
+		tamper bool  // 修改密文的最后一个字节
+		want   error // nil 表示应正常解密
+	}
+
+	tests := []struct {
+		name       string
+		deliveries []delivery
+		wantStats  SessionStats
+	}{
+		{"按序到达", []delivery{{0, false, nil}, {1, false, nil}, {2, false, nil}}, SessionStats{}},
+		{"窗口内乱序到达", []delivery{{3, false, nil}, {1, false, nil}, {2, false, nil}, {0, false, nil}}, SessionStats{}},
+		{"重复的序号", []delivery{{0, false, nil}, {1, false, nil}, {1, false, errReplayedFrame}, {2, false, nil}}, SessionStats{ReplayRejected: 1}},
+		{"乱序到达后重复", []delivery{{5, false, nil}, {2, false, nil}, {2, false, errReplayedFrame}, {5, false, errReplayedFrame}}, SessionStats{ReplayRejected: 2}},
+		{"窗口边界内的旧序号", []delivery{{70, false, nil}, {7, false, nil}}, SessionStats{}},
+		{"刚滑出窗口的旧序号", []delivery{{70, false, nil}, {6, false, errStaleFrame}}, SessionStats{StaleRejected: 1}},
+		{"远低于窗口的旧序号", []delivery{{70, false, nil}, {0, false, errStaleFrame}, {71, false, nil}}, SessionStats{StaleRejected: 1}},
+		{"篡改的帧", []delivery{{0, true, errForgedFrame}, {0, false, nil}}, SessionStats{AuthFailed: 1}},
+		{"窗口内篡改的帧", []delivery{{3, false, nil}, {1, true, errForgedFrame}, {1, false, nil}}, SessionStats{AuthFailed: 1}},
+		{"各类拒绝分别计数", []delivery{
+			{70, false, nil},
+			{70, false, errReplayedFrame},
+			{1, false, errStaleFrame},
+			{69, true, errForgedFrame},
+			{69, false, nil},
+			{69, false, errReplayedFrame},
+		}, SessionStats{ReplayRejected: 2, StaleRejected: 1, AuthFailed: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, receiver := newSessionPair(t)
+			var maxSeq uint64
+			for _, d := range tt.deliveries {
+				if d.seq > maxSeq {
+					maxSeq = d.seq
+				}
+			}
+			frames := make([][]byte, maxSeq+1)
+			for i := range frames {
+				frames[i] = mustSeal(t, sender, fmt.Sprintf(`{"type":"chat","content":"%d"}`, i))
+			}
+
+			// 所有帧写入同一条连接，被丢弃的帧之后的帧仍应正常读取
+			var stream bytes.Buffer
+			for _, d := range tt.deliveries {
+				payload := append([]byte(nil), frames[d.seq]...)
+				if d.tamper {
+					payload[len(payload)-1] ^= 0x01
+				}
+				if err := writeFrame(&stream, FrameTypeSealed, 0, payload); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			node := &P2PNode{ID: "receiver"}
+			peer := &Peer{
+				ID:              "sender",
+				Reader:          bufio.NewReader(&stream),
+				ProtocolVersion: ProtocolVersionFramed,
+				Capabilities:    map[string]bool{CapabilitySealedEnvelope: true},
+				Session:         receiver,
+			}
+
+			for i, d := range tt.deliveries {
+				msg, err := node.readPeerMessage(peer)
+				if d.want == nil {
+					if err != nil {
+						t.Fatalf("第 %d 次投递 (序号 %d) 返回错误: %v", i, d.seq, err)
+					}
+					if want := fmt.Sprint(d.seq); msg.Content != want {
+						t.Errorf("第 %d 次投递内容 = %q, 期望 %q", i, msg.Content, want)
+					}
+					continue
+				}
+				if !errors.Is(err, d.want) {
+					t.Fatalf("第 %d 次投递 (序号 %d) 返回 %v, 期望 %v", i, d.seq, err, d.want)
+				}
+				// 读取循环只在 errFrameDropped 时继续，其余错误会断开连接
+				if !errors.Is(err, errFrameDropped) {
+					t.Fatalf("第 %d 次投递的错误 %v 未包装 errFrameDropped，连接会被关闭", i, err)
+				}
+			}
+			if _, err := node.readPeerMessage(peer); err != io.EOF {
+				t.Errorf("全部帧读取后返回 %v, 期望 io.EOF（帧边界错位）", err)
+			}
+
+			if got := peer.FrameStats.snapshot(); got != tt.wantStats {
+				t.Errorf("拒绝统计 = %+v, 期望 %+v", got, tt.wantStats)
+			}
+		})
+	}
+}
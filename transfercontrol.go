@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// 暂停与取消传输
+//
+// 任一方都可以暂停或取消传输，并通过 file_pause / file_cancel 通知对方，双方的发送协程
+// 据状态变化退出，接收方丢弃之后到达的数据块。暂停的传输保存续传状态，不会在重新连接
+// 时自动续传，由任一方执行 /resume 按断点续传流程继续；取消的传输删除续传状态，接收方
+// 删除未完成的临时文件。任务的暂停和取消作用于其中所有未完成的文件。
+
+// TransferControl结构体 - 暂停或取消传输的通知
+type TransferControl struct {
+	Type      string    `json:"type"` // file_pause, file_cancel
+	FileID    string    `json:"fileId"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// 暂停传输
+func (node *P2PNode) pauseTransfer(fileID string) error {
+	if node.isBroadcast(fileID) {
+		return node.controlBroadcast(fileID, node.pauseTransfer)
+	}
+	peerID, err := node.applyTransferControl(fileID, "paused")
+	if err != nil {
+		return err
+	}
+	node.sendTransferControl(peerID, "file_pause", fileID)
+	return nil
+}
+
+// 取消传输
+func (node *P2PNode) cancelTransfer(fileID string) error {
+	if node.isBroadcast(fileID) {
+		return node.controlBroadcast(fileID, node.cancelTransfer)
+	}
+	peerID, err := node.applyTransferControl(fileID, "cancelled")
+	if err != nil {
+		return err
+	}
+	node.sendTransferControl(peerID, "file_cancel", fileID)
+	return nil
+}
+
+// 处理对方的暂停或取消通知
+func (node *P2PNode) handleTransferControl(from string, control TransferControl) {
+	node.FileTransfersMutex.RLock()
+	transfer, exists := node.FileTransfers[control.FileID]
+	valid := exists && transfer.PeerID == from
+	node.FileTransfersMutex.RUnlock()
+	if !valid {
+		return
+	}
+
+	status := "paused"
+	action := "暂停"
+	if control.Type == "file_cancel" {
+		status = "cancelled"
+		action = "取消"
+	}
+	if _, err := node.applyTransferControl(control.FileID, status); err != nil {
+		return // 已完成或已处于该状态
+	}
+	fmt.Printf("\n%s %s了文件传输: %s\n", node.getPeerName(from), action, transfer.FileName)
+	if status == "paused" {
+		fmt.Printf("要继续，请输入: /resume %s\n", control.FileID)
+	}
+}
+
+// 本地把传输（任务则包括其中未完成的文件）设为暂停或取消，返回对方的ID
+func (node *P2PNode) applyTransferControl(fileID string, status string) (string, error) {
+	node.FileTransfersMutex.Lock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists {
+		node.FileTransfersMutex.Unlock()
+		return "", fmt.Errorf("无效的文件传输ID")
+	}
+	switch {
+	case status == "paused" && transfer.Status != "transferring" && transfer.Status != "interrupted":
+		node.FileTransfersMutex.Unlock()
+		return "", fmt.Errorf("只能暂停进行中或已中断的传输（状态: %s）", transfer.Status)
+	case status == "cancelled" && (transfer.Status == "completed" || transfer.Status == "cancelled" || transfer.Status == "rejected"):
+		node.FileTransfersMutex.Unlock()
+		return "", fmt.Errorf("该传输已结束（状态: %s）", transfer.Status)
+	}
+
+	ids := []string{fileID}
+	if transfer.IsJob {
+		ids = append(ids, transfer.Children...)
+	}
+	var changed []string
+	var partFiles []string
+	for _, id := range ids {
+		t, exists := node.FileTransfers[id]
+		if !exists || t.Status == "completed" || t.Status == "cancelled" || t.Status == status {
+			continue
+		}
+		// 任务中校验失败或已失败的文件保持原状态，只暂停尚未完成传输的文件
+		if status == "paused" && t.Status != "transferring" && t.Status != "interrupted" && t.Status != "pending" {
+			continue
+		}
+		t.Status = status
+		if status == "paused" {
+			t.Resumable = true
+		} else {
+			t.Resumable = false
+			t.EndTime = time.Now()
+			if t.Direction == "receive" && t.FilePath != "" && !t.IsJob {
+				partFiles = append(partFiles, partFilePath(t.FilePath))
+			}
+		}
+		changed = append(changed, id)
+	}
+	peerID := transfer.PeerID
+	node.FileTransfersMutex.Unlock()
+
+	for _, id := range changed {
+		if status == "paused" {
+			if err := node.saveTransferState(id); err != nil {
+				fmt.Printf("保存续传状态失败: %v\n", err)
+			}
+		} else {
+			removeTransferState(id)
+		}
+	}
+	for _, path := range partFiles {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("删除临时文件失败: %v\n", err)
+		}
+	}
+	for _, id := range changed {
+		node.publishTransfer(id, true)
+	}
+	return peerID, nil
+}
+
+// 通知对方暂停或取消
+func (node *P2PNode) sendTransferControl(peerID string, msgType string, fileID string) {
+	node.PeersMutex.RLock()
+	peer, online := node.Peers[peerID]
+	node.PeersMutex.RUnlock()
+	if !online || !peer.IsActive {
+		return // 对方离线时只在本地生效；已取消的传输会拒绝对方之后的续传请求
+	}
+	if !peer.hasCapability(CapabilityTransferControl) {
+		fmt.Printf("对方客户端不支持暂停和取消，仅在本地停止传输\n")
+		return
+	}
+	msg := Message{
+		Type:      msgType,
+		From:      node.ID,
+		To:        peerID,
+		Timestamp: time.Now(),
+		Data: TransferControl{
+			Type:      msgType,
+			FileID:    fileID,
+			Timestamp: time.Now(),
+		},
+	}
+	if err := node.sendMessageToPeer(peer, msg); err != nil {
+		fmt.Printf("通知对方失败: %v\n", err)
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"database/sql"
 	_ "github.com/mattn/go-sqlite3"
 	"net"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 )
@@ -14,8 +16,9 @@ type P2PNode struct {
 	LocalIP   string
 	LocalPort int
 	Name      string
-	ID        string
+	ID        string // 由身份公钥派生，重启和IP变化后保持不变
 	Address   string // 新增：本地地址 "IP:port"
+	Identity  *NodeIdentity // 长期身份密钥
 
 	Listener   net.Listener
 	Peers      map[string]*Peer
@@ -37,10 +40,37 @@ type P2PNode struct {
 	// 文件传输相关
 	FileTransfers     map[string]*FileTransferStatus
 	FileTransfersMutex sync.RWMutex
-	ACLs              map[string]map[string]bool
+	DataChannels      map[string]*pendingDataChannel // 等待对方回连的数据连接
+	DataChannelsMutex sync.Mutex
+	ACLs              map[string]map[string]bool // 本节点ID -> 对方节点ID -> 是否允许
 	ACLMutex          sync.RWMutex
 	DB                *sql.DB
 	LocalDBKey        [32]byte
+	DBKeyMutex        sync.RWMutex // 更换数据库密钥时阻止并发读写
+
+	// 已知节点身份（首次连接时记录指纹）
+	KnownPeers      map[string]*KnownPeer
+	KnownPeersMutex sync.RWMutex
+	StrictIdentity  bool // 严格模式：同名用户的身份密钥变更时直接拒绝连接
+
+	// 自动接受规则
+	AutoAcceptRules []*AutoAcceptRule
+	AutoAcceptMutex sync.RWMutex
+
+	// 下载位置
+	Downloads      DownloadConfig
+	DownloadsMutex sync.RWMutex
+
+	// 限速与发送队列
+	RateLimits     RateLimitConfig
+	RateLimitMutex sync.RWMutex
+	UploadBucket   *tokenBucket
+	DownloadBucket *tokenBucket
+	PeerBuckets    map[string]*peerBuckets // 节点ID -> 该用户的令牌桶
+	Scheduler      *transferScheduler
+
+	// Web界面事件推送
+	Events *EventBus
 
 	// 内存管理
 	lastCleanupTime   time.Time
@@ -54,13 +84,26 @@ type Peer struct {
 	Conn          net.Conn
 	IsActive      bool
 	LastSeen      time.Time
-	SharedKey     []byte    // 新增：共享密钥
+	SharedKey     []byte    // 新增：共享密钥（仅旧版节点保留）
+	Session       *SecureSession // 加密信封的会话密钥状态（棘轮）
 	PrivateKey    [32]byte  // 临时私钥
 	PublicKey     [32]byte  // 临时公钥
 	ReconnectAttempts int   // 重连尝试次数
 	LastReconnectTime time.Time // 上次重连尝试时间
 	IP            string    // IP地址
 	Port          int       // 端口号
+
+	// 协议相关
+	Reader          *bufio.Reader   // 连接读取缓冲，兼容帧与旧版JSON行
+	WriteMutex      sync.Mutex      // 保证并发写入时帧不交错
+	ProtocolVersion int             // 协商后的协议版本，0表示握手尚未完成
+	Capabilities    map[string]bool // 协商后的公共能力
+	FrameStats      SessionStats    // 被拒绝的加密帧统计（重放、过旧、认证失败）
+
+	// 身份认证相关
+	IdentityKey     []byte // 对端长期身份公钥
+	Authenticated   bool   // 握手签名是否验证通过
+	IdentityChanged bool   // 同名用户的身份密钥与记录不一致
 }
 
 // Message结构体 - 通用消息结构
@@ -76,6 +119,12 @@ type Message struct {
 	Ciphertext  []byte      `json:"ciphertext,omitempty"`
 	SenderPubKey []byte     `json:"sender_pub_key,omitempty"`
 
+	// 握手字段：协议版本与能力协商
+	ProtocolVersion int      `json:"protocolVersion,omitempty"`
+	Capabilities    []string `json:"capabilities,omitempty"`
+	IdentityKey     []byte   `json:"identityKey,omitempty"` // 长期身份公钥
+	Signature       []byte   `json:"signature,omitempty"`   // 身份密钥对握手记录（双方临时公钥）的签名
+
 	// 扩展字段：消息类型相关
 	MessageType    string `json:"messageType,omitempty"`    // text, image, file, reply
 	MessageID      string `json:"messageId,omitempty"`      // 消息唯一ID
@@ -125,6 +174,9 @@ type FileTransferRequest struct {
 	FileID      string    `json:"fileId"`
 	FileName    string    `json:"fileName"`
 	FileSize    int64     `json:"fileSize"`
+	SHA256      string    `json:"sha256,omitempty"` // 整个文件的SHA-256（十六进制），接收完成后校验
+	HashPending bool      `json:"hashPending,omitempty"` // 校验值仍在计算，随 file_sent 通知发送
+	Manifest    []JobEntry `json:"manifest,omitempty"` // 目录或多文件任务的文件清单
 	From        string    `json:"from"`
 	To          string    `json:"to"`
 	Timestamp   time.Time `json:"timestamp"`
@@ -136,6 +188,7 @@ type FileTransferResponse struct {
 	FileID    string    `json:"fileId"`
 	Accepted  bool      `json:"accepted"`
 	Message   string    `json:"message"`
+	SHA256    string    `json:"sha256,omitempty"` // file_sent 通知中附带后台计算的校验值
 	Timestamp time.Time `json:"timestamp"`
 }
 
@@ -145,11 +198,26 @@ type FileChunk struct {
 	FileID      string    `json:"fileId"`
 	ChunkNum    int       `json:"chunkNum"`
 	TotalChunks int       `json:"totalChunks"`
+	Offset      int64     `json:"offset"`         // 块在文件中的偏移
+	Hash        []byte    `json:"hash,omitempty"` // 块明文的SHA-256
 	Data        []byte    `json:"data,omitempty"`
 	Timestamp   time.Time `json:"timestamp"`
 	Encrypted   bool      `json:"encrypted"`
 	Nonce       []byte    `json:"nonce,omitempty"`
 	Ciphertext  []byte    `json:"ciphertext,omitempty"`
+	Compression string    `json:"compression,omitempty"` // 数据在加密前的压缩算法，为空时未压缩
+}
+
+// FileResume结构体 - 断点续传协商，接收方报告已收到的块
+type FileResume struct {
+	Type      string    `json:"type"`
+	FileID    string    `json:"fileId"`
+	FileName  string    `json:"fileName"`
+	FileSize  int64     `json:"fileSize"`
+	ChunkSize int       `json:"chunkSize"`
+	Offset    int64     `json:"offset"`           // 从文件开头起连续已接收的字节数
+	Bitmap    []byte    `json:"bitmap,omitempty"` // 已接收的块，由发送方发起时为空
+	Timestamp time.Time `json:"timestamp"`
 }
 
 // ECDHKeyPair结构体 - ECDH密钥对
@@ -161,10 +229,17 @@ type ECDHKeyPair struct {
 type FileTransferStatus struct {
 	FileID         string    `json:"fileId"`
 	FileName       string    `json:"fileName"`
-	FilePath       string    `json:"-"` // 发送方的文件完整路径，不进行json序列化
+	FilePath       string    `json:"-"` // 发送方的文件完整路径或接收方的保存路径，不进行json序列化
+	SaveDir        string    `json:"-"` // 接收方接受时指定的保存目录，为空时按下载配置
+	SaveName       string    `json:"-"` // 接收方接受时指定的文件名，为空时使用原文件名
+	SavedPath      string    `json:"savedPath,omitempty"` // 接收完成后文件（任务为顶层目录）的实际保存路径
 	FileSize       int64     `json:"fileSize"`
+	SHA256         string    `json:"sha256,omitempty"` // 发送方提供的整个文件的SHA-256
+	HashPending    bool      `json:"-"` // 校验值由 file_sent 通知提供，接收方收到前不完成接收
+	HashDone       chan struct{} `json:"-"` // 发送方后台计算校验值完成时关闭
+	Responding     bool      `json:"-"` // 接收方正在接受或拒绝该请求，防止重复响应
 	Progress       int64     `json:"progress"`
-	Status         string    `json:"status"` // pending, transferring, completed, failed
+	Status         string    `json:"status"` // pending, transferring, paused, interrupted, completed, corrupted, failed, cancelled, rejected
 	Direction      string    `json:"direction"` // send, receive
 	PeerName       string    `json:"peerName"` // 对方的用户名
 	PeerID         string    `json:"-"`        // 对方的peer ID，用于获取共享密钥
@@ -172,8 +247,52 @@ type FileTransferStatus struct {
 	StartTime      time.Time `json:"startTime"`
 	EndTime        time.Time `json:"endTime"`
 	Speed          float64   `json:"speed"`          // 传输速度 (bytes/second)
+	RateLimit      int64     `json:"rateLimit,omitempty"` // 生效的限速 (bytes/second)，0 表示不限
+	Queued         bool      `json:"queued,omitempty"`    // 等待发送名额
+	Priority       int       `json:"priority,omitempty"`  // 发送优先级: 1 高, 0 普通, -1 低
+
+	// 压缩相关
+	Compression      string  `json:"compression,omitempty"`      // 文件块使用的压缩算法，未压缩时为空
+	CompressionRatio float64 `json:"compressionRatio,omitempty"` // 传输大小与原始大小之比
+	RawBytes         int64   `json:"-"`                          // 已传输块的原始字节数
+	WireBytes        int64   `json:"-"`                          // 已传输块压缩后的字节数
 	ETA            int64     `json:"eta"`            // 预计剩余时间 (seconds)
 	LastUpdateTime time.Time `json:"-"`              // 上次更新时间，用于计算速度
+	SpeedBytes     int64     `json:"-"`              // 上次计算速度后新增的字节数
+	LastEventTime  time.Time `json:"-"`              // 上次推送进度事件的时间
+	RecordedStatus string    `json:"-"`              // 上次写入传输历史时的状态
+
+	// 断点续传相关
+	TotalChunks    int       `json:"totalChunks"`
+	ReceivedChunks int       `json:"-"`         // 接收方已写入的块数
+	ChunkBitmap    []byte    `json:"-"`         // 接收方已写入的块，第 i 位对应第 i+1 块
+	UnsavedChunks  int       `json:"-"`         // 上次保存续传状态后新写入的块数
+	Resumable      bool      `json:"resumable"` // 中断后可以续传
+	SourceModTime  time.Time `json:"-"`         // 发送方源文件的修改时间，续传前校验
+	Attempt        int       `json:"-"`         // 发送尝试序号，续传后旧的发送协程据此退出
+	MissingRetries int       `json:"-"`         // 接收方请求补发缺失块的次数
+
+	// 流控相关
+	Window      *sendWindow `json:"-"` // 发送方当前的滑动窗口
+	PendingAcks []int       `json:"-"` // 接收方尚未确认的块
+	AckTimer    *time.Timer `json:"-"` // 接收方延迟发送确认的定时器
+	DataChannel bool        `json:"dataChannel"` // 文件块正通过独立的数据连接传输
+
+	// 目录或多文件任务相关
+	IsJob          bool        `json:"isJob,omitempty"`          // 任务记录，进度和状态由子传输汇总
+	Files          int         `json:"files,omitempty"`          // 任务中的文件数
+	CompletedFiles int         `json:"completedFiles,omitempty"` // 任务中已完成的文件数
+	Manifest       []JobEntry  `json:"-"`                        // 任务的文件清单
+	Children       []string    `json:"-"`                        // 任务中各文件的传输ID
+	JobID          string      `json:"jobId,omitempty"`          // 子传输所属的任务ID
+	Mode           os.FileMode `json:"-"`                        // 接收完成后设置的权限
+
+	// 群发相关
+	IsBroadcast         bool          `json:"isBroadcast,omitempty"`         // 群发记录，进度和状态由各接收方汇总
+	Recipients          int           `json:"recipients,omitempty"`          // 接收方数量
+	CompletedRecipients int           `json:"completedRecipients,omitempty"` // 已接收完成的接收方数量
+	BroadcastID         string        `json:"broadcastId,omitempty"`         // 所属的群发记录ID
+	Source              *sharedSource `json:"-"`                             // 各接收方共用的源文件读取缓存
 }
 
 // 消息类型常量
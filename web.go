@@ -65,9 +65,10 @@ func (node *P2PNode) startWebGUI() {
 	mux.Handle("/emoji-gifs/", http.StripPrefix("/emoji-gifs/", emojiGifServer))
 
 	// 图片文件服务器
-	// 请求 /images/filename.jpg -> 从 images/filename.jpg 服务
-	imageServer := http.FileServer(http.Dir("images"))
-	mux.Handle("/images/", http.StripPrefix("/images/", imageServer))
+	// 请求 /images/filename.jpg -> 从图片目录下的 filename.jpg 服务，图片目录修改后立即生效
+	mux.Handle("/images/", http.StripPrefix("/images/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.FileServer(http.Dir(node.imageDir())).ServeHTTP(w, r)
+	})))
 
 	// 获取 GIF 表情列表处理器
 	mux.HandleFunc("/emoji-gifs-list", func(w http.ResponseWriter, r *http.Request) {
@@ -131,13 +132,18 @@ func (node *P2PNode) startWebGUI() {
 					   file_name, file_size, file_type, file_url, file_data
 				FROM messages
 				WHERE is_private = TRUE AND (
-					(sender = ? AND recipient = ?) OR
-					(sender = ? AND recipient = ?)
+					(sender_id = ? AND recipient_id = ?) OR
+					(sender_id = ? AND recipient_id = ?) OR
+					(sender_id IS NULL AND (
+						(sender = ? AND recipient = ?) OR
+						(sender = ? AND recipient = ?)
+					))
 				)
 				ORDER BY timestamp ASC
 				LIMIT ? OFFSET ?
 			`
-			args = []interface{}{node.Name, chatId, chatId, node.Name, limit, offset}
+			peerID := node.resolvePeerID(chatId)
+			args = []interface{}{node.ID, peerID, peerID, node.ID, node.Name, chatId, chatId, node.Name, limit, offset}
 		}
 
 		rows, err = node.DB.Query(query, args...)
@@ -168,7 +174,7 @@ func (node *P2PNode) startWebGUI() {
 				continue
 			}
 
-			plaintext, err := decryptMessage(node.LocalDBKey, content, nonce)
+			plaintext, err := node.decryptFromDB(content, nonce)
 			if err != nil {
 				fmt.Printf("解密历史消息失败: %v\n", err)
 				continue
@@ -214,6 +220,116 @@ func (node *P2PNode) startWebGUI() {
 	})
 
 
+	// 搜索历史消息处理器
+	searchHandler := func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := SearchFilter{
+			Query:        query.Get("q"),
+			Sender:       query.Get("sender"),
+			Conversation: query.Get("chat"),
+			MessageType:  query.Get("type"),
+		}
+		if limit, err := strconv.Atoi(query.Get("limit")); err == nil {
+			filter.Limit = limit
+		}
+		if since := query.Get("since"); since != "" {
+			date, err := time.ParseInLocation(searchDateLayout, since, time.Local)
+			if err != nil {
+				http.Error(w, "since 格式应为 YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			filter.Since = date
+		}
+		if until := query.Get("until"); until != "" {
+			date, err := time.ParseInLocation(searchDateLayout, until, time.Local)
+			if err != nil {
+				http.Error(w, "until 格式应为 YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			filter.Until = date.AddDate(0, 0, 1) // 包含当天
+		}
+
+		results, err := node.searchMessages(filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if results == nil {
+			results = []SearchResult{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"results": results,
+		})
+	}
+	mux.HandleFunc("/search", searchHandler)
+	mux.HandleFunc("/api/search", searchHandler) // 兼容早期版本的接口地址
+
+	// 传输历史处理器
+	mux.HandleFunc("/transferhistory", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := TransferHistoryFilter{
+			Peer:      query.Get("peer"),
+			Status:    query.Get("status"),
+			Direction: query.Get("direction"),
+			Name:      query.Get("q"),
+		}
+		if limit, err := strconv.Atoi(query.Get("limit")); err == nil {
+			filter.Limit = limit
+		}
+		if since := query.Get("since"); since != "" {
+			date, err := time.ParseInLocation(searchDateLayout, since, time.Local)
+			if err != nil {
+				http.Error(w, "since 格式应为 YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			filter.Since = date
+		}
+		if until := query.Get("until"); until != "" {
+			date, err := time.ParseInLocation(searchDateLayout, until, time.Local)
+			if err != nil {
+				http.Error(w, "until 格式应为 YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			filter.Until = date.AddDate(0, 0, 1) // 包含当天
+		}
+
+		records, err := node.queryTransferHistory(filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if records == nil {
+			records = []TransferRecord{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"transfers": records,
+		})
+	})
+
+	// 搜索结果上下文处理器
+	searchContextHandler := func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "无效的消息编号", http.StatusBadRequest)
+			return
+		}
+		radius, _ := strconv.Atoi(r.URL.Query().Get("radius"))
+
+		messages, err := node.messageContext(id, radius)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"messages": messages,
+		})
+	}
+	mux.HandleFunc("/searchcontext", searchContextHandler)
+	mux.HandleFunc("/api/context", searchContextHandler) // 兼容早期版本的接口地址
+
 	// Ping处理器，用于检查Web服务器是否在线
 	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -239,6 +355,50 @@ func (node *P2PNode) startWebGUI() {
 		w.WriteHeader(http.StatusOK)
 	})
 
+	// 事件推送处理器 (Server-Sent Events)，取代前端轮询；轮询接口保留以兼容旧页面
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		events := node.Events.Subscribe()
+		defer node.Events.Unsubscribe(events)
+
+		// 断线后浏览器3秒后自动重连
+		fmt.Fprint(w, "retry: 3000\n\n")
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(15 * time.Second)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					return // 订阅已被断开
+				}
+				data, err := json.Marshal(event.Data)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+				flusher.Flush()
+			case <-heartbeat.C:
+				// 注释行作为心跳，保持连接并让前端感知断线
+				fmt.Fprint(w, ": ping\n\n")
+				flusher.Flush()
+			}
+		}
+	})
+
 	// 获取消息处理器
 	mux.HandleFunc("/messages", func(w http.ResponseWriter, r *http.Request) {
 		node.MessagesMutex.RLock()
@@ -260,9 +420,14 @@ func (node *P2PNode) startWebGUI() {
 		for _, peer := range node.Peers {
 			if peer.IsActive {
 				status := ""
-				if node.isBlocked(peer.Address) {
+				if node.isBlocked(peer.ID) {
 					status = " (屏蔽)"
 				}
+				if peer.IdentityChanged {
+					status += " (⚠身份变更)"
+				} else if !peer.Authenticated {
+					status += " (未验证)"
+				}
 				users = append(users, peer.Name + status)
 			}
 		}
@@ -274,26 +439,75 @@ func (node *P2PNode) startWebGUI() {
 		})
 	})
 
+	// 获取安全码处理器，用于与对方核对身份
+	mux.HandleFunc("/verify", func(w http.ResponseWriter, r *http.Request) {
+		targetName := r.URL.Query().Get("user")
+
+		var target *Peer
+		node.PeersMutex.RLock()
+		for _, peer := range node.Peers {
+			if peer.Name == targetName && peer.IsActive {
+				target = peer
+				break
+			}
+		}
+		node.PeersMutex.RUnlock()
+
+		if target == nil {
+			http.Error(w, "目标用户不在线", http.StatusNotFound)
+			return
+		}
+		if !target.Authenticated {
+			http.Error(w, "对方使用旧版客户端，无法验证", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"user":            target.Name,
+			"safetyCode":      computeSafetyCode(node.Identity.PublicKey, target.IdentityKey),
+			"fingerprint":     formatFingerprint(target.IdentityKey),
+			"identityChanged": target.IdentityChanged,
+		})
+	})
+
+	// 连接诊断处理器：会话状态与被拒绝的帧统计
+	mux.HandleFunc("/diagnostics", func(w http.ResponseWriter, r *http.Request) {
+		peers := []map[string]interface{}{}
+		node.PeersMutex.RLock()
+		for _, peer := range node.Peers {
+			if !peer.IsActive {
+				continue
+			}
+			entry := map[string]interface{}{
+				"user":            peer.Name,
+				"protocolVersion": peer.ProtocolVersion,
+				"sealed":          peer.sealsEnvelope(),
+				"rejectedFrames":  peer.FrameStats.snapshot(),
+			}
+			if peer.sealsEnvelope() {
+				entry["session"] = peer.Session.status()
+			}
+			peers = append(peers, entry)
+		}
+		node.PeersMutex.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"peers": peers,
+		})
+	})
+
 	// 获取屏蔽列表处理器
 	mux.HandleFunc("/acl", func(w http.ResponseWriter, r *http.Request) {
 		node.ACLMutex.RLock()
 		defer node.ACLMutex.RUnlock()
 		
 		blocked := []string{}
-		if acl, exists := node.ACLs[node.Address]; exists {
-			for addr, allowed := range acl {
+		if acl, exists := node.ACLs[node.ID]; exists {
+			for peerID, allowed := range acl {
 				if !allowed {
-					// 查找用户名
-					displayName := addr
-					node.PeersMutex.RLock()
-					for _, peer := range node.Peers {
-						if peer.Address == addr {
-							displayName = peer.Name
-							break
-						}
-					}
-					node.PeersMutex.RUnlock()
-					blocked = append(blocked, displayName)
+					blocked = append(blocked, node.getPeerName(peerID))
 				}
 			}
 		}
@@ -304,32 +518,195 @@ func (node *P2PNode) startWebGUI() {
 		})
 	})
 
-	// 发送文件处理器
-	mux.HandleFunc("/sendfile", func(w http.ResponseWriter, r *http.Request) {
+	// 自动接受规则处理器：GET 获取规则，POST 添加规则
+	// 规则允许对方直接写入磁盘，只接受 JSON 请求，其他网页无法通过表单跨站提交
+	mux.HandleFunc("/autoaccept", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			if r.Header.Get("Content-Type") != "application/json" {
+				http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+			var req struct {
+				Peer         string `json:"peer"`
+				Extensions   string `json:"extensions"`
+				MaxSize      string `json:"maxSize"`
+				MinFreeSpace string `json:"minFreeSpace"`
+				Directory    string `json:"directory"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			rule, err := node.newAutoAcceptRule(req.Peer, req.Extensions, req.MaxSize, req.MinFreeSpace, req.Directory)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, err := node.addAutoAcceptRule(rule); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		rules := []map[string]interface{}{}
+		for _, rule := range node.autoAcceptRules() {
+			rules = append(rules, map[string]interface{}{
+				"id":          rule.ID,
+				"peerName":    rule.PeerName,
+				"description": rule.describe(),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"rules": rules,
+		})
+	})
+
+	// 删除自动接受规则处理器
+	mux.HandleFunc("/autoaccept/remove", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// 解析multipart表单
-		err := r.ParseMultipartForm(10 << 20) // 10MB限制
-		if err != nil {
-			http.Error(w, "文件太大或格式错误", http.StatusBadRequest)
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req struct {
+			ID int `json:"id"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if err := node.removeAutoAcceptRule(req.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	// 限速处理器：GET 获取限速和发送队列，POST 修改限速
+	// 速度为 "2MB"、"500KB"、"off" 等字符串，留空表示不变；peer 非空时修改该用户的限速
+	mux.HandleFunc("/ratelimits", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			if r.Header.Get("Content-Type") != "application/json" {
+				http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+			var req struct {
+				Peer          string `json:"peer"`
+				Upload        string `json:"upload"`
+				Download      string `json:"download"`
+				MaxConcurrent *int   `json:"maxConcurrent"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			var upload, download *int64
+			for _, field := range []struct {
+				value  string
+				target **int64
+			}{{req.Upload, &upload}, {req.Download, &download}} {
+				if field.value == "" {
+					continue
+				}
+				rate, err := parseRateArg(field.value)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				*field.target = &rate
+			}
+			var err error
+			if req.Peer != "" {
+				err = node.setPeerRateLimit(req.Peer, upload, download)
+			} else {
+				err = node.setGlobalRateLimits(upload, download, req.MaxConcurrent)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// 获取文件
-		file, handler, err := r.FormFile("file")
+		config := node.rateLimitConfig()
+		active, waiting := node.Scheduler.stats()
+		peers := []map[string]interface{}{}
+		for id, limit := range config.Peers {
+			peers = append(peers, map[string]interface{}{
+				"peerId":   id,
+				"peerName": limit.PeerName,
+				"upload":   limit.Upload,
+				"download": limit.Download,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"upload":        config.Upload,
+			"download":      config.Download,
+			"maxConcurrent": config.MaxConcurrent,
+			"active":        active,
+			"queued":        waiting,
+			"peers":         peers,
+		})
+	})
+
+	// 调整发送优先级处理器
+	mux.HandleFunc("/filepriority", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			FileID   string `json:"fileId"`
+			Priority string `json:"priority"` // high, normal, low
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		priority, err := parsePriority(req.Priority)
 		if err != nil {
-			http.Error(w, "无法获取文件", http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := node.setTransferPriority(req.FileID, priority); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
-		defer file.Close()
 
-		// 获取目标用户
-		targetName := r.FormValue("targetName")
-		if targetName == "" {
-			http.Error(w, "请选择目标用户", http.StatusBadRequest)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	// 发送文件处理器
+	mux.HandleFunc("/sendfile", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// 逐个读取multipart部分，文件内容直接写入磁盘，不在内存或临时目录中缓冲
+		reader, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, "格式错误", http.StatusBadRequest)
 			return
 		}
 
@@ -340,22 +717,99 @@ func (node *P2PNode) startWebGUI() {
 			return
 		}
 
-		// 创建临时文件
-		tempFile, err := os.Create(filepath.Join(uploadDir, handler.Filename))
-		if err != nil {
-			http.Error(w, "无法创建临时文件", http.StatusInternalServerError)
+		// 选择多个文件时作为一个任务发送
+		var targetNames []string
+		var uploadPaths []string
+		removeUploads := func() {
+			for _, path := range uploadPaths {
+				os.Remove(path)
+			}
+		}
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, "读取上传内容失败", http.StatusBadRequest)
+				removeUploads()
+				return
+			}
+
+			switch part.FormName() {
+			case "targetName":
+				value, _ := io.ReadAll(io.LimitReader(part, 1024))
+				if name := string(value); name != "" {
+					targetNames = append(targetNames, name)
+				}
+			case "file":
+				if part.FileName() == "" {
+					break
+				}
+				// 浏览器可能带上客户端路径（如 Windows 的 C:\dir\a.txt），只取文件名部分
+				name := part.FileName()
+				name = name[strings.LastIndexAny(name, `/\`)+1:]
+				name, err := sanitizeFileName(name)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("文件名无效: %v", err), http.StatusBadRequest)
+					removeUploads()
+					return
+				}
+				// 同名文件（包括同一次上传中的多个同名文件）不互相覆盖
+				tempFile, path, err := createUniqueFile(uploadDir, name, "")
+				if err != nil {
+					http.Error(w, "无法创建临时文件", http.StatusInternalServerError)
+					removeUploads()
+					return
+				}
+				_, err = io.Copy(tempFile, part)
+				tempFile.Close()
+				if err != nil {
+					os.Remove(path)
+					http.Error(w, "无法保存上传的文件", http.StatusInternalServerError)
+					removeUploads()
+					return
+				}
+				uploadPaths = append(uploadPaths, path)
+			}
+			part.Close()
+		}
+
+		if len(uploadPaths) == 0 {
+			http.Error(w, "无法获取文件", http.StatusBadRequest)
 			return
 		}
-		defer tempFile.Close()
 
-		// 将上传的文件内容复制到临时文件
-		if _, err := io.Copy(tempFile, file); err != nil {
-			http.Error(w, "无法保存上传的文件", http.StatusInternalServerError)
+		// 获取目标用户
+		if len(targetNames) == 0 {
+			removeUploads()
+			http.Error(w, "请选择目标用户", http.StatusBadRequest)
 			return
 		}
-		
+
+		// 多个目标用户或 "*"（所有在线用户）时群发
+		everyone := false
+		for _, name := range targetNames {
+			everyone = everyone || name == "*"
+		}
+		broadcast := len(targetNames) > 1 || everyone
+		if broadcast && len(uploadPaths) > 1 {
+			removeUploads()
+			http.Error(w, "群发只支持单个文件", http.StatusBadRequest)
+			return
+		}
+
 		// 发送文件传输请求，使用临时文件的路径
-		node.sendFileTransferRequest(tempFile.Name(), targetName)
+		switch {
+		case everyone:
+			node.sendBroadcast(uploadPaths[0], nil)
+		case broadcast:
+			node.sendBroadcast(uploadPaths[0], targetNames)
+		case len(uploadPaths) == 1:
+			node.sendFileTransferRequest(uploadPaths[0], targetNames[0])
+		default:
+			node.sendJobRequest(uploadPaths, targetNames[0])
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("文件传输请求已发送"))
 	})
@@ -403,7 +857,7 @@ func (node *P2PNode) startWebGUI() {
 		}
 
 		// 创建images目录
-		imageDir := "images"
+		imageDir := node.imageDir()
 		if err := os.MkdirAll(imageDir, 0755); err != nil {
 			http.Error(w, "无法创建图片目录", http.StatusInternalServerError)
 			return
@@ -461,6 +915,7 @@ func (node *P2PNode) startWebGUI() {
 		}
 
 		// 根据目标用户设置消息接收者
+		targetID := "all"
 		if targetName == "all" {
 			// 公聊消息
 			imageMsg.To = "all"
@@ -468,7 +923,7 @@ func (node *P2PNode) startWebGUI() {
 		} else {
 			// 私聊消息
 			// 查找目标用户ID
-			var targetID string
+			targetID = ""
 			node.PeersMutex.RLock()
 			for id, peer := range node.Peers {
 				if peer.Name == targetName && peer.IsActive {
@@ -494,7 +949,7 @@ func (node *P2PNode) startWebGUI() {
 		// 添加到本地消息列表
 		isPrivate := targetName != "all"
 		node.addChatMessageWithType(
-			node.Name, targetName, imageMsg.Content, true, isPrivate,
+			node.Name, node.ID, targetName, targetID, imageMsg.Content, true, isPrivate,
 			MessageTypeImage, messageID, "", "", "", handler.Filename, handler.Size, contentType, imageURL,
 		)
 
@@ -571,7 +1026,7 @@ func (node *P2PNode) startWebGUI() {
 		// 添加到本地消息列表
 		isPrivate := targetID != "all"
 		node.addChatMessageWithType(
-			node.Name, req.TargetName, content, true, isPrivate,
+			node.Name, node.ID, req.TargetName, targetID, content, true, isPrivate,
 			MessageTypeFile, messageID, "", "", "", req.FileName, req.FileSize, req.FileType, "",
 		)
 
@@ -648,7 +1103,7 @@ func (node *P2PNode) startWebGUI() {
 		// 添加到本地消息列表
 		isPrivate := targetID != "all"
 		node.addChatMessageWithType(
-			node.Name, req.TargetName, content, true, isPrivate,
+			node.Name, node.ID, req.TargetName, targetID, content, true, isPrivate,
 			MessageTypeReply, messageID, req.OriginalMsgID, req.OriginalContent, req.OriginalSender,
 			"", 0, "", "",
 		)
@@ -685,6 +1140,7 @@ func (node *P2PNode) startWebGUI() {
 		var req struct {
 			FileID   string `json:"fileId"`
 			Accepted bool   `json:"accepted"`
+			Path     string `json:"path"` // 可选的保存位置
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -692,13 +1148,106 @@ func (node *P2PNode) startWebGUI() {
 			return
 		}
 
+		if req.Accepted && strings.TrimSpace(req.Path) != "" {
+			// 指定保存位置可以写入任意目录，只接受 JSON 请求，其他网页无法通过表单跨站提交
+			if r.Header.Get("Content-Type") != "application/json" {
+				http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+			if err := node.setSaveLocation(req.FileID, req.Path); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
 		// 调用核心逻辑来处理响应
-		node.respondToFileTransfer(req.FileID, req.Accepted)
+		if err := node.respondToFileTransfer(req.FileID, req.Accepted); err != nil {
+			if req.Accepted && strings.TrimSpace(req.Path) != "" {
+				node.clearSaveLocation(req.FileID)
+			}
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	})
 
+	// 续传已中断的文件传输处理器
+	mux.HandleFunc("/fileresume", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			FileID string `json:"fileId"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if err := node.requestResume(req.FileID); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	// 暂停文件传输处理器
+	mux.HandleFunc("/filepause", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			FileID string `json:"fileId"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if err := node.pauseTransfer(req.FileID); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	// 取消文件传输处理器
+	mux.HandleFunc("/filecancel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			FileID string `json:"fileId"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if err := node.cancelTransfer(req.FileID); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
 	// 关闭Web服务器处理器
 	mux.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
@@ -734,6 +1283,8 @@ func (node *P2PNode) startWebGUI() {
 		Addr:    fmt.Sprintf("127.0.0.1:%d", node.WebPort),
 		Handler: mux,
 	}
+	// 关闭时先断开事件流，否则长连接会阻塞 Shutdown
+	node.WebServer.RegisterOnShutdown(node.Events.DisconnectAll)
 
 	// 启动Web服务器
 		go func() {
@@ -800,17 +1351,18 @@ func (node *P2PNode) handleWebMessage(text string) {
 			Timestamp: time.Now(),
 		}
 		node.broadcastMessage(msg)
-		node.addChatMessage("我", "all", text, true, false)
+		node.addChatMessage("我", "all", "all", text, true, false)
 	}
 }
 
-// 添加聊天消息（扩展版）
-func (node *P2PNode) addChatMessage(sender, recipient, content string, isOwn, isPrivate bool) {
-	node.addChatMessageWithType(sender, recipient, content, isOwn, isPrivate, MessageTypeText, "", "", "", "", "", 0, "", "")
+// 添加聊天消息（扩展版，仅用于自己发出的消息）
+func (node *P2PNode) addChatMessage(sender, recipient, recipientID, content string, isOwn, isPrivate bool) {
+	node.addChatMessageWithType(sender, node.ID, recipient, recipientID, content, isOwn, isPrivate, MessageTypeText, "", "", "", "", "", 0, "", "")
 }
 
 // 添加聊天消息（完整版）
-func (node *P2PNode) addChatMessageWithType(sender, recipient, content string, isOwn, isPrivate bool,
+// senderID/recipientID 为节点ID（公聊为"all"），用于跨重启和改名关联历史记录
+func (node *P2PNode) addChatMessageWithType(sender, senderID, recipient, recipientID, content string, isOwn, isPrivate bool,
 	messageType, messageID, replyToID, replyToContent, replyToSender, fileName string, fileSize int64, fileType, fileURL string) {
 
 	// 生成消息ID（如果未提供）
@@ -846,26 +1398,14 @@ func (node *P2PNode) addChatMessageWithType(sender, recipient, content string, i
 		if len(node.Messages) > 100 {
 			node.Messages = node.Messages[1:]
 		}
+		node.Events.Publish(EventChat, msg)
 	}
 
 	// 保存到数据库
 	if node.DB != nil {
-		ciphertext, nonce, err := encryptMessage(node.LocalDBKey, []byte(content))
-		if err != nil {
-			fmt.Printf("加密消息失败: %v\n", err)
-		} else {
-			_, err = node.DB.Exec(`
-				INSERT INTO messages (
-					sender, recipient, content, nonce, is_private, is_own,
-					message_type, message_id, reply_to_id, reply_to_content,
-					reply_to_sender, file_name, file_size, file_type, file_url, file_data
-				) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-				sender, recipient, ciphertext, nonce, isPrivate, isOwn,
-				messageType, messageID, replyToID, replyToContent,
-				replyToSender, fileName, fileSize, fileType, fileURL, "")
-			if err != nil {
-				fmt.Printf("保存消息到数据库失败: %v\n", err)
-			}
+		if err := node.saveMessageToDB(sender, senderID, recipient, recipientID, content, isOwn, isPrivate,
+			messageType, messageID, replyToID, replyToContent, replyToSender, fileName, fileSize, fileType, fileURL); err != nil {
+			fmt.Printf("保存消息到数据库失败: %v\n", err)
 		}
 	}
 
@@ -904,3 +1444,45 @@ func (node *P2PNode) addChatMessageWithType(sender, recipient, content string, i
 		fmt.Printf("[%s] %s: %s\n", timestamp, sender, displayContent)
 	}
 }
+
+// 加密并保存消息，同一事务中写入搜索索引
+func (node *P2PNode) saveMessageToDB(sender, senderID, recipient, recipientID, content string, isOwn, isPrivate bool,
+	messageType, messageID, replyToID, replyToContent, replyToSender, fileName string, fileSize int64, fileType, fileURL string) error {
+	// 加密与写入期间持有读锁，避免更换密钥时写入旧密钥加密的记录
+	node.DBKeyMutex.RLock()
+	defer node.DBKeyMutex.RUnlock()
+
+	ciphertext, nonce, err := encryptMessage(node.LocalDBKey, []byte(content))
+	if err != nil {
+		return fmt.Errorf("加密消息失败: %v", err)
+	}
+
+	tx, err := node.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO messages (
+			sender, recipient, content, nonce, is_private, is_own,
+			message_type, message_id, reply_to_id, reply_to_content,
+			reply_to_sender, file_name, file_size, file_type, file_url, file_data,
+			sender_id, recipient_id
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		sender, recipient, ciphertext, nonce, isPrivate, isOwn,
+		messageType, messageID, replyToID, replyToContent,
+		replyToSender, fileName, fileSize, fileType, fileURL, "",
+		senderID, recipientID)
+	if err != nil {
+		return err
+	}
+	rowID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if err := indexMessage(tx, searchIndexKey(node.LocalDBKey), rowID, content, fileName); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -11,6 +11,8 @@ let shownFailedTransfers = new Set();
 let shownCompletedTransfers = new Set();
 let blockedUsers = new Set();
 let replyingToMessage = null; // 当前正在回复的消息
+let warnedIdentityChanges = new Set(); // 已提示过身份变更的用户
+let transfersById = new Map(); // 文件传输状态，按文件ID索引
 
 // =================================
 async function loadBlockedUsers() {
@@ -41,14 +43,8 @@ async function init() {
     loadMessages();
     loadFileTransfers();
     
-    // 设置定时器
-    setInterval(loadMessages, 2000); // 消息可以稍微慢一点
-    setInterval(() => {
-        loadBlockedUsers();
-        loadUsers();
-    }, 3000);    // 用户列表不需要太频繁
-    setInterval(loadFileTransfers, 3000);
-    setInterval(checkConnection, 5000); // 添加连接检查
+    // 优先使用服务器推送，不可用时退回定时轮询
+    initEventStream();
     
     // 初始化功能
     initFileTransfer();
@@ -59,6 +55,96 @@ async function init() {
     console.log('LANShare P2P Web客户端已初始化');
 }
 
+// =================================
+// 服务器推送 (Server-Sent Events)
+// =================================
+let pollingTimers = [];
+let eventStreamOpened = false;
+
+function startPolling() {
+    if (pollingTimers.length > 0) return;
+    pollingTimers = [
+        setInterval(loadMessages, 2000), // 消息可以稍微慢一点
+        setInterval(() => {
+            loadBlockedUsers();
+            loadUsers();
+        }, 3000),    // 用户列表不需要太频繁
+        setInterval(loadFileTransfers, 3000),
+        setInterval(updateUserSelect, 5000), // 文件接收方下拉框
+        setInterval(checkConnection, 5000) // 添加连接检查
+    ];
+}
+
+function stopPolling() {
+    pollingTimers.forEach(timer => clearInterval(timer));
+    pollingTimers = [];
+}
+
+function initEventStream() {
+    if (!window.EventSource) {
+        startPolling();
+        return;
+    }
+
+    const source = new EventSource('/events');
+
+    source.onopen = () => {
+        stopPolling();
+        showConnectedState();
+        // 重连后重新拉取完整状态，补上断线期间错过的事件
+        if (eventStreamOpened) {
+            loadMessages();
+            loadBlockedUsers().then(loadUsers);
+            updateUserSelect();
+            loadFileTransfers();
+        }
+        eventStreamOpened = true;
+    };
+
+    // 断线期间浏览器会自动重连，同时先用轮询保持界面更新
+    source.onerror = () => {
+        showDisconnectedState();
+        startPolling();
+    };
+
+    const onEvent = (type, handler) => {
+        source.addEventListener(type, event => handler(JSON.parse(event.data)));
+    };
+
+    onEvent('chat', msg => {
+        allMessages.push(msg);
+        displayMessages();
+    });
+    onEvent('peer_joined', () => {
+        loadUsers();
+        updateUserSelect();
+    });
+    onEvent('peer_left', () => {
+        loadUsers();
+        updateUserSelect();
+    });
+    onEvent('peer_renamed', data => {
+        if (currentChat.id !== 'all' && currentChat.name === data.oldName) {
+            currentChat.name = data.name;
+        }
+        loadUsers();
+        updateUserSelect();
+    });
+    onEvent('acl', () => loadBlockedUsers().then(loadUsers));
+    onEvent('transfer', transfer => {
+        transfersById.set(transfer.fileId, transfer);
+        handleTransfersUpdate();
+    });
+    onEvent('file_request', transfer => {
+        transfersById.set(transfer.fileId, transfer);
+        handleTransfersUpdate();
+    });
+    onEvent('transfer_removed', data => {
+        transfersById.delete(data.fileId);
+        handleTransfersUpdate();
+    });
+}
+
 // =================================
 // 聊天上下文切换
 // =================================
@@ -391,15 +477,27 @@ function displayUsers(users) {
             newUsers.add(username);
             
             const isBlocked = blockedUsers.has(username);
+            const identityChanged = user.includes('身份变更');
+            const unverified = user.includes('未验证');
             const buttonText = isBlocked ? '🔓' : '🚫';
             const buttonTitle = isBlocked ? '解除屏蔽' : '屏蔽用户';
-            const liClass = isBlocked ? 'blocked' : '';
+            let liClass = isBlocked ? 'blocked' : '';
+            if (identityChanged) {
+                liClass += ' identity-changed';
+            }
+            const userIcon = identityChanged ? '⚠️' : (unverified ? '❔' : '👤');
+
+            if (identityChanged && !warnedIdentityChanges.has(username)) {
+                showNotification(`警告: ${username} 的身份密钥已变更，请核对安全码`, 'error');
+                warnedIdentityChanges.add(username);
+            }
 
             let li;
             if (existingUsers.has(username)) {
                 // 更新现有用户
                 li = usersList.querySelector(`li[data-chat-id="${username}"]`);
                 li.className = liClass;
+                li.querySelector('.user-icon').textContent = userIcon;
                 const btn = li.querySelector('.block-btn');
                 btn.textContent = buttonText;
                 btn.title = buttonTitle;
@@ -409,9 +507,9 @@ function displayUsers(users) {
                 li.className = liClass;
                 li.dataset.chatId = username;
                 li.dataset.chatName = username;
-                li.innerHTML = `👤 ${username} <button class="block-btn" onclick="blockUser('${username}', event)" title="${buttonTitle}">${buttonText}</button>`;
+                li.innerHTML = `<span class="user-icon">${userIcon}</span> ${username} <button class="verify-btn" onclick="verifyUser('${username}', event)" title="核对安全码">🔑</button><button class="block-btn" onclick="blockUser('${username}', event)" title="${buttonTitle}">${buttonText}</button>`;
                 li.addEventListener('click', (e) => {
-                    if (!e.target.classList.contains('block-btn')) {
+                    if (!e.target.classList.contains('block-btn') && !e.target.classList.contains('verify-btn')) {
                         switchChat(li);
                     }
                 });
@@ -434,7 +532,7 @@ function displayUsers(users) {
 // =================================
 // 文件传输
 // =================================
-let selectedFile = null;
+let selectedFiles = [];
 
 function initFileTransfer() {
     const fileInput = document.getElementById('fileInput');
@@ -445,8 +543,11 @@ function initFileTransfer() {
     // 文件选择处理
     fileInput.addEventListener('change', function(event) {
         if (event.target.files.length > 0) {
-            selectedFile = event.target.files[0];
-            fileNameDisplay.textContent = selectedFile.name;
+            // 选择多个文件时作为一个任务发送
+            selectedFiles = Array.from(event.target.files);
+            fileNameDisplay.textContent = selectedFiles.length === 1
+                ? selectedFiles[0].name
+                : `${selectedFiles[0].name} 等 ${selectedFiles.length} 个文件`;
             fileControls.style.display = 'flex';
         } else {
             cancelFileSelection();
@@ -464,12 +565,11 @@ function initFileTransfer() {
 
     document.getElementById('fileTargetUser').addEventListener('change', updateSendFileButton);
     updateUserSelect();
-    setInterval(updateUserSelect, 5000);
 }
 
 function updateUserSelect() {
     const targetUserSelect = document.getElementById('fileTargetUser');
-    const currentSelection = targetUserSelect.value;
+    const currentSelection = selectedTargetUsers();
     
     fetch('/users')
         .then(response => response.json())
@@ -488,26 +588,40 @@ function updateUserSelect() {
                 option.textContent = username;
                 targetUserSelect.appendChild(option);
             });
-            targetUserSelect.value = currentSelection;
+            Array.from(targetUserSelect.options).forEach(option => {
+                option.selected = currentSelection.includes(option.value);
+            });
+            updateSendFileButton();
         });
 }
 
+// 选中的接收方；"*" 表示所有在线用户
+function selectedTargetUsers() {
+    const targetUserSelect = document.getElementById('fileTargetUser');
+    return Array.from(targetUserSelect.selectedOptions).map(option => option.value);
+}
+
 function updateSendFileButton() {
     const sendFileBtn = document.getElementById('sendFileBtn');
-    const targetUserSelect = document.getElementById('fileTargetUser');
-    sendFileBtn.disabled = !selectedFile || !targetUserSelect.value;
+    sendFileBtn.disabled = selectedFiles.length === 0 || selectedTargetUsers().length === 0;
 }
 
 function sendFile() {
-    if (!selectedFile || !document.getElementById('fileTargetUser').value) {
+    const targetUsers = selectedTargetUsers();
+    if (selectedFiles.length === 0 || targetUsers.length === 0) {
         showNotification('请选择文件和目标用户', 'error');
         return;
     }
-    
-    const targetUser = document.getElementById('fileTargetUser').value;
+    // 发给多个用户时每人独立确认，只支持单个文件
+    if ((targetUsers.length > 1 || targetUsers.includes('*')) && selectedFiles.length > 1) {
+        showNotification('发给多个用户时只能选择一个文件', 'error');
+        return;
+    }
+
     const formData = new FormData();
-    formData.append('file', selectedFile);
-    formData.append('targetName', targetUser);
+    // 目标用户放在文件之前，服务端边读边写时无需等待整个文件
+    targetUsers.forEach(user => formData.append('targetName', user));
+    selectedFiles.forEach(file => formData.append('file', file));
     
     fetch('/sendfile', { method: 'POST', body: formData })
         .then(response => {
@@ -515,7 +629,7 @@ function sendFile() {
                 showNotification('文件传输请求已发送', 'success');
                 cancelFileSelection();
             } else {
-                throw new Error('文件发送失败');
+                return response.text().then(text => { throw new Error(text.trim() || '文件发送失败'); });
             }
         })
         .catch(error => showNotification(error.message, 'error'));
@@ -525,7 +639,7 @@ function cancelFileSelection() {
     const fileInput = document.getElementById('fileInput');
     const fileControls = document.getElementById('file-transfer-controls');
     
-    selectedFile = null;
+    selectedFiles = [];
     fileInput.value = ''; // 重置文件输入
     fileControls.style.display = 'none';
     document.getElementById('fileNameDisplay').textContent = '';
@@ -541,34 +655,8 @@ function loadFileTransfers() {
             return response.json();
         })
         .then(data => {
-            const transfers = data.transfers || [];
-            displayFileTransfers(transfers);
-
-            // 处理待接收的文件确认对话框
-            const pendingReceive = transfers.find(t => t.direction === 'receive' && t.status === 'pending');
-            if (pendingReceive && !shownPendingTransfers.has(pendingReceive.fileId)) {
-                showFileConfirmDialog(pendingReceive);
-                shownPendingTransfers.add(pendingReceive.fileId);
-            }
-
-            // 检查是否有失败的传输并显示通知
-            const failedTransfers = transfers.filter(t => t.status === 'failed');
-            failedTransfers.forEach(transfer => {
-                if (!shownFailedTransfers.has(transfer.fileId)) {
-                    showNotification(`文件传输失败: ${transfer.fileName}`, 'error');
-                    shownFailedTransfers.add(transfer.fileId);
-                }
-            });
-
-            // 检查是否有完成的传输并显示通知
-            const completedTransfers = transfers.filter(t => t.status === 'completed');
-            completedTransfers.forEach(transfer => {
-                if (!shownCompletedTransfers.has(transfer.fileId)) {
-                    const directionText = transfer.direction === 'send' ? '发送' : '接收';
-                    showNotification(`文件${directionText}完成: ${transfer.fileName}`, 'success');
-                    shownCompletedTransfers.add(transfer.fileId);
-                }
-            });
+            transfersById = new Map((data.transfers || []).map(t => [t.fileId, t]));
+            handleTransfersUpdate();
         })
         .catch(error => {
             console.error('加载文件传输列表失败:', error);
@@ -576,17 +664,58 @@ function loadFileTransfers() {
         });
 }
 
+// 渲染传输列表并处理确认弹窗和完成/失败通知
+function handleTransfersUpdate() {
+    // 任务中的文件由任务汇总显示，群发的各接收方显示在群发记录下
+    const transfers = [...transfersById.values()].filter(t => !t.jobId && !t.broadcastId);
+    displayFileTransfers(transfers);
+
+    // 处理待接收的文件确认对话框
+    const pendingReceive = transfers.find(t => t.direction === 'receive' && t.status === 'pending');
+    if (pendingReceive && !shownPendingTransfers.has(pendingReceive.fileId)) {
+        showFileConfirmDialog(pendingReceive);
+        shownPendingTransfers.add(pendingReceive.fileId);
+    }
+
+    // 续传或重新传输后允许再次提示失败
+    transfers.filter(t => t.status === 'transferring').forEach(t => shownFailedTransfers.delete(t.fileId));
+
+    // 检查是否有失败或校验失败的传输并显示通知
+    const failedTransfers = transfers.filter(t => t.status === 'failed' || t.status === 'corrupted');
+    failedTransfers.forEach(transfer => {
+        if (!shownFailedTransfers.has(transfer.fileId)) {
+            const reason = transfer.status === 'corrupted' ? '校验失败，文件内容与发送方不一致' : '失败';
+            showNotification(`文件传输${reason}: ${transfer.fileName}`, 'error');
+            shownFailedTransfers.add(transfer.fileId);
+        }
+    });
+
+    // 检查是否有完成的传输并显示通知
+    const completedTransfers = transfers.filter(t => t.status === 'completed');
+    completedTransfers.forEach(transfer => {
+        if (!shownCompletedTransfers.has(transfer.fileId)) {
+            const directionText = transfer.direction === 'send' ? '发送' : '接收';
+            showNotification(`文件${directionText}完成: ${transfer.fileName}`, 'success');
+            shownCompletedTransfers.add(transfer.fileId);
+        }
+    });
+}
+
 function showFileConfirmDialog(transfer) {
     const dialog = document.getElementById('file-confirm-dialog');
-    document.getElementById('dialog-filename').textContent = transfer.fileName;
+    document.getElementById('dialog-filename').textContent = transfer.isJob
+        ? `${transfer.fileName} (${transfer.files} 个文件)`
+        : transfer.fileName;
     document.getElementById('dialog-filesize').textContent = formatBytes(transfer.fileSize);
     document.getElementById('dialog-sender').textContent = transfer.peerName;
+    const savePathInput = document.getElementById('dialog-save-path');
+    savePathInput.value = '';
 
     const acceptBtn = document.getElementById('dialog-accept-btn');
     const rejectBtn = document.getElementById('dialog-reject-btn');
 
     const onAccept = () => {
-        sendFileResponse(transfer.fileId, true);
+        sendFileResponse(transfer.fileId, true, savePathInput.value.trim());
         hideDialog();
     };
     const onReject = () => {
@@ -610,17 +739,19 @@ function showFileConfirmDialog(transfer) {
     }
 }
 
-function sendFileResponse(fileId, accepted) {
+function sendFileResponse(fileId, accepted, path = '') {
     fetch('/fileresponse', {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ fileId, accepted })
+        body: JSON.stringify({ fileId, accepted, path })
     })
     .then(response => {
-        if (!response.ok) throw new Error('响应失败');
+        if (!response.ok) {
+            return response.text().then(text => { throw new Error(text.trim() || '响应失败'); });
+        }
         showNotification(`文件传输已${accepted ? '接受' : '拒绝'}`, 'success');
     })
-    .catch(error => showNotification('发送响应失败', 'error'));
+    .catch(error => showNotification(`发送响应失败: ${error.message}`, 'error'));
 }
 
 function displayFileTransfers(transfers) {
@@ -628,7 +759,7 @@ function displayFileTransfers(transfers) {
     const list = document.getElementById('fileTransfersList');
 
     // 检查是否有活跃的传输（非完成状态）
-    const activeTransfers = transfers.filter(t => t.status !== 'completed' && t.status !== 'failed');
+    const activeTransfers = transfers.filter(t => !['completed', 'failed', 'cancelled', 'rejected'].includes(t.status));
 
     if (activeTransfers.length === 0) {
         // 如果没有活跃传输，隐藏区域
@@ -652,14 +783,21 @@ function createFileTransferElement(transfer) {
 
     const progressPercent = transfer.fileSize > 0 ? (transfer.progress / transfer.fileSize * 100) : 0;
     const progressText = `${formatBytes(transfer.progress)} / ${formatBytes(transfer.fileSize)}`;
-    const speedText = transfer.speed > 0 ? formatSpeed(transfer.speed) : '--';
+    let speedText = transfer.speed > 0 ? formatSpeed(transfer.speed) : '--';
+    if (transfer.rateLimit > 0) {
+        speedText += ` (限速 ${formatSpeed(transfer.rateLimit)})`;
+    }
     const etaText = transfer.eta > 0 ? formatETA(transfer.eta) : '--';
 
-    const statusText = getStatusText(transfer.status);
-    const directionIcon = transfer.direction === 'send' ? '📤' : '📥';
+    const statusText = transfer.queued ? '排队中' : getStatusText(transfer.status);
+    const directionIcon = transfer.isJob ? '📁' : (transfer.isBroadcast ? '📢' : (transfer.direction === 'send' ? '📤' : '📥'));
+    let filesText = transfer.isJob ? ` (${transfer.completedFiles || 0}/${transfer.files} 个文件)` : '';
+    if (transfer.isBroadcast) {
+        filesText = ` (${transfer.completedRecipients || 0}/${transfer.recipients} 人已完成)`;
+    }
 
     div.innerHTML = `
-        <div class="file-name">${directionIcon} ${transfer.fileName}</div>
+        <div class="file-name">${directionIcon} ${transfer.fileName}${filesText}</div>
         <div class="file-progress">
             <div class="progress-bar">
                 <div class="progress-fill" style="width: ${progressPercent}%"></div>
@@ -675,9 +813,126 @@ function createFileTransferElement(transfer) {
         </div>
     `;
 
+    if (transfer.compression) {
+        const compression = document.createElement('div');
+        compression.className = 'file-compression';
+        compression.textContent = `压缩: 传输量为原大小的 ${(transfer.compressionRatio * 100).toFixed(0)}%`;
+        div.querySelector('.file-details').appendChild(compression);
+    }
+
+    if (transfer.savedPath) {
+        const savedPath = document.createElement('div');
+        savedPath.className = 'file-saved-path';
+        savedPath.textContent = `保存到: ${transfer.savedPath}`;
+        savedPath.title = transfer.savedPath;
+        div.querySelector('.file-details').appendChild(savedPath);
+    }
+
+    if (transfer.isBroadcast) {
+        div.appendChild(createBroadcastRecipients(transfer));
+    }
+
+    // 进行中的传输可以暂停，已暂停或已中断的传输可以续传，校验失败的传输可以重新传输
+    if (transfer.status === 'transferring') {
+        div.appendChild(createTransferButton('暂停', () => controlFileTransfer('/filepause', transfer.fileId, '暂停')));
+    }
+    // 排队中的发送可以提前
+    if (transfer.queued && transfer.direction === 'send' && !(transfer.priority > 0)) {
+        div.appendChild(createTransferButton('优先发送', () => setTransferPriority(transfer.fileId, 'high')));
+    }
+    if ((transfer.status === 'interrupted' || transfer.status === 'paused' || transfer.status === 'corrupted') && transfer.resumable) {
+        const text = transfer.status === 'corrupted' ? '重新传输' : '继续传输';
+        div.appendChild(createTransferButton(text, () => resumeFileTransfer(transfer.fileId)));
+    }
+    // 等待确认中的传输由接收方接受或拒绝，其余未结束的传输都可以取消
+    if (transfer.status !== 'completed' && transfer.status !== 'cancelled' &&
+        !(transfer.status === 'pending' && transfer.direction === 'receive')) {
+        const cancelBtn = createTransferButton('取消', () => {
+            if (confirm(`确定取消传输 ${transfer.fileName} 吗？`)) {
+                controlFileTransfer('/filecancel', transfer.fileId, '取消');
+            }
+        });
+        cancelBtn.classList.add('transfer-cancel-btn');
+        div.appendChild(cancelBtn);
+    }
+
     return div;
 }
 
+// 群发中各接收方的进度
+function createBroadcastRecipients(broadcast) {
+    const list = document.createElement('div');
+    list.className = 'broadcast-recipients';
+    [...transfersById.values()]
+        .filter(t => t.broadcastId === broadcast.fileId)
+        .forEach(t => {
+            const percent = t.fileSize > 0 ? (t.progress / t.fileSize * 100) : 0;
+            const row = document.createElement('div');
+            row.className = 'broadcast-recipient';
+            const name = document.createElement('span');
+            name.textContent = t.peerName;
+            const state = document.createElement('span');
+            state.textContent = `${percent.toFixed(1)}% ${getStatusText(t.status)}`;
+            row.appendChild(name);
+            row.appendChild(state);
+            list.appendChild(row);
+        });
+    return list;
+}
+
+function createTransferButton(text, onClick) {
+    const button = document.createElement('button');
+    button.className = 'transfer-resume-btn';
+    button.textContent = text;
+    button.onclick = onClick;
+    return button;
+}
+
+function controlFileTransfer(endpoint, fileId, action) {
+    fetch(endpoint, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ fileId })
+    })
+    .then(response => {
+        if (!response.ok) {
+            return response.text().then(text => { throw new Error(text.trim() || `${action}失败`); });
+        }
+        showNotification(`已${action}文件传输`, 'success');
+    })
+    .catch(error => showNotification(`${action}失败: ${error.message}`, 'error'));
+}
+
+function setTransferPriority(fileId, priority) {
+    fetch('/filepriority', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ fileId, priority })
+    })
+    .then(response => {
+        if (!response.ok) {
+            return response.text().then(text => { throw new Error(text.trim() || '调整优先级失败'); });
+        }
+        showNotification('已调整发送优先级', 'success');
+    })
+    .catch(error => showNotification(`调整优先级失败: ${error.message}`, 'error'));
+}
+
+function resumeFileTransfer(fileId) {
+    fetch('/fileresume', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ fileId })
+    })
+    .then(response => {
+        if (!response.ok) {
+            return response.text().then(text => { throw new Error(text.trim() || '续传失败'); });
+        }
+        showNotification('已发送续传请求', 'success');
+    })
+    .catch(error => showNotification(`续传失败: ${error.message}`, 'error'));
+}
+
 function formatSpeed(bytesPerSecond) {
     if (bytesPerSecond < 1024) {
         return `${bytesPerSecond.toFixed(0)} B/s`;
@@ -706,8 +961,13 @@ function getStatusText(status) {
     switch (status) {
         case 'pending': return '等待中';
         case 'transferring': return '传输中';
+        case 'paused': return '已暂停';
+        case 'interrupted': return '已中断';
+        case 'corrupted': return '校验失败';
         case 'completed': return '已完成';
         case 'failed': return '失败';
+        case 'cancelled': return '已取消';
+        case 'rejected': return '已拒绝';
         default: return status;
     }
 }
@@ -985,6 +1245,25 @@ function blockUser(username, event) {
 }
 
 // 添加自定义警报函数
+function verifyUser(username, event) {
+    event.stopPropagation();
+    fetch(`/verify?user=${encodeURIComponent(username)}`)
+        .then(response => {
+            if (!response.ok) {
+                return response.text().then(text => { throw new Error(text); });
+            }
+            return response.json();
+        })
+        .then(data => {
+            let message = `与 ${data.user} 的安全码:\n\n${data.safetyCode}\n\n请与对方当面核对，双方看到的安全码应完全一致。`;
+            if (data.identityChanged) {
+                message += `\n\n⚠ 该用户身份密钥已变更，核对无误后可在命令行使用 /trust ${data.user}`;
+            }
+            showEmojiAlert(message);
+        })
+        .catch(error => showNotification(error.message || '获取安全码失败', 'error'));
+}
+
 function showEmojiAlert(message) {
     const dialog = document.getElementById('emoji-alert-dialog');
     const messageEl = document.getElementById('alert-message');
@@ -1185,3 +1464,304 @@ function sendReplyMessage(replyContent) {
         showNotification('发送回复失败，请重试', 'error');
     });
 }
+
+// =================================
+// 历史消息搜索
+// =================================
+let lastSearchResults = [];
+
+function openSearchDialog() {
+    const dialog = document.getElementById('search-dialog');
+    dialog.style.display = 'flex';
+    setTimeout(() => dialog.classList.add('visible'), 10);
+    document.getElementById('searchQuery').focus();
+}
+
+function closeSearchDialog() {
+    const dialog = document.getElementById('search-dialog');
+    dialog.classList.remove('visible');
+    setTimeout(() => dialog.style.display = 'none', 300);
+}
+
+function runSearch() {
+    const params = new URLSearchParams();
+    params.set('q', document.getElementById('searchQuery').value.trim());
+    const filters = { sender: 'searchSender', chat: 'searchChat', type: 'searchType', since: 'searchSince', until: 'searchUntil' };
+    for (const [key, id] of Object.entries(filters)) {
+        const value = document.getElementById(id).value.trim();
+        if (value) params.set(key, value);
+    }
+
+    fetch('/search?' + params.toString())
+        .then(async response => {
+            if (!response.ok) throw new Error(await response.text());
+            return response.json();
+        })
+        .then(data => {
+            lastSearchResults = data.results || [];
+            showSearchResults();
+        })
+        .catch(error => showNotification('搜索失败: ' + error.message, 'error'));
+}
+
+function showSearchResults() {
+    const container = document.getElementById('searchResults');
+    document.getElementById('searchBackBtn').style.display = 'none';
+    container.innerHTML = '';
+
+    if (lastSearchResults.length === 0) {
+        container.innerHTML = '<div class="search-empty">没有找到匹配的消息</div>';
+        return;
+    }
+
+    lastSearchResults.forEach(result => {
+        const item = document.createElement('div');
+        item.className = 'search-result';
+        item.title = '点击查看上下文';
+
+        const meta = document.createElement('div');
+        meta.className = 'search-result-meta';
+        const where = result.isPrivate ? `私聊 ${result.conversation}` : '公聊';
+        const sender = result.isOwn ? '我' : result.sender;
+        meta.textContent = `${new Date(result.timestamp).toLocaleString('zh-CN', { hour12: false })} · ${sender} · ${where}`;
+
+        const snippet = document.createElement('div');
+        snippet.className = 'search-result-snippet';
+        // 按片段构建，避免把消息内容当作HTML解析
+        result.snippet.forEach(segment => {
+            if (segment.match) {
+                const mark = document.createElement('mark');
+                mark.textContent = segment.text;
+                snippet.appendChild(mark);
+            } else {
+                snippet.appendChild(document.createTextNode(segment.text));
+            }
+        });
+
+        item.appendChild(meta);
+        item.appendChild(snippet);
+        item.onclick = () => showSearchContext(result.id);
+        container.appendChild(item);
+    });
+}
+
+function showSearchContext(messageId) {
+    fetch(`/searchcontext?id=${messageId}`)
+        .then(async response => {
+            if (!response.ok) throw new Error(await response.text());
+            return response.json();
+        })
+        .then(data => {
+            const container = document.getElementById('searchResults');
+            container.innerHTML = '';
+            document.getElementById('searchBackBtn').style.display = '';
+
+            let target = null;
+            (data.messages || []).forEach(msg => {
+                const item = document.createElement('div');
+                item.className = 'search-context-message' + (msg.isTarget ? ' target' : '');
+                const meta = document.createElement('div');
+                meta.className = 'search-result-meta';
+                meta.textContent = `${new Date(msg.timestamp).toLocaleString('zh-CN', { hour12: false })} · ${msg.isOwn ? '我' : msg.sender}`;
+                const content = document.createElement('div');
+                content.textContent = msg.content.startsWith('emoji:') ? '[表情]' : msg.content;
+                item.appendChild(meta);
+                item.appendChild(content);
+                container.appendChild(item);
+                if (msg.isTarget) target = item;
+            });
+            if (target) target.scrollIntoView({ block: 'center' });
+        })
+        .catch(error => showNotification('获取上下文失败: ' + error.message, 'error'));
+}
+
+// =================================
+// 自动接受规则
+// =================================
+function openAutoAcceptDialog() {
+    const dialog = document.getElementById('autoaccept-dialog');
+    dialog.style.display = 'flex';
+    setTimeout(() => dialog.classList.add('visible'), 10);
+
+    // 只能为在线且已验证身份的用户添加规则
+    const peerSelect = document.getElementById('autoAcceptPeer');
+    fetch('/users')
+        .then(response => response.json())
+        .then(data => {
+            peerSelect.innerHTML = '';
+            (data.users || [])
+                .filter(u => !u.includes('(自己)') && !u.includes('未验证') && !u.includes('身份变更'))
+                .forEach(u => {
+                    const option = document.createElement('option');
+                    option.value = option.textContent = u.split(' ')[0];
+                    peerSelect.appendChild(option);
+                });
+        });
+    loadAutoAcceptRules();
+}
+
+function closeAutoAcceptDialog() {
+    const dialog = document.getElementById('autoaccept-dialog');
+    dialog.classList.remove('visible');
+    setTimeout(() => dialog.style.display = 'none', 300);
+}
+
+function loadAutoAcceptRules() {
+    fetch('/autoaccept')
+        .then(response => response.json())
+        .then(data => displayAutoAcceptRules(data.rules || []))
+        .catch(error => console.error('加载自动接受规则失败:', error));
+}
+
+function displayAutoAcceptRules(rules) {
+    const container = document.getElementById('autoAcceptRules');
+    container.innerHTML = '';
+    if (rules.length === 0) {
+        container.innerHTML = '<div class="search-empty">还没有自动接受规则</div>';
+        return;
+    }
+    rules.forEach(rule => {
+        const item = document.createElement('div');
+        item.className = 'autoaccept-rule';
+
+        const text = document.createElement('span');
+        text.textContent = `#${rule.id} ${rule.peerName}: ${rule.description}`;
+
+        const removeBtn = document.createElement('button');
+        removeBtn.className = 'autoaccept-remove-btn';
+        removeBtn.textContent = '删除';
+        removeBtn.onclick = () => removeAutoAcceptRule(rule.id);
+
+        item.appendChild(text);
+        item.appendChild(removeBtn);
+        container.appendChild(item);
+    });
+}
+
+function addAutoAcceptRule() {
+    const peer = document.getElementById('autoAcceptPeer').value;
+    if (!peer) {
+        showNotification('没有可以添加规则的在线用户', 'error');
+        return;
+    }
+    fetch('/autoaccept', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({
+            peer,
+            extensions: document.getElementById('autoAcceptExt').value.trim(),
+            maxSize: document.getElementById('autoAcceptMaxSize').value.trim(),
+            minFreeSpace: document.getElementById('autoAcceptMinFree').value.trim(),
+            directory: document.getElementById('autoAcceptDir').value.trim()
+        })
+    })
+    .then(async response => {
+        if (!response.ok) throw new Error((await response.text()).trim());
+        return response.json();
+    })
+    .then(data => {
+        displayAutoAcceptRules(data.rules || []);
+        ['autoAcceptExt', 'autoAcceptMaxSize', 'autoAcceptMinFree', 'autoAcceptDir'].forEach(id => {
+            document.getElementById(id).value = '';
+        });
+        showNotification(`已为 ${peer} 添加自动接受规则`, 'success');
+    })
+    .catch(error => showNotification('添加规则失败: ' + error.message, 'error'));
+}
+
+function removeAutoAcceptRule(id) {
+    fetch('/autoaccept/remove', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ id })
+    })
+    .then(response => {
+        if (!response.ok) {
+            return response.text().then(text => { throw new Error(text.trim() || '删除失败'); });
+        }
+        loadAutoAcceptRules();
+    })
+    .catch(error => showNotification('删除规则失败: ' + error.message, 'error'));
+}
+
+// =================================
+// 传输历史
+// =================================
+function openHistoryDialog() {
+    const dialog = document.getElementById('history-dialog');
+    dialog.style.display = 'flex';
+    setTimeout(() => dialog.classList.add('visible'), 10);
+    loadTransferHistory();
+}
+
+function closeHistoryDialog() {
+    const dialog = document.getElementById('history-dialog');
+    dialog.classList.remove('visible');
+    setTimeout(() => dialog.style.display = 'none', 300);
+}
+
+function loadTransferHistory() {
+    const params = new URLSearchParams();
+    const filters = { q: 'historyQuery', peer: 'historyPeer', direction: 'historyDirection', status: 'historyStatus', since: 'historySince', until: 'historyUntil' };
+    for (const [key, id] of Object.entries(filters)) {
+        const value = document.getElementById(id).value.trim();
+        if (value) params.set(key, value);
+    }
+
+    fetch('/transferhistory?' + params.toString())
+        .then(async response => {
+            if (!response.ok) throw new Error((await response.text()).trim());
+            return response.json();
+        })
+        .then(data => displayTransferHistory(data.transfers || []))
+        .catch(error => showNotification('查询传输历史失败: ' + error.message, 'error'));
+}
+
+function displayTransferHistory(records) {
+    const container = document.getElementById('historyResults');
+    container.innerHTML = '';
+
+    if (records.length === 0) {
+        container.innerHTML = '<div class="search-empty">没有符合条件的传输记录</div>';
+        return;
+    }
+
+    records.forEach(record => {
+        const item = document.createElement('div');
+        item.className = 'history-record';
+
+        const meta = document.createElement('div');
+        meta.className = 'search-result-meta';
+        const direction = record.direction === 'send' ? `📤 发送给 ${record.peerName}` : `📥 接收自 ${record.peerName}`;
+        let details = `${new Date(record.startTime).toLocaleString('zh-CN', { hour12: false })} · ${direction} · ${getStatusText(record.status)}`;
+        if (record.status === 'completed' && record.duration > 0) {
+            details += ` · 用时 ${formatETA(Math.round(record.duration))} · 平均 ${formatSpeed(record.avgSpeed)}`;
+        }
+        meta.textContent = details;
+
+        // 文件名和路径来自对方，按文本显示
+        const name = document.createElement('div');
+        name.className = 'history-record-name';
+        name.textContent = record.isJob ? `📁 ${record.fileName} (${record.files} 个文件)` : record.fileName;
+        const size = document.createElement('span');
+        size.className = 'history-record-size';
+        size.textContent = ` ${formatBytes(record.fileSize)}`;
+        name.appendChild(size);
+
+        item.appendChild(meta);
+        item.appendChild(name);
+        if (record.savedPath) {
+            const path = document.createElement('div');
+            path.className = 'file-saved-path';
+            path.textContent = `保存到: ${record.savedPath}`;
+            item.appendChild(path);
+        }
+        if (record.sha256) {
+            const hash = document.createElement('div');
+            hash.className = 'history-record-hash';
+            hash.textContent = `SHA-256: ${record.sha256}`;
+            item.appendChild(hash);
+        }
+        container.appendChild(item);
+    });
+}